@@ -5,17 +5,39 @@ local and remote systems."""
 
 import argparse
 import asyncio
+import base64
+import collections
+import configparser
+import contextlib
+import copy
+import errno
+import fnmatch
 import hashlib
+import io
+import ipaddress
+import itertools
 import json
 import logging
 import os
+import platform
 import shlex
 import shutil
+import socket
+import statistics
 import struct
 import subprocess
 import sys
-
-from typing import Any, Dict, List, Tuple, Callable, IO
+import tarfile
+import tempfile
+import threading
+import time
+import traceback
+import urllib.parse
+import urllib.request
+
+from concurrent.futures import ThreadPoolExecutor
+from importlib import metadata
+from typing import Any, Dict, List, Tuple, Callable, IO, Iterable, Iterator, NoReturn, TypedDict
 
 from pathlib import Path
 from select import select
@@ -23,35 +45,455 @@ from select import select
 import notmuch2
 import xapian
 
+try:
+    import blake3 # type: ignore[import-not-found]
+except ImportError:
+    blake3 = None
+
+try:
+    import dns.resolver # type: ignore[import-not-found]
+except ImportError:
+    dns = None
+
+try:
+    import msgpack # type: ignore[import-not-found]
+except ImportError:
+    msgpack = None
+
+try:
+    import paramiko # type: ignore[import-not-found]
+except ImportError:
+    paramiko = None
+
+try:
+    import cbor2 # type: ignore[import-not-found]
+except ImportError:
+    cbor2 = None
+
 logging.basicConfig(format="[{asctime}] {message}", style="{")
 logger = logging.getLogger(__name__)
+# details that can be logged separately with --log-scope: protocol frames and
+# negotiation, decisions about files, and changes to the notmuch database
+LOG_SCOPES = ["protocol", "files", "notmuch"]
+protocol_logger = logging.getLogger(f"{__name__}.protocol")
+files_logger = logging.getLogger(f"{__name__}.files")
+notmuch_logger = logging.getLogger(f"{__name__}.notmuch")
 
 transfer = {"read": 0, "write": 0}
+# wall-clock seconds and bytes received/sent in each phase of the sync, see
+# measure
+phases: Dict[str, Dict[str, float]] = {}
+
+# number of recent frames to keep for diagnostic bundles
+FRAME_TRACE = 20
+# number of recent log records sent to clients that start tailing a sync
+ACTIVITY_BACKLOG = 20
+# recently sent and received frames (direction, size, and start of the data)
+frames: collections.deque = collections.deque(maxlen=FRAME_TRACE)
+
+# file all frames are recorded to with --trace-file, whether to include their
+# data, and the phase of the sync, see trace_frame
+trace: Dict[str, Any] = {"file": None, "payload": False, "phase": None}
+trace_lock = threading.Lock()
+
+# problems with individual files by problem and folder, see warn_file
+file_warnings: Dict[Tuple[str, str], List[str]] = {}
+
+try:
+    VERSION = metadata.version("notmuch-sync")
+except metadata.PackageNotFoundError:
+    VERSION = "unknown"
+
+# version of the wire protocol, changed whenever implementations need to
+# change to stay compatible
+PROTOCOL = 1
+
+# version of the format of sync state files, changed whenever older versions
+# can't read them anymore, see record_sync
+STATE_VERSION = 1
+
+# parameters negotiated with the other side at the start of the sync
+session: Dict[str, Any] = {"digest": "sha256", "delta": False, "buckets": False, "policies": [],
+                           "resolved": {}, "sync_flags": True, "read_only": False, "peer_read_only": False,
+                           "deferred": False, "notmuch_dir": None, "xattrs": False, "revisions": False,
+                           "batches": False, "encoding": "json", "mbsync_digests": False, "outcomes": False, "nfs": False,
+                           "case_insensitive": False, "hash_workers": None,
+                           "file_order": False, "order": "newest", "resolutions": False, "file_digests": False,
+                           "duplicate_counts": False,
+                           "local_tags": [], "received_tags": [], "ignore_tags": [], "only_tags": [], "tag_map": {}, "folder_map": {}, "exclude_tags": {},
+                           "portable": False,
+                           "mail_dirs": ["cur", "new"], "folder_layout": "nested",
+                           "fsync": True, "received_tag": None, "strict": False, "read_only_db": False,
+                           "peer_read_only_db": False, "pull_only": False}
+
+# changes that would have been made, recorded instead of applied with --dry-run
+planned: List[Dict[str, Any]] = []
+
+# destructive changes of the running sync, recorded for the undo command, see
+# record_undo
+undo_log: Dict[str, Any] = {"dir": None, "prefix": None, "count": 0, "tagged": set()}
+
+# numbers of items (files, or messages for deletes) that were synced, failed,
+# or were skipped in each phase of the sync, for this side ("local") and the
+# other side ("remote"), see count_outcome
+outcomes: Dict[str, Dict[str, Dict[str, int]]] = {}
+
+DIGESTS = ["sha256"] + (["blake3"] if blake3 is not None else [])
+# encodings of changes, file names, and hashes supported on this side
+ENCODINGS = ["json"] + (["msgpack"] if msgpack is not None else []) + (["cbor"] if cbor2 is not None else [])
+
+# compressions of the tar stream of --clone
+COMPRESSIONS = ["none", "gz", "bz2", "xz"]
+
+# orders to receive files in, see order_files
+ORDERS = ["newest", "oldest", "smallest"]
+
+# commands given after the flags, see parse_args
+COMMANDS = ["sync", "serve", "clone", "hydrate", "diff", "verify", "repair", "undo", "status", "capabilities", "replay",
+            "repro", "tail", "completion"]
+
+# flags of the command asked for by the other side that a --read-only remote
+# started as SSH forced command takes over, see forced_command_args (--multi
+# only if the forced command has it too)
+FORCED_COMMAND_FLAGS = ["dry_run", "clone", "accept_new_uuid", "strict", "command", "query"]
+
+# shells to generate completion scripts for
+SHELLS = ["bash", "zsh", "fish"]
+
+# optional protocol features this side supports
+FEATURES = ["delta", "id-buckets", "xattrs", "revisions", "change-batches", "mbsync-digests", "outcomes", "file-order",
+            "conflict-resolutions", "file-digests", "duplicate-counts"]
+
+# block size for delta transfers
+DELTA_BLOCK = 1024
+# bytes read at a time when sending a file while computing its digest
+SEND_CHUNK = 1024 * 1024
+
+# number of files to hash before adjusting the number of hashing threads
+HASH_BATCH = 64
+# number of message IDs per frame when exchanging IDs for --delete
+ID_BATCH = 10000
+# where to install notmuch-sync on the remote with --bootstrap, see bootstrap
+BOOTSTRAP_DIR = "~/.cache/notmuch-sync"
+# target number of message IDs per bucket when comparing bucket digests for
+# --delete
+ID_BUCKET_SIZE = 64
+# prefix of the names of files that are being received
+PARTIAL_PREFIX = ".notmuch-sync-partial-"
+# problem of files that collide with another file on a case-insensitive file
+# system, see case_collision
+CASE_COLLISION = "not synced, its name only differs in case from another file on this case-insensitive file system"
+# seconds to wait for the remote to respond when connecting and between
+# keepalives with --transport native-ssh
+SSH_TIMEOUT = 30
+SSH_KEEPALIVE = 15
+# number of past syncs whose phase statistics are kept as the baseline to
+# detect slow syncs, how many of them are needed before warning, and how
+# much slower than the baseline a phase has to be to warn
+STATS_HISTORY = 20
+STATS_MIN_HISTORY = 3
+STATS_SLOWDOWN = 10
+# phases that transfer at least this many bytes are compared by throughput
+# rather than time, and phases that take less than this many seconds are
+# never considered slow
+STATS_MIN_BYTES = 1024 * 1024
+STATS_MIN_SECONDS = 1.0
+# the likely culprit if a phase of the sync (see measure) is slow
+PHASE_CULPRITS = {"UUID exchange": "the connection to the remote or starting notmuch-sync there",
+                  "changeset": "the notmuch database or the disk on either side",
+                  "tag sync": "the notmuch database on either side",
+                  "file transfer": "the network or the disk on either side",
+                  "deletes": "the notmuch database on either side",
+                  "mbsync": "the disk on either side"}
+
+# exit codes: the connection to the remote failed, the remote failed, this
+# side failed (e.g. its notmuch database), diff or verify found differences,
+# the sync completed, but failed for some files or messages, and invalid
+# arguments or configuration; only with --exit-changes, the sync changed
+# something (or 'status' found pending changes)
+EXIT_CHANGES = 1
+EXIT_TRANSPORT = 2
+EXIT_REMOTE = 3
+EXIT_LOCAL = 4
+EXIT_MISMATCH = 5
+EXIT_PARTIAL = 6
+EXIT_USAGE = 7
+
+# metrics written with --metrics-textfile: name, type, and help
+METRICS = [("notmuch_sync_syncs_total", "counter", "Number of syncs run."),
+           ("notmuch_sync_failures_total", "counter", "Number of syncs that failed."),
+           ("notmuch_sync_messages_transferred_total", "counter", "Number of new messages on either side."),
+           ("notmuch_sync_received_bytes_total", "counter", "Number of bytes received from the remote."),
+           ("notmuch_sync_sent_bytes_total", "counter", "Number of bytes sent to the remote."),
+           ("notmuch_sync_last_success_timestamp_seconds", "gauge", "Time of the last successful sync.")]
+
+# tags that are kept as they are in reproductions, all others are replaced
+REPRO_TAGS = ["inbox", "unread", "replied", "flagged", "draft", "passed", "deleted", "attachment",
+              "signed", "encrypted", "sent", "spam"]
+
+# policy for all files while a mail directory is read-only, see negotiate
+READ_ONLY_POLICY = {"pattern": "*", "files": False, "delete": False, "priority": 0}
+
+
+class Change(TypedDict):
+    """
+    Tags and files (relative to the mail directory) of a message, as exchanged
+    with the other side. Part of the wire protocol, i.e. changing it requires a
+    new protocol version; see decode_change for the validation of received
+    changes.
+    """
+    tags: List[str]
+    files: List[str]
 
-def digest(data: bytes) -> str:
+
+# changes of messages by message ID
+Changes = Dict[str, Change]
+
+
+def digest(data: bytes, algo: str | None = None) -> str:
     """
-    Compute SHA256 digest of data, removing any X-TUID: lines. This is
-    nececessary because mbsync adds these lines to keep track of internal
-    progress, but they make identical emails that were retrieved separately
-    different.
+    Compute digest of data, removing any X-TUID: lines. This is nececessary
+    because mbsync adds these lines to keep track of internal progress, but they
+    make identical emails that were retrieved separately different.
 
     Args:
         data (bytes): The data to compute the checsum for.
+        algo (str): Digest algorithm to use, "sha256" or "blake3". Defaults to
+        the algorithm negotiated with the remote.
 
     Returns:
         The computed checksum.
     """
-    pat = b"X-TUID: "
-    to_digest = data
-    start_idx = data.find(pat)
-    if start_idx != -1:
-        search_start = start_idx + len(pat)
-        end_idx = data.find(b"\n", search_start)
+    hasher = Digester(algo)
+    hasher.update(data)
+    return hasher.hexdigest()
+
+
+class Digester:
+    """
+    Compute the digest of data given in pieces, like digest, so that a file
+    can be hashed while it is sent without reading it into memory. Data that
+    may belong to the X-TUID: line is held back until the end of the line is
+    seen.
+    """
+
+    PATTERN = b"X-TUID: "
+
+    def __init__(self, algo: str | None = None) -> None:
+        if algo is None:
+            algo = session["digest"]
+        if algo == "blake3":
+            if blake3 is None:
+                raise ValueError("BLAKE3 digest requested, but blake3 module not available!")
+            self.hasher = blake3.blake3()
+        else:
+            self.hasher = hashlib.new("sha256")
+        self.pending = b""
+        # "search" for the X-TUID: line, "skip" to its end, or "done"
+        self.state = "search"
+
+    def update(self, data: bytes) -> None:
+        """
+        Add the next piece of data.
+        """
+        if self.state == "done":
+            self.hasher.update(data)
+            return
+        searched = len(self.pending)
+        self.pending = self.pending + data if self.pending else data
+        if self.state == "search":
+            start = self.pending.find(self.PATTERN)
+            if start == -1:
+                keep = max(0, len(self.pending) - len(self.PATTERN) + 1)
+                self.hasher.update(self.pending[:keep])
+                self.pending = self.pending[keep:]
+                return
+            self.hasher.update(self.pending[:start])
+            self.pending = self.pending[start:]
+            self.state = "skip"
+            searched = 0
+        end = self.pending.find(b"\n", max(len(self.PATTERN), searched))
+        if end != -1:
+            self.hasher.update(self.pending[end + 1:])
+            self.pending = b""
+            self.state = "done"
+
+    def hexdigest(self) -> str:
+        """
+        Finish and return the digest; an X-TUID: line without a newline is
+        kept.
+        """
+        self.hasher.update(self.pending)
+        self.pending = b""
+        self.state = "done"
+        return self.hasher.hexdigest()
+
+
+def tune_workers(
+    workers: int,
+    rate: float,
+    best: Tuple[int, float],
+    max_workers: int
+) -> Tuple[int, Tuple[int, float], bool]:
+    """
+    Hill-climbing step for the number of worker threads: double the number of
+    workers as long as that increases throughput by at least 10%, otherwise go
+    back to the best number of workers seen so far and stop tuning.
+
+    Args:
+        workers (int): Number of workers used for the last batch.
+        rate (float): Throughput achieved for the last batch.
+        best (tuple): (number of workers, throughput) of the best batch so far.
+        max_workers (int): Upper limit for the number of workers.
+
+    Returns:
+        tuple: (number of workers for next batch, best so far, whether to
+                continue tuning)
+    """
+    if rate > best[1] * 1.1:
+        best = (workers, rate)
+        if workers < max_workers:
+            return (min(max_workers, workers * 2), best, True)
+    return (best[0], best, False)
+
+
+def warn_file(fname: str, problem: str) -> None:
+    """
+    Record a problem with an individual file. Only logged in full at debug
+    level, so that many files with the same problem don't flood the log; see
+    log_file_warnings for the summary. With --strict, the sync fails instead.
+
+    Args:
+        fname (str): Path of the file.
+        problem (str): Description of the problem, e.g. "could not be read".
+    """
+    if session["strict"]:
+        raise ValueError(f"{fname} {problem}, aborting (--strict)...")
+    files_logger.debug("%s %s.", fname, problem)
+    file_warnings.setdefault((problem, os.path.dirname(fname)), []).append(fname)
+
+
+def log_file_warnings() -> None:
+    """
+    Log the problems with individual files recorded with warn_file, aggregated
+    by problem and folder, and clear them.
+    """
+    for (problem, folder), fnames in sorted(file_warnings.items()):
+        if len(fnames) == 1:
+            logger.warning("%s %s.", fnames[0], problem)
+        else:
+            logger.warning("%s files %s in folder %s, e.g. %s (use -vv for all).",
+                           len(fnames), problem, folder, fnames[0])
+    file_warnings.clear()
+
+
+def count_outcome(phase: str, outcome: str, n: int = 1, side: str = "local") -> None:
+    """
+    Count items of a phase of the sync that were synced, failed, or skipped,
+    for the summary at the end. With --strict, failures on this side fail the
+    sync instead.
+
+    Args:
+        phase (str): Name of the phase, as for measure, e.g. "file transfer".
+        outcome (str): "success", "failed", or "skipped".
+        n (int): Number of items.
+        side (str): "local" for this side, "remote" for numbers reported by
+        the other side.
+    """
+    if n > 0 and outcome == "failed" and side == "local" and session["strict"]:
+        raise ValueError(f"{n} items of {phase} failed, aborting (--strict)...")
+    if n > 0:
+        counts = outcomes.setdefault(side, {}).setdefault(phase, {"success": 0, "failed": 0, "skipped": 0})
+        counts[outcome] += n
+
+
+def recv_outcomes(stream: IO[bytes]) -> None:
+    """
+    Receive the numbers of synced, failed, and skipped items by phase from the
+    other side (see count_outcome) and add them to its counts.
+
+    Args:
+        stream: Stream to read from the other side.
+
+    Raises:
+        ValueError: If the numbers are invalid.
+    """
+    theirs = json.loads(read(stream).decode("utf-8"))
+    if not isinstance(theirs, dict):
+        raise ValueError(f"Invalid phase outcomes {theirs!r} from other side, aborting...")
+    for phase, counts in theirs.items():
+        if (not isinstance(counts, dict) or
+            not all(k in ["success", "failed", "skipped"] and isinstance(v, int) and v >= 0 for k, v in counts.items())):
+            raise ValueError(f"Invalid outcomes {counts!r} of phase {phase!r} from other side, aborting...")
+        for outcome, n in counts.items():
+            count_outcome(phase, outcome, n, "remote")
+
+
+def hash_files(fnames: List[str], workers: int | None = None) -> List[str | None]:
+    """
+    Compute digests of files using multiple threads. The number of threads is
+    tuned based on the observed throughput in batches of HASH_BATCH files,
+    which adapts to whether hashing is limited by CPU or IO, up to the number
+    of CPUs, unless a fixed number is given (or with --hash-workers).
+
+    Args:
+        fnames (list): Paths of files to hash.
+        workers (int): Number of threads to use, None for --hash-workers or to
+        tune automatically.
 
-        if end_idx != -1:
-            to_digest = data[:start_idx] + data[end_idx + 1:]
+    Returns:
+        list: Digests of the files, in the same order; None for files that
+        could not be read (see warn_file).
+    """
+    def _hash(fname: str) -> Tuple[str | None, int]:
+        try:
+            data = Path(fname).read_bytes()
+        except OSError:
+            warn_file(fname, "could not be read")
+            return (None, 0)
+        return (digest(data), len(data))
+
+    if workers is None:
+        workers = session["hash_workers"]
+    max_workers = os.cpu_count() or 1
+    tuning = workers is None
+    n = 1 if workers is None else workers
+    best = (n, 0.0)
+    ret: List[str | None] = []
+    for i in range(0, len(fnames), HASH_BATCH):
+        start = time.monotonic()
+        with ThreadPoolExecutor(max_workers=n) as ex:
+            res = list(ex.map(_hash, fnames[i:i + HASH_BATCH]))
+        rate = sum(r[1] for r in res) / max(time.monotonic() - start, 1e-9)
+        ret.extend(r[0] for r in res)
+        if tuning:
+            n, best, tuning = tune_workers(n, rate, best, max_workers)
+            files_logger.debug("Hashed at %.0f bytes/s, using %s hashing threads.", rate, n)
+    return ret
+
+
+def trace_frame(direction: str, data: bytes, raw: bool = False, size: int | None = None) -> None:
+    """
+    Record a frame sent to or received from the other side in the trace file
+    as a line of JSON with time, direction, size, and the phase of the sync,
+    and the base64-encoded data if requested, if --trace-file is given.
 
-    return hashlib.new("sha256", to_digest).hexdigest()
+    Args:
+        direction (str): "sent" or "received".
+        data (bytes): The data of the frame, without length prefix.
+        raw (bool): Whether the data was sent without length prefix.
+        size (int): Size of the frame, if it isn't all in data (see
+        write_file); its data is then never recorded.
+    """
+    if trace["file"] is None:
+        return
+    entry = {"time": time.time(), "dir": direction, "size": len(data) if size is None else size, "phase": trace["phase"]}
+    if raw:
+        entry["raw"] = True
+    if trace["payload"] and size is None:
+        entry["data"] = base64.b64encode(data).decode("ascii")
+    with trace_lock:
+        trace["file"].write(json.dumps(entry) + "\n")
 
 
 def write(data: bytes, stream: IO[bytes] | None) -> None:
@@ -64,6 +506,9 @@ def write(data: bytes, stream: IO[bytes] | None) -> None:
     """
     if stream is None:
         return
+    frames.append({"dir": "sent", "size": len(data), "data": data[:64].decode("utf-8", "replace")})
+    trace_frame("sent", data)
+    protocol_logger.debug("Sending frame of %s bytes.", len(data))
     stream.write(struct.pack("!I", len(data)))
     transfer["write"] += 4
     written = stream.write(data)
@@ -73,6 +518,73 @@ def write(data: bytes, stream: IO[bytes] | None) -> None:
     stream.flush()
 
 
+def write_file(fname: str, stream: IO[bytes] | None, with_digest: bool = False) -> str | None:
+    """
+    Write the content of a file to a stream with a 4-byte length prefix, like
+    write. If the stream is a pipe (to ssh or, on the remote, from sshd), the
+    content is copied by the kernel with os.sendfile instead of being read into
+    memory and written again, or, if the digest is asked for, read and written
+    in chunks that are hashed on the way. Otherwise, and if the data of frames
+    is traced, the file is read and written with write.
+
+    Args:
+        fname (str): Path to the file to write.
+        stream: A writable stream supporting .write() and .flush().
+        with_digest (bool): Whether to compute the digest of the content (see
+        digest) while writing it.
+
+    Returns:
+        str: The digest of the content if asked for, None otherwise.
+
+    Raises:
+        ValueError: If the file becomes shorter while it is written.
+    """
+    if stream is None:
+        return None
+    with open(fname, "rb") as f:
+        out = None
+        if hasattr(os, "sendfile") and isinstance(stream, io.BufferedWriter) and not trace["payload"]:
+            try:
+                out = stream.fileno()
+            except (OSError, ValueError):
+                pass
+        if out is None:
+            content = f.read()
+            write(content, stream)
+            return digest(content) if with_digest else None
+        size = os.fstat(f.fileno()).st_size
+        head = os.pread(f.fileno(), 64, 0)
+        frames.append({"dir": "sent", "size": size, "data": head.decode("utf-8", "replace")})
+        trace_frame("sent", head, size=size)
+        protocol_logger.debug("Sending frame of %s bytes from %s.", size, fname)
+        stream.write(struct.pack("!I", size))
+        stream.flush()
+        transfer["write"] += 4
+        hasher = Digester() if with_digest else None
+        offset = 0
+        while offset < size:
+            if hasher is not None:
+                chunk = f.read(min(SEND_CHUNK, size - offset))
+                hasher.update(chunk)
+                sent = stream.write(chunk) if chunk else 0
+                stream.flush()
+            else:
+                try:
+                    sent = os.sendfile(out, f.fileno(), offset, size - offset)
+                except OSError as e:
+                    # e.g. not supported for this kind of pipe or file system
+                    if e.errno not in (errno.EINVAL, errno.ENOSYS, errno.EOPNOTSUPP):
+                        raise
+                    f.seek(offset)
+                    sent = stream.write(f.read(size - offset))
+                    stream.flush()
+            if sent == 0:
+                raise ValueError(f"Tried to write {size} bytes of {fname}, but wrote only {offset}, aborting...")
+            offset += sent
+            transfer["write"] += sent
+        return hasher.hexdigest() if hasher is not None else None
+
+
 def read(stream: IO[bytes] | None) -> bytes:
     """
     Read 4-byte length-prefixed data from a stream.
@@ -86,786 +598,6069 @@ def read(stream: IO[bytes] | None) -> bytes:
     if stream is None:
         return b''
     size_data = stream.read(4)
+    if len(size_data) < 4:
+        raise EOFError("Connection to other side closed while waiting for data, aborting...")
     transfer["read"] += 4
     size = struct.unpack("!I", size_data)[0]
     data = stream.read(size)
+    frames.append({"dir": "received", "size": size, "data": data[:64].decode("utf-8", "replace")})
+    trace_frame("received", data)
+    protocol_logger.debug("Received frame of %s bytes.", size)
     if len(data) < size:
         raise ValueError(f"Tried to read {size} bytes, but read only {len(data)}, aborting...")
     transfer["read"] += size
     return data
 
 
-def run_async(m1: Callable[[], Any], m2: Callable[[], Any]) -> None:
+def validate_fname(fname: Any, mail: bool = True) -> str:
     """
-    Run two functions async. Used to read/write to streams at the same time.
+    Check that a file name received from the other side is a relative path
+    inside the mail directory (and not in the notmuch database directory), so
+    that the other side can't make this side read or write any other files.
+    Names of mail files must also be in a directory that matches one of the
+    patterns of --mail-dirs (the cur/ and new/ directories of maildir folders
+    by default), so that e.g. a bad entry in the other side's database can't
+    make this side write mail files anywhere else.
 
     Args:
-        m1: One function.
-        m2: Other function.
+        fname: The file name.
+        mail (bool): Whether it is the name of a mail file, rather than e.g.
+        of an mbsync file.
+
+    Returns:
+        str: The file name.
+
+    Raises:
+        ValueError: If the file name is invalid.
     """
-    async def _tmp():
-        await asyncio.gather(asyncio.to_thread(m1), asyncio.to_thread(m2))
+    parts = Path(fname).parts if isinstance(fname, str) else ()
+    if not parts or "\0" in fname or os.path.isabs(fname) or ".." in parts or parts[0] == ".notmuch":
+        raise ValueError(f"Invalid file name {fname!r} from other side, aborting...")
+    if mail and not any(fnmatch.fnmatchcase(Path(fname).parent.name, pat) for pat in session["mail_dirs"]):
+        raise ValueError(f"File name {fname!r} from other side is not in a mail directory ({', '.join(session['mail_dirs'])}), aborting...")
+    return fname
 
-    asyncio.run(_tmp())
 
+def to_wire(fname: str) -> str:
+    """
+    Translate the name of a mail file on this side to the nested folder layout
+    that is used on the wire, so that sides with different layouts (see
+    --folder-layout) can sync: in Maildir++, ".A.B/cur/1" becomes "A/B/cur/1".
+    Files of the top-level maildir (e.g. "cur/1") are the same in both layouts.
+    Folders are then renamed with --folder-map, see map_folders.
+
+    Args:
+        fname (str): The file name on this side.
 
-def get_changes(
-    db: notmuch2.Database,
-    revision: notmuch2.DbRevision,
-    prefix: str,
-    sync_file: str
-) -> Dict[str, Dict[str, Any]]:
+    Returns:
+        str: The file name on the wire.
+
+    Raises:
+        ValueError: If the folder can't be renamed unambiguously.
     """
-    Get changes that happened since the last sync, or everything in the DB if no previous sync.
+    parts = fname.split("/")
+    if session["folder_layout"] == "maildir++" and len(parts) >= 3 and parts[0].startswith("."):
+        fname = "/".join(parts[0][1:].split(".") + parts[1:])
+    return map_folders(fname, True)
+
+
+def from_wire(fname: str) -> str:
+    """
+    Translate the name of a mail file on the wire to the folder layout of this
+    side, see to_wire.
 
     Args:
-        db: An open notmuch2.Database object.
-        revision: Database revision object, must have .uuid and .rev.
-        prefix (str): Prefix path for filenames (notmuch config database.path).
-        sync_file (str): Path to the file storing the sync state.
+        fname (str): The file name on the wire.
 
     Returns:
-        dict: Mapping of message IDs to their tags and files.
+        str: The file name on this side.
+
+    Raises:
+        ValueError: If a folder name contains ".", which separates folders in
+        Maildir++, or the folder can't be renamed unambiguously.
     """
-    rev_prev = -1
-    try:
-        with open(sync_file, 'r', encoding="utf-8") as f:
-            tmp = f.read().strip('\n\r').split(' ')
-            uuid = revision.uuid.decode()
-            try:
-                if tmp[1] != uuid:
-                    raise ValueError(f"Last sync with UUID {tmp[1]}, but notmuch DB has UUID {uuid}, aborting...")
-                rev_prev = int(tmp[0])
-                if rev_prev > revision.rev:
-                    raise ValueError(f"Last sync revision {rev_prev} larger than current DB revision {revision.rev}, aborting...")
-            except (AttributeError, IndexError, UnicodeError) as e:
-                raise ValueError(f"Sync state file '{sync_file}' corrupted, delete to sync from scratch.") from e
-    except FileNotFoundError:
-        # no previous sync or sync file broken, leave rev_prev at -1 as this will sync entire DB
-        pass
+    fname = map_folders(fname, False)
+    parts = fname.split("/")
+    if session["folder_layout"] != "maildir++" or len(parts) < 3:
+        return fname
+    if any("." in folder for folder in parts[:-2]):
+        raise ValueError(f"Folder of {fname!r} from other side can't be represented in Maildir++ layout, aborting...")
+    return "/".join(["." + ".".join(parts[:-2])] + parts[-2:])
 
-    logger.info("Previous sync revision %s, current revision %s.", rev_prev, revision.rev)
-    return {msg.messageid: {"tags": list(msg.tags),
-                            "files": [str(f).removeprefix(prefix) for f in msg.filenames()]}
-                            for msg in db.messages(f"lastmod:{rev_prev + 1}..")}
 
+def rename_folder(fname: str, mapping: Dict[str, str]) -> str:
+    """
+    Rename the folder of a mail file with the longest folder in the mapping
+    that it is in, if any. The empty folder is the top-level maildir, e.g.
+    with {"": "work"}, "INBOX/cur/1" becomes "work/INBOX/cur/1".
 
-def sync_tags(
-    db: notmuch2.Database,
-    changes_mine: Dict[str, Dict[str, Any]],
-    changes_theirs: Dict[str, Dict[str, Any]]
-) -> int:
+    Args:
+        fname (str): The file name, in the nested folder layout.
+        mapping (dict): New folder names by folder name.
+
+    Returns:
+        str: The renamed file name.
     """
-    Synchronize tags between local and remote changes. Applies tags from all
-    remotely changed IDs to local messages with the same ID, overwriting any
-    local tags. If an ID appears both in remote and local changes, take the
-    union of all tags. If a message is not found locally, do nothing (will be
-    synced later).
+    parts = fname.split("/")
+    folders = parts[:-2]
+    for n in range(len(folders), -1, -1):
+        folder = "/".join(folders[:n])
+        if folder in mapping:
+            return "/".join([p for p in mapping[folder].split("/") if p] + parts[n:])
+    return fname
+
+
+def map_folders(fname: str, to_remote: bool) -> str:
+    """
+    Rename the folder of a mail file with the map given with --folder-map on
+    this side, from the folder on this side to the folder on the remote or
+    back. File names that would be renamed differently in the other direction
+    (e.g. a folder "Inbox" on this side with the map "INBOX=Inbox") can't be
+    synced.
 
     Args:
-        db: An open notmuch2.Database object.
-        changes_mine (dict): Local changes, mapping message IDs to tags.
-        changes_theirs (dict): Remote changes, mapping message IDs to tags.
+        fname (str): The file name, in the nested folder layout.
+        to_remote (bool): Whether to rename to the folder on the remote.
 
     Returns:
-        int: Number of tag changes made.
+        str: The renamed file name.
+
+    Raises:
+        ValueError: If the folder can't be renamed unambiguously.
     """
-    changes = 0
-    for mid in changes_theirs:
-        tags = changes_theirs[mid]["tags"]
-        if mid in changes_mine:
-            tags = set(tags) | set(changes_mine[mid]["tags"])
-        tags = set(tags)
-        try:
-            msg = db.find(mid)
-            if msg.ghost:
-                continue
-            if tags != set(msg.tags):
-                logger.info("Setting tags %s for %s.", sorted(list(tags)), mid)
-                with msg.frozen():
-                    changes += 1
-                    msg.tags.clear()
-                    for tag in sorted(list(tags)):
-                        msg.tags.add(tag)
-                    msg.tags.to_maildir_flags()
-        except LookupError:
-            # we don't have this message on our side, it will be added later
-            # when syncing files
-            pass
+    if not session["folder_map"] or len(fname.split("/")) < 2:
+        return fname
+    back = {v: k for k, v in session["folder_map"].items()}
+    mapping, back = (session["folder_map"], back) if to_remote else (back, session["folder_map"])
+    mapped = rename_folder(fname, mapping)
+    if rename_folder(mapped, back) != fname:
+        side = "this side" if to_remote else "other side"
+        raise ValueError(f"Folder of {fname!r} from {side} can't be renamed unambiguously with --folder-map, aborting...")
+    return mapped
+
+
+def parse_folder_map(value: str) -> Dict[str, str]:
+    """
+    Parse a folder map of the form "LOCAL=REMOTE,...", see map_folders. Either
+    side may be empty for the top-level maildir.
 
-    return changes
+    Args:
+        value (str): The folder map.
 
+    Returns:
+        dict: Folders on the remote by folders on this side.
 
-def record_sync(fname: str, revision: notmuch2.DbRevision) -> None:
+    Raises:
+        argparse.ArgumentTypeError: If the folder map is invalid or maps
+        several folders to the same folder.
     """
-    Record last sync revision.
+    mapping = {}
+    for pair in value.replace(",", " ").split():
+        local, eq, remote = pair.partition("=")
+        local, remote = local.strip("/"), remote.strip("/")
+        if not eq or local == remote or any(p in (".", "..") for p in (local + "/" + remote).split("/")):
+            raise argparse.ArgumentTypeError(f"invalid folder map entry '{pair}', use LOCAL=REMOTE")
+        mapping[local] = remote
+    if len(set(mapping.values())) != len(mapping):
+        raise argparse.ArgumentTypeError(f"folder map '{value}' maps several folders to the same folder")
+    return mapping
+
+
+def changes_to_wire(changes: Dict[str, Dict[str, Any]]) -> Dict[str, Dict[str, Any]]:
+    """
+    Translate the file names of changes or listings to send to the other side,
+    see to_wire.
 
     Args:
-        fname: File to write to.
-        revision: Revision/UUID to record.
+        changes (dict): Tags and files (and possibly other data) by message ID.
+
+    Returns:
+        dict: The changes with translated file names.
     """
-    with open(fname, 'w', encoding="utf-8") as f:
-        logger.info("Writing last sync revision %s.", revision.rev)
-        f.write(f"{revision.rev} {revision.uuid.decode()}")
+    if session["folder_layout"] == "nested" and not session["folder_map"]:
+        return changes
+    return {mid: {**change, "files": [to_wire(f) for f in change["files"]]} for mid, change in changes.items()}
 
 
-def initial_sync(
-    dbw: notmuch2.Database,
-    prefix: str,
-    from_stream: IO[bytes] | None,
-    to_stream: IO[bytes] | None
-) -> Tuple[Dict[str, Dict[str, Any]], Dict[str, Dict[str, Any]], int, str]:
+def encode_data(obj: Any) -> bytes:
     """
-    Perform the initial synchronization of UUIDs and tag changes, which includes
-    applying any remote tag changes to messages that exist locally. UUIDs and
-    changes are communicated to/from the remote over the respective streams.
+    Encode changes, file names, or hashes to send to the other side with the
+    negotiated encoding (JSON, MessagePack, or CBOR).
 
     Args:
-        dbw: An open writable notmuch2.Database object.
-        prefix (str): Prefix path for filenames (notmuch config database.path).
-        from_stream: Stream to read from the remote.
-        to_stream: Stream to write to the remote.
+        obj: What to encode.
 
     Returns:
-        tuple: (local changes dict, remote changes dict, number of tag changes,
-                name of sync file)
+        bytes: The encoded data.
     """
-    revision = dbw.revision()
-    uuids = {}
-    uuids["mine"] = revision.uuid.decode()
+    if session["encoding"] == "msgpack":
+        return msgpack.packb(obj)
+    if session["encoding"] == "cbor":
+        return cbor2.dumps(obj)
+    return json.dumps(obj).encode("utf-8")
 
-    def _send_uuid():
-        logger.info("Sending UUID %s...", uuids["mine"])
-        to_stream.write(uuids["mine"].encode("utf-8"))
-        transfer["write"] += 36
-        to_stream.flush()
 
-    def _recv_uuid():
-        logger.info("Receiving UUID...")
-        uuids["theirs"] = from_stream.read(36).decode("utf-8")
-        transfer["read"] += 36
+def decode_data(data: bytes) -> Any:
+    """
+    Decode changes, file names, or hashes received from the other side with
+    the negotiated encoding, see encode_data.
 
-    run_async(_send_uuid, _recv_uuid)
+    Args:
+        data (bytes): The encoded data.
 
-    logger.info("UUIDs synced.")
-    logger.debug("Local UUID %s, remote UUID %s.", uuids["mine"], uuids["theirs"])
-    fname = os.path.join(prefix, ".notmuch", "notmuch-sync-" + uuids["theirs"])
+    Returns:
+        The decoded data.
 
-    changes = {}
-    logger.info("Computing local changes...")
-    changes["mine"] = get_changes(dbw, revision, prefix, fname)
+    Raises:
+        ValueError: If the data can't be decoded.
+    """
+    if session["encoding"] == "json":
+        return json.loads(data.decode("utf-8"))
+    try:
+        if session["encoding"] == "msgpack":
+            return msgpack.unpackb(data)
+        return cbor2.loads(data)
+    except Exception as e:
+        raise ValueError(f"Invalid {session['encoding']} data from other side, aborting...") from e
 
-    def _send_changes():
-        logger.info("Sending local changes...")
-        write(json.dumps(changes["mine"]).encode("utf-8"), to_stream)
 
-    def _recv_changes():
-        logger.info("Receiving remote changes...")
-        changes["theirs"] = json.loads(read(from_stream).decode("utf-8"))
+def decode_fnames(data: bytes, mail: bool = True) -> List[str]:
+    """
+    Decode a JSON-encoded list of file names received from the other side.
 
-    run_async(_send_changes, _recv_changes)
+    Args:
+        data (bytes): The JSON-encoded file names.
+        mail (bool): Whether they are names of mail files, see validate_fname.
 
-    logger.info("Changes synced.")
-    logger.debug("Local changes %s, remote changes %s.", changes["mine"], changes["theirs"])
-    tchanges = sync_tags(dbw, changes["mine"], changes["theirs"])
-    logger.info("Tags synced.")
+    Returns:
+        list: The file names.
 
-    return (changes["mine"], changes["theirs"], tchanges, fname)
+    Raises:
+        ValueError: If the data is not a list of valid file names (see
+        validate_fname).
+    """
+    fnames = decode_data(data)
+    if not isinstance(fnames, list):
+        raise ValueError("Invalid file names from other side, aborting...")
+    if not mail:
+        return [validate_fname(f, mail) for f in fnames]
+    return [from_wire(validate_fname(f)) for f in fnames]
 
 
-def get_missing_files(
-    dbw: notmuch2.Database,
-    prefix: str,
-    changes_mine: Dict[str, Dict[str, Any]],
-    changes_theirs: Dict[str, Dict[str, Any]],
-    from_stream: IO[bytes] | None,
-    to_stream: IO[bytes] | None,
-    move_on_change: bool = False
-) -> Tuple[Dict[str, Dict[str, Any]], int, int]:
+def decode_change(mid: str, change: Any) -> Change:
     """
-    Determine which files are missing locally compared to the remote, and handle
-    file moves/copies based on SHA256 checksums. Delete any files that aren't
-    there on the remote anymore. This never deletes a message, only duplicate
-    files for a message.
+    Check the decoded tags and files of a message received from the other side.
 
     Args:
-        dbw: An open writable notmuch2.Database object.
-        prefix (str): Prefix path for filenames (notmuch config database.path).
-        changes_mine (dict): Local changes.
-        changes_theirs (dict): Remote changes.
-        from_stream: Stream to read from the remote.
-        to_stream: Stream to write to the remote.
-        move_on_change: Whether to move file that has local and remote changes.
-        This flag is used to prevent infinite loops where local has one file
-        name and remote another file name (e.g. when running mbsync independently).
+        mid (str): The message ID.
+        change: The decoded JSON.
 
     Returns:
-        tuple: (dict of missing files, number of local moves/copies, number of
-                local deletions)
+        Change: The tags and files, without any other keys.
+
+    Raises:
+        ValueError: If the message ID is empty, the data doesn't have lists of
+        tags and files, or a file name is invalid (see validate_fname), saying
+        which.
     """
-    ret = {}
-    mcchanges = 0
-    dchanges = 0
-    hashes: dict[str, List[str]] = {}
-    # check which files we need to get digests for to determine if they've
-    # been moved/copied
-    hashes["req_mine"] = []
-    for mid in changes_theirs:
-        try:
-            msg = dbw.find(mid)
-            if msg.ghost:
-                continue
-            fnames_theirs = changes_theirs[mid]["files"]
-            fnames_mine = [ str(f).removeprefix(prefix) for f in msg.filenames() ]
-            missing_mine = set(fnames_theirs) - set(fnames_mine)
-            if len(missing_mine) > 0:
-                hashes["req_mine"].extend(fnames_theirs)
-        except LookupError:
-            continue
+    if not isinstance(mid, str) or not mid:
+        raise ValueError(f"Invalid changes from other side, invalid message ID {mid!r}, aborting...")
+    if not isinstance(change, dict):
+        raise ValueError(f"Invalid changes for {mid!r} from other side, expected tags and files, got {type(change).__name__}, aborting...")
+    for key in ["tags", "files"]:
+        if key not in change:
+            raise ValueError(f"Invalid changes for {mid!r} from other side, {key} missing, aborting...")
+        if not isinstance(change[key], list) or not all(isinstance(v, str) for v in change[key]):
+            raise ValueError(f"Invalid changes for {mid!r} from other side, {key} must be a list of strings, got {change[key]!r}, aborting...")
+    for f in change["files"]:
+        validate_fname(f)
+    return {"tags": change["tags"], "files": [from_wire(f) for f in change["files"]]}
+
+
+def decode_changes(data: bytes) -> Changes:
+    """
+    Decode JSON-encoded tags and files by message ID received from the other
+    side.
 
-    def _send_hashes_req():
-        logger.info("Requesting %s hashes from remote...", len(hashes["req_mine"]))
-        logger.debug("Requesting hashes %s", hashes["req_mine"])
-        write(json.dumps(hashes["req_mine"]).encode("utf-8"), to_stream)
+    Args:
+        data (bytes): The JSON-encoded changes.
 
-    def _recv_hashes_req():
-        logger.info("Receiving hash requests from remote...")
-        hashes["req_theirs"] = json.loads(read(from_stream).decode("utf-8"))
-        logger.debug("Hashes requested by remote %s", hashes["req_theirs"])
+    Returns:
+        dict: Mapping of message IDs to their tags and files.
 
-    run_async(_send_hashes_req, _recv_hashes_req)
+    Raises:
+        ValueError: If the data is not a mapping of message IDs to valid tags
+        and files (see decode_change).
+    """
+    changes = decode_data(data)
+    if not isinstance(changes, dict):
+        raise ValueError(f"Invalid changes from other side, expected changes by message ID, got {type(changes).__name__}, aborting...")
+    return {mid: decode_change(mid, change) for mid, change in changes.items()}
+
+
+def decode_hashes(data: bytes, count: int) -> List[str | None]:
+    """
+    Decode the hashes of requested files received from the other side.
+
+    Args:
+        data (bytes): The encoded hashes.
+        count (int): Number of files whose hashes were requested.
+
+    Returns:
+        list: The hash of each requested file, in the order requested, None
+        for files the other side doesn't have.
+
+    Raises:
+        ValueError: If the data is not a hash or None for each requested file.
+    """
+    hashes = decode_data(data)
+    if (not isinstance(hashes, list) or len(hashes) != count or
+            not all(h is None or isinstance(h, str) for h in hashes)):
+        raise ValueError(f"Invalid hashes from other side, expected {count} hashes, aborting...")
+    return hashes
+
+
+def decode_signatures(data: bytes, count: int) -> List[List[List[Any]] | None]:
+    """
+    Decode the block signatures of files received from the other side, see
+    block_signature.
+
+    Args:
+        data (bytes): The JSON-encoded block signatures.
+        count (int): Number of files the other side requested.
+
+    Returns:
+        list: The block signature of each requested file, None for files it
+        has no basis for.
+
+    Raises:
+        ValueError: If the data is not a block signature or None for each
+        requested file.
+    """
+    sigs = json.loads(data.decode("utf-8"))
+
+    def _valid(sig: Any) -> bool:
+        return sig is None or (isinstance(sig, list) and
+                               all(isinstance(s, list) and len(s) == 2 and type(s[0]) is int and
+                                   0 <= s[0] < 2**32 and isinstance(s[1], str) for s in sig))
+
+    if not isinstance(sigs, list) or len(sigs) != count or not all(_valid(sig) for sig in sigs):
+        raise ValueError(f"Invalid block signatures from other side, expected {count} signatures, aborting...")
+    return sigs
+
+
+class FrameWriter(io.RawIOBase):
+    """
+    Writable file-like object that writes everything to a stream in 4-byte
+    length-prefixed frames. Closing it writes an empty frame to mark the end.
+    """
+
+    def __init__(self, stream: IO[bytes] | None):
+        self.stream = stream
+
+    def writable(self) -> bool:
+        return True
+
+    def write(self, b) -> int:
+        if len(b) > 0:
+            write(bytes(b), self.stream)
+        return len(b)
+
+    def close(self) -> None:
+        if not self.closed:
+            write(b'', self.stream)
+        super().close()
+
+
+class FrameReader(io.RawIOBase):
+    """
+    Readable file-like object that reads frames written by FrameWriter from a
+    stream until the empty frame that marks the end. Closing it skips anything
+    that has not been read up to the end.
+    """
+
+    def __init__(self, stream: IO[bytes] | None):
+        self.stream = stream
+        self.buf = b''
+        self.eof = False
+
+    def readable(self) -> bool:
+        return True
+
+    def readinto(self, b) -> int:
+        while len(self.buf) == 0 and not self.eof:
+            self.buf = read(self.stream)
+            self.eof = len(self.buf) == 0
+        n = min(len(b), len(self.buf))
+        b[:n] = self.buf[:n]
+        self.buf = self.buf[n:]
+        return n
+
+    def close(self) -> None:
+        while not self.eof:
+            self.eof = len(read(self.stream)) == 0
+        super().close()
+
+
+def run_async(m1: Callable[[], Any], m2: Callable[[], Any]) -> None:
+    """
+    Run two functions async. Used to read/write to streams at the same time.
+
+    Args:
+        m1: One function.
+        m2: Other function.
+    """
+    async def _tmp():
+        await asyncio.gather(asyncio.to_thread(m1), asyncio.to_thread(m2))
+
+    asyncio.run(_tmp())
+
+
+class SyncError(Exception):
+    """
+    Error that records what was being done when the error that caused it
+    occurred: the phase of the sync, the other side, and the file or message
+    involved, if any. See format_error.
+    """
+
+    def __init__(self, phase: str, peer: str | None = None, obj: str | None = None):
+        self.phase = phase
+        self.peer = peer
+        self.obj = obj
+        super().__init__(self.describe())
+
+    def describe(self) -> str:
+        """
+        Describe the context of the error.
+
+        Returns:
+            str: Phase, other side, and object.
+        """
+        out = self.phase
+        if self.obj is not None:
+            out += f" {self.obj}"
+        if self.peer is not None:
+            out += f" with {self.peer}"
+        return out
+
+
+@contextlib.contextmanager
+def context(phase: str, obj: str | None = None) -> Iterator[None]:
+    """
+    Context manager that wraps any error in a SyncError with the given phase
+    and object and the other side of the current session, with the original
+    error as the cause.
+
+    Args:
+        phase (str): What is being done, e.g. "receiving".
+        obj (str): File or message this is being done for, if any.
+    """
+    prev = trace["phase"]
+    trace["phase"] = phase
+    try:
+        yield
+    except Exception as e:
+        raise SyncError(phase, session.get("peer") if obj is None else None, obj) from e
+    finally:
+        trace["phase"] = prev
+
+
+@contextlib.contextmanager
+def measure(phase: str) -> Iterator[None]:
+    """
+    Context manager that adds the wall-clock time and the bytes received from
+    and sent to the other side while it is active to the statistics of the
+    given phase of the sync.
+
+    Args:
+        phase (str): Name of the phase, e.g. "tag sync".
+    """
+    start = time.monotonic()
+    nread, nwrite = transfer["read"], transfer["write"]
+    try:
+        yield
+    finally:
+        stats = phases.setdefault(phase, {"seconds": 0.0, "read": 0, "write": 0})
+        stats["seconds"] += time.monotonic() - start
+        stats["read"] += transfer["read"] - nread
+        stats["write"] += transfer["write"] - nwrite
+
+
+def track_phases(fname: str, current: Dict[str, Dict[str, float]]) -> List[str]:
+    """
+    Compare the statistics of the phases of a sync (see measure) to the
+    baseline of the last STATS_HISTORY syncs with the same remote, warn about
+    phases that are STATS_SLOWDOWN times slower than the median (e.g. because
+    a disk is failing), and add the sync to the history. Phases that transfer
+    at least STATS_MIN_BYTES are compared by throughput, all others by time.
+
+    Args:
+        fname (str): File the history is kept in, as JSON.
+        current (dict): Statistics of the sync by phase.
+
+    Returns:
+        list: The phases that are slow.
+    """
+    try:
+        with open(fname, "r", encoding="utf-8") as f:
+            history = json.load(f)
+    except (FileNotFoundError, ValueError):
+        history = {}
+    slow = []
+    for phase, stats in current.items():
+        nbytes = stats["read"] + stats["write"]
+        past = history.get(phase, [])
+        if stats["seconds"] >= STATS_MIN_SECONDS:
+            if nbytes >= STATS_MIN_BYTES:
+                rates = [p["bytes"] / p["seconds"] for p in past if p["bytes"] >= STATS_MIN_BYTES and p["seconds"] > 0]
+                ratio = statistics.median(rates) / (nbytes / stats["seconds"]) if len(rates) >= STATS_MIN_HISTORY else 0
+            else:
+                times = [p["seconds"] for p in past if p["bytes"] < STATS_MIN_BYTES]
+                ratio = stats["seconds"] / max(statistics.median(times), 1e-3) if len(times) >= STATS_MIN_HISTORY else 0
+            if ratio >= STATS_SLOWDOWN:
+                logger.warning("%s took %.2f s, %.0f times slower than usual; check %s.", phase, stats["seconds"], ratio,
+                               PHASE_CULPRITS.get(phase, "either side"))
+                slow.append(phase)
+        history[phase] = (past + [{"seconds": stats["seconds"], "bytes": nbytes}])[-STATS_HISTORY:]
+    write_atomic(fname, json.dumps(history).encode("utf-8"))
+    return slow
+
+
+class RemoteError(Exception):
+    """
+    The remote reported an error, see sync_local.
+    """
+
+
+class ConfigError(ValueError):
+    """
+    The configuration file or a value in it is invalid.
+    """
+
+
+class ReadOnlyError(ValueError):
+    """
+    The other side asked for changes on this side, which was started with
+    --read-only. The message lists what would have been changed as JSON.
+    """
+
+    def __init__(self, op: str, targets: List[str]) -> None:
+        super().__init__(f"refusing to {op} on read-only side: {json.dumps(sorted(targets))}")
+        self.op = op
+        self.targets = targets
+
+
+def exit_code(e: BaseException) -> int:
+    """
+    Get the exit code for an error that aborted the sync: EXIT_REMOTE if the
+    remote reported an error, EXIT_USAGE if the configuration is invalid,
+    EXIT_TRANSPORT if the connection to the remote failed, and EXIT_LOCAL for
+    anything else. EXIT_CHANGES, EXIT_MISMATCH, and EXIT_PARTIAL are for
+    completed runs, see main.
+
+    Args:
+        e: The error.
+
+    Returns:
+        int: The exit code.
+    """
+    cur: BaseException | None = e
+    while cur is not None:
+        if isinstance(cur, RemoteError):
+            return EXIT_REMOTE
+        if isinstance(cur, ConfigError):
+            return EXIT_USAGE
+        if cur.__cause__ is None and (cur.__context__ is None or cur.__suppress_context__):
+            break
+        cur = cur.__cause__ or cur.__context__
+    if isinstance(cur, (EOFError, ConnectionError, TimeoutError, socket.gaierror)):
+        return EXIT_TRANSPORT
+    return EXIT_LOCAL
+
+
+def format_error(e: BaseException) -> str:
+    """
+    Format an error and its causes as a compact chain, outermost first.
+
+    Args:
+        e: The error.
+
+    Returns:
+        str: The chain of errors, separated by colons.
+    """
+    parts = []
+    cur: BaseException | None = e
+    while cur is not None:
+        if isinstance(cur, SyncError):
+            parts.append(cur.describe())
+        else:
+            parts.append(str(cur) or type(cur).__name__)
+        cur = cur.__cause__ or (None if cur.__suppress_context__ else cur.__context__)
+    return ": ".join(parts)
+
+
+def is_bug(e: BaseException) -> bool:
+    """
+    Determine whether an error is unexpected, i.e. likely a bug in
+    notmuch-sync rather than a problem with the environment (e.g. the
+    connection, the filesystem, or invalid data).
+
+    Args:
+        e: The error.
+
+    Returns:
+        bool: Whether the root cause of the error is unexpected.
+    """
+    while e.__cause__ is not None or (e.__context__ is not None and not e.__suppress_context__):
+        e = e.__cause__ or e.__context__ # type: ignore[assignment]
+    return not isinstance(e, (ValueError, OSError, EOFError, subprocess.CalledProcessError))
+
+
+def make_bundle(e: BaseException, side: str) -> Dict[str, Any]:
+    """
+    Collect a diagnostic bundle for an error that can be attached to a bug
+    report: the traceback, the phase of the sync (see SyncError), the session
+    parameters, the last FRAME_TRACE frames exchanged with the other side, the
+    time and bytes of each phase so far, and information about the
+    environment. The bundle does not contain message contents, but may contain
+    message IDs, file names, and host names.
+
+    Args:
+        e: The error.
+        side (str): "local" or "remote".
+
+    Returns:
+        dict: The bundle.
+    """
+    return {
+        "side": side,
+        "error": format_error(e),
+        "traceback": traceback.format_exception(e),
+        "session": {k: v for k, v in session.items() if k != "resolved"},
+        "frames": list(frames),
+        "transfer": transfer,
+        "phases": phases,
+        "argv": sys.argv,
+        "version": VERSION,
+        "protocol": PROTOCOL,
+        "notmuch": notmuch_version(),
+        "python": sys.version,
+        "platform": platform.platform(),
+    }
+
+
+def write_bundle(bundle: Dict[str, Any]) -> str | None:
+    """
+    Write a diagnostic bundle (see make_bundle) to the cache directory.
+
+    Args:
+        bundle (dict): The bundle.
+
+    Returns:
+        str: Path of the bundle, None if it could not be written.
+    """
+    cache = os.environ.get("XDG_CACHE_HOME", os.path.join(os.path.expanduser("~"), ".cache"))
+    fname = os.path.join(cache, "notmuch-sync", time.strftime("crash-%Y%m%d-%H%M%S") + f"-{os.getpid()}.json")
+    try:
+        Path(fname).parent.mkdir(parents=True, exist_ok=True)
+        Path(fname).write_text(json.dumps(bundle, indent=2, default=str), encoding="utf-8")
+    except OSError:
+        return None
+    return fname
+
+
+def upload_bundle(bundle: Dict[str, Any], url: str) -> None:
+    """
+    Post a diagnostic bundle (see make_bundle) as JSON to a URL. The beginnings
+    of the protocol frames are left out, as they may contain the beginnings of
+    transferred mail files.
+
+    Args:
+        bundle (dict): The bundle.
+        url (str): The URL to post to.
+
+    Raises:
+        OSError: If the bundle could not be posted.
+        ValueError: If the URL is invalid.
+    """
+    scrubbed = {**bundle, "frames": [{k: v for k, v in f.items() if k != "data"} for f in bundle["frames"]]}
+    req = urllib.request.Request(url, data=json.dumps(scrubbed, default=str).encode("utf-8"),
+                                 headers={"Content-Type": "application/json"}, method="POST")
+    with urllib.request.urlopen(req, timeout=30):
+        pass
+
+
+def report_error(e: BaseException, side: str, url: str | None = None) -> None:
+    """
+    Print an error as a compact chain (see format_error) to stderr. For
+    unexpected errors, write a diagnostic bundle (see make_bundle) and point
+    to it. If a crash report URL is given, the bundle is posted there for any
+    error (see upload_bundle).
+
+    Args:
+        e: The error.
+        side (str): "local" or "remote".
+        url (str): URL to post the diagnostic bundle to, if any.
+    """
+    msg = format_error(e)
+    bug = is_bug(e)
+    bundle = make_bundle(e, side) if bug or url else {}
+    if bug:
+        fname = write_bundle(bundle)
+        if fname is not None:
+            msg += f" (this is likely a bug, please attach diagnostic bundle {fname} to a bug report)"
+    if url:
+        try:
+            upload_bundle(bundle, url)
+        except (OSError, ValueError) as ue:
+            msg += f" (could not send crash report to {url}: {ue})"
+    print(f"Error: {msg}", file=sys.stderr)
+
+
+def notmuch_version() -> str:
+    """
+    Get the version of notmuch installed on this side.
+
+    Returns:
+        str: The version, "unknown" if it can't be determined.
+    """
+    try:
+        res = subprocess.run(["notmuch", "--version"], capture_output=True, check=True)
+        return res.stdout.decode("utf-8", errors="replace").strip().removeprefix("notmuch ")
+    except (OSError, subprocess.CalledProcessError):
+        return "unknown"
+
+
+def report_unavailable(mine: Dict[str, Any], theirs: Dict[str, Any]) -> None:
+    """
+    Warn about requested features that are not used because the remote doesn't
+    support them.
+
+    Args:
+        mine (dict): Hello frame of this side, including preferences.
+        theirs (dict): Hello frame of the other side.
+    """
+    remote = f"remote notmuch-sync {theirs.get('version', 'unknown')} ({theirs.get('implementation', 'unknown')})"
+    if mine.get("delta") and not session["delta"]:
+        logger.warning("Delta transfers requested, but %s doesn't support them.", remote)
+    if mine.get("xattrs") and not session["xattrs"]:
+        logger.warning("Preserving extended attributes requested, but %s doesn't support it.", remote)
+    if mine.get("digest") and mine["digest"] != session["digest"]:
+        logger.warning("%s digests requested, but %s doesn't support them or prefers %s, using %s.",
+                       mine["digest"], remote, theirs.get("digest"), session["digest"])
+    if mine.get("encoding") and mine["encoding"] != session["encoding"]:
+        logger.warning("%s encoding requested, but %s doesn't support it, using %s.",
+                       mine["encoding"], remote, session["encoding"])
+
+
+def check_compat(theirs: Dict[str, Any]) -> None:
+    """
+    Check that the other side speaks the same wire protocol, which is all that
+    is needed for different versions or implementations to work together.
+
+    Args:
+        theirs (dict): Hello frame of the other side.
+    """
+    if not isinstance(theirs, dict):
+        theirs = {}
+    if theirs.get("protocol") != PROTOCOL:
+        raise ValueError(f"Incompatible notmuch-sync on other side ({theirs.get('implementation', 'unknown')} implementation "
+                         f"version {theirs.get('version', 'unknown')}, protocol {theirs.get('protocol', 'unknown')}), "
+                         f"this side is python implementation version {VERSION}, protocol {PROTOCOL}; "
+                         "update both sides to the same version, aborting...")
+    protocol_logger.debug("Other side is %s implementation version %s.", theirs.get("implementation"), theirs.get("version"))
+
+
+def negotiate(
+    mine: Dict[str, Any],
+    theirs: Dict[str, Any]
+) -> Dict[str, Any]:
+    """
+    Determine the session parameters from what both sides support and prefer.
+    The result is the same regardless of which side calls this.
+
+    Args:
+        mine (dict): Supported ("digests", "encodings", "features") and
+        preferred ("digest", "encoding", "delta", "xattrs") parameters, folder
+        "policies", prefixes of "local-tags", "received-tags", patterns of
+        "ignore-tags" and "sync-tags", "exclude-tags" with their modes, whether the mail
+        directory is "read-only", and whether the notmuch database and mail
+        must not be changed ("read-only-db") of this side.
+        theirs (dict): Supported and preferred parameters of the other side.
+
+    Returns:
+        dict: The negotiated session parameters.
+    """
+    prefs = {h.get("digest") for h in (mine, theirs)} - {None}
+    algo = "sha256"
+    if len(prefs) == 1:
+        pref = prefs.pop()
+        if pref in mine.get("digests", []) and pref in theirs.get("digests", []):
+            algo = pref
+    prefs = {h.get("encoding") for h in (mine, theirs)} - {None}
+    encoding = "json"
+    if len(prefs) == 1:
+        pref = prefs.pop()
+        if pref in mine.get("encodings", []) and pref in theirs.get("encodings", []):
+            encoding = pref
+    delta = (any(h.get("delta", False) for h in (mine, theirs)) and
+             all("delta" in h.get("features", []) for h in (mine, theirs)))
+    buckets = all("id-buckets" in h.get("features", []) for h in (mine, theirs))
+    xattrs = (any(h.get("xattrs", False) for h in (mine, theirs)) and
+              all("xattrs" in h.get("features", []) for h in (mine, theirs)))
+    revisions = all("revisions" in h.get("features", []) for h in (mine, theirs))
+    batches = all("change-batches" in h.get("features", []) for h in (mine, theirs))
+    mbsync_digests = all("mbsync-digests" in h.get("features", []) for h in (mine, theirs))
+    phase_outcomes = all("outcomes" in h.get("features", []) for h in (mine, theirs))
+    file_order = all("file-order" in h.get("features", []) for h in (mine, theirs))
+    resolutions = all("conflict-resolutions" in h.get("features", []) for h in (mine, theirs))
+    file_digests = all("file-digests" in h.get("features", []) for h in (mine, theirs))
+    duplicate_counts = all("duplicate-counts" in h.get("features", []) for h in (mine, theirs))
+    # policies of both sides apply; as the most restrictive matching policy
+    # wins, the order doesn't matter
+    policies = list(mine.get("policies", []))
+    policies += [p for p in theirs.get("policies", []) if p not in policies]
+    # device-local tags of either side are kept out of the sync on both
+    local_tags = sorted(set(mine.get("local-tags", [])) | set(theirs.get("local-tags", [])))
+    # as are the tags added to received messages, which only match exactly
+    received_tags = sorted(set(mine.get("received-tags", [])) | set(theirs.get("received-tags", [])))
+    # as are tags matching the ignore patterns of either side, and tags not
+    # matching the sync patterns of each side that has them
+    ignore_tags = sorted(set(mine.get("ignore-tags", [])) | set(theirs.get("ignore-tags", [])))
+    only_tags = [h["sync-tags"] for h in (mine, theirs) if h.get("sync-tags")]
+    # as are messages with exclusion tags of either side, see excluded; the
+    # more restrictive mode wins
+    exclude_tags = dict(theirs.get("exclude-tags", {}))
+    for tag, mode in mine.get("exclude-tags", {}).items():
+        exclude_tags[tag] = "all" if "all" in (mode, exclude_tags.get(tag)) else mode
+    # with a read-only mail directory on either side, only tags are synced and
+    # the sync state isn't recorded, so that files are synced next time
+    deferred = any(h.get("read-only", False) for h in (mine, theirs))
+    # with --read-only on either side, changes only go from that side to the
+    # other
+    pull_only = any(h.get("read-only-db", False) for h in (mine, theirs))
+    if deferred:
+        policies.append(READ_ONLY_POLICY)
+    return {"digest": algo, "delta": delta, "buckets": buckets, "policies": policies, "deferred": deferred,
+            "xattrs": xattrs, "revisions": revisions, "batches": batches, "encoding": encoding,
+            "mbsync_digests": mbsync_digests, "outcomes": phase_outcomes, "local_tags": local_tags,
+            "received_tags": received_tags, "ignore_tags": ignore_tags, "only_tags": only_tags, "exclude_tags": exclude_tags,
+            "pull_only": pull_only, "file_order": file_order, "resolutions": resolutions,
+            "file_digests": file_digests, "duplicate_counts": duplicate_counts}
+
+
+def exclude_tags(args: argparse.Namespace) -> Dict[str, str]:
+    """
+    Get the exclusion tag of this side with its mode, see excluded.
+
+    Args:
+        args: Parsed command-line arguments.
+
+    Returns:
+        dict: Mode by exclusion tag, empty if there is none.
+    """
+    return {args.exclude_tag: args.exclude_tag_mode} if args.exclude_tag else {}
+
+
+def read_policies(config: configparser.ConfigParser) -> List[Dict[str, Any]]:
+    """
+    Get folder sync policies from "[folder PATTERN]" sections of the
+    configuration file. PATTERN is matched against file names relative to the
+    mail directory (see mail_root); "files" (default yes) determines whether files are
+    transferred, copied, moved, and deleted, "delete" (default yes) whether
+    messages are deleted with --delete, and "priority" (default 0) the order
+    in which missing files are transferred.
+
+    Args:
+        config: The parsed configuration file.
+
+    Returns:
+        list: Policies with "pattern", "files", "delete", and "priority".
+
+    Raises:
+        ConfigError: If a value is invalid.
+    """
+    try:
+        return [{"pattern": name.removeprefix("folder ").strip(),
+                 "files": config[name].getboolean("files", True),
+                 "delete": config[name].getboolean("delete", True),
+                 "priority": config[name].getint("priority", 0)}
+                for name in config.sections() if name.startswith("folder ")]
+    except ValueError as e:
+        raise ConfigError(f"Invalid folder policy in configuration file: {e}") from e
+
+
+def excluded(tags: Iterable[str]) -> str | None:
+    """
+    Check whether a message is kept out of the sync by an exclusion tag
+    negotiated for the session. With mode "files", its files are neither
+    transferred, copied, moved, nor deleted, but its tags are synced; with
+    mode "all", its tags aren't synced either.
+
+    Args:
+        tags: Tags of the message.
+
+    Returns:
+        str: The most restrictive mode of the message's exclusion tags, None if
+        it has none.
+    """
+    modes = {session["exclude_tags"][t] for t in tags if t in session["exclude_tags"]}
+    return "all" if "all" in modes else "files" if modes else None
+
+
+def policy_for(fnames: Iterable[str], tags: Iterable[str] = ()) -> Dict[str, Any]:
+    """
+    Get the sync policy for a message from the policies negotiated for the
+    session. If several policies match any of the message's files, the most
+    restrictive one applies and the highest priority. Messages with an
+    exclusion tag (see excluded) are treated like files = no and delete = no.
+
+    Args:
+        fnames: File names of the message, relative to the mail directory.
+        tags: Tags of the message on either side.
+
+    Returns:
+        dict: "files", "delete", and "priority" for the message.
+    """
+    excl = excluded(tags) is None
+    ret = {"files": excl, "delete": excl, "priority": None}
+    for f in fnames:
+        f = str(f).lstrip("/")
+        for p in session["policies"]:
+            if fnmatch.fnmatchcase(f, p["pattern"]):
+                ret["files"] = ret["files"] and p["files"]
+                ret["delete"] = ret["delete"] and p["delete"]
+                if ret["priority"] is None or p["priority"] > ret["priority"]:
+                    ret["priority"] = p["priority"]
+    if ret["priority"] is None:
+        ret["priority"] = 0
+    return ret
+
+
+def get_changes(
+    db: notmuch2.Database,
+    revision: notmuch2.DbRevision,
+    prefix: str,
+    sync_file: str,
+    accept_new_uuid: bool = False,
+    peer_rev: int | None = None,
+    last_rev: int | None = None
+) -> Changes:
+    """
+    Get changes that happened since the last sync, or everything in the DB if no previous sync.
+
+    Args:
+        db: An open notmuch2.Database object.
+        revision: Database revision object, must have .uuid and .rev.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        sync_file (str): Path to the file storing the sync state.
+        accept_new_uuid: If the sync state was recorded for a different UUID
+        of this database, set it aside and sync everything instead of
+        aborting.
+        peer_rev (int): Current revision of the other side's database, if
+        known, to compare to the one recorded at the last sync.
+        last_rev (int): Revision of this side's database after the last sync
+        as recorded by the other side, used instead of the sync state with
+        --read-only, which isn't recorded then.
+
+    Returns:
+        dict: Mapping of message IDs to their tags and files.
+    """
+    rev_prev = -1
+    if session["read_only_db"]:
+        # the sync state isn't recorded with --read-only
+        state = {"peer_rev": None}
+        if isinstance(last_rev, int) and 0 <= last_rev <= revision.rev:
+            rev_prev = last_rev
+    else:
+        try:
+            state = read_sync_state(sync_file)
+            uuid = revision.uuid.decode()
+            if state["uuid"] != uuid:
+                if not accept_new_uuid:
+                    raise ValueError(f"Last sync with UUID {state['uuid']}, but notmuch DB has UUID {uuid}, aborting...")
+                # the state file is overwritten with the new UUID at the end
+                # of the sync
+                logger.warning("Last sync with UUID %s, but notmuch DB has UUID %s, syncing everything.", state["uuid"], uuid)
+            elif peer_rev is not None and state["peer_rev"] is not None and peer_rev < state["peer_rev"]:
+                # the other side's database and sync state have been restored from
+                # a backup; changes sent to it since then would be lost otherwise
+                logger.warning("notmuch DB of other side at revision %s, but was at revision %s after the last sync, syncing everything.",
+                               peer_rev, state["peer_rev"])
+            else:
+                rev_prev = state["rev"]
+            if rev_prev > revision.rev:
+                raise ValueError(f"Last sync revision {rev_prev} larger than current DB revision {revision.rev}, aborting...")
+        except FileNotFoundError:
+            # no previous sync or sync file broken, leave rev_prev at -1 as this will sync entire DB
+            state = {"peer_rev": None}
+
+    if peer_rev is not None and state["peer_rev"] is not None:
+        logger.info("Previous sync revision %s, current revision %s, other side previous sync revision %s, current revision %s.",
+                    rev_prev, revision.rev, state["peer_rev"], peer_rev)
+        if rev_prev == revision.rev and peer_rev == state["peer_rev"]:
+            logger.info("Neither side changed since the last sync.")
+            return {}
+    else:
+        logger.info("Previous sync revision %s, current revision %s.", rev_prev, revision.rev)
+    return {msg.messageid: {"tags": list(msg.tags),
+                            "files": [str(f).removeprefix(prefix) for f in msg.filenames()]}
+                            for msg in db.messages(f"lastmod:{rev_prev + 1}..")}
+
+
+def notmuch_dir(path: str) -> str:
+    """
+    Find the directory notmuch keeps its database in, which is also where the
+    sync state is kept: .notmuch in the database path (the traditional layout
+    with mail and database in the same directory), or the database path itself
+    if it contains the Xapian database (e.g. $XDG_DATA_HOME/notmuch/default,
+    with database.mail_root pointing to the mail directory).
+
+    Args:
+        path (str): notmuch config database.path.
+
+    Returns:
+        str: The directory of the notmuch database.
+    """
+    if not os.path.isdir(os.path.join(path, ".notmuch")) and os.path.isdir(os.path.join(path, "xapian")):
+        return path
+    return os.path.join(path, ".notmuch")
+
+
+def use_notmuch_dir(db: notmuch2.Database) -> None:
+    """
+    Determine the directory of the opened notmuch database from its
+    configuration (see notmuch_dir) for the sync state and direct Xapian
+    access. Sets session["notmuch_dir"]; if the configuration doesn't have the
+    database path, .notmuch in the mail directory is used.
+
+    Args:
+        db: An open notmuch2.Database object.
+    """
+    path = db.config.get("database.path")
+    session["notmuch_dir"] = notmuch_dir(path) if path else None
+
+
+def state_path(prefix: str, name: str) -> str:
+    """
+    Get the path of a file in the directory of the notmuch database.
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        name (str): Name of the file.
+
+    Returns:
+        str: The path.
+    """
+    return os.path.join(session["notmuch_dir"] or os.path.join(prefix, ".notmuch"), name)
+
+
+def mail_root(db: notmuch2.Database) -> str:
+    """
+    Get the directory the mail files are in, which all file names are relative
+    to: database.mail_root if configured (e.g. with the database in
+    $XDG_DATA_HOME/notmuch/default and the mail elsewhere), database.path
+    otherwise.
+
+    Args:
+        db: An open notmuch2.Database object.
+
+    Returns:
+        str: The mail directory with trailing separator, for use as prefix.
+    """
+    for key in ["database.mail_root", "database.path"]:
+        path = db.config.get(key)
+        if path:
+            return os.path.join(path, '')
+    return os.path.join(str(db.default_path()), '')
+
+
+def sync_flags_enabled(db: notmuch2.Database) -> bool:
+    """
+    Determine whether notmuch synchronizes maildir flags with tags
+    (maildir.synchronize_flags, enabled by default).
+
+    Args:
+        db: An open notmuch2.Database object.
+
+    Returns:
+        bool: Whether maildir flags are synchronized with tags.
+    """
+    return db.config.get("maildir.synchronize_flags", "").lower() not in ["false", "no", "0"]
+
+
+def without_local_tags(tags: Iterable[str], prefixes: List[str] | None = None) -> List[str]:
+    """
+    Remove device-local tags, i.e. tags that start with any of the prefixes
+    given with --local-tags or are the tag given with --received-tag on either
+    side, and tags filtered with --ignore-tags or --sync-tags on either side,
+    which are never synced.
+
+    Args:
+        tags: The tags.
+        prefixes (list): Prefixes of device-local tags, the negotiated ones
+        of the session if None.
+
+    Returns:
+        list: The tags that are synced.
+    """
+    prefixes = session["local_tags"] if prefixes is None else prefixes
+
+    def _matches(tag: str, patterns: List[str]) -> bool:
+        return any(fnmatch.fnmatchcase(tag, p) for p in patterns)
+
+    return [t for t in tags if not t.startswith(tuple(prefixes)) and t not in session["received_tags"] and
+            not _matches(t, session["ignore_tags"]) and
+            all(_matches(t, patterns) for patterns in session["only_tags"])]
+
+
+def filters_tags() -> bool:
+    """
+    Check whether any tags are kept out of the sync, see without_local_tags.
+
+    Returns:
+        bool: Whether device-local tags or tag patterns have been negotiated.
+    """
+    return bool(session["local_tags"] or session["received_tags"] or session["ignore_tags"] or session["only_tags"])
+
+
+def map_tags(tags: Iterable[str], to_remote: bool) -> List[str]:
+    """
+    Rename tags with the map given with --tag-map on this side, from the names
+    on this side to the names on the remote or back.
+
+    Args:
+        tags: The tags.
+        to_remote (bool): Whether to rename to the names on the remote.
+
+    Returns:
+        list: The renamed tags.
+    """
+    mapping = session["tag_map"] if to_remote else {v: k for k, v in session["tag_map"].items()}
+    return [mapping.get(t, t) for t in tags]
+
+
+def parse_tag_map(value: str) -> Dict[str, str]:
+    """
+    Parse a tag map of the form "LOCAL=REMOTE,...", see map_tags.
+
+    Args:
+        value (str): The tag map.
+
+    Returns:
+        dict: Names on the remote by names on this side.
+
+    Raises:
+        argparse.ArgumentTypeError: If the tag map is invalid or maps several
+        tags to the same name.
+    """
+    mapping = {}
+    for pair in value.replace(",", " ").split():
+        local, _, remote = pair.partition("=")
+        if not local or not remote:
+            raise argparse.ArgumentTypeError(f"invalid tag map entry '{pair}', use LOCAL=REMOTE")
+        mapping[local] = remote
+    if len(set(mapping.values())) != len(mapping):
+        raise argparse.ArgumentTypeError(f"tag map '{value}' maps several tags to the same name")
+    return mapping
+
+
+def sync_tags(
+    db: notmuch2.Database,
+    changes_mine: Changes,
+    changes_theirs: Changes,
+    dry_run: bool = False
+) -> int:
+    """
+    Synchronize tags between local and remote changes. Applies tags from all
+    remotely changed IDs to local messages with the same ID, overwriting any
+    local tags. If an ID appears both in remote and local changes, take the
+    union of all tags, unless the conflict has been resolved by a conflict
+    command. Device-local tags (see without_local_tags) are kept, and the tags
+    of messages excluded with mode "all" (see excluded) aren't changed. If a message
+    is not found locally, do nothing (will be synced later). If notmuch synchronizes maildir flags (see sync_flags_enabled),
+    the files of the message are renamed to match the new tags.
+
+    Args:
+        db: An open notmuch2.Database object.
+        changes_mine (dict): Local changes, mapping message IDs to tags.
+        changes_theirs (dict): Remote changes, mapping message IDs to tags.
+        dry_run: Only record tag changes in planned, do not apply them.
+
+    Returns:
+        int: Number of tag changes made.
+    """
+    changes = 0
+    resolved = session["resolved"].get("tags", {})
+    for mid in changes_theirs:
+        tags = changes_theirs[mid]["tags"]
+        if mid in resolved:
+            tags = resolved[mid]
+        elif mid in changes_mine:
+            tags = set(tags) | set(changes_mine[mid]["tags"])
+        tags = set(without_local_tags(tags))
+        try:
+            msg = db.find(mid)
+            if msg.ghost:
+                continue
+            current = set(msg.tags)
+            if excluded(current) == "all":
+                notmuch_logger.debug("Not setting tags for %s because of exclusion tag.", mid)
+                continue
+            tags |= current - set(without_local_tags(current))
+            if tags != current:
+                notmuch_logger.debug("Setting tags %s for %s.", sorted(list(tags)), mid)
+                if dry_run:
+                    changes += 1
+                    planned.append({"op": "tags", "id": mid,
+                                    "add": sorted(tags - current),
+                                    "remove": sorted(current - tags)})
+                    continue
+                record_undo("tags", id=mid, tags=sorted(current))
+                with msg.frozen():
+                    changes += 1
+                    msg.tags.clear()
+                    for tag in sorted(list(tags)):
+                        msg.tags.add(tag)
+                    # files can't be renamed in a read-only mail directory
+                    if session["sync_flags"] and not session["read_only"]:
+                        msg.tags.to_maildir_flags()
+        except LookupError:
+            # we don't have this message on our side, it will be added later
+            # when syncing files
+            pass
+
+    return changes
+
+
+def resolve_conflicts(
+    cmd: str,
+    changes_local: Changes,
+    changes_remote: Changes
+) -> Dict[str, Dict[str, Any]]:
+    """
+    Run a conflict command for each message that has been changed on both sides
+    and has different tags or files. The command gets a JSON description of the
+    conflict on stdin ({"type": "tags" or "files", "id": message ID, "local":
+    local tags/files, "remote": remote tags/files}) and outputs the resolution
+    as JSON ({"tags": [tags]} or {"files": "local" or "remote"}, for which side's
+    file names to keep). If the command outputs nothing, the default applies
+    (union of tags, remote file names).
+
+    Args:
+        cmd (str): The conflict command.
+        changes_local (dict): Local changes.
+        changes_remote (dict): Remote changes.
+
+    Returns:
+        dict: Resolved "tags" by message ID and "files" winner by message ID.
+    """
+    resolved: Dict[str, Dict[str, Any]] = {"tags": {}, "files": {}}
+    for mid in changes_local.keys() & changes_remote.keys():
+        for kind in ["tags", "files"]:
+            if set(changes_local[mid][kind]) == set(changes_remote[mid][kind]):
+                continue
+            conflict = {"type": kind, "id": mid, "local": sorted(changes_local[mid][kind]),
+                        "remote": sorted(changes_remote[mid][kind])}
+            res = subprocess.run(shlex.split(cmd), input=json.dumps(conflict).encode("utf-8"),
+                                 capture_output=True, check=True)
+            out = res.stdout.decode("utf-8").strip()
+            if not out:
+                continue
+            resolution = json.loads(out)[kind]
+            if kind == "files" and resolution not in ("local", "remote"):
+                raise ValueError(f"Conflict command returned invalid resolution '{resolution}' for files of {mid}, aborting...")
+            notmuch_logger.debug("Resolved %s conflict for %s as %s.", kind, mid, resolution)
+            resolved[kind][mid] = resolution
+    return resolved
+
+
+def read_sync_state(fname: str) -> Dict[str, Any]:
+    """
+    Read a sync state file, see record_sync.
+
+    Args:
+        fname: File to read.
+
+    Returns:
+        dict: Revision ("rev") and "uuid" of this side's database, revision
+        ("peer_rev") and UUID ("peer_uuid") of the other side's database, the
+        other side's identity ("peer"), and the Unix "time" of the sync; the
+        latter four are None if not recorded. "stats" has the numbers of
+        changes of the sync, see record_sync, and is empty if not recorded.
+
+    Raises:
+        FileNotFoundError: If there is no sync state.
+        ValueError: If the sync state is corrupted or written by a newer
+        version.
+    """
+    with open(fname, 'r', encoding="utf-8") as f:
+        content = f.read()
+    if content.startswith("{"):
+        try:
+            state = json.loads(content)
+            version = state.pop("version")
+            checksum = state.pop("checksum")
+        except (ValueError, KeyError, TypeError) as e:
+            raise ValueError(f"Sync state file '{fname}' corrupted, delete to sync from scratch.") from e
+        if not isinstance(version, int) or version > STATE_VERSION:
+            raise ValueError(f"Sync state file '{fname}' has format version {version!r}, but only up to {STATE_VERSION} is supported; update notmuch-sync.")
+        if (checksum != state_checksum(state) or not isinstance(state.get("rev"), int) or
+            not isinstance(state.get("uuid"), str)):
+            raise ValueError(f"Sync state file '{fname}' corrupted, delete to sync from scratch.")
+        return {"peer_rev": None, "peer_uuid": None, "peer": None, "time": None, "stats": {}, **state}
+    # format before STATE_VERSION 1, space-separated; replaced with the next
+    # recorded sync
+    try:
+        tmp = content.strip('\n\r').split(' ', 2)
+        state = {"rev": int(tmp[0]), "uuid": tmp[1], "peer_rev": None, "peer_uuid": None, "peer": None, "time": None,
+                 "stats": {}}
+        rest = tmp[2] if len(tmp) > 2 else None
+        # identities are host:path, so never just a number
+        if rest is not None and rest.split(' ', 1)[0].isdigit():
+            peer = rest.split(' ', 2)
+            state["peer_rev"] = int(peer[0])
+            state["peer_uuid"] = peer[1]
+            rest = peer[2] if len(peer) > 2 else None
+        state["peer"] = rest
+        return state
+    except (ValueError, IndexError, UnicodeError) as e:
+        raise ValueError(f"Sync state file '{fname}' corrupted, delete to sync from scratch.") from e
+
+
+def state_checksum(state: Dict[str, Any]) -> str:
+    """
+    Compute the checksum of a sync state, see record_sync.
+
+    Args:
+        state (dict): The sync state without "version" and "checksum".
+
+    Returns:
+        str: SHA256 digest of the state's JSON encoding with sorted keys.
+    """
+    return hashlib.sha256(json.dumps(state, sort_keys=True).encode("utf-8")).hexdigest()
+
+
+def record_sync(
+    fname: str,
+    revision: notmuch2.DbRevision,
+    peer_revision: Dict[str, Any] | None = None,
+    stats: Dict[str, int] | None = None
+) -> None:
+    """
+    Record last sync revision and time, the other side's revision and identity
+    if known, and the numbers of changes of the sync, as JSON with the format
+    "version" (STATE_VERSION) and a "checksum" of everything else (see
+    state_checksum).
+
+    Args:
+        fname: File to write to.
+        revision: Revision/UUID to record.
+        peer_revision (dict): Revision ("rev") and "uuid" of the other side's
+        database after the sync, see exchange_revisions.
+        stats (dict): Numbers of changes on this side by kind, e.g. "messages"
+        for new messages.
+    """
+    state = {"rev": revision.rev, "uuid": revision.uuid.decode(),
+             "peer_rev": peer_revision["rev"] if peer_revision else None,
+             "peer_uuid": peer_revision["uuid"] if peer_revision else None,
+             "peer": session.get("peer"), "time": int(time.time()), "stats": stats or {}}
+    logger.info("Writing last sync revision %s.", revision.rev)
+    # replaced atomically, so that a crash never leaves a truncated state that
+    # every later sync refuses; the files synced up to this revision have been
+    # written to disk already, see write_atomic
+    write_atomic(fname, json.dumps({"version": STATE_VERSION, **state, "checksum": state_checksum(state)}).encode("utf-8"))
+
+
+def exchange_revisions(
+    revision: notmuch2.DbRevision,
+    from_stream: IO[bytes] | None,
+    to_stream: IO[bytes] | None
+) -> Dict[str, Any] | None:
+    """
+    Exchange the revisions of both databases after the sync, so that each side
+    can record the other's along with its own. Only done if both sides support
+    it.
+
+    Args:
+        revision: Revision/UUID of this side's database.
+        from_stream: Stream to read from the remote.
+        to_stream: Stream to write to the remote.
+
+    Returns:
+        dict: Revision ("rev") and "uuid" of the other side's database, None
+        if not supported.
+    """
+    if not session["revisions"]:
+        return None
+    revs = {"mine": {"rev": revision.rev, "uuid": revision.uuid.decode()}}
+
+    def _send_revision():
+        write(json.dumps(revs["mine"]).encode("utf-8"), to_stream)
+
+    def _recv_revision():
+        revs["theirs"] = json.loads(read(from_stream).decode("utf-8"))
+
+    run_async(_send_revision, _recv_revision)
+    if (not isinstance(revs["theirs"], dict) or not isinstance(revs["theirs"].get("rev"), int) or
+            not isinstance(revs["theirs"].get("uuid"), str) or len(revs["theirs"]["uuid"]) != 36):
+        raise ValueError(f"Invalid revision {revs['theirs']!r} from other side, aborting...")
+    return revs["theirs"]
+
+
+def find_replaced_state(prefix: str, peer: str | None, uuid: str) -> str | None:
+    """
+    Find the sync state file of an earlier sync with the same other side, but
+    under a different UUID, i.e. the other side's notmuch database has been
+    recreated since.
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        peer (str): Identity (host name and database path) of the other side.
+        uuid (str): Current UUID of the other side's database.
+
+    Returns:
+        str: Path of the old sync state file, or None if there is none.
+    """
+    if not peer:
+        return None
+    for other, state in read_sync_states(prefix).items():
+        if other != uuid and state["peer"] == peer:
+            return state_path(prefix, "notmuch-sync-" + other)
+    return None
+
+
+def read_sync_states(prefix: str) -> Dict[str, Dict[str, Any]]:
+    """
+    Read the sync states of all other sides synced with, skipping any that
+    can't be read.
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+
+    Returns:
+        dict: Sync state (see read_sync_state) by UUID of the other side's
+        database.
+    """
+    states = {}
+    for f in Path(state_path(prefix, "")).glob("notmuch-sync-*"):
+        if len(f.name) != len("notmuch-sync-") + 36:
+            continue
+        try:
+            states[f.name[len("notmuch-sync-"):]] = read_sync_state(str(f))
+        except (OSError, ValueError):
+            continue
+    return states
+
+
+def sync_status(db: notmuch2.Database, prefix: str) -> Dict[str, Any]:
+    """
+    Get the state of the syncs of this side with all other sides.
+
+    Args:
+        db: An open notmuch2.Database object.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+
+    Returns:
+        dict: UUID ("uuid") and current revision ("rev") of this side's
+        database, and by UUID of each other side's database ("peers") its
+        identity ("peer"), the time of the last sync with it ("time"), the
+        revision of this side's database after that sync ("rev"), and the
+        number of messages changed on this side since ("pending"). If this
+        side's database has been recreated since, all messages are pending.
+    """
+    revision = db.revision()
+    uuid = revision.uuid.decode()
+    peers = {}
+    for other, state in read_sync_states(prefix).items():
+        query = f"lastmod:{state['rev'] + 1}.." if state["uuid"] == uuid else "*"
+        peers[other] = {"peer": state["peer"], "time": state["time"], "rev": state["rev"],
+                        "pending": db.count_messages(query)}
+    return {"uuid": uuid, "rev": revision.rev, "peers": peers}
+
+
+def format_status(mine: Dict[str, Any], theirs: Dict[str, Any] | None = None, remote: str = "remote") -> str:
+    """
+    Format the state of the syncs of this side, one line per other side, or
+    only the line for the remote if its state is given.
+
+    Args:
+        mine (dict): State of this side, see sync_status.
+        theirs (dict): State of the remote, see sync_status.
+        remote (str): Name of the remote.
+
+    Returns:
+        str: The report.
+    """
+    peers = mine["peers"]
+    if theirs is not None:
+        peers = {theirs["uuid"]: peers[theirs["uuid"]]} if theirs["uuid"] in peers else {}
+    if not peers:
+        return f"Never synced with {remote}.\n" if theirs is not None else "Never synced.\n"
+    lines = []
+    for other, state in sorted(peers.items(), key=lambda p: p[1]["peer"] or p[0]):
+        when = time.strftime("%Y-%m-%d %H:%M", time.localtime(state["time"])) if state["time"] else "unknown"
+        line = (f"{state['peer'] or other}: last sync {when}, revision {state['rev']} of {mine['rev']}, "
+                f"{state['pending']} local changes pending")
+        if theirs is not None:
+            back = theirs["peers"].get(mine["uuid"])
+            line += f", {back['pending']} remote changes pending" if back else f", no sync state on {remote}"
+        lines.append(line)
+    return "\n".join(lines) + "\n"
+
+
+def status(args: argparse.Namespace) -> int:
+    """
+    Print the state of the syncs of this side to stdout, see format_status.
+    If a remote is given, connect to it to also get the number of changes
+    pending there.
+
+    Args:
+        args: Parsed command-line arguments.
+
+    Returns:
+        int: Number of messages with changes pending on either side.
+    """
+    with notmuch2.Database(mode=notmuch2.Database.MODE.READ_ONLY) as db:
+        use_notmuch_dir(db)
+        mine = sync_status(db, mail_root(db))
+    theirs = query_remote(args, "sync status") if args.remote or args.remote_cmd else None
+    sys.stdout.write(format_status(mine, theirs, args.remote or "remote"))
+    sys.stdout.flush()
+    if theirs is None:
+        return sum(state["pending"] for state in mine["peers"].values())
+    back = theirs["peers"].get(mine["uuid"])
+    return (mine["peers"][theirs["uuid"]]["pending"] if theirs["uuid"] in mine["peers"] else 0) + \
+        (back["pending"] if back else 0)
+
+
+def read_evicted(prefix: str) -> Dict[str, List[str]]:
+    """
+    Read the messages whose files have been evicted on this side.
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+
+    Returns:
+        dict: Mapping of evicted message IDs to their tags.
+    """
+    try:
+        with open(state_path(prefix, "notmuch-sync-evicted"), 'r', encoding="utf-8") as f:
+            return json.load(f)
+    except FileNotFoundError:
+        return {}
+
+
+def write_evicted(prefix: str, evicted: Dict[str, List[str]]) -> None:
+    """
+    Record the messages whose files have been evicted on this side.
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        evicted (dict): Mapping of evicted message IDs to their tags.
+    """
+    write_atomic(state_path(prefix, "notmuch-sync-evicted"), json.dumps(evicted).encode("utf-8"))
+
+
+def read_pending_deletes(prefix: str) -> Dict[str, int]:
+    """
+    Read the messages that are missing on the other side and will be deleted
+    on this side once the grace period of --delete-grace has passed.
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+
+    Returns:
+        dict: Mapping of message IDs to when they were first found missing.
+    """
+    try:
+        with open(state_path(prefix, "notmuch-sync-pending-deletes"), 'r', encoding="utf-8") as f:
+            return json.load(f)
+    except FileNotFoundError:
+        return {}
+
+
+def write_pending_deletes(prefix: str, pending: Dict[str, int]) -> None:
+    """
+    Record the messages that will be deleted on this side once the grace
+    period has passed.
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        pending (dict): Mapping of message IDs to when they were first found
+        missing.
+    """
+    write_atomic(state_path(prefix, "notmuch-sync-pending-deletes"), json.dumps(pending).encode("utf-8"))
+
+
+def delete_due(pending: Dict[str, int], mid: str, grace: int | None) -> bool:
+    """
+    Check whether a message that is missing on the other side is to be deleted
+    now. With a grace period, it is only deleted by a sync at least that long
+    after the one that first found it missing, so that e.g. a half-restored
+    database on the other side doesn't cause messages to be deleted here right
+    away.
+
+    Args:
+        pending (dict): Mapping of message IDs to when they were first found
+        missing, updated for the message.
+        mid (str): Message ID.
+        grace (int): Grace period in seconds, None to delete right away.
+
+    Returns:
+        bool: Whether to delete the message.
+    """
+    if grace is None:
+        return True
+    since = pending.setdefault(mid, int(time.time()))
+    if time.time() - since < grace:
+        notmuch_logger.debug("Not removing %s yet, missing on other side since %s.", mid,
+                             time.strftime("%Y-%m-%d %H:%M", time.localtime(since)))
+        return False
+    return True
+
+
+def start_undo(prefix: str) -> None:
+    """
+    Start recording the destructive changes of a sync for the undo command.
+    They are recorded in the notmuch-sync-undo.new directory, which replaces
+    notmuch-sync-undo (the changes of the previous sync) once the sync has
+    finished, see finish_undo. The changes of an earlier sync that didn't
+    finish, e.g. a failed attempt with --retries, are kept there and the
+    changes of this one added, so that they are undone together. Entries of
+    the log that can't be read (e.g. the last one, cut off by a crash while
+    appending it) are dropped, but the backups of deleted files are never
+    removed.
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+    """
+    path = state_path(prefix, "notmuch-sync-undo.new")
+    try:
+        entries, broken = read_undo_log(path)
+    except FileNotFoundError:
+        entries, broken = [], 0
+    if broken > 0:
+        logger.warning("Dropping %s unreadable entries of the undo log of an unfinished sync in %s.", broken, path)
+        # so that new entries aren't appended to a cut-off line
+        write_atomic(os.path.join(path, "log"), "".join(json.dumps(e) + "\n" for e in entries).encode("utf-8"))
+    os.makedirs(path, exist_ok=True)
+    # backups are numbered by entry, don't overwrite the backup of an entry
+    # that was lost
+    count = max([len(entries)] + [int(n) + 1 for n in os.listdir(path) if n.isdigit()])
+    undo_log.update({"dir": path, "prefix": prefix, "count": count,
+                     "tagged": {e["id"] for e in entries if e["op"] == "tags"}})
+
+
+def read_undo_log(path: str) -> Tuple[List[Dict[str, Any]], int]:
+    """
+    Read the changes recorded by record_undo in a directory.
+
+    Args:
+        path (str): Directory with the recorded changes.
+
+    Returns:
+        tuple: (readable entries in the order they were recorded, number of
+        entries that can't be read, e.g. cut off by a crash)
+
+    Raises:
+        FileNotFoundError: If no changes were recorded in the directory.
+    """
+    entries = []
+    broken = 0
+    with open(os.path.join(path, "log"), 'r', encoding="utf-8") as f:
+        for line in f:
+            if not line.strip():
+                continue
+            try:
+                entry = json.loads(line)
+            except ValueError:
+                entry = None
+            if isinstance(entry, dict) and entry.get("op") in ("delete", "move", "tags"):
+                entries.append(entry)
+            else:
+                broken += 1
+    return entries, broken
+
+
+def record_undo(op: str, **entry: Any) -> None:
+    """
+    Record a destructive change, if recording has been started with
+    start_undo: a file "name" that is about to be deleted ("delete", a hard
+    link to or copy of the file is kept), a file moved from "src" to "dst"
+    ("move"), or the "tags" of message "id" before they are changed ("tags",
+    only the first time for each message). File names are relative to the
+    prefix.
+
+    Args:
+        op (str): "delete", "move", or "tags".
+        entry: Details of the change.
+    """
+    if undo_log["dir"] is None:
+        return
+    if op == "tags":
+        if entry["id"] in undo_log["tagged"]:
+            return
+        undo_log["tagged"].add(entry["id"])
+    elif op == "delete":
+        entry["backup"] = str(undo_log["count"])
+        src = os.path.join(undo_log["prefix"], entry["name"])
+        dst = os.path.join(undo_log["dir"], entry["backup"])
+        try:
+            os.link(src, dst)
+        except OSError:
+            shutil.copy2(src, dst)
+    with open(os.path.join(undo_log["dir"], "log"), 'a', encoding="utf-8") as f:
+        f.write(json.dumps({"op": op, **entry}) + "\n")
+        f.flush()
+        # the change is made right after this, e.g. the file deleted
+        if session["fsync"]:
+            os.fsync(f.fileno())
+    if op == "delete":
+        fsync_path(undo_log["dir"])
+    undo_log["count"] += 1
+
+
+def finish_undo(completed: bool = True) -> None:
+    """
+    Stop recording destructive changes and keep them for the undo command
+    instead of those of the previous sync, unless there weren't any. If the
+    sync didn't complete, they stay in notmuch-sync-undo.new for the next sync
+    to add to, see start_undo, and for the undo command.
+
+    Args:
+        completed (bool): Whether the sync completed.
+    """
+    if undo_log["dir"] is None:
+        return
+    path = undo_log["dir"]
+    if not completed:
+        if undo_log["count"] == 0:
+            shutil.rmtree(path, ignore_errors=True)
+    elif undo_log["count"] > 0:
+        shutil.rmtree(path.removesuffix(".new"), ignore_errors=True)
+        os.replace(path, path.removesuffix(".new"))
+    else:
+        shutil.rmtree(path, ignore_errors=True)
+    undo_log.update({"dir": None, "prefix": None, "count": 0, "tagged": set()})
+
+
+def undo_changes(dbw: notmuch2.Database, prefix: str, path: str, dry_run: bool = False) -> int:
+    """
+    Undo the destructive changes recorded by record_undo in a directory, in
+    reverse order: restore deleted files and add them to the database again,
+    move moved files back, and set the tags that messages had before.
+
+    Args:
+        dbw: An open writable notmuch2.Database object.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        path (str): Directory with the recorded changes.
+        dry_run: Only log what would be undone.
+
+    Returns:
+        int: Number of changes undone.
+    """
+    entries, broken = read_undo_log(path)
+    if broken > 0:
+        logger.warning("Skipping %s unreadable entries of the undo log in %s.", broken, path)
+    nundone = 0
+    for entry in reversed(entries):
+        if entry["op"] == "delete":
+            dst = os.path.join(prefix, entry["name"])
+            logger.info("Restoring %s.", dst)
+            if not dry_run:
+                Path(dst).parent.mkdir(parents=True, exist_ok=True)
+                move_file(os.path.join(path, entry["backup"]), dst)
+                dbw.add(dst)
+        elif entry["op"] == "move":
+            src, dst = os.path.join(prefix, entry["dst"]), os.path.join(prefix, entry["src"])
+            if not os.path.exists(src):
+                logger.warning("Not moving %s back to %s, it doesn't exist anymore.", src, dst)
+                continue
+            logger.info("Moving %s back to %s.", src, dst)
+            if not dry_run:
+                move_file(src, dst)
+                dbw.add(dst)
+                dbw.remove(src)
+        elif entry["op"] == "tags":
+            try:
+                msg = dbw.find(entry["id"])
+            except LookupError:
+                logger.warning("Not restoring tags of %s, it doesn't exist anymore.", entry["id"])
+                continue
+            logger.info("Setting tags %s for %s.", sorted(entry["tags"]), entry["id"])
+            if not dry_run:
+                with msg.frozen():
+                    msg.tags.clear()
+                    for tag in entry["tags"]:
+                        msg.tags.add(tag)
+                    if session["sync_flags"]:
+                        msg.tags.to_maildir_flags()
+        nundone += 1
+    return nundone
+
+
+def send_changes(changes: Changes, stream: IO[bytes] | None) -> None:
+    """
+    Send changes, in batches of ID_BATCH messages terminated by an empty frame
+    if both sides support it, so that the JSON encoding of all changes of e.g.
+    an initial sync of a large database isn't held in memory at once.
+
+    Args:
+        changes (dict): Mapping of message IDs to their tags and files.
+        stream: Stream to write to.
+    """
+    if not session["batches"]:
+        write(encode_data(changes_to_wire(changes)), stream)
+        return
+    mids = iter(changes)
+    while batch := {mid: changes[mid] for mid in itertools.islice(mids, ID_BATCH)}:
+        write(encode_data(changes_to_wire(batch)), stream)
+    write(b"", stream)
+
+
+def recv_changes(stream: IO[bytes] | None) -> Changes:
+    """
+    Receive changes sent with send_changes().
+
+    Args:
+        stream: Stream to read from.
+
+    Returns:
+        dict: Mapping of message IDs to their tags and files.
+    """
+    if not session["batches"]:
+        return decode_changes(read(stream))
+    changes = {}
+    while data := read(stream):
+        changes.update(decode_changes(data))
+    return changes
+
+
+def initial_sync(
+    dbw: notmuch2.Database,
+    prefix: str,
+    from_stream: IO[bytes] | None,
+    to_stream: IO[bytes] | None,
+    prefs: Dict[str, Any] | None = None,
+    dry_run: bool = False,
+    delete: bool = False,
+    accept_new_uuid: bool = False,
+    conflict_cmd: str | None = None,
+    review: bool = False
+) -> Tuple[Changes, Changes, int, str]:
+    """
+    Perform the initial synchronization of UUIDs, session parameters, and tag
+    changes, which includes applying any remote tag changes to messages that
+    exist locally. UUIDs and changes are communicated to/from the remote over
+    the respective streams.
+
+    Args:
+        dbw: An open writable notmuch2.Database object.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        from_stream: Stream to read from the remote.
+        to_stream: Stream to write to the remote.
+        prefs (dict): Preferred session parameters ("digest" algorithm,
+        "delta" transfers), None for no preference.
+        dry_run: Do not apply tag changes, only record them.
+        delete: Whether deletions will be synced; refuse to do so if the
+        remote's UUID has changed.
+        accept_new_uuid: Proceed if the UUID of either database has changed
+        since the last sync.
+        conflict_cmd (str): Command to resolve conflicts with, see
+        resolve_conflicts. Only given on local, so that its changes are
+        local and the remote's remote.
+        review (bool): Ask whether to apply the remote changes before
+        anything is changed, see review_changes. Only given on local.
+
+    Returns:
+        tuple: (local changes dict, remote changes dict, number of tag changes,
+                name of sync file)
+    """
+    revision = dbw.revision()
+    uuids = {}
+    uuids["mine"] = revision.uuid.decode()
+
+    def _send_uuid():
+        logger.info("Sending UUID %s...", uuids["mine"])
+        to_stream.write(uuids["mine"].encode("utf-8"))
+        trace_frame("sent", uuids["mine"].encode("utf-8"), raw=True)
+        transfer["write"] += 36
+        to_stream.flush()
+
+    def _recv_uuid():
+        logger.info("Receiving UUID...")
+        data = from_stream.read(36)
+        trace_frame("received", data, raw=True)
+        uuids["theirs"] = data.decode("utf-8")
+        transfer["read"] += 36
+
+    with measure("UUID exchange"):
+        run_async(_send_uuid, _recv_uuid)
+
+    logger.info("UUIDs synced.")
+    protocol_logger.debug("Local UUID %s, remote UUID %s.", uuids["mine"], uuids["theirs"])
+
+    fname = state_path(prefix, "notmuch-sync-" + uuids["theirs"])
+    try:
+        # for the other side in case it can't record it, see get_changes
+        last_rev = read_sync_state(fname)["peer_rev"]
+    except (OSError, ValueError):
+        last_rev = None
+
+    hello = {"mine": {"implementation": "python", "version": VERSION, "protocol": PROTOCOL,
+                      "notmuch": notmuch_version(),
+                      "digests": DIGESTS, "encodings": ENCODINGS, "features": FEATURES, "read-only": session["read_only"],
+                      "read-only-db": session["read_only_db"], "last-rev": last_rev,
+                      "peer": f"{socket.gethostname()}:{prefix}", "revision": revision.rev, **(prefs or {})}}
+
+    def _send_hello():
+        write(json.dumps(hello["mine"]).encode("utf-8"), to_stream)
+
+    def _recv_hello():
+        hello["theirs"] = json.loads(read(from_stream).decode("utf-8"))
+
+    start = time.monotonic()
+    with measure("UUID exchange"):
+        run_async(_send_hello, _recv_hello)
+    check_compat(hello["theirs"])
+    logger.info("Local notmuch-sync %s (notmuch %s), remote notmuch-sync %s (notmuch %s).",
+                VERSION, hello["mine"]["notmuch"], hello["theirs"].get("version", "unknown"),
+                hello["theirs"].get("notmuch", "unknown"))
+    # both sides send at the same time, so this approximates the latency of the
+    # connection (plus any delay on the other side)
+    session["rtt"] = time.monotonic() - start
+    protocol_logger.debug("Latency about %.0f ms.", session["rtt"] * 1000)
+    session.update(negotiate(hello["mine"], hello["theirs"]))
+    report_unavailable(hello["mine"], hello["theirs"])
+    session["peer_read_only"] = hello["theirs"].get("read-only", False)
+    if session["peer_read_only"]:
+        logger.warning("Mail directory of %s is on a read-only file system, only syncing tags; files will be synced once it is writable again.",
+                       hello["theirs"].get("peer", "other side"))
+    protocol_logger.debug("Using %s digests, delta transfers %s, ID buckets %s.", session["digest"],
+                          "enabled" if session["delta"] else "disabled",
+                          "enabled" if session["buckets"] else "disabled")
+
+    session["peer"] = hello["theirs"].get("peer")
+    session["peer_read_only_db"] = hello["theirs"].get("read-only-db", False)
+    if session["peer_read_only_db"]:
+        logger.warning("%s is read-only, only getting changes from it; local changes, deletions, and mbsync files are not synced.",
+                       session["peer"] or "Other side")
+    old = find_replaced_state(prefix, session["peer"], uuids["theirs"])
+    if old is not None:
+        msg = f"notmuch DB of {session['peer']} has new UUID {uuids['theirs']}, previously synced with UUID {old[-36:]}"
+        if delete and not accept_new_uuid:
+            raise ValueError(f"{msg}, refusing to sync deletions (use --accept-new-uuid to proceed), aborting...")
+        logger.warning("%s, syncing everything.", msg)
+        if not dry_run:
+            os.replace(old, old + ".replaced")
+
+    changes = {}
+    logger.info("Computing local changes...")
+    peer_rev = hello["theirs"].get("revision")
+    with measure("changeset"):
+        changes["mine"] = get_changes(dbw, revision, prefix, fname, accept_new_uuid,
+                                      peer_rev if isinstance(peer_rev, int) else None, hello["theirs"].get("last-rev"))
+    if filters_tags():
+        for change in changes["mine"].values():
+            change["tags"] = without_local_tags(change["tags"])
+    if session["exclude_tags"]:
+        changes["mine"] = {mid: change for mid, change in changes["mine"].items() if excluded(change["tags"]) != "all"}
+
+    def _send_changes():
+        logger.info("Sending local changes...")
+        if session["peer_read_only_db"]:
+            send_changes({}, to_stream)
+        elif session["tag_map"]:
+            send_changes({mid: {**change, "tags": map_tags(change["tags"], True)}
+                          for mid, change in changes["mine"].items()}, to_stream)
+        else:
+            send_changes(changes["mine"], to_stream)
+
+    def _recv_changes():
+        logger.info("Receiving remote changes...")
+        changes["theirs"] = recv_changes(from_stream)
+        if session["tag_map"]:
+            for change in changes["theirs"].values():
+                change["tags"] = map_tags(change["tags"], False)
+        # in case the other side doesn't know about device-local tags
+        if filters_tags():
+            for change in changes["theirs"].values():
+                change["tags"] = without_local_tags(change["tags"])
+
+    with measure("changeset"):
+        run_async(_send_changes, _recv_changes)
+
+    logger.info("Changes synced.")
+    protocol_logger.debug("Local changes %s, remote changes %s.", changes["mine"], changes["theirs"])
+    if session["read_only_db"] and changes["theirs"]:
+        raise ReadOnlyError("change tags or files of messages", list(changes["theirs"]))
+
+    resolved = {}
+    resolved["mine"] = resolve_conflicts(conflict_cmd, changes["mine"], changes["theirs"]) if conflict_cmd else {}
+    # the remote doesn't change anything before it has the resolutions
+    if review and not dry_run:
+        session["resolved"] = {kind: resolved["mine"].get(kind, {}) for kind in ["tags", "files"]}
+        if not review_changes(dbw, prefix, changes["mine"], changes["theirs"]):
+            raise ValueError("Remote changes not accepted, aborting...")
+
+    def _send_resolved():
+        tags = {mid: map_tags(t, True) for mid, t in resolved["mine"].get("tags", {}).items()}
+        write(json.dumps({**resolved["mine"], "tags": tags} if tags else resolved["mine"]).encode("utf-8"), to_stream)
+
+    def _recv_resolved():
+        resolved["theirs"] = json.loads(read(from_stream).decode("utf-8"))
+        if resolved["theirs"].get("tags"):
+            resolved["theirs"]["tags"] = {mid: map_tags(t, False) for mid, t in resolved["theirs"]["tags"].items()}
+
+    # only exchanged if both sides know about it, older versions don't expect
+    # this frame
+    if session["resolutions"]:
+        with measure("tag sync"):
+            run_async(_send_resolved, _recv_resolved)
+    elif resolved["mine"]:
+        raise ValueError("Conflicts resolved with --conflict-cmd, but the remote doesn't support exchanging conflict resolutions, aborting...")
+    else:
+        resolved["theirs"] = {}
+    session["resolved"] = {kind: {**resolved["theirs"].get(kind, {}), **resolved["mine"].get(kind, {})}
+                           for kind in ["tags", "files"]}
+    protocol_logger.debug("Resolved conflicts %s.", session["resolved"])
+
+    with measure("tag sync"):
+        tchanges = sync_tags(dbw, changes["mine"], changes["theirs"], dry_run)
+    logger.info("Tags synced.")
+
+    return (changes["mine"], changes["theirs"], tchanges, fname)
+
+
+def review_changes(dbw: notmuch2.Database, prefix: str, changes_mine: Changes, changes_theirs: Changes) -> bool:
+    """
+    Show the changes received from the remote that would be applied on this
+    side (tag changes and files that aren't here yet, some of which may turn
+    out to be moves or copies of files that are) in the format of --dry-run on
+    stdout, and ask whether to apply them (--review).
+
+    Args:
+        dbw: An open writable notmuch2.Database object.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        changes_mine (dict): Local changes, mapping message IDs to tags.
+        changes_theirs (dict): Remote changes, mapping message IDs to tags.
+
+    Returns:
+        bool: Whether to apply the changes, True if there are none.
+    """
+    start = len(planned)
+    sync_tags(dbw, changes_mine, changes_theirs, dry_run=True)
+    entries = planned[start:]
+    del planned[start:]
+    entries += [{"op": "add", "name": f} for change in changes_theirs.values() for f in change["files"]
+                if not os.path.exists(os.path.join(prefix, f))]
+    if not entries:
+        return True
+    sys.stdout.write(format_plan(entries, "local"))
+    sys.stdout.flush()
+    try:
+        answer = input("Apply these changes? [y/N] ")
+    except EOFError:
+        # not run interactively
+        answer = ""
+    return answer.strip().lower() in ("y", "yes")
+
+
+def maildir_flags(fname: str) -> Tuple[str, str | None]:
+    """
+    Split a maildir file name into the part before the flags and the flags.
+
+    Args:
+        fname (str): File name, e.g. "INBOX/cur/123.abc:2,RS".
+
+    Returns:
+        tuple: (file name without flags, flags), flags None if there's no
+               maildir info.
+    """
+    if ":2," not in os.path.basename(fname):
+        return (fname, None)
+    base, flags = fname.rsplit(":2,", 1)
+    return (base, flags)
+
+
+def mbsync_uid(fname: str) -> int | None:
+    """
+    Get the UID mbsync stores in the name of a maildir file.
+
+    Args:
+        fname (str): File name, e.g. "INBOX/cur/123.abc,U=42:2,S".
+
+    Returns:
+        int: The UID, None if the name doesn't have one.
+    """
+    base = maildir_flags(os.path.basename(fname))[0]
+    _, sep, uid = base.rpartition(",U=")
+    uid = uid.split(",")[0]
+    return int(uid) if sep and uid.isdigit() else None
+
+
+def mbsync_tracked(fname: str) -> bool:
+    """
+    Check whether mbsync keeps track of a file by the UID in its name, i.e.
+    whether the .mbsyncstate of its maildir folder has a message with that
+    UID on the maildir side. Deleting such a file would make mbsync delete the
+    message on the server as well. If the state can't be read (e.g. because
+    it's kept elsewhere), files with a UID are assumed to be tracked.
+
+    Args:
+        fname (str): Path of the file.
+
+    Returns:
+        bool: Whether mbsync tracks the file.
+    """
+    uid = mbsync_uid(fname)
+    if uid is None:
+        return False
+    try:
+        state = (Path(fname).parent.parent / ".mbsyncstate").read_text(encoding="utf-8", errors="replace")
+    except OSError:
+        return True
+    # header lines are followed by lines with the far and near side UIDs and
+    # flags of each message
+    for line in state.splitlines():
+        fields = line.split()
+        if len(fields) >= 2 and fields[0].isdigit() and fields[1] == str(uid):
+            return True
+    return False
+
+
+def flag_renames(fnames_mine: List[str], fnames_theirs: List[str]) -> Dict[str, str]:
+    """
+    Determine how to reconcile files of a message that differ only in their
+    maildir flags on both sides. If notmuch synchronizes maildir flags with
+    tags, the flags follow the synced tags (see sync_tags), so the names on the
+    other side are mapped to the names on this side and nothing is renamed on
+    either side. Otherwise, both are renamed to the name with the union of the
+    flags, so that both sides come to the same result.
+
+    Args:
+        fnames_mine (list): File names of the message on this side.
+        fnames_theirs (list): File names of the message on the other side.
+
+    Returns:
+        dict: New names for the file names on either side that need to be
+              renamed.
+    """
+    renames = {}
+    only_mine = {}
+    for f in set(fnames_mine) - set(fnames_theirs):
+        base, flags = maildir_flags(f)
+        if flags is not None:
+            only_mine[base] = (f, flags)
+    for f in set(fnames_theirs) - set(fnames_mine):
+        base, flags = maildir_flags(f)
+        if flags is None or base not in only_mine:
+            continue
+        mine, flags_mine = only_mine.pop(base)
+        if session["sync_flags"]:
+            renames[f] = mine
+            continue
+        target = f"{base}:2,{''.join(sorted(set(flags) | set(flags_mine)))}"
+        for src in [mine, f]:
+            if src != target:
+                renames[src] = target
+    return renames
+
+
+def get_missing_files(
+    dbw: notmuch2.Database,
+    prefix: str,
+    changes_mine: Changes,
+    changes_theirs: Changes,
+    from_stream: IO[bytes] | None,
+    to_stream: IO[bytes] | None,
+    move_on_change: bool = False,
+    dry_run: bool = False
+) -> Tuple[Dict[str, Dict[str, Any]], int, int]:
+    """
+    Determine which files are missing locally compared to the remote, and handle
+    file moves/copies based on SHA256 checksums. Delete any files that aren't
+    there on the remote anymore. This never deletes a message, only duplicate
+    files for a message.
+
+    Args:
+        dbw: An open writable notmuch2.Database object.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        changes_mine (dict): Local changes.
+        changes_theirs (dict): Remote changes.
+        from_stream: Stream to read from the remote.
+        to_stream: Stream to write to the remote.
+        move_on_change: Whether to move file that has local and remote changes.
+        This flag is used to prevent infinite loops where local has one file
+        name and remote another file name (e.g. when running mbsync independently).
+        dry_run: Do not copy, move, or delete files, only record these
+        operations.
+
+    Returns:
+        tuple: (dict of missing files, number of local moves/copies, number of
+                local deletions)
+    """
+    ret = {}
+    mcchanges = 0
+    dchanges = 0
+    evicted = read_evicted(prefix)
+    hashes: dict[str, Any] = {}
+    # check which files we need to get digests for to determine if they've
+    # been moved/copied
+    hashes["req_mine"] = []
+    # files on this side to compare with, hashed while exchanging hashes
+    hashes["files_mine"] = []
+    for mid in changes_theirs:
+        try:
+            msg = dbw.find(mid)
+            if msg.ghost:
+                continue
+            fnames_theirs = changes_theirs[mid]["files"]
+            fnames_mine = [ str(f).removeprefix(prefix) for f in msg.filenames() ]
+            if not policy_for(fnames_theirs + fnames_mine, list(msg.tags) + changes_theirs[mid]["tags"])["files"]:
+                continue
+            renames = flag_renames(fnames_mine, fnames_theirs)
+            missing_mine = {renames.get(f, f) for f in fnames_theirs} - {renames.get(f, f) for f in fnames_mine}
+            if len(missing_mine) > 0:
+                hashes["req_mine"].extend(fnames_theirs)
+                hashes["files_mine"].extend(fnames_mine)
+        except LookupError:
+            continue
+
+    def _send_hashes_req():
+        logger.info("Requesting %s hashes from remote...", len(hashes["req_mine"]))
+        protocol_logger.debug("Requesting hashes %s", hashes["req_mine"])
+        write(encode_data([to_wire(f) for f in hashes["req_mine"]]), to_stream)
+
+    def _recv_hashes_req():
+        logger.info("Receiving hash requests from remote...")
+        hashes["req_theirs"] = decode_fnames(read(from_stream))
+        protocol_logger.debug("Hashes requested by remote %s", hashes["req_theirs"])
+
+    run_async(_send_hashes_req, _recv_hashes_req)
 
     def _send_hashes():
         logger.info("Hashing %s requested files and sending to remote...",
                     len(hashes["req_theirs"]))
-        tmp = [digest(Path(os.path.join(prefix, f)).read_bytes()) for f in hashes["req_theirs"]]
-        write(json.dumps(tmp).encode("utf-8"), to_stream)
+        tmp = hash_files([os.path.join(prefix, f) for f in hashes["req_theirs"]])
+        write(encode_data(tmp), to_stream)
+
+    def _recv_hashes():
+        logger.info("Receiving hashes from remote...")
+        tmp = decode_hashes(read(from_stream), len(hashes["req_mine"]))
+        hashes["theirs"] = dict(zip(hashes["req_mine"], tmp))
+
+    with ThreadPoolExecutor(max_workers=1) as ex:
+        hashing = ex.submit(hash_files, [os.path.join(prefix, f) for f in hashes["files_mine"]])
+        run_async(_send_hashes, _recv_hashes)
+        hashes["mine"] = dict(zip(hashes["files_mine"], hashing.result()))
+
+    # now actually determine changes and move/copy
+    for mid in changes_theirs:
+        try:
+            msg = dbw.find(mid)
+            if msg.ghost:
+                if policy_for(changes_theirs[mid]["files"], changes_theirs[mid]["tags"])["files"]:
+                    ret[mid] = changes_theirs[mid]
+                else:
+                    count_outcome("file transfer", "skipped", len(changes_theirs[mid]["files"]))
+                continue
+            fnames_theirs = changes_theirs[mid]["files"]
+            fnames_mine = [ str(f).removeprefix(prefix) for f in msg.filenames() ]
+            if not policy_for(fnames_theirs + fnames_mine, list(msg.tags) + changes_theirs[mid]["tags"])["files"]:
+                files_logger.debug("Not syncing files for %s because of folder policy or exclusion tag.", mid)
+                count_outcome("file transfer", "skipped", len(set(fnames_theirs) ^ set(fnames_mine)))
+                continue
+            # with a resolved conflict, the side whose file names lose moves
+            winner = session["resolved"].get("files", {}).get(mid)
+            move_here = move_on_change if winner is None else (winner == "remote") == move_on_change
+            # files that only differ in maildir flags are renamed to the same
+            # name on both sides
+            renames = flag_renames(fnames_mine, fnames_theirs)
+            for f in [f for f in fnames_mine if f in renames]:
+                src = os.path.join(prefix, f)
+                dst = os.path.join(prefix, renames[f])
+                mcchanges += 1
+                files_logger.debug("Renaming %s to %s to reconcile maildir flags.", src, dst)
+                if dry_run:
+                    planned.append({"op": "move", "src": f, "dst": renames[f]})
+                else:
+                    record_undo("move", src=f, dst=renames[f])
+                    move_file(src, dst)
+                    dbw.add(dst)
+                    dbw.remove(src)
+            fnames_mine = [renames.get(f, f) for f in fnames_mine]
+            fnames_theirs = [renames.get(f, f) for f in fnames_theirs]
+            missing_mine = set(fnames_theirs) - set(fnames_mine)
+            if len(missing_mine) > 0:
+                fnames = [str(f).removeprefix(prefix) for f in msg.filenames()]
+                todo = [f for f in fnames if f not in hashes["mine"]]
+                if len(todo) > 0:
+                    paths = [os.path.join(prefix, f if dry_run else renames.get(f, f)) for f in todo]
+                    hashes["mine"].update(zip(todo, hash_files(paths)))
+                hashes_mine = {renames.get(f, f): hashes["mine"][f] for f in fnames
+                               if hashes["mine"][f] is not None}
+                for f in changes_theirs[mid]["files"]:
+                    if f in missing_mine and hashes["theirs"][f] is None:
+                        # can't be read on the other side, don't request it
+                        missing_mine.remove(f)
+                    elif f in missing_mine:
+                        # check if it has been moved/copied
+                        matches = [x[0] for x in hashes_mine.items() if hashes["theirs"][f] == x[1]]
+                        # of identical files (e.g. differing only in X-TUID),
+                        # prefer moving the one with the UID of the new name
+                        # and leave the ones mbsync tracks alone otherwise
+                        matches.sort(key=lambda m: (mbsync_uid(m) != mbsync_uid(f),
+                                                    mbsync_tracked(os.path.join(prefix, m))))
+                        other = case_collision(os.path.join(prefix, f))
+                        if other is not None:
+                            # only the file that differs in case can be moved
+                            # to it, anything else would overwrite that file
+                            other = other.removeprefix(prefix)
+                            matches = [m for m in matches if m == other and m not in changes_theirs[mid]["files"]]
+                            if len(matches) == 0:
+                                warn_file(os.path.join(prefix, f), CASE_COLLISION)
+                                count_outcome("file transfer", "skipped")
+                                missing_mine.remove(f)
+                                continue
+                        if len(matches) > 0:
+                            src = os.path.join(prefix, matches[0])
+                            dst = os.path.join(prefix, f)
+                            if matches[0] in changes_theirs[mid]["files"]:
+                                mcchanges += 1
+                                files_logger.debug("Copying %s to %s.", src, dst)
+                                if dry_run:
+                                    planned.append({"op": "copy", "src": matches[0], "dst": f})
+                                else:
+                                    Path(dst).parent.mkdir(parents=True, exist_ok=True)
+                                    copy_file(src, dst)
+                                    # moves keep extended attributes
+                                    if session["xattrs"]:
+                                        set_xattrs(dst, get_xattrs(src))
+                                    dbw.add(dst)
+                                fnames_mine.append(f)
+                            elif mid not in changes_mine or move_here:
+                                mcchanges += 1
+                                files_logger.debug("Moving %s to %s.", src, dst)
+                                if dry_run:
+                                    planned.append({"op": "move", "src": matches[0], "dst": f})
+                                else:
+                                    Path(dst).parent.mkdir(parents=True, exist_ok=True)
+                                    record_undo("move", src=matches[0], dst=f)
+                                    move_file(src, dst)
+                                    dbw.add(dst)
+                                    notmuch_logger.debug("Removing %s from DB.", src)
+                                    dbw.remove(src)
+                                fnames_mine.append(f)
+                                fnames_mine.remove(matches[0])
+                                hashes_mine[f] = hashes_mine[matches[0]]
+                                del hashes_mine[matches[0]]
+                            missing_mine.remove(f)
+            # check which ones are still missing
+            if len(missing_mine) > 0:
+                ret[mid] = {"files": [f for f in changes_theirs[mid]["files"] if f in missing_mine]}
+
+            # delete any files that are not there remotely after copy/move
+            if mid not in changes_mine:
+                if len(set(fnames_mine).intersection(fnames_theirs)) == 0:
+                    raise ValueError(f"Message '{mid}' has {fnames_theirs} on remote and different {fnames_mine} locally!")
+                to_delete = set(fnames_mine) - set(fnames_theirs)
+                uids_theirs = {mbsync_uid(f) for f in fnames_theirs}
+                for f in sorted(to_delete):
+                    fname = os.path.join(prefix, f)
+                    if mbsync_uid(f) not in uids_theirs and mbsync_tracked(fname):
+                        logger.warning("Not deleting %s, mbsync keeps track of it by UID.", fname)
+                        count_outcome("file transfer", "skipped")
+                        continue
+                    if case_collision(fname, [os.path.join(prefix, t) for t in fnames_theirs]) is not None:
+                        # deleting it would delete the file that is kept
+                        warn_file(fname, CASE_COLLISION)
+                        count_outcome("file transfer", "skipped")
+                        continue
+                    dchanges += 1
+                    notmuch_logger.debug("Removing %s from DB and deleting file.", fname)
+                    if dry_run:
+                        planned.append({"op": "delete", "name": f})
+                        continue
+                    record_undo("delete", name=f)
+                    dbw.remove(fname)
+                    Path(fname).unlink()
+        except LookupError:
+            if mid in evicted:
+                # files evicted on purpose, only keep track of tags
+                evicted[mid] = changes_theirs[mid]["tags"]
+                continue
+            # don't have this message; all files missing
+            if policy_for(changes_theirs[mid]["files"], changes_theirs[mid]["tags"])["files"]:
+                ret[mid] = changes_theirs[mid]
+            else:
+                count_outcome("file transfer", "skipped", len(changes_theirs[mid]["files"]))
+
+    if evicted and not dry_run:
+        write_evicted(prefix, evicted)
+    log_file_warnings()
+
+    return (ret, mcchanges, dchanges)
+
+
+def weak_checksum(data: bytes) -> Tuple[int, int]:
+    """
+    Compute the two components of the rsync rolling checksum of a block.
+
+    Args:
+        data (bytes): The block.
+
+    Returns:
+        tuple: (a, b) components of the checksum.
+    """
+    a = sum(data) % 65536
+    b = sum((len(data) - i) * x for i, x in enumerate(data)) % 65536
+    return (a, b)
+
+
+def block_signature(data: bytes, block: int = DELTA_BLOCK) -> List[List[Any]]:
+    """
+    Compute the weak and strong checksums of all complete blocks of data, which
+    the other side uses to determine which blocks it does not need to send.
+
+    Args:
+        data (bytes): The data of the file the other side is going to send
+        changes against.
+        block (int): Block size.
+
+    Returns:
+        list: [weak checksum, strong checksum] for each block.
+    """
+    sig = []
+    for i in range(0, len(data) - block + 1, block):
+        a, b = weak_checksum(data[i:i + block])
+        sig.append([(b << 16) | a, hashlib.blake2b(data[i:i + block], digest_size=16).hexdigest()])
+    return sig
+
+
+def compute_delta(data: bytes, sig: List[List[Any]], block: int = DELTA_BLOCK) -> bytes:
+    """
+    Encode data as references to blocks the other side already has (according
+    to its block signature) and literal data for everything else.
+
+    Args:
+        data (bytes): The data to send.
+        sig (list): Block signature of the data the other side has.
+        block (int): Block size.
+
+    Returns:
+        bytes: The encoded delta: 4 bytes total length, followed by "B" and
+        4 bytes block index for a block reference or "L", 4 bytes length, and
+        the data for literal data.
+    """
+    weak: Dict[int, List[Tuple[int, str]]] = {}
+    for idx, (w, strong) in enumerate(sig):
+        weak.setdefault(w, []).append((idx, strong))
+
+    out = bytearray(struct.pack("!I", len(data)))
+    lit = bytearray()
+
+    def _flush():
+        if lit:
+            out.extend(b"L" + struct.pack("!I", len(lit)) + lit)
+            lit.clear()
+
+    i = 0
+    n = len(data)
+    a, b = weak_checksum(data[0:block])
+    while i + block <= n:
+        match = None
+        for idx, strong in weak.get((b << 16) | a, []):
+            if hashlib.blake2b(data[i:i + block], digest_size=16).hexdigest() == strong:
+                match = idx
+                break
+        if match is not None:
+            _flush()
+            out.extend(b"B" + struct.pack("!I", match))
+            i += block
+            a, b = weak_checksum(data[i:i + block])
+            continue
+        # roll checksum one byte forward
+        lit.append(data[i])
+        if i + block < n:
+            a = (a - data[i] + data[i + block]) % 65536
+            b = (b - block * data[i] + a) % 65536
+        i += 1
+    lit.extend(data[i:])
+    _flush()
+    return bytes(out)
+
+
+def apply_delta(basis: bytes, delta: bytes, block: int = DELTA_BLOCK) -> bytes:
+    """
+    Reconstruct data from a delta and the data it was computed against.
+
+    Args:
+        basis (bytes): The data the block signature was computed for.
+        delta (bytes): The encoded delta, see compute_delta.
+        block (int): Block size.
+
+    Returns:
+        bytes: The reconstructed data.
+
+    Raises:
+        ValueError: If the delta is malformed (cut off, or referring to blocks
+        or data that don't exist) or the reconstructed data does not have the
+        expected length.
+    """
+    if len(delta) < 4:
+        raise ValueError(f"Delta of {len(delta)} bytes is too short, aborting...")
+    size = struct.unpack("!I", delta[0:4])[0]
+    nblocks = (len(basis) + block - 1) // block
+    out = bytearray()
+    i = 4
+    while i < len(delta):
+        kind = delta[i:i + 1]
+        if kind not in (b"B", b"L"):
+            raise ValueError(f"Invalid delta record type {kind!r}, aborting...")
+        if i + 5 > len(delta):
+            raise ValueError(f"Delta record at {i} cut off, aborting...")
+        val = struct.unpack("!I", delta[i + 1:i + 5])[0]
+        i += 5
+        if kind == b"B":
+            if val >= nblocks:
+                raise ValueError(f"Delta refers to block {val}, but the basis only has {nblocks}, aborting...")
+            out.extend(basis[val * block:(val + 1) * block])
+        else:
+            if i + val > len(delta):
+                raise ValueError(f"Literal data of {val} bytes at {i} goes past the end of the delta, aborting...")
+            out.extend(delta[i:i + val])
+            i += val
+        if len(out) > size:
+            break
+    if len(out) != size:
+        raise ValueError(f"Reconstructed {len(out)} bytes from delta, but expected {size}, aborting...")
+    return bytes(out)
+
+
+def send_file(
+    fname: str,
+    stream: IO[bytes],
+    sig: List[List[Any]] | None = None
+) -> None:
+    """
+    Send a file's contents to a stream with 4-byte length prefix, followed by
+    its digest if both sides support it, for the other side to check the file
+    it wrote (see write_atomic), and its extended attributes if they are
+    preserved (see get_xattrs).
+
+    Args:
+        fname (str): Path to the file to send.
+        stream: Writable stream.
+        sig (list): Block signature of the file the other side has for this
+        message; if given, only send the delta against that file.
+    """
+    if sig is None:
+        checksum = write_file(fname, stream, session["file_digests"])
+    else:
+        content = Path(fname).read_bytes()
+        write(compute_delta(content, sig), stream)
+        checksum = digest(content)
+    if session["file_digests"]:
+        write(checksum.encode("utf-8"), stream)
+    if session["xattrs"]:
+        write(json.dumps(get_xattrs(fname)).encode("utf-8"), stream)
+
+
+def get_xattrs(fname: str) -> Dict[str, str]:
+    """
+    Get the extended attributes of a file, including e.g. its SELinux context
+    (security.selinux). Problems are recorded with warn_file.
+
+    Args:
+        fname (str): Path of the file.
+
+    Returns:
+        dict: Base64-encoded values by name, empty on platforms without
+        extended attributes.
+    """
+    if not hasattr(os, "listxattr"):
+        return {}
+    try:
+        return {name: base64.b64encode(os.getxattr(fname, name)).decode("ascii")
+                for name in os.listxattr(fname)}
+    except OSError:
+        warn_file(fname, "had extended attributes that could not be read")
+        return {}
+
+
+def set_xattrs(fname: str, xattrs: Dict[str, str]) -> None:
+    """
+    Set extended attributes of a file as returned by get_xattrs. Attributes
+    that can't be set (e.g. SELinux contexts without permission to relabel)
+    are recorded with warn_file.
+
+    Args:
+        fname (str): Path of the file.
+        xattrs (dict): Base64-encoded values by name.
+    """
+    if not hasattr(os, "setxattr"):
+        return
+    for name, value in xattrs.items():
+        try:
+            os.setxattr(fname, name, base64.b64decode(value))
+        except OSError:
+            warn_file(fname, "could not be given all extended attributes")
+
+
+def decode_xattrs(data: bytes) -> Dict[str, str]:
+    """
+    Decode and validate extended attributes received from the other side.
+
+    Args:
+        data (bytes): JSON-encoded base64-encoded values by name.
+
+    Returns:
+        dict: The extended attributes.
+
+    Raises:
+        ValueError: If the data isn't valid.
+    """
+    xattrs = json.loads(data.decode("utf-8"))
+    if not isinstance(xattrs, dict) or not all(isinstance(v, str) for v in xattrs.values()):
+        raise ValueError("Invalid extended attributes from other side, aborting...")
+    for value in xattrs.values():
+        base64.b64decode(value, validate=True)
+    return xattrs
+
+
+def wait_for_space(
+    fname: str,
+    needed: int,
+    reserve: int = 0,
+    inodes: int = 0,
+    wait: int = 0
+) -> None:
+    """
+    Make sure that there is enough space and there are enough inodes to write a
+    file. If not, pause until there are, for at most the given time.
+
+    Args:
+        fname (str): Path of the file to write.
+        needed (int): Size of the file to write.
+        reserve (int): Number of bytes that must remain free after writing.
+        inodes (int): Number of inodes that must remain free after writing
+        (ignored for filesystems without inode limit).
+        wait (int): Number of seconds to wait for space to become available.
+
+    Raises:
+        ValueError: If there is not enough space after waiting.
+    """
+    path = Path(fname).parent
+    while not path.exists():
+        path = path.parent
+    start = time.monotonic()
+    paused = False
+    while True:
+        st = os.statvfs(path)
+        free = st.f_bavail * st.f_frsize
+        if free - needed >= reserve and (st.f_files == 0 or st.f_favail > inodes):
+            if paused:
+                logger.warning("Enough space available again, resuming transfer.")
+            return
+        if time.monotonic() - start >= wait:
+            raise ValueError(f"Only {free} bytes and {st.f_favail} inodes free to write {needed} bytes "
+                             f"to '{fname}', aborting; rerun when more space is available to resume.")
+        if not paused:
+            logger.warning("Only %s bytes and %s inodes free, pausing transfer for up to %s seconds...",
+                           free, st.f_favail, wait)
+            paused = True
+        time.sleep(min(5, wait))
+
+
+def partial_path(fname: str) -> str:
+    """
+    Get the path to write a file that is being received to before it is
+    complete. This is the tmp/ directory of the maildir for files in cur/ or
+    new/ (which notmuch doesn't index), and a hidden file in the same directory
+    otherwise, so that renaming it to the final name is atomic.
+
+    Args:
+        fname (str): Destination file path.
+
+    Returns:
+        str: Path of the partial file.
+    """
+    path = Path(fname)
+    parent = path.parent
+    if parent.name in ["cur", "new"]:
+        parent = parent.parent / "tmp"
+    return str(parent / (PARTIAL_PREFIX + path.name))
+
+
+def writable(path: str) -> bool:
+    """
+    Check whether files can be written in a directory by creating (and
+    removing) a test file, to detect read-only file systems (e.g. remounted
+    read-only to save battery) before anything is changed.
+
+    Args:
+        path (str): The directory to check.
+
+    Returns:
+        bool: False if the directory is on a read-only file system, True
+        otherwise (other errors are left to the actual writes to report).
+    """
+    try:
+        fd, fname = tempfile.mkstemp(prefix=PARTIAL_PREFIX, dir=path)
+    except OSError as e:
+        return e.errno != errno.EROFS
+    os.close(fd)
+    os.unlink(fname)
+    return True
+
+
+def open_write_db() -> notmuch2.Database:
+    """
+    Open the notmuch database in write mode, with a clear error if it can't
+    be opened because it is on a read-only file system. With --read-only, it
+    is opened read-only, so that any attempt to change it fails.
+
+    Returns:
+        The opened notmuch2.Database.
+    """
+    if session["read_only_db"]:
+        return notmuch2.Database(mode=notmuch2.Database.MODE.READ_ONLY)
+    try:
+        return notmuch2.Database(mode=notmuch2.Database.MODE.READ_WRITE)
+    except notmuch2.NotmuchError as e:
+        path = notmuch_dir(str(notmuch2.Database.default_path()))
+        if os.path.isdir(path) and not writable(path):
+            raise OSError(errno.EROFS, "notmuch database is on a read-only file system, try again once it is writable", path) from e
+        raise
+
+
+def check_read_only(prefix: str) -> None:
+    """
+    Check whether the mail directory is on a read-only file system and if so,
+    only sync tags this time (see negotiate). Sets session["read_only"].
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+    """
+    # nothing is written with --read-only, not even to test
+    session["read_only"] = not session["read_only_db"] and not writable(prefix)
+    if session["read_only"]:
+        logger.warning("Mail directory %s is on a read-only file system, only syncing tags; files will be synced once it is writable again.",
+                       prefix)
+
+
+def case_insensitive(path: str) -> bool:
+    """
+    Check whether a directory is on a case-insensitive file system (e.g. APFS
+    or HFS+ on macOS by default) by creating (and removing) a test file and
+    looking for it with the case of its name swapped.
+
+    Args:
+        path (str): The directory to check.
+
+    Returns:
+        bool: True if file names that only differ in case are the same file.
+    """
+    try:
+        fd, fname = tempfile.mkstemp(prefix=PARTIAL_PREFIX, dir=path)
+    except OSError:
+        return False
+    os.close(fd)
+    try:
+        return os.path.exists(os.path.join(path, os.path.basename(fname).swapcase()))
+    finally:
+        os.unlink(fname)
+
+
+def check_case_insensitive(prefix: str) -> None:
+    """
+    Check whether the mail directory is on a case-insensitive file system,
+    where files of the other side whose names only differ in case would
+    overwrite or delete each other, see case_collision. Sets
+    session["case_insensitive"].
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+    """
+    # nothing is written with --read-only or on a read-only file system
+    session["case_insensitive"] = not session["read_only_db"] and not session["read_only"] and case_insensitive(prefix)
+    if session["case_insensitive"]:
+        logger.info("Mail directory %s is on a case-insensitive file system, not syncing files whose names only differ in case.",
+                    prefix)
+
+
+def case_collision(fname: str, others: Iterable[str] = ()) -> str | None:
+    """
+    On a case-insensitive file system (see check_case_insensitive), find a file
+    whose name only differs in case from a file name, so that creating the file
+    would overwrite it or deleting the file would delete it as well.
+
+    Args:
+        fname (str): The file name.
+        others: Other file names (e.g. of files that are about to be created or
+        have to be kept) to check in addition to the existing files.
+
+    Returns:
+        str | None: The colliding file name, if any.
+    """
+    if not session["case_insensitive"]:
+        return None
+    folded = fname.casefold()
+    for other in others:
+        if other != fname and other.casefold() == folded:
+            return other
+    if not os.path.lexists(fname):
+        return None
+    parent, name = os.path.split(fname)
+    for entry in os.listdir(parent or "."):
+        if entry != name and entry.casefold() == name.casefold():
+            return os.path.join(parent, entry)
+    return None
+
+
+def process_start_time(pid: int) -> float | None:
+    """
+    Determine when a process was started, from /proc on Linux.
+
+    Args:
+        pid (int): The process ID.
+
+    Returns:
+        float: Start time of the process as a UNIX timestamp, None if it can't
+        be determined.
+    """
+    try:
+        # the command name in parentheses may contain spaces, starttime is
+        # the 22nd field, in clock ticks after boot
+        stat = Path(f"/proc/{pid}/stat").read_text(encoding="utf-8")
+        ticks = int(stat[stat.rindex(")") + 2:].split()[19])
+        btime = next(int(line.split()[1]) for line in Path("/proc/stat").read_text(encoding="utf-8").splitlines()
+                     if line.startswith("btime "))
+        return btime + ticks / os.sysconf("SC_CLK_TCK")
+    except (OSError, ValueError, IndexError, StopIteration):
+        return None
+
+
+def lock_is_stale(owner: str) -> bool:
+    """
+    Determine whether the sync that holds a lock (see lock_mail_dir) has died
+    without removing it. This can only be determined for locks held on this
+    host: if the process isn't running anymore or has been started after the
+    lock was created (i.e. the PID has been reused), the lock is stale.
+
+    Args:
+        owner (str): Contents of the lock file, host name, PID, and the time
+        the lock was created.
+
+    Returns:
+        bool: Whether the lock is stale.
+    """
+    fields = owner.split()
+    if len(fields) < 2 or fields[0] != socket.gethostname():
+        return False
+    try:
+        pid = int(fields[1])
+        created = float(fields[2]) if len(fields) > 2 else None
+    except ValueError:
+        return False
+    try:
+        os.kill(pid, 0)
+    except ProcessLookupError:
+        return True
+    except PermissionError:
+        # running as another user
+        pass
+    started = process_start_time(pid)
+    # allow for the clock tick resolution of the start time
+    return created is not None and started is not None and started > created + 1
+
+
+@contextlib.contextmanager
+def lock_mail_dir(enabled: bool = True) -> Iterator[None]:
+    """
+    Context manager that holds a lock file in the directory of the notmuch
+    database (see state_path) while it is active, so that only one sync
+    changes the mail directory at a time, in particular from different
+    machines sharing it over NFS. The lock file is created with O_EXCL, which
+    is atomic on NFS (unlike e.g. flock), and contains the host name and PID of
+    the sync holding it and the time it was created. A lock left behind by a
+    sync on this host that has died is removed (see lock_is_stale).
+
+    Args:
+        enabled (bool): Whether to lock, i.e. --nfs is given.
+
+    Raises:
+        OSError: If another sync holds the lock.
+    """
+    if not enabled:
+        yield
+        return
+    with notmuch2.Database(mode=notmuch2.Database.MODE.READ_ONLY) as db:
+        use_notmuch_dir(db)
+        path = state_path(mail_root(db), "notmuch-sync.lock")
+    for attempt in range(2):
+        try:
+            fd = os.open(path, os.O_WRONLY | os.O_CREAT | os.O_EXCL, 0o644)
+            break
+        except FileExistsError as e:
+            try:
+                owner = Path(path).read_text(encoding="utf-8").strip()
+            except OSError:
+                owner = "unknown"
+            if attempt == 0 and lock_is_stale(owner):
+                logger.warning("Removing stale lock %s of a sync that isn't running anymore (%s).", path, owner)
+                Path(path).unlink(missing_ok=True)
+                continue
+            raise OSError(errno.EEXIST, f"mail directory is locked by another sync ({owner}); remove the lock file if it isn't running anymore", path) from e
+    with os.fdopen(fd, "w", encoding="utf-8") as f:
+        f.write(f"{socket.gethostname()} {os.getpid()} {time.time():.0f}\n")
+    try:
+        yield
+    finally:
+        Path(path).unlink(missing_ok=True)
+
+
+def clean_partials(prefix: str, dry_run: bool = False) -> int:
+    """
+    Remove partial files left behind by interrupted transfers. Must only be
+    called with the notmuch database open in write mode, so that no other sync
+    can be receiving files at the same time. The cur/ and new/ directories of
+    maildirs, which hold almost all files, are not listed, as partial files
+    are never written there (see partial_path).
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        dry_run (bool): Only report stale partial files.
+
+    Returns:
+        int: The number of stale partial files.
+    """
+    stale = 0
+    for root, dirs, files in os.walk(prefix):
+        dirs[:] = [d for d in dirs if d not in (".notmuch", "cur", "new")]
+        for f in files:
+            if f.startswith(PARTIAL_PREFIX):
+                stale += 1
+                files_logger.debug("Removing stale partial file %s.", os.path.join(root, f))
+                if not dry_run:
+                    Path(root, f).unlink(missing_ok=True)
+    if stale > 0:
+        logger.warning("Removed %s stale partial files of interrupted transfers.", stale)
+    return stale
+
+
+def fsync_path(path: str) -> None:
+    """
+    Make sure that a file (or the entries of a directory, i.e. that files have
+    been created, renamed, or removed in it) is written to disk, so that it
+    survives a power loss, unless --no-fsync is given. Errors are ignored, as
+    not all file systems support syncing directories.
+
+    Args:
+        path (str): Path of the file or directory.
+    """
+    if not session["fsync"]:
+        return
+    try:
+        fd = os.open(path, os.O_RDONLY)
+    except OSError:
+        return
+    try:
+        os.fsync(fd)
+    except OSError:
+        pass
+    finally:
+        os.close(fd)
+
+
+def copy_file(src: str, dst: str) -> None:
+    """
+    Copy a file with its permissions. With --portable (e.g. for shared storage
+    on Android, where permissions can't be changed), only the content is
+    copied, and synced to disk.
+
+    Args:
+        src (str): Source file path.
+        dst (str): Destination file path.
+    """
+    if session["portable"]:
+        with open(src, "rb") as fin, open(dst, "wb") as fout:
+            shutil.copyfileobj(fin, fout)
+    else:
+        shutil.copy(src, dst)
+    fsync_path(dst)
+    fsync_path(os.path.dirname(dst))
+
+
+def move_file(src: str, dst: str) -> None:
+    """
+    Move a file. With --portable, the file is copied (see copy_file) and then
+    removed instead of renamed, as renames may fail or not be atomic there,
+    unless the names only differ in case on a case-insensitive file system,
+    where the file would be copied onto itself.
+
+    Args:
+        src (str): Source file path.
+        dst (str): Destination file path.
+    """
+    if session["portable"] and not (session["case_insensitive"] and src.casefold() == dst.casefold()):
+        copy_file(src, dst)
+        os.unlink(src)
+    else:
+        shutil.move(src, dst)
+        fsync_path(os.path.dirname(dst))
+    fsync_path(os.path.dirname(src))
+
+
+def set_mtime(fname: str, mtime: float) -> None:
+    """
+    Set the modification time of a file. With --portable, failing to do so
+    (e.g. on shared storage on Android) is not an error, the file just keeps
+    the time it was written.
+
+    Args:
+        fname (str): File path.
+        mtime (float): Modification time as a UNIX timestamp.
+    """
+    try:
+        os.utime(fname, (mtime, mtime))
+    except OSError as e:
+        if not session["portable"]:
+            raise
+        files_logger.debug("Could not set modification time of %s: %s", fname, e)
+
+
+def write_atomic(fname: str, content: bytes, expected: str | None = None) -> None:
+    """
+    Write a file atomically. The content is written to a partial file first
+    (see partial_path), synced to disk, and, if the digest of the file on the
+    other side is given, read back and its digest checked against it before it
+    is renamed to the destination, so that an interrupted or corrupted transfer
+    never leaves a truncated or wrong file. The partial file is removed if
+    writing fails.
+
+    Args:
+        fname (str): Destination file path.
+        content (bytes): Content to write.
+        expected (str): Digest of the file on the other side, not checked if
+        None.
+
+    Raises:
+        ValueError: If the written file's digest does not match the expected
+        one.
+    """
+    Path(fname).parent.mkdir(parents=True, exist_ok=True)
+    tmp = partial_path(fname)
+    Path(tmp).parent.mkdir(parents=True, exist_ok=True)
+    try:
+        with open(tmp, "wb") as f:
+            f.write(content)
+            f.flush()
+            if session["fsync"]:
+                os.fsync(f.fileno())
+        if expected is not None and digest(Path(tmp).read_bytes()) != expected:
+            raise ValueError(f"Checksum of written '{fname}' does not match the file on the other side, aborting...")
+        try:
+            os.replace(tmp, fname)
+        except FileNotFoundError:
+            # NFS reports a retransmitted rename that succeeded the first time
+            # as failed
+            if not session["nfs"] or os.path.exists(tmp) or not os.path.exists(fname):
+                raise
+        fsync_path(os.path.dirname(fname))
+    except (OSError, ValueError):
+        Path(tmp).unlink(missing_ok=True)
+        raise
+
+
+def recv_file(
+    fname: str,
+    stream: IO[bytes],
+    overwrite_raise: bool=True,
+    basis: str | None = None,
+    space: Dict[str, int] | None = None
+) -> None:
+    """
+    Receive a file with a 4-byte length prefix from a stream and write it to
+    disk atomically (see write_atomic), followed by its digest if both sides
+    support it, which the written file is checked against, and its extended
+    attributes if they are preserved.
+
+    Args:
+        fname (str): Destination file path.
+        stream: Readable stream.
+        overwrite_raise: Raise error if existing file would be overwritten.
+        basis (str): Path of the file the other side sends a delta against, if
+        any.
+        space (dict): Space ("reserve" bytes, "inodes") that must remain free
+        after writing and seconds to "wait" for it, see wait_for_space. Not
+        checked if None.
+
+    Raises:
+        ValueError: If file to receive already exists or the written file's
+        checksum does not match expected.
+    """
+    content = read(stream)
+    expected = read(stream).decode("utf-8") if session["file_digests"] else None
+    xattrs = decode_xattrs(read(stream)) if session["xattrs"] else None
+    if basis is not None:
+        content = apply_delta(Path(basis).read_bytes(), content)
+    if space is not None:
+        wait_for_space(fname, len(content), **space)
+    if Path(fname).exists() and overwrite_raise:
+        sha_mine = digest(content)
+        sha_exists = digest(Path(fname).read_bytes())
+        if sha_exists != sha_mine:
+            raise ValueError(f"Receiving '{fname}', but already exists with different content!")
+    write_atomic(fname, content, expected)
+    if xattrs is not None:
+        set_xattrs(fname, xattrs)
+
+
+def check_space(
+    prefix: str,
+    send: List[str],
+    reserve: int,
+    from_stream: IO[bytes] | None,
+    to_stream: IO[bytes] | None,
+    dry_run: bool = False
+) -> None:
+    """
+    Exchange the free space on the filesystem of the mail directory and the
+    size of the files to be transferred with the other side and check that both
+    sides will have enough space left after the transfer. Both sides come to the
+    same conclusion, so either both abort or neither does.
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        send (list): Names of the files to be sent to the other side.
+        reserve (int): Number of bytes that must remain free on this side.
+        from_stream: Stream to read from the other side.
+        to_stream: Stream to write to the other side.
+        dry_run: Only warn if there is not enough space.
+
+    Raises:
+        ValueError: If either side would run out of space.
+    """
+    size = 0
+    for f in send:
+        try:
+            size += Path(os.path.join(prefix, f)).stat().st_size
+        except OSError:
+            pass
+    space = {"mine": {"free": shutil.disk_usage(prefix).free, "size": size, "reserve": reserve}}
+
+    def _send_space():
+        logger.info("Sending free space and transfer size...")
+        write(json.dumps(space["mine"]).encode("utf-8"), to_stream)
+
+    def _recv_space():
+        logger.info("Receiving free space and transfer size...")
+        space["theirs"] = json.loads(read(from_stream).decode("utf-8"))
+
+    run_async(_send_space, _recv_space)
+    protocol_logger.debug("Free space and transfer size %s.", space)
+
+    problems = []
+    for side, recv, dest in [("this side", space["theirs"]["size"], space["mine"]),
+                             ("other side", space["mine"]["size"], space["theirs"])]:
+        if recv > dest["free"] - dest["reserve"]:
+            problems.append(f"{recv} bytes to be received on {side}, but only {dest['free']} bytes free"
+                            f" ({dest['reserve']} bytes to be kept free)")
+    if problems:
+        msg = "Not enough space: " + "; ".join(problems) + ", aborting..."
+        if dry_run:
+            logger.warning(msg)
+        else:
+            raise ValueError(msg)
+
+
+def find_basis(
+    dbw: notmuch2.Database,
+    prefix: str,
+    mid: str
+) -> str | None:
+    """
+    Find an existing file of a message to use as the basis for a delta
+    transfer of another file of the same message.
+
+    Args:
+        dbw: An open notmuch2.Database object.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        mid (str): Message ID.
+
+    Returns:
+        str: Path of an existing file of the message, or None if there is none.
+    """
+    try:
+        msg = dbw.find(mid)
+        if msg.ghost:
+            return None
+        for f in msg.filenames():
+            if Path(f).exists():
+                return str(f)
+    except LookupError:
+        pass
+    return None
+
+
+def file_info(dbw: notmuch2.Database, fname: str) -> List[int]:
+    """
+    Get the date of the message of a file (its modification time if it isn't
+    in the database) and its size, see order_files.
+
+    Args:
+        dbw: An open notmuch2.Database object.
+        fname (str): Path of the file.
+
+    Returns:
+        list: Date (seconds since the epoch) and size in bytes, 0 for files
+        that can't be read.
+    """
+    try:
+        st = os.stat(fname)
+    except OSError:
+        return [0, 0]
+    try:
+        date = int(dbw.get(fname).date)
+    except (LookupError, notmuch2.NotmuchError):
+        date = int(st.st_mtime)
+    return [date, st.st_size]
+
+
+def order_files(
+    dbw: notmuch2.Database,
+    prefix: str,
+    files: Dict[str, List[Any]],
+    from_stream: IO[bytes] | None,
+    to_stream: IO[bytes] | None
+) -> None:
+    """
+    Sort the files missing on this side in the order given with --order, so
+    that e.g. the newest mail arrives first if the sync is interrupted, and the
+    files to send in the order the other side asks for. Each side sends the
+    date and size of the files the other side requested (see file_info), which
+    only the side that has them knows, and then the order to send the files it
+    requested in as indices into its request. Files with a higher priority
+    (see policy_for) still come first. Modifies files in place.
+
+    Args:
+        dbw: An open notmuch2.Database object.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        files (dict): Files missing on this side ("mine", with "name" and
+        "id") and on the other side ("theirs", names).
+        from_stream: Stream to read from the other side.
+        to_stream: Stream to write to the other side.
+
+    Raises:
+        ValueError: If the dates and sizes or the order from the other side
+        don't match the requested files.
+    """
+    info: Dict[str, Any] = {}
+
+    def _send_info():
+        logger.info("Sending dates and sizes of files missing on remote...")
+        write(encode_data([file_info(dbw, os.path.join(prefix, f)) for f in files["theirs"]]), to_stream)
+
+    def _recv_info():
+        logger.info("Receiving dates and sizes of files missing on local...")
+        info["mine"] = decode_data(read(from_stream))
+
+    run_async(_send_info, _recv_info)
+    if (not isinstance(info["mine"], list) or len(info["mine"]) != len(files["mine"]) or
+            not all(isinstance(i, list) and len(i) == 2 for i in info["mine"])):
+        raise ValueError("Dates and sizes of files from other side don't match the requested files, aborting...")
+
+    keys = {"newest": lambda i: -info["mine"][i][0], "oldest": lambda i: info["mine"][i][0],
+            "smallest": lambda i: info["mine"][i][1]}
+    key = keys[session["order"]]
+    order = sorted(range(len(files["mine"])),
+                   key=lambda i: (-policy_for([files["mine"][i]["name"]])["priority"], key(i)))
+    files["mine"] = [files["mine"][i] for i in order]
+
+    def _send_order():
+        logger.info("Sending order of files missing on local...")
+        write(encode_data(order), to_stream)
+
+    def _recv_order():
+        logger.info("Receiving order of files missing on remote...")
+        info["theirs"] = decode_data(read(from_stream))
+
+    run_async(_send_order, _recv_order)
+    if not isinstance(info["theirs"], list) or sorted(info["theirs"]) != list(range(len(files["theirs"]))):
+        raise ValueError("Order of files from other side doesn't match the requested files, aborting...")
+    files["theirs"] = [files["theirs"][i] for i in info["theirs"]]
+
+
+def sync_files(
+    dbw: notmuch2.Database,
+    prefix: str,
+    missing: Dict[str, Dict[str, Any]],
+    from_stream: IO[bytes] | None,
+    to_stream: IO[bytes] | None,
+    dry_run: bool = False,
+    reserve: int = 0,
+    space: Dict[str, int] | None = None
+) -> Tuple[int, int, int]:
+    """
+    Synchronize files that are missing locally or remotely.
+
+    Args:
+        dbw: An open writable notmuch2.Database object.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        missing (dict): Mapping of missing files by message ID.
+        from_stream: Stream to read file names and files from.
+        to_stream: Stream to send file names and files to.
+        dry_run: Only exchange the file names and record the files that would
+        be received, do not transfer anything.
+        reserve (int): Number of bytes that must remain free after the
+        transfer.
+        space (dict): Space that must remain free while receiving files and
+        seconds to wait for it, see wait_for_space.
+
+    Returns:
+        tuple: (number of added messages, number of added files, number of
+        added files of messages that were already in the database)
+    """
+    files = {}
+    files["mine"] = [ {"name": f, "id": mid} for mid in missing for f in missing[mid]["files"] ]
+    # the other side sends files in the order they are requested
+    files["mine"].sort(key=lambda f: -policy_for([f["name"]])["priority"])
+    if session["case_insensitive"]:
+        # files whose names only differ in case would overwrite each other
+        # or existing files
+        requested: List[str] = []
+        for f in list(files["mine"]):
+            dst = os.path.join(prefix, f["name"])
+            if case_collision(dst, requested) is not None:
+                warn_file(dst, CASE_COLLISION)
+                count_outcome("file transfer", "skipped")
+                files["mine"].remove(f)
+            else:
+                requested.append(dst)
+    changes = {"files": len(files["mine"]), "messages": 0, "duplicates": 0}
+
+    def _send_fnames():
+        logger.info("Sending file names missing on local...")
+        write(encode_data([to_wire(f["name"]) for f in files["mine"]]), to_stream)
+
+    def _recv_fnames():
+        logger.info("Receiving file names missing on remote...")
+        files["theirs"] = decode_fnames(read(from_stream))
+
+    run_async(_send_fnames, _recv_fnames)
+
+    logger.info("Missing file names synced.")
+
+    if session["file_order"]:
+        order_files(dbw, prefix, files, from_stream, to_stream)
+
+    check_space(prefix, files["theirs"], reserve, from_stream, to_stream, dry_run)
+
+    if dry_run:
+        for f in files["mine"]:
+            planned.append({"op": "add", "name": f["name"]})
+        return (len([mid for mid in missing if "tags" in missing[mid]]), changes["files"], 0)
+
+    # files to apply received deltas to and block signatures to compute deltas
+    # to send against
+    delta: Dict[str, List[Any]] = {"bases": [None] * len(files["mine"]),
+                                   "sigs": [None] * len(files["theirs"])}
+    if session["delta"]:
+        def _send_sigs():
+            logger.info("Sending block signatures for files missing on local...")
+            out = []
+            for idx, f in enumerate(files["mine"]):
+                delta["bases"][idx] = find_basis(dbw, prefix, f["id"])
+                out.append(None if delta["bases"][idx] is None else
+                           block_signature(Path(delta["bases"][idx]).read_bytes()))
+            write(json.dumps(out).encode("utf-8"), to_stream)
+
+        def _recv_sigs():
+            logger.info("Receiving block signatures for files missing on remote...")
+            delta["sigs"] = decode_signatures(read(from_stream), len(files["theirs"]))
+
+        run_async(_send_sigs, _recv_sigs)
+
+    def _send_files():
+        for idx, fname in enumerate(files["theirs"]):
+            files_logger.debug("%s/%s Sending %s...", idx + 1, len(files["theirs"]),
+                               fname)
+            with context("sending", fname):
+                send_file(os.path.join(prefix, fname), to_stream, delta["sigs"][idx])
+
+    def _recv_files():
+        for idx, f in enumerate(files["mine"]):
+            files_logger.debug("%s/%s Receiving %s...", idx + 1, len(files["mine"]), f["name"])
+            dst = os.path.join(prefix, f["name"])
+            with context("receiving", f["name"]):
+                recv_file(dst, from_stream, basis=delta["bases"][idx], space=space)
+
+        for idx, f in enumerate(files["mine"]):
+            dst = os.path.join(prefix, f["name"])
+            notmuch_logger.debug("Adding %s to DB.", dst)
+            # index the file and set its tags in one transaction, so that
+            # e.g. a concurrent search never sees a new message without its
+            # tags
+            try:
+                with dbw.atomic():
+                    msg, dup = dbw.add(dst)
+                    if dup:
+                        changes["duplicates"] += 1
+                    else:
+                        changes["messages"] += 1
+                        with msg.frozen():
+                            notmuch_logger.debug("Setting tags %s for received %s.",
+                                                 sorted(missing[f["id"]]["tags"]),
+                                                 msg.messageid)
+                            msg.tags.clear()
+                            for tag in missing[f["id"]]["tags"]:
+                                msg.tags.add(tag)
+                            if session["received_tag"]:
+                                msg.tags.add(session["received_tag"])
+            except notmuch2.FileNotEmailError:
+                # keep the file, but don't let one broken message abort the
+                # sync
+                warn_file(dst, "is not an email")
+                count_outcome("file transfer", "failed")
+                changes["files"] -= 1
+
+    run_async(_send_files, _recv_files)
+    log_file_warnings()
+
+    logger.info("Missing files synced.")
+
+    return (changes["messages"], changes["files"], changes["duplicates"])
+
+
+def get_ids(prefix: str) -> List[str]:
+    """
+    Get all message IDs from the notmuch database, using Xapian directly (much
+    faster).
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+
+    Returns:
+        list: All message IDs.
+    """
+    db = xapian.Database(state_path(prefix, "xapian"))
+    message_ids = []
+
+    logger.info("Getting all message IDs from DB...")
+    ghosts = {p.docid for p in db.postlist("Tghost")} # type: ignore[attr-defined]
+    all_docs = set(range(1, db.get_lastdocid() + 1))
+    for doc_id in all_docs - ghosts:
+        try:
+            doc = db.get_document(doc_id)
+            value = doc.get_value(1)
+            if value:
+                message_ids.append(value.decode("utf-8"))
+        except xapian.DocNotFoundError:
+            pass
+        except RuntimeError:
+            # not entirely sure why, but this seems to happen sometimes
+            continue
+
+    db.close()
+
+    return message_ids
+
+
+def ids_digest(ids: List[str]) -> str:
+    """
+    Compute a digest of a sorted list of message IDs to quickly check whether
+    both sides have the same set of messages.
+
+    Args:
+        ids (list): Sorted message IDs.
+
+    Returns:
+        str: Hex digest of the IDs.
+    """
+    h = hashlib.sha256()
+    for mid in ids:
+        h.update(mid.encode("utf-8"))
+        h.update(b"\0")
+    return h.hexdigest()
+
+
+def bucket_count(n: int) -> int:
+    """
+    Get the number of buckets to split message IDs into, a power of two such
+    that each bucket holds about ID_BUCKET_SIZE IDs.
+
+    Args:
+        n (int): Number of message IDs.
+
+    Returns:
+        int: Number of buckets.
+    """
+    count = 1
+    while n > count * ID_BUCKET_SIZE:
+        count *= 2
+    return count
+
+
+def bucket_of(mid: str, count: int) -> int:
+    """
+    Get the bucket of a message ID. This depends only on the ID itself, so that
+    the same ID is in the same bucket on both sides.
+
+    Args:
+        mid (str): Message ID.
+        count (int): Number of buckets.
+
+    Returns:
+        int: Index of the bucket.
+    """
+    return int.from_bytes(hashlib.sha256(mid.encode("utf-8")).digest()[:4], "big") % count
+
+
+def changed_buckets(
+    ids: List[str],
+    from_stream: IO[bytes] | None,
+    to_stream: IO[bytes] | None
+) -> List[str]:
+    """
+    Exchange digests of buckets of message IDs with the other side and get the
+    IDs in buckets that differ. Both sides send the same frames, so this is
+    symmetric.
+
+    Args:
+        ids (list): Sorted message IDs of this side.
+        from_stream: Stream to read from the other side.
+        to_stream: Stream to write to the other side.
+
+    Returns:
+        list: Sorted message IDs of this side in buckets that differ.
+    """
+    write(json.dumps(len(ids)).encode("utf-8"), to_stream)
+    count = bucket_count(max(len(ids), json.loads(read(from_stream).decode("utf-8"))))
+
+    idx = [bucket_of(mid, count) for mid in ids]
+    hashes = [hashlib.sha256() for _ in range(count)]
+    for mid, i in zip(ids, idx):
+        hashes[i].update(mid.encode("utf-8"))
+        hashes[i].update(b"\0")
+    mine = [h.hexdigest()[:16] for h in hashes]
+    write(json.dumps(mine).encode("utf-8"), to_stream)
+    theirs = json.loads(read(from_stream).decode("utf-8"))
+
+    differ = {i for i in range(count) if mine[i] != theirs[i]}
+    logger.info("%d of %d ID buckets differ.", len(differ), count)
+    return [mid for mid, i in zip(ids, idx) if i in differ]
+
+
+def send_ids(ids: List[str], stream: IO[bytes] | None) -> None:
+    """
+    Send message IDs in batches of ID_BATCH, terminated by an empty frame.
+
+    Args:
+        ids (list): Message IDs to send.
+        stream: Stream to write to.
+    """
+    for i in range(0, len(ids), ID_BATCH):
+        write(json.dumps(ids[i:i + ID_BATCH]).encode("utf-8"), stream)
+    write(b"", stream)
+
+
+def recv_ids(stream: IO[bytes] | None) -> Iterator[str]:
+    """
+    Receive message IDs sent with send_ids().
+
+    Args:
+        stream: Stream to read from.
+
+    Yields:
+        str: The received message IDs, in the order they were sent.
+    """
+    while True:
+        data = read(stream)
+        if not data:
+            return
+        yield from json.loads(data.decode("utf-8"))
+
+
+def diff_sorted(mine: List[str], theirs: Iterable[str]) -> Tuple[List[str], List[str]]:
+    """
+    Compare two sorted sequences of message IDs without materializing the
+    second one.
+
+    Args:
+        mine (list): Sorted local message IDs.
+        theirs: Sorted message IDs of the other side, e.g. as received.
+
+    Returns:
+        tuple: IDs only in mine, IDs only in theirs.
+    """
+    only_mine = []
+    only_theirs = []
+    i = 0
+    for mid in theirs:
+        while i < len(mine) and mine[i] < mid:
+            only_mine.append(mine[i])
+            i += 1
+        if i < len(mine) and mine[i] == mid:
+            i += 1
+        else:
+            only_theirs.append(mid)
+    only_mine.extend(mine[i:])
+    return (only_mine, only_theirs)
+
+
+# Separate methods for local and remote to avoid sending all IDs both ways --
+# have local figure out what needs to be deleted on both sides
+def sync_deletes_local(
+    prefix: str,
+    from_stream: IO[bytes] | None,
+    to_stream: IO[bytes] | None,
+    no_check: bool = False,
+    dry_run: bool = False,
+    grace: int | None = None,
+    limit: Tuple[float, bool] | None = None
+) -> int:
+    """
+    Synchronize deletions for the local database and instruct remote to delete
+    messages/files as needed.
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        from_stream: Stream to read from the remote.
+        to_stream: Stream to write to the remote.
+        no_check: Delete message not present on other side even if it doesn't
+        have the 'deleted' tag.
+        dry_run: Only record the messages that would be deleted.
+        grace (int): Seconds a message must have been missing on the remote
+        before it is deleted here, see delete_due.
+        limit (tuple): Maximum number of messages to delete on either side,
+        see parse_limit; nothing is deleted if more are missing on the other
+        side. None for no limit.
+
+    Returns:
+        int: Number of deletions performed.
+    """
+    dels = {'a': 0}
+    # messages with evicted files are still there as far as the remote is
+    # concerned
+    evicted = read_evicted(prefix)
+    nevicted = len(evicted)
+    pending = read_pending_deletes(prefix)
+    npending = len(pending)
+
+    ids = sorted(set(get_ids(prefix)) | set(evicted))
+    nmine = len(ids)
+    mine = ids_digest(ids)
+    write(mine.encode("utf-8"), to_stream)
+    if read(from_stream).decode("utf-8") == mine:
+        logger.info("Message IDs identical on both sides, nothing to delete.")
+        if pending and not dry_run:
+            write_pending_deletes(prefix, {})
+        return 0
+    if session["buckets"]:
+        ids = changed_buckets(ids, from_stream, to_stream)
+
+    logger.info("Receiving message IDs from remote...")
+    to_del, to_del_remote = diff_sorted(ids, recv_ids(from_stream))
+
+    logger.info("Message IDs synced.")
+
+    if limit is not None:
+        counts = {"here": (len(to_del), nmine),
+                  "on the remote": (len(to_del_remote), nmine - len(to_del) + len(to_del_remote))}
+        over = [f"{n} of {total} messages {side}" for side, (n, total) in counts.items()
+                if n > (limit[0] * total / 100 if limit[1] else limit[0])]
+        if over:
+            logger.error("Deleting up to %s, more than --max-delete %s%s, not deleting anything (use --force to delete anyway).",
+                         " and ".join(over), f"{limit[0]:g}", "%" if limit[1] else "")
+            count_outcome("deletes", "failed", len(to_del) + len(to_del_remote))
+            to_del, to_del_remote = [], []
+
+    def _send_del_ids():
+        files_logger.debug("Remote IDs to be deleted %s.", to_del_remote)
+        logger.info("Sending message IDs to be deleted to remote...")
+        send_ids(to_del_remote, to_stream)
+
+    def _recv_del_ids():
+        files_logger.debug("Local IDs to be deleted %s.", to_del)
+        mode = notmuch2.Database.MODE.READ_ONLY if dry_run else notmuch2.Database.MODE.READ_WRITE
+        with notmuch2.Database(mode=mode) as dbw:
+            for mid in to_del:
+                if mid in evicted:
+                    notmuch_logger.debug("Forgetting evicted %s.", mid)
+                    del evicted[mid]
+                    continue
+                try:
+                    msg = dbw.find(mid)
+                    if msg.ghost:
+                        continue
+                    if "deleted" in msg.tags or no_check:
+                        fnames = list(msg.filenames())
+                        if not policy_for((str(f).removeprefix(prefix) for f in fnames), msg.tags)["delete"]:
+                            files_logger.debug("Not removing %s because of folder policy or exclusion tag.", mid)
+                            count_outcome("deletes", "skipped")
+                            continue
+                        if not delete_due(pending, mid, grace):
+                            count_outcome("deletes", "skipped")
+                            continue
+                        dels["a"] += 1
+                        notmuch_logger.debug("Removing %s from DB and deleting files.", mid)
+                        if dry_run:
+                            planned.append({"op": "delete-message", "id": mid,
+                                            "files": [str(f).removeprefix(prefix) for f in fnames]})
+                            continue
+                        record_undo("tags", id=mid, tags=sorted(msg.tags))
+                        for f in fnames:
+                            files_logger.debug("Removing %s.", f)
+                            record_undo("delete", name=str(f).removeprefix(prefix))
+                            dbw.remove(f)
+                            Path(f).unlink()
+                        pending.pop(mid, None)
+                    else:
+                        # not there on remote, but no "deleted" tag -- assume
+                        # that something went wrong and set tags again to make
+                        # it show up in next changeset to be synced back to
+                        # remote
+                        logger.info("%s set to be removed, but not tagged 'deleted'!", mid)
+                        count_outcome("deletes", "failed")
+                        if dry_run:
+                            continue
+                        with msg.frozen():
+                            tmp = "".join(msg.tags)
+                            msg.tags.add(tmp)
+                            msg.tags.discard(tmp)
+                except LookupError:
+                    # already deleted? doesn't matter
+                    pass
+        if not dry_run and len(evicted) < nevicted:
+            write_evicted(prefix, evicted)
+        if (pending or npending) and not dry_run:
+            # messages that are back on the other side aren't deleted later
+            missing = set(to_del)
+            write_pending_deletes(prefix, {mid: since for mid, since in pending.items() if mid in missing})
+
+    run_async(_send_del_ids, _recv_del_ids)
+
+    return dels["a"]
+
+
+def sync_deletes_remote(
+    prefix: str,
+    from_stream: IO[bytes] | None,
+    to_stream: IO[bytes] | None,
+    no_check: bool = False,
+    dry_run: bool = False,
+    grace: int | None = None
+) -> int:
+    """
+    Receive instructions from local to delete messages/files from the remote database.
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        from_stream: Stream to read from the local.
+        to_stream: Stream to write to the local.
+        no_check: Delete message not present on other side even if it doesn't
+        have the 'deleted' tag.
+        dry_run: Only record the messages that would be deleted.
+        grace (int): Seconds a message must have been missing on the local
+        before it is deleted here, see delete_due.
+
+    Returns:
+        int: Number of deletions performed.
+    """
+    dels = 0
+    pending = read_pending_deletes(prefix)
+    npending = len(pending)
+    ids = sorted(get_ids(prefix))
+    mine = ids_digest(ids)
+    write(mine.encode("utf-8"), to_stream)
+    if read(from_stream).decode("utf-8") == mine:
+        if pending and not dry_run:
+            write_pending_deletes(prefix, {})
+        return 0
+    if session["buckets"]:
+        ids = changed_buckets(ids, from_stream, to_stream)
+    send_ids(ids, to_stream)
+    del ids
+
+    to_del = recv_ids(from_stream)
+    missing = set()
+    mode = notmuch2.Database.MODE.READ_ONLY if dry_run else notmuch2.Database.MODE.READ_WRITE
+    with notmuch2.Database(mode=mode) as dbw:
+        for mid in to_del:
+            missing.add(mid)
+            try:
+                msg = dbw.find(mid)
+                if msg.ghost:
+                    continue
+                if "deleted" in msg.tags or no_check:
+                    fnames = list(msg.filenames())
+                    if not policy_for((str(f).removeprefix(prefix) for f in fnames), msg.tags)["delete"]:
+                        count_outcome("deletes", "skipped")
+                        continue
+                    if not delete_due(pending, mid, grace):
+                        count_outcome("deletes", "skipped")
+                        continue
+                    dels += 1
+                    if dry_run:
+                        planned.append({"op": "delete-message", "id": mid,
+                                        "files": [str(f).removeprefix(prefix) for f in fnames]})
+                        continue
+                    record_undo("tags", id=mid, tags=sorted(msg.tags))
+                    for f in fnames:
+                        record_undo("delete", name=str(f).removeprefix(prefix))
+                        dbw.remove(f)
+                        Path(f).unlink()
+                    pending.pop(mid, None)
+                else:
+                    count_outcome("deletes", "failed")
+                    if dry_run:
+                        continue
+                    # not on local, but no "deleted" tag -- assume that
+                    # something went wrong and set tags again to make it
+                    # show up in next changeset to be synced back to local
+                    with msg.frozen():
+                        tmp = "".join(msg.tags)
+                        msg.tags.add(tmp)
+                        msg.tags.discard(tmp)
+            except LookupError:
+                # already deleted? doesn't matter
+                pass
+    if (pending or npending) and not dry_run:
+        # messages that are back on the other side aren't deleted later
+        write_pending_deletes(prefix, {mid: since for mid, since in pending.items() if mid in missing})
+    return dels
+
+
+def mbsync_stats(prefix: str) -> Dict[str, Any]:
+    """
+    Get the modification times of all mbsync files (.uidvalidity and
+    .mbsyncstate) in the mail directory, with their digests if both sides
+    support comparing them.
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+
+    Returns:
+        dict: Modification time, or [modification time, digest], by file name.
+    """
+    fnames = [f for pat in [".uidvalidity", ".mbsyncstate"] for f in Path(prefix).rglob(pat)]
+    if not session["mbsync_digests"]:
+        return {str(f).removeprefix(prefix): f.stat().st_mtime for f in fnames}
+    return {str(f).removeprefix(prefix): [f.stat().st_mtime, h]
+            for f, h in zip(fnames, hash_files([str(f) for f in fnames]))}
+
+
+def sync_mbsync_local(
+    prefix: str,
+    from_stream: IO[bytes] | None,
+    to_stream: IO[bytes] | None,
+    dry_run: bool = False
+) -> None:
+    """
+    Synchronize local mbsync files with remote.
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        from_stream: Stream to read from the remote.
+        to_stream: Stream to write to the remote.
+        dry_run: Only record the files that would be transferred; the remote
+        is told to transfer nothing.
+    """
+    mbsync = {}
+
+    def _get_mbsync():
+        logger.info("Getting local mbsync file stats...")
+        mbsync["mine"] = mbsync_stats(prefix)
+
+    def _recv_mbsync():
+        logger.info("Receiving mbsync file stats from remote...")
+        mbsync["theirs"] = json.loads(read(from_stream).decode("utf-8"))
+        if not isinstance(mbsync["theirs"], dict):
+            raise ValueError("Invalid mbsync file stats from other side, aborting...")
+        for f, stat in mbsync["theirs"].items():
+            validate_fname(f, mail=False)
+            if session["mbsync_digests"] and (not isinstance(stat, list) or len(stat) != 2):
+                raise ValueError(f"Invalid mbsync file stats for {f!r} from other side, aborting...")
+
+    run_async(_get_mbsync, _recv_mbsync)
+
+    logger.info("mbsync file stats synced.")
+
+    if session["mbsync_digests"]:
+        # files with the same contents are left alone, whatever their mtimes,
+        # which e.g. NFS doesn't keep precisely
+        same = {f for f in mbsync["mine"] if f in mbsync["theirs"] and mbsync["mine"][f][1] == mbsync["theirs"][f][1]}
+        mbsync["mine"] = {f: stat[0] for f, stat in mbsync["mine"].items() if f not in same}
+        mbsync["theirs"] = {f: stat[0] for f, stat in mbsync["theirs"].items() if f not in same}
+
+    pull = [ f for f in mbsync["mine"].keys()
+            if (f in mbsync["theirs"] and mbsync["theirs"][f] > mbsync["mine"][f]) ]
+    pull += list(set(mbsync["theirs"].keys()) - set(mbsync["mine"].keys()))
+    files_logger.debug("Local mbsync files to be updated from remote %s.", pull)
+    push = [ f for f in mbsync["theirs"].keys()
+            if (f in mbsync["mine"] and mbsync["mine"][f] > mbsync["theirs"][f]) ]
+    push += list(set(mbsync["mine"].keys()) - set(mbsync["theirs"].keys()))
+    # read-only mail directories are updated next time
+    if session["read_only"]:
+        pull = []
+    if session["peer_read_only"]:
+        push = []
+    if dry_run:
+        planned.extend({"op": "mbsync-pull", "name": f} for f in pull)
+        planned.extend({"op": "mbsync-push", "name": f} for f in push)
+        pull = []
+        push = []
+    write(encode_data(pull), to_stream)
+
+    def _send_mbsync_files():
+        files_logger.debug("mbsync files to update on remote %s.", push)
+        logger.info("Sending %s mbsync files to remote...", len(push))
+        write(encode_data(push), to_stream)
+        for idx, f in enumerate(push):
+            files_logger.debug("%s/%s Sending mbsync file %s to remote...", idx + 1,
+                               len(push), f)
+            to_stream.write(struct.pack("!d", mbsync["mine"][f]))
+            to_stream.flush()
+            trace_frame("sent", struct.pack("!d", mbsync["mine"][f]), raw=True)
+            transfer["write"] += 8
+            send_file(os.path.join(prefix, f), to_stream)
+
+    def _recv_mbsync_files():
+        logger.info("Receiving %s mbsync files from remote...", len(pull))
+        for idx, f in enumerate(pull):
+            files_logger.debug("%s/%s Receiving mbsync file %s from remote...",
+                               idx + 1, len(pull), f)
+            mtime_data = from_stream.read(8)
+            trace_frame("received", mtime_data, raw=True)
+            transfer["read"] += 8
+            mtime = struct.unpack("!d", mtime_data)[0]
+            fname = os.path.join(prefix, f)
+            recv_file(fname, from_stream, overwrite_raise=False)
+            set_mtime(fname, mtime)
+
+    run_async(_send_mbsync_files, _recv_mbsync_files)
+    log_file_warnings()
+
+    logger.info("mbsync files synced.")
+
+
+def sync_mbsync_remote(
+    prefix: str,
+    from_stream: IO[bytes] | None,
+    to_stream: IO[bytes] | None
+) -> None:
+    """
+    Synchronize remote mbsync files with local.
+
+    Args:
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        from_stream: Stream to read from the remote.
+        to_stream: Stream to write to the remote.
+    """
+    write(json.dumps(mbsync_stats(prefix)).encode("utf-8"), to_stream)
+    push = decode_fnames(read(from_stream), mail=False)
+
+    def _send_mbsync_files():
+        for f in push:
+            fname = os.path.join(prefix, f)
+            to_stream.write(struct.pack("!d", Path(fname).stat().st_mtime))
+            to_stream.flush()
+            transfer["write"] += 8
+            send_file(fname, to_stream)
+
+    def _recv_mbsync_files():
+        pull = decode_fnames(read(from_stream), mail=False)
+        for f in pull:
+            mtime_data = from_stream.read(8)
+            trace_frame("received", mtime_data, raw=True)
+            transfer["read"] += 8
+            mtime = struct.unpack("!d", mtime_data)[0]
+            fname = os.path.join(prefix, f)
+            recv_file(fname, from_stream, overwrite_raise=False)
+            set_mtime(fname, mtime)
+
+    run_async(_send_mbsync_files, _recv_mbsync_files)
+
+
+def evict(dbw: notmuch2.Database, prefix: str, age: int, dry_run: bool = False) -> int:
+    """
+    Remove the files of messages older than the given age from the database
+    and disk, keeping track of their IDs and tags so that they are neither
+    transferred again nor deleted on the other side.
+
+    Args:
+        dbw: An open writable notmuch2.Database object.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        age (int): Minimum age in seconds of messages to evict.
+        dry_run: Only record the messages that would be evicted.
+
+    Returns:
+        int: Number of evicted messages.
+    """
+    evicted = read_evicted(prefix)
+    cutoff = int(time.time()) - age
+    msgs = [(msg.messageid, list(msg.tags), list(msg.filenames()))
+            for msg in dbw.messages(f"date:..@{cutoff}") if not msg.ghost]
+
+    if dry_run:
+        for mid, _, fnames in msgs:
+            planned.append({"op": "evict", "id": mid,
+                            "files": [str(f).removeprefix(prefix) for f in fnames]})
+        return len(msgs)
+
+    # recorded before anything is removed, so that an interrupted eviction
+    # never leaves messages that are gone without a record, which the other
+    # side would delete as well
+    if len(msgs) > 0:
+        write_evicted(prefix, {**evicted, **{mid: tags for mid, tags, _ in msgs}})
+    for mid, _, fnames in msgs:
+        notmuch_logger.debug("Evicting %s.", mid)
+        for f in fnames:
+            files_logger.debug("Removing %s.", f)
+            dbw.remove(f)
+            Path(f).unlink()
+    return len(msgs)
+
+
+def repair_db(dbw: notmuch2.Database, prefix: str, dry_run: bool = False) -> Tuple[int, int, int, int]:
+    """
+    Reconcile the database with the files on disk: remove files that no
+    longer exist from the database, index files in cur/ and new/ directories
+    that aren't in the database, and report messages with several files whose
+    contents differ. Messages that are left without any files are recorded as
+    evicted, so that their tags are kept and they can be fetched from the other
+    side with hydrate; messages whose files have only been moved get their tags
+    back.
+
+    Args:
+        dbw: An open writable notmuch2.Database object.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        dry_run: Only report what would be repaired.
+
+    Returns:
+        tuple: Numbers of files removed from the database, files indexed,
+        messages without files, and messages with differing files.
+    """
+    msgs = [(msg.messageid, list(msg.tags), [str(f) for f in msg.filenames()])
+            for msg in dbw.messages("*") if not msg.ghost]
+    indexed = {f for _, _, fnames in msgs for f in fnames}
+
+    nremoved = 0
+    lost = {}
+    dups = []
+    for mid, tags, fnames in msgs:
+        gone = [f for f in fnames if not os.path.exists(f)]
+        for f in gone:
+            logger.info("Removing %s of %s from DB, file doesn't exist.", f, mid)
+            nremoved += 1
+            if not dry_run:
+                dbw.remove(f)
+        if len(gone) == len(fnames):
+            lost[mid] = tags
+        elif len(fnames) - len(gone) > 1:
+            dups.append((mid, [f for f in fnames if f not in gone]))
+
+    nindexed = 0
+    for root, dirs, files in os.walk(prefix):
+        dirs.sort()
+        if os.path.basename(root) not in ["cur", "new"]:
+            continue
+        for name in sorted(files):
+            f = os.path.join(root, name)
+            if f in indexed:
+                continue
+            logger.info("Indexing %s, not in DB.", f)
+            nindexed += 1
+            if dry_run:
+                continue
+            try:
+                dbw.add(f)
+            except notmuch2.FileNotEmailError:
+                warn_file(f, "is not an email")
+                nindexed -= 1
+
+    if not dry_run:
+        for mid in list(lost):
+            try:
+                msg = dbw.find(mid)
+                if msg.ghost:
+                    continue
+            except LookupError:
+                continue
+            logger.info("Files of %s moved, restoring tags.", mid)
+            with msg.frozen():
+                msg.tags.clear()
+                for tag in sorted(lost[mid]):
+                    msg.tags.add(tag)
+            del lost[mid]
+        if len(lost) > 0:
+            evicted = read_evicted(prefix)
+            evicted.update(lost)
+            write_evicted(prefix, evicted)
+    for mid in sorted(lost):
+        logger.info("No files left for %s.", mid)
+
+    ndiffer = 0
+    fnames = [f for _, files in dups for f in files]
+    hashes = dict(zip(fnames, hash_files(fnames)))
+    for mid, files in dups:
+        if len({hashes[f] for f in files}) > 1:
+            ndiffer += 1
+            logger.warning("Files of %s differ: %s", mid, ", ".join(files))
+    log_file_warnings()
+
+    if len(lost) > 0:
+        logger.warning("%s messages have no files left, use hydrate to fetch them from the other side.", len(lost))
+    return nremoved, nindexed, len(lost), ndiffer
+
+
+def hydrate_local(
+    dbw: notmuch2.Database,
+    prefix: str,
+    from_stream: IO[bytes] | None,
+    to_stream: IO[bytes] | None,
+    reserve: int = 0,
+    space: Dict[str, int] | None = None
+) -> Tuple[int, int, int]:
+    """
+    Fetch the files of messages matching the query run on the remote that are
+    not present locally, e.g. because they have been evicted, and add them
+    with the remote's tags.
+
+    Args:
+        dbw: An open writable notmuch2.Database object.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        from_stream: Stream to read from the remote.
+        to_stream: Stream to write to the remote.
+        reserve (int): Number of bytes that must remain free after the
+        transfer.
+        space (dict): Space that must remain free while receiving files and
+        seconds to wait for it, see wait_for_space.
 
-    def _recv_hashes():
-        logger.info("Receiving hashes from remote...")
-        tmp = json.loads(read(from_stream).decode("utf-8"))
-        hashes["theirs"] = dict(zip(hashes["req_mine"], tmp))
+    Returns:
+        tuple: (number of added messages, number of added files, number of
+        added files of messages that were already in the database)
+    """
+    logger.info("Receiving matching messages from remote...")
+    found = decode_changes(read(from_stream))
+    missing = {}
+    for mid in found:
+        try:
+            if not dbw.find(mid).ghost:
+                continue
+        except LookupError:
+            pass
+        missing[mid] = found[mid]
+    logger.info("%s of %s matching messages missing locally.", len(missing), len(found))
 
-    run_async(_send_hashes, _recv_hashes)
+    ret = sync_files(dbw, prefix, missing, from_stream, to_stream, reserve=reserve, space=space)
 
-    # now actually determine changes and move/copy
-    for mid in changes_theirs:
+    evicted = read_evicted(prefix)
+    if len(set(evicted) & set(missing)) > 0:
+        write_evicted(prefix, {mid: tags for mid, tags in evicted.items() if mid not in missing})
+    return ret
+
+
+def hydrate_remote(
+    db: notmuch2.Database,
+    prefix: str,
+    query: str,
+    from_stream: IO[bytes] | None,
+    to_stream: IO[bytes] | None
+) -> None:
+    """
+    Send the messages matching a query to local and the files local requests.
+
+    Args:
+        db: An open notmuch2.Database object.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        query (str): notmuch query for the messages to send.
+        from_stream: Stream to read from the local.
+        to_stream: Stream to write to the local.
+    """
+    found = {msg.messageid: {"tags": list(msg.tags),
+                             "files": [str(f).removeprefix(prefix) for f in msg.filenames()]}
+             for msg in db.messages(query) if not msg.ghost}
+    write(encode_data(changes_to_wire(found)), to_stream)
+    sync_files(db, prefix, {}, from_stream, to_stream)
+
+
+def list_messages(db: notmuch2.Database, prefix: str, checksums: bool = False) -> Iterator[Dict[str, Dict[str, Any]]]:
+    """
+    Get tags and files of all messages in the database in batches of ID_BATCH
+    messages.
+
+    Args:
+        db: An open notmuch2.Database object.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        checksums (bool): Whether to include the digests of the files, in the
+        same order as the files (None for files that could not be read).
+
+    Returns:
+        iterator: Batches of tags and files by message ID.
+    """
+    batch: Dict[str, Dict[str, Any]] = {}
+    for msg in db.messages("*"):
+        batch[msg.messageid] = {"tags": sorted(msg.tags),
+                                "files": sorted(str(f).removeprefix(prefix) for f in msg.filenames())}
+        if len(batch) >= ID_BATCH:
+            yield add_checksums(batch, prefix) if checksums else batch
+            batch = {}
+    if len(batch) > 0:
+        yield add_checksums(batch, prefix) if checksums else batch
+
+
+def add_checksums(batch: Dict[str, Dict[str, Any]], prefix: str) -> Dict[str, Dict[str, Any]]:
+    """
+    Add the digests of the files of a batch of messages from list_messages.
+
+    Args:
+        batch (dict): Tags and files by message ID.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+
+    Returns:
+        dict: The batch, with the digests of the files of each message.
+    """
+    fnames = [f for entry in batch.values() for f in entry["files"]]
+    hashes = iter(hash_files([prefix + f for f in fnames]))
+    for entry in batch.values():
+        entry["checksums"] = [next(hashes) for _ in entry["files"]]
+    return batch
+
+
+def send_listing(db: notmuch2.Database, prefix: str, to_stream: IO[bytes] | None, checksums: bool = False) -> None:
+    """
+    Send tags and files of all messages in the database, preceded by
+    implementation and protocol version, in batches of ID_BATCH messages
+    terminated by an empty frame.
+
+    Args:
+        db: An open notmuch2.Database object.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+        to_stream: Stream to write to.
+        checksums (bool): Whether to send the digests of the files as well.
+    """
+    write(json.dumps({"implementation": "python", "version": VERSION, "protocol": PROTOCOL}).encode("utf-8"), to_stream)
+    for batch in list_messages(db, prefix, checksums):
+        write(encode_data(changes_to_wire(batch)), to_stream)
+    write(b"", to_stream)
+
+
+def recv_listing(from_stream: IO[bytes] | None) -> Dict[str, Dict[str, Any]]:
+    """
+    Receive tags and files of all messages sent with send_listing().
+
+    Args:
+        from_stream: Stream to read from.
+
+    Returns:
+        dict: Mapping of message IDs to their tags and files, and the digests
+        of the files if they were sent.
+
+    Raises:
+        ValueError: If the data is invalid (see decode_change), or the digests
+        don't match the files.
+    """
+    check_compat(json.loads(read(from_stream).decode("utf-8")))
+    ret: Dict[str, Dict[str, Any]] = {}
+    while True:
+        data = read(from_stream)
+        if not data:
+            return ret
+        listing = decode_data(data)
+        if not isinstance(listing, dict):
+            raise ValueError(f"Invalid listing from other side, expected messages by ID, got {type(listing).__name__}, aborting...")
+        for mid, entry in listing.items():
+            ret[mid] = dict(decode_change(mid, entry))
+            if "checksums" in entry:
+                sums = entry["checksums"]
+                if not isinstance(sums, list) or len(sums) != len(ret[mid]["files"]) or \
+                        not all(c is None or isinstance(c, str) for c in sums):
+                    raise ValueError(f"Invalid checksums for {mid!r} from other side, got {sums!r}, aborting...")
+                ret[mid]["checksums"] = sums
+
+
+def format_diff(
+    listings: Tuple[Dict[str, Dict[str, Any]], Dict[str, Dict[str, Any]]],
+    names: Tuple[str, str]
+) -> Tuple[str, int]:
+    """
+    Format the differences between the messages of two databases as a
+    diff-like report. Files that are on both sides, but whose contents differ,
+    are marked with "!" if the listings include the digests of the files.
+
+    Args:
+        listings (tuple): Tags and files by message ID of both databases, as
+        returned by recv_listing.
+        names (tuple): Names of both databases.
+
+    Returns:
+        tuple: (report, number of messages that differ)
+    """
+    a, b = listings
+    out = [f"--- {names[0]}", f"+++ {names[1]}"]
+    ndiff = 0
+    for mid in sorted(set(a) | set(b)):
+        lines = []
+        if mid not in b:
+            lines.append("-message")
+        elif mid not in a:
+            lines.append("+message")
+        ma = a.get(mid, {"tags": [], "files": []})
+        mb = b.get(mid, {"tags": [], "files": []})
+        lines.extend(f"-tag:{t}" for t in sorted(set(ma["tags"]) - set(mb["tags"])))
+        lines.extend(f"+tag:{t}" for t in sorted(set(mb["tags"]) - set(ma["tags"])))
+        lines.extend(f"-{f}" for f in sorted(set(ma["files"]) - set(mb["files"])))
+        lines.extend(f"+{f}" for f in sorted(set(mb["files"]) - set(ma["files"])))
+        if "checksums" in ma and "checksums" in mb:
+            sa = dict(zip(ma["files"], ma["checksums"]))
+            sb = dict(zip(mb["files"], mb["checksums"]))
+            lines.extend(f"!{f}" for f in sorted(set(sa) & set(sb)) if sa[f] != sb[f])
+        if len(lines) > 0:
+            ndiff += 1
+            out.append(f"@@ message {mid} @@")
+            out.extend(lines)
+    return ("\n".join(out) + "\n", ndiff)
+
+
+def get_listing(args: argparse.Namespace) -> Dict[str, Dict[str, Any]]:
+    """
+    Connect to a remote and get the tags and files of all its messages.
+
+    Args:
+        args: Parsed command-line arguments for the remote.
+
+    Returns:
+        dict: Tags and files by message ID, as returned by recv_listing.
+    """
+    if args.fallbacks and not args.remote_cmd:
+        failover(args)
+    if args.ssh_control_path and not args.remote_cmd:
+        ssh_master(args)
+    if args.bootstrap and not args.remote_cmd:
+        bootstrap(args)
+    logger.info("Connecting to %s...", args.remote)
+    with connect_remote(args, stdin=False) as proc:
         try:
-            msg = dbw.find(mid)
-            if msg.ghost:
-                ret[mid] = changes_theirs[mid]
+            listing = recv_listing(proc.stdout)
+        except (ValueError, struct.error) as e:
+            err = proc.stderr.read() if proc.stderr is not None else b""
+            raise ValueError(f"Getting messages from {args.remote} failed: {err!r}") from e
+    logger.info("Got %s messages from %s.", len(listing), args.remote)
+    return listing
+
+
+def query_remote(args: argparse.Namespace, what: str) -> Dict[str, Any]:
+    """
+    Connect to a remote and get a single JSON object from it, for commands
+    that don't sync.
+
+    Args:
+        args: Parsed command-line arguments for the remote.
+        what (str): What is requested, for messages.
+
+    Returns:
+        dict: The object sent by the remote.
+    """
+    if args.fallbacks and not args.remote_cmd:
+        failover(args)
+    if args.ssh_control_path and not args.remote_cmd:
+        ssh_master(args)
+    logger.info("Connecting to %s...", args.remote)
+    with connect_remote(args, stdin=False) as proc:
+        try:
+            data = json.loads(read(proc.stdout).decode("utf-8"))
+        except (ValueError, struct.error) as e:
+            err = proc.stderr.read() if proc.stderr is not None else b""
+            raise ValueError(f"Getting {what} from {args.remote} failed: {err!r}") from e
+    if not isinstance(data, dict):
+        raise ValueError(f"Invalid {what} {data!r} from {args.remote}, aborting...")
+    return data
+
+
+def capabilities() -> Dict[str, Any]:
+    """
+    Get what this side supports, as in the hello frame at the start of a sync.
+
+    Returns:
+        dict: Implementation, version, wire protocol, notmuch version,
+        digests, encodings, optional features, and compressions.
+    """
+    return {"implementation": "python", "version": VERSION, "protocol": PROTOCOL, "notmuch": notmuch_version(),
+            "digests": DIGESTS, "encodings": ENCODINGS, "features": FEATURES, "compressions": COMPRESSIONS}
+
+
+def format_capabilities(mine: Dict[str, Any], theirs: Dict[str, Any], remote: str) -> str:
+    """
+    Format what this side and the remote support side by side, along with
+    what they have in common.
+
+    Args:
+        mine (dict): Capabilities of this side, see capabilities.
+        theirs (dict): Capabilities of the remote; anything an older version
+        doesn't report is shown as unknown.
+        remote (str): Name of the remote.
+
+    Returns:
+        str: The report.
+    """
+    def _show(h: Dict[str, Any], key: str) -> str:
+        if key == "implementation":
+            return f"{h.get('implementation', 'unknown')} {h.get('version', 'unknown')}"
+        value = h.get(key, "unknown")
+        return " ".join(value) if isinstance(value, list) else str(value)
+
+    keys = ["implementation", "protocol", "notmuch", "digests", "encodings", "features", "compressions"]
+    rows = [("", "local", remote)] + [(key, _show(mine, key), _show(theirs, key)) for key in keys]
+    widths = [max(len(row[i]) for row in rows) for i in range(2)]
+    lines = [f"{key:<{widths[0]}}  {local:<{widths[1]}}  {other}".rstrip() for key, local, other in rows]
+    lines.append("")
+    if theirs.get("protocol") == PROTOCOL:
+        for key in keys[3:]:
+            common = [v for v in mine[key] if v in theirs.get(key, [])]
+            lines.append(f"common {key}: {' '.join(common) or 'none'}")
+    else:
+        lines.append(f"incompatible: protocol {_show(theirs, 'protocol')} on {remote}, {PROTOCOL} on local")
+    return "\n".join(lines) + "\n"
+
+
+def show_capabilities(args: argparse.Namespace) -> bool:
+    """
+    Connect to the remote and print what both sides support to stdout, see
+    format_capabilities.
+
+    Args:
+        args: Parsed command-line arguments.
+
+    Returns:
+        bool: Whether both sides speak the same wire protocol.
+    """
+    theirs = query_remote(args, "capabilities")
+    sys.stdout.write(format_capabilities(capabilities(), theirs, args.remote or "remote"))
+    sys.stdout.flush()
+    return theirs.get("protocol") == PROTOCOL
+
+
+def diff_remotes(args: argparse.Namespace) -> int:
+    """
+    Connect to two remotes, get tags and files of all their messages, and print
+    where they differ to stdout. Nothing is changed on either remote.
+
+    Args:
+        args: Parsed command-line arguments, with the two remotes in peers.
+
+    Returns:
+        int: Number of messages that differ.
+    """
+    listings: List[Dict[str, Dict[str, Any]]] = [{}, {}]
+
+    def _get(idx: int) -> None:
+        listings[idx] = get_listing(args.peers[idx])
+
+    run_async(lambda: _get(0), lambda: _get(1))
+
+    report, ndiff = format_diff((listings[0], listings[1]), (args.peers[0].remote, args.peers[1].remote))
+    sys.stdout.write(report)
+    sys.stdout.flush()
+    logger.warning("%s messages differ.", ndiff)
+    return ndiff
+
+
+def verify_remote(args: argparse.Namespace) -> int:
+    """
+    Compare the tags, files, and file contents of all messages on this side
+    and the remote and print where they differ to stdout. Nothing is changed
+    on either side.
+
+    Args:
+        args: Parsed command-line arguments.
+
+    Returns:
+        int: Number of messages that differ.
+    """
+    listings: List[Dict[str, Dict[str, Any]]] = [{}, {}]
+
+    def _get_local() -> None:
+        with notmuch2.Database(mode=notmuch2.Database.MODE.READ_ONLY) as db:
+            use_notmuch_dir(db)
+            for batch in list_messages(db, mail_root(db), checksums=True):
+                listings[0].update(batch)
+        logger.info("Got %s local messages.", len(listings[0]))
+
+    def _get_remote() -> None:
+        listings[1] = get_listing(args)
+
+    run_async(_get_local, _get_remote)
+
+    report, ndiff = format_diff((listings[0], listings[1]), ("local", args.remote or "remote"))
+    sys.stdout.write(report)
+    sys.stdout.flush()
+    logger.warning("%s messages differ.", ndiff)
+    return ndiff
+
+
+def format_plan(entries: List[Dict[str, Any]], side: str) -> str:
+    """
+    Format recorded changes as a diff-like report for review, grouped by folder
+    for file operations and by message for tag changes and deletions.
+
+    Args:
+        entries (list): Recorded changes, as in planned.
+        side (str): Name of the side the changes would be made on.
+
+    Returns:
+        str: The report.
+    """
+    folders: Dict[str, List[str]] = {}
+    messages: Dict[str, List[str]] = {}
+    for e in entries:
+        op = e["op"]
+        if op in ("add", "delete", "mbsync-pull", "mbsync-push"):
+            sign = "-" if op == "delete" else "+"
+            note = {"mbsync-pull": "  (mbsync state from remote)",
+                    "mbsync-push": "  (mbsync state to remote)"}.get(op, "")
+            folders.setdefault(os.path.dirname(e["name"]), []).append(f"{sign}{e['name']}{note}")
+        elif op in ("copy", "move"):
+            lines = folders.setdefault(os.path.dirname(e["dst"]), [])
+            if op == "move":
+                lines.append(f"-{e['src']}")
+            lines.append(f"+{e['dst']}  ({op} of {e['src']})")
+        elif op == "tags":
+            lines = messages.setdefault(e["id"], [])
+            lines.extend(f"-tag:{t}" for t in e["remove"])
+            lines.extend(f"+tag:{t}" for t in e["add"])
+        elif op == "delete-message":
+            lines = messages.setdefault(e["id"], [])
+            lines.append("-message")
+            lines.extend(f"-{f}" for f in e["files"])
+        elif op == "evict":
+            lines = messages.setdefault(e["id"], [])
+            lines.extend(f"-{f}  (evicted)" for f in e["files"])
+
+    out = [f"--- {side}", f"+++ {side} (after sync)"]
+    for folder in sorted(folders):
+        out.append(f"@@ folder {folder or '.'} @@")
+        out.extend(folders[folder])
+    for mid in sorted(messages):
+        out.append(f"@@ message {mid} @@")
+        out.extend(messages[mid])
+    return "\n".join(out) + "\n"
+
+
+def dump_without_local_tags(dump: bytes, prefixes: List[str]) -> bytes:
+    """
+    Remove device-local tags (see without_local_tags) from the output of
+    `notmuch dump`.
+
+    Args:
+        dump (bytes): The dump, in batch-tag format.
+        prefixes (list): Prefixes of device-local tags.
+
+    Returns:
+        bytes: The dump without device-local tags.
+    """
+    if not prefixes:
+        return dump
+    lines = []
+    for line in dump.decode("utf-8").splitlines(keepends=True):
+        if not line.startswith("#") and " -- " in line:
+            tags, query = line.split(" -- ", 1)
+            # tags are +tag, with special characters %-encoded
+            tags = " ".join(t for t in tags.split() if without_local_tags([urllib.parse.unquote(t[1:])], prefixes))
+            line = f"{tags} -- {query}"
+        lines.append(line)
+    return "".join(lines).encode("utf-8")
+
+
+def dump_tags(db: notmuch2.Database) -> bytes:
+    """
+    Dump the tags of all messages with libnotmuch, in the format of `notmuch
+    dump`, for where the notmuch CLI isn't installed.
+
+    Args:
+        db: An open notmuch2.Database object.
+
+    Returns:
+        bytes: The dump.
+    """
+    lines = []
+    for msg in db.messages("*"):
+        if msg.ghost:
+            continue
+        # like notmuch, %-encode everything but a few safe characters
+        tags = " ".join("+" + urllib.parse.quote(t, safe="+-_@=.,") for t in sorted(msg.tags))
+        lines.append(f"{tags} -- id:{urllib.parse.quote(msg.messageid, safe='+-_@=.,')}\n")
+    return "".join(lines).encode("utf-8")
+
+
+def restore_tags(dbw: notmuch2.Database, dump: bytes) -> int:
+    """
+    Restore the tags of messages from a dump (see dump_tags) with libnotmuch,
+    like `notmuch restore`. Messages that aren't in the database are skipped.
+
+    Args:
+        dbw: An open writable notmuch2.Database object.
+        dump (bytes): The dump.
+
+    Returns:
+        int: Number of messages whose tags were restored.
+    """
+    n = 0
+    for line in dump.decode("utf-8").splitlines():
+        if line.startswith("#") or " -- id:" not in line:
+            continue
+        tags, mid = line.split(" -- id:", 1)
+        try:
+            msg = dbw.find(urllib.parse.unquote(mid.strip().strip('"')))
+        except LookupError:
+            notmuch_logger.debug("Not restoring tags of %s, not in DB.", mid)
+            continue
+        with msg.frozen():
+            msg.tags.clear()
+            for tag in tags.split():
+                msg.tags.add(urllib.parse.unquote(tag[1:]))
+        n += 1
+    return n
+
+
+def index_new(dbw: notmuch2.Database, prefix: str) -> Tuple[int, int]:
+    """
+    Index new files in cur/ and new/ directories and remove files that no
+    longer exist from the database with libnotmuch, like `notmuch new` (but
+    without hooks), for where the notmuch CLI isn't installed. New messages get
+    the tags of the new.tags configuration.
+
+    Args:
+        dbw: An open writable notmuch2.Database object.
+        prefix (str): Prefix path for filenames (the mail directory, see mail_root).
+
+    Returns:
+        tuple: Numbers of files indexed and removed from the database.
+    """
+    fnames = [str(f) for msg in dbw.messages("*") if not msg.ghost for f in msg.filenames()]
+    nremoved = 0
+    for f in fnames:
+        if not os.path.exists(f):
+            notmuch_logger.debug("Removing %s from DB, file doesn't exist.", f)
+            dbw.remove(f)
+            nremoved += 1
+    indexed = set(fnames)
+    new_tags = [t for t in dbw.config.get("new.tags", "unread;inbox").split(";") if t]
+    nindexed = 0
+    for root, dirs, files in os.walk(prefix):
+        dirs.sort()
+        if os.path.basename(root) not in ["cur", "new"]:
+            continue
+        for name in sorted(files):
+            f = os.path.join(root, name)
+            if f in indexed or name.startswith("."):
                 continue
-            fnames_theirs = changes_theirs[mid]["files"]
-            fnames_mine = [ str(f).removeprefix(prefix) for f in msg.filenames() ]
-            missing_mine = set(fnames_theirs) - set(fnames_mine)
-            if len(missing_mine) > 0:
-                hashes_mine = {str(f).removeprefix(prefix): digest(Path(f).read_bytes()) for f in msg.filenames()}
-                for f in changes_theirs[mid]["files"]:
-                    if f in missing_mine:
-                        # check if it has been moved/copied
-                        matches = [x[0] for x in hashes_mine.items() if hashes["theirs"][f] == x[1]]
-                        if len(matches) > 0:
-                            src = os.path.join(prefix, matches[0])
-                            dst = os.path.join(prefix, f)
-                            if matches[0] in changes_theirs[mid]["files"]:
-                                mcchanges += 1
-                                logger.info("Copying %s to %s.", src, dst)
-                                Path(dst).parent.mkdir(parents=True, exist_ok=True)
-                                shutil.copy(src, dst)
-                                fnames_mine.append(f)
-                                dbw.add(dst)
-                            elif mid not in changes_mine or move_on_change:
-                                mcchanges += 1
-                                logger.info("Moving %s to %s.", src, dst)
-                                Path(dst).parent.mkdir(parents=True, exist_ok=True)
-                                shutil.move(src, dst)
-                                fnames_mine.append(f)
-                                fnames_mine.remove(matches[0])
-                                hashes_mine[f] = hashes_mine[matches[0]]
-                                del hashes_mine[matches[0]]
-                                dbw.add(dst)
-                                logger.info("Removing %s from DB.", src)
-                                dbw.remove(src)
-                            missing_mine.remove(f)
-            # check which ones are still missing
-            if len(missing_mine) > 0:
-                ret[mid] = {"files": [f for f in changes_theirs[mid]["files"] if f in missing_mine]}
+            notmuch_logger.debug("Indexing %s.", f)
+            try:
+                msg, dup = dbw.add(f)
+            except notmuch2.FileNotEmailError:
+                warn_file(f, "is not an email")
+                continue
+            nindexed += 1
+            if not dup:
+                with msg.frozen():
+                    for tag in new_tags:
+                        msg.tags.add(tag)
+    log_file_warnings()
+    return nindexed, nremoved
+
+
+def clone(
+    from_stream: IO[bytes] | None,
+    to_stream: IO[bytes] | None,
+    compression: str = "none",
+    mbsync: bool = False,
+    local_tags: List[str] | None = None
+) -> int:
+    """
+    Bootstrap an empty notmuch database from the other side. The side that has
+    messages streams its entire mail directory as a tar archive and a dump of
+    all tags; the side with the empty database extracts the archive, runs
+    `notmuch new`, and restores the tags. Nothing happens if both databases are
+    empty. Must be run while the notmuch database is not open for writing.
+
+    Args:
+        from_stream: Stream to read from the other side.
+        to_stream: Stream to write to the other side.
+        compression (str): Compression for the tar archive ("none", "gz",
+        "bz2", or "xz"), only used when sending.
+        mbsync: Whether to include mbsync state files.
+        local_tags (list): Prefixes of device-local tags of this side, which
+        are neither sent nor restored.
+
+    Returns:
+        int: Number of files received.
+
+    Raises:
+        ValueError: If both databases have messages.
+    """
+    with notmuch2.Database() as db:
+        prefix = mail_root(db)
+        counts = {"mine": db.count_messages("*")}
+
+    def _send_count():
+        write(json.dumps(counts["mine"]).encode("utf-8"), to_stream)
+
+    def _recv_count():
+        counts["theirs"] = json.loads(read(from_stream).decode("utf-8"))
+
+    run_async(_send_count, _recv_count)
+
+    if counts["mine"] > 0 and counts["theirs"] > 0:
+        raise ValueError("Cloning requires an empty notmuch database on one side, "
+                         f"but local has {counts['mine']} and remote {counts['theirs']} messages, aborting...")
+    if counts["mine"] == 0 and counts["theirs"] == 0:
+        logger.info("Both notmuch databases empty, nothing to clone.")
+        return 0
+    if counts["mine"] == 0 and session["read_only_db"]:
+        raise ReadOnlyError("clone into mail directory", [prefix])
+
+    def _exclude(info: tarfile.TarInfo) -> tarfile.TarInfo | None:
+        name = Path(info.name)
+        if ".notmuch" in name.parts[:1]:
+            return None
+        if not mbsync and name.name in [".uidvalidity", ".mbsyncstate"]:
+            return None
+        return info
+
+    if counts["mine"] > 0:
+        logger.info("Sending %s messages as tar stream...", counts["mine"])
+        mode = "w|" + ("" if compression == "none" else compression)
+        with FrameWriter(to_stream) as fw:
+            with tarfile.open(fileobj=fw, mode=mode) as tar: # type: ignore[call-overload]
+                for f in sorted(Path(prefix).iterdir()):
+                    tar.add(str(f), arcname=f.name, filter=_exclude)
+        logger.info("Sending tags...")
+        try:
+            dump = subprocess.run(["notmuch", "dump"], capture_output=True, check=True).stdout
+        except FileNotFoundError:
+            logger.info("notmuch not found, dumping tags with libnotmuch...")
+            with notmuch2.Database() as db:
+                dump = dump_tags(db)
+        write(dump_without_local_tags(dump, local_tags or []), to_stream)
+        return 0
+
+    logger.info("Receiving %s messages as tar stream...", counts["theirs"])
+    nfiles = 0
+    with FrameReader(from_stream) as fr:
+        with tarfile.open(fileobj=fr, mode="r|*") as tar: # type: ignore[call-overload]
+            for info in tar:
+                if _exclude(info) is None:
+                    continue
+                if info.isfile():
+                    nfiles += 1
+                # permissions and modification times can't be set with --portable
+                if hasattr(tarfile, "data_filter"):
+                    tar.extract(info, prefix, set_attrs=not session["portable"], filter="data")
+                else:
+                    if os.path.isabs(info.name) or ".." in Path(info.name).parts or not (info.isfile() or info.isdir()):
+                        raise ValueError(f"Refusing to extract '{info.name}', aborting...")
+                    tar.extract(info, prefix, set_attrs=not session["portable"])
+    dump = dump_without_local_tags(read(from_stream), local_tags or [])
+    logger.info("Received %s files, running notmuch new...", nfiles)
+    try:
+        subprocess.run(["notmuch", "new"], capture_output=True, check=True)
+    except FileNotFoundError:
+        logger.info("notmuch not found, indexing and restoring tags with libnotmuch...")
+        with open_write_db() as dbw:
+            index_new(dbw, prefix)
+            restore_tags(dbw, dump)
+        return nfiles
+    logger.info("Restoring tags...")
+    subprocess.run(["notmuch", "restore"], input=dump, capture_output=True, check=True)
+    return nfiles
+
+
+def notmuch_new(no_hooks: bool = False) -> None:
+    """
+    Run `notmuch new` to index new mail. Must be run while the notmuch database
+    is not open for writing. If the notmuch CLI isn't installed, new mail is
+    indexed with libnotmuch instead (see index_new), without hooks.
+
+    Args:
+        no_hooks: Do not run the notmuch pre-new and post-new hooks.
+    """
+    cmd = ["notmuch", "new"] + (["--no-hooks"] if no_hooks else [])
+    logger.info("Running %s...", " ".join(cmd))
+    try:
+        res = subprocess.run(cmd, capture_output=True, check=True)
+    except FileNotFoundError:
+        logger.info("notmuch not found, indexing new mail with libnotmuch (without hooks)...")
+        with open_write_db() as dbw:
+            nindexed, nremoved = index_new(dbw, mail_root(dbw))
+        notmuch_logger.debug("Indexed %s files, removed %s from DB.", nindexed, nremoved)
+        return
+    notmuch_logger.debug("%s", res.stdout.decode("utf-8", errors="replace").strip())
+
+
+def snapshot(cmd: str) -> None:
+    """
+    Run the snapshot command, e.g. to create a file system snapshot of the mail
+    directory and notmuch database, before anything is changed. Raises an error
+    if it fails, so that nothing is deleted or moved without a snapshot.
+
+    Args:
+        cmd (str): The snapshot command.
+    """
+    logger.info("Running snapshot command %s...", cmd)
+    res = subprocess.run(shlex.split(cmd), capture_output=True, check=True)
+    logger.debug("%s", res.stdout.decode("utf-8", errors="replace").strip())
+
+
+def new_mail_hook(cmd: str, count: int) -> None:
+    """
+    Run the command given with --new-mail-cmd after a sync that added at least
+    --new-mail-min messages on this side, e.g. to warm notmuch address
+    completion or update other tools that index the mail. The number of new
+    messages is passed in $NOTMUCH_SYNC_NEW_MESSAGES. As the sync itself has
+    succeeded, the command failing only results in a warning.
+
+    Args:
+        cmd (str): The command.
+        count (int): Number of new messages.
+    """
+    logger.info("Running new mail command %s for %s new messages...", cmd, count)
+    try:
+        res = subprocess.run(shlex.split(cmd), env={**os.environ, "NOTMUCH_SYNC_NEW_MESSAGES": str(count)},
+                             capture_output=True, check=True)
+        logger.debug("%s", res.stdout.decode("utf-8", errors="replace").strip())
+    except subprocess.CalledProcessError as e:
+        logger.warning("New mail command %s failed: %s", cmd, e.stderr.decode("utf-8", errors="replace").strip() or e)
+    except OSError as e:
+        logger.warning("New mail command %s failed: %s", cmd, e)
+
+
+def sync_databases(
+    args: argparse.Namespace,
+    from_stream: IO[bytes] | None,
+    to_stream: IO[bytes] | None,
+    local: bool
+) -> Tuple[Tuple[int, ...], str]:
+    """
+    Sync this side's notmuch database with the other side over an established
+    connection, the part of a sync that is the same on both sides: cloning,
+    running notmuch new and the snapshot command before, tags, files,
+    revisions, deletions, and mbsync files, with the undo log of this side
+    (see start_undo). The local side additionally sends its preferences for
+    the session, resolves conflicts, moves files whose tags changed, and
+    evicts messages.
+
+    Args:
+        args: Parsed command-line arguments.
+        from_stream: Stream to read from the other side.
+        to_stream: Stream to write to the other side.
+        local (bool): Whether this is the local side, which started the sync.
+
+    Returns:
+        tuple: Numbers of new messages, new files, files copied/moved, files
+        deleted, messages with tag changes, messages deleted, and duplicate
+        files on this side, and the path of the sync state file.
+    """
+    if args.clone:
+        with context("cloning"):
+            nfiles = clone(from_stream, to_stream, args.clone, args.mbsync, args.local_tags)
+        if nfiles > 0:
+            logger.warning("Cloned %s files from remote.", nfiles)
+    if args.pre_new and not args.dry_run:
+        with context("running notmuch new"):
+            notmuch_new(args.new_no_hooks)
+    if args.snapshot_cmd and not args.dry_run:
+        with context("creating snapshot"):
+            snapshot(args.snapshot_cmd)
+
+    completed = False
+    try:
+        with open_write_db() as dbw:
+            prefix = mail_root(dbw)
+            use_notmuch_dir(dbw)
+            session["sync_flags"] = sync_flags_enabled(dbw)
+            check_read_only(prefix)
+            check_case_insensitive(prefix)
+            if not session["read_only"] and not session["read_only_db"]:
+                clean_partials(prefix, args.dry_run)
+            if not args.dry_run and not session["read_only_db"]:
+                start_undo(prefix)
+            with context("exchanging changes"):
+                prefs = {"policies": read_policies(read_config(args.config)), "local-tags": args.local_tags,
+                         "received-tags": [args.received_tag] if args.received_tag else [],
+                         "ignore-tags": args.ignore_tags, "sync-tags": args.sync_tags, "exclude-tags": exclude_tags(args)}
+                if local:
+                    prefs.update({"digest": args.digest, "encoding": args.encoding, "delta": args.delta, "xattrs": args.xattrs})
+                changes_mine, changes_theirs, tchanges, sync_fname = initial_sync(dbw, prefix, from_stream, to_stream, prefs,
+                                                                                  args.dry_run, args.delete, args.accept_new_uuid,
+                                                                                  args.conflict_cmd if local else None, local and args.review)
+            with context("syncing files"), measure("file transfer"):
+                missing, fchanges, dfchanges = get_missing_files(dbw, prefix, changes_mine, changes_theirs, from_stream, to_stream, move_on_change=local, dry_run=args.dry_run)
+            files_logger.debug("Missing files %s.", missing)
+            with context("transferring files"), measure("file transfer"):
+                rmessages, rfiles, rduplicates = sync_files(dbw, prefix, missing, from_stream, to_stream, args.dry_run, args.min_free * 1024 * 1024,
+                                                            {"reserve": args.min_free * 1024 * 1024, "inodes": args.min_inodes, "wait": args.space_wait})
+            revision = dbw.revision()
+            with context("exchanging revisions"):
+                peer_revision = exchange_revisions(revision, from_stream, to_stream)
+            stats = {"messages": rmessages, "files": rfiles, "moved": fchanges, "deleted_files": dfchanges, "tags": tchanges}
+            if session["deferred"]:
+                logger.info("Not recording sync state, so that files are synced next time.")
+            elif not args.dry_run and not args.strict and not session["read_only_db"]:
+                with context("recording sync state", sync_fname):
+                    record_sync(sync_fname, revision, peer_revision, stats)
+            if local and args.evict_older_than is not None and not session["read_only"] and not session["read_only_db"]:
+                with context("evicting messages"):
+                    nevicted = evict(dbw, prefix, args.evict_older_than, args.dry_run)
+                logger.warning("%s messages evicted.", nevicted)
+
+        dchanges = 0
+        if args.delete and not session["pull_only"]:
+            with context("syncing deletions"), measure("deletes"):
+                if local:
+                    dchanges = sync_deletes_local(prefix, from_stream, to_stream, args.delete_no_check, args.dry_run,
+                                                  args.delete_grace, None if args.force else args.max_delete)
+                else:
+                    dchanges = sync_deletes_remote(prefix, from_stream, to_stream, args.delete_no_check, args.dry_run,
+                                                   args.delete_grace)
+        if args.mbsync and not session["pull_only"]:
+            with context("syncing mbsync files"), measure("mbsync"):
+                if local:
+                    sync_mbsync_local(prefix, from_stream, to_stream, args.dry_run)
+                else:
+                    sync_mbsync_remote(prefix, from_stream, to_stream)
+        if args.strict and not session["deferred"] and not args.dry_run and not session["read_only_db"]:
+            # only once everything has succeeded
+            with context("recording sync state", sync_fname):
+                record_sync(sync_fname, revision, peer_revision, {**stats, "deleted_messages": dchanges})
+        completed = True
+    finally:
+        finish_undo(completed)
 
-            # delete any files that are not there remotely after copy/move
-            if mid not in changes_mine:
-                if len(set(fnames_mine).intersection(fnames_theirs)) == 0:
-                    raise ValueError(f"Message '{mid}' has {fnames_theirs} on remote and different {fnames_mine} locally!")
-                to_delete = set(fnames_mine) - set(fnames_theirs)
-                for f in to_delete:
-                    fname = os.path.join(prefix, f)
-                    dchanges += 1
-                    logger.info("Removing %s from DB and deleting file.", fname)
-                    dbw.remove(fname)
-                    Path(fname).unlink()
-        except LookupError:
-            # don't have this message; all files missing
-            ret[mid] = changes_theirs[mid]
+    count_outcome("tag sync", "success", tchanges)
+    count_outcome("file transfer", "success", rfiles + fchanges + dfchanges)
+    count_outcome("deletes", "success", dchanges)
+    return (rmessages, rfiles, fchanges, dfchanges, tchanges, dchanges, rduplicates), sync_fname
 
-    return (ret, mcchanges, dchanges)
+
+def sync_remote(args: argparse.Namespace) -> None:
+    """
+    Run synchronization in remote mode.
+
+    Args:
+        args: Parsed command-line arguments.
+    """
+    if args.command == "hydrate":
+        with notmuch2.Database(mode=notmuch2.Database.MODE.READ_ONLY) as db, context("hydrating"):
+            use_notmuch_dir(db)
+            hydrate_remote(db, mail_root(db), args.query, sys.stdin.buffer, sys.stdout.buffer)
+        return
+    if args.command == "capabilities":
+        write(json.dumps(capabilities()).encode("utf-8"), sys.stdout.buffer)
+        sys.stdout.buffer.flush()
+        return
+    if args.command == "states":
+        with notmuch2.Database(mode=notmuch2.Database.MODE.READ_ONLY) as db, context("getting sync status"):
+            use_notmuch_dir(db)
+            write(json.dumps(sync_status(db, mail_root(db))).encode("utf-8"), sys.stdout.buffer)
+        sys.stdout.buffer.flush()
+        return
+    if args.command in ("list", "verify"):
+        with notmuch2.Database(mode=notmuch2.Database.MODE.READ_ONLY) as db, context("listing messages"):
+            use_notmuch_dir(db)
+            send_listing(db, mail_root(db), sys.stdout.buffer, args.command == "verify")
+        return
+
+    (rmessages, rfiles, fchanges, dfchanges, tchanges, dchanges, rduplicates), _ = sync_databases(args, sys.stdin.buffer, sys.stdout.buffer, False)
+    if args.dry_run:
+        write(json.dumps(planned).encode("utf-8"), sys.stdout.buffer)
+    if args.post_new and not args.dry_run:
+        with context("running notmuch new"):
+            notmuch_new(args.new_no_hooks)
+    sys.stdout.buffer.write(struct.pack("!IIIIII", tchanges, fchanges, dfchanges,
+                                        rmessages, dchanges, rfiles))
+    if session["duplicate_counts"]:
+        sys.stdout.buffer.write(struct.pack("!I", rduplicates))
+    mine = outcomes.pop("local", {})
+    if session["outcomes"]:
+        write(json.dumps(mine).encode("utf-8"), sys.stdout.buffer)
+    sys.stdout.buffer.flush()
 
 
-def send_file(fname: str, stream: IO[bytes]) -> None:
+def sync_remote_profiles(args: argparse.Namespace) -> None:
     """
-    Send a file's contents to a stream with 4-byte length prefix.
+    Run synchronization in remote mode for several notmuch databases over one
+    connection. Before each one, the other side sends the notmuch profile to
+    sync; an empty frame ends the sync.
 
     Args:
-        fname (str): Path to the file to send.
-        stream: Writable stream.
+        args: Parsed command-line arguments.
     """
-    with open(fname, "rb") as f:
-        write(f.read(), stream)
+    while len(data := read(sys.stdin.buffer)) > 0:
+        profile = json.loads(data.decode("utf-8"))
+        if not isinstance(profile, dict) or not isinstance(profile.get("profile"), str):
+            raise ValueError(f"Invalid profile {profile!r} from other side, aborting...")
+        os.environ["NOTMUCH_PROFILE"] = profile["profile"]
+        planned.clear()
+        with context("syncing profile", profile["profile"]), lock_mail_dir(args.nfs):
+            sync_remote(args)
 
 
-def recv_file(
-    fname: str,
-    stream: IO[bytes],
-    overwrite_raise: bool=True
-) -> None:
+def happy_eyeballs(host: str, port: int = 22, timeout: float = 10) -> str | None:
     """
-    Receive a file with a 4-byte length prefix from a stream and write it to
-    disk, validating its checksum.
+    Resolve both IPv4 and IPv6 addresses of a host and race connections to
+    them (RFC 8305), returning the address that connected first.
 
     Args:
-        fname (str): Destination file path.
-        stream: Readable stream.
-        overwrite_raise: Raise error if existing file would be overwritten.
+        host (str): Host name to connect to.
+        port (int): Port to connect to.
+        timeout (float): Seconds to wait for any connection to succeed.
+
+    Returns:
+        str: The address that connected first, None if no connection could be
+        established (e.g. because the host name is an SSH config alias).
+    """
+    async def _connect():
+        _, writer = await asyncio.wait_for(
+            asyncio.open_connection(host, port, happy_eyeballs_delay=0.25, interleave=1),
+            timeout)
+        addr = writer.get_extra_info("peername")[0]
+        writer.close()
+        return addr
+
+    try:
+        return asyncio.run(_connect())
+    except (OSError, asyncio.TimeoutError) as e:
+        logger.debug("Could not connect to %s port %s: %s", host, port, e)
+        return None
+
+
+def default_config_path() -> str:
+    """
+    Get the path of the configuration file.
+
+    Returns:
+        str: $XDG_CONFIG_HOME/notmuch-sync/config, with XDG_CONFIG_HOME
+        defaulting to ~/.config.
+    """
+    base = os.environ.get("XDG_CONFIG_HOME") or os.path.join(os.path.expanduser("~"), ".config")
+    return os.path.join(base, "notmuch-sync", "config")
+
+
+def read_config(fname: str) -> configparser.ConfigParser:
+    """
+    Read the configuration file, if it exists.
+
+    Args:
+        fname (str): Path to the configuration file.
+
+    Returns:
+        The parsed configuration, empty if the file does not exist.
 
     Raises:
-        ValueError: If file to receive already exists or received file's
-        checksum does not match expected.
+        ConfigError: If the file can't be parsed.
     """
-    content = read(stream)
-    if Path(fname).exists() and overwrite_raise:
-        sha_mine = digest(content)
-        sha_exists = digest(Path(fname).read_bytes())
-        if sha_exists != sha_mine:
-            raise ValueError(f"Receiving '{fname}', but already exists with different content!")
-    Path(fname).parent.mkdir(parents=True, exist_ok=True)
-    with open(fname, "wb") as f:
-        f.write(content)
+    config = configparser.ConfigParser(interpolation=None)
+    try:
+        config.read(fname, encoding="utf-8")
+    except configparser.Error as e:
+        raise ConfigError(f"Invalid configuration file {fname}: {e}") from e
+    return config
 
 
-def sync_files(
-    dbw: notmuch2.Database,
-    prefix: str,
-    missing: Dict[str, Dict[str, Any]],
-    from_stream: IO[bytes] | None,
-    to_stream: IO[bytes] | None
-) -> Tuple[int, int]:
+def srv_lookup(name: str) -> Tuple[str, int] | None:
     """
-    Synchronize files that are missing locally or remotely.
+    Look up the _notmuch-sync._tcp SRV record for a domain and pick the target
+    with the lowest priority and highest weight. Requires the dnspython
+    module.
 
     Args:
-        dbw: An open writable notmuch2.Database object.
-        prefix (str): Prefix path for filenames (notmuch config database.path).
-        missing (dict): Mapping of missing files by message ID.
-        from_stream: Stream to read file names and files from.
-        to_stream: Stream to send file names and files to.
+        name (str): Domain to look up the SRV record for.
 
     Returns:
-        tuple: (number of added messages, number of added files)
+        tuple: (host, port), or None if there is no SRV record.
     """
-    files = {}
-    files["mine"] = [ {"name": f, "id": mid} for mid in missing for f in missing[mid]["files"] ]
-    changes = {"files": len(files["mine"]), "messages": 0}
+    if dns is None:
+        logger.warning("SRV lookup for %s requested, but dnspython module not available.", name)
+        return None
+    try:
+        answers = dns.resolver.resolve(f"_notmuch-sync._tcp.{name}", "SRV")
+    except dns.exception.DNSException as e:
+        logger.debug("No SRV record for %s: %s", name, e)
+        return None
+    rec = sorted(answers, key=lambda r: (r.priority, -r.weight))[0]
+    return (str(rec.target).rstrip("."), rec.port)
 
-    def _send_fnames():
-        logger.info("Sending file names missing on local...")
-        write(json.dumps([f["name"] for f in files["mine"]]).encode("utf-8"), to_stream)
 
-    def _recv_fnames():
-        logger.info("Receiving file names missing on remote...")
-        files["theirs"] = json.loads(read(from_stream).decode("utf-8"))
+def parse_profiles(profiles: str) -> List[Tuple[str, str]]:
+    """
+    Parse the pairs of notmuch profiles to sync, given as e.g. "work
+    personal:home", i.e. separated by whitespace or commas, with LOCAL:REMOTE
+    for a local profile synced with a differently named remote profile.
 
-    run_async(_send_fnames, _recv_fnames)
+    Args:
+        profiles (str): The pairs of profiles.
 
-    logger.info("Missing file names synced.")
+    Returns:
+        list: (local profile, remote profile) tuples.
+    """
+    pairs = []
+    for pair in profiles.replace(",", " ").split():
+        local, _, remote = pair.partition(":")
+        pairs.append((local, remote or local))
+    return pairs
 
-    def _send_files():
-        for idx, fname in enumerate(files["theirs"]):
-            logger.info("%s/%s Sending %s...", idx + 1, len(files["theirs"]),
-                        fname)
-            send_file(os.path.join(prefix, fname), to_stream)
 
-    def _recv_files():
-        for idx, f in enumerate(files["mine"]):
-            logger.info("%s/%s Receiving %s...", idx + 1, len(files["mine"]), f["name"])
-            dst = os.path.join(prefix, f["name"])
-            recv_file(dst, from_stream)
+def network_host(networks: str) -> str | None:
+    """
+    Pick the host to connect to on the network this machine is currently on
+    from pairs of NETWORK=HOST given as e.g. "192.168.1.0/24=192.168.1.2,
+    10.8.0.0/16=mail.vpn", separated by whitespace or commas. This machine is
+    on a network if it would reach it from an address in that network, i.e.
+    the network is directly connected (or through a VPN). Nothing is sent to
+    find out.
 
-        for idx, f in enumerate(files["mine"]):
-            dst = os.path.join(prefix, f["name"])
-            logger.info("Adding %s to DB.", dst)
-            msg, dup = dbw.add(dst)
-            if not dup:
-                changes["messages"] += 1
-                with msg.frozen():
-                    logger.info("Setting tags %s for received %s.",
-                                sorted(missing[f["id"]]["tags"]),
-                                msg.messageid)
-                    msg.tags.clear()
-                    for tag in missing[f["id"]]["tags"]:
-                        msg.tags.add(tag)
+    Args:
+        networks (str): The pairs of networks and hosts.
 
-    run_async(_send_files, _recv_files)
+    Returns:
+        str: The host for the first network this machine is on, None if it
+        isn't on any of them.
+    """
+    for pair in networks.replace(",", " ").split():
+        net, _, host = pair.partition("=")
+        try:
+            network = ipaddress.ip_network(net, strict=False)
+        except ValueError:
+            logger.warning("Ignoring invalid network %s.", net)
+            continue
+        family = socket.AF_INET6 if network.version == 6 else socket.AF_INET
+        try:
+            # connecting a UDP socket only selects the route
+            with socket.socket(family, socket.SOCK_DGRAM) as s:
+                s.connect((str(next(network.hosts(), network.network_address)), 22))
+                local = ipaddress.ip_address(s.getsockname()[0].split("%")[0])
+        except OSError as e:
+            logger.debug("No route to %s: %s", network, e)
+            continue
+        if local in network:
+            logger.info("On network %s, using %s.", network, host)
+            return host
+    return None
 
-    logger.info("Missing files synced.")
 
-    return (changes["messages"], changes["files"])
+def resolve_remote(args: argparse.Namespace, config: configparser.ConfigParser) -> None:
+    """
+    Resolve the remote given on the command line as an alias defined in a
+    "[remote NAME]" section of the configuration file (with keys host, which
+    may list fallback hosts after the first, see failover, hosts-by-network for
+    the host to try first on particular networks, see network_host, user, port,
+    path, ssh-cmd, transport, srv, notmuch-config and profile for the notmuch
+    configuration to use on the remote, snapshot-cmd for the snapshot command
+    to run on the remote, folder-layout for the folder layout of the mail
+    directory on the remote, local-tags for prefixes of device-local tags,
+    received-tag for the tag of messages received from the remote, ignore-tags
+    and sync-tags for patterns of tags (not) to sync, tag-map for tags named
+    differently on the remote, exclude-tag and exclude-tag-mode for the tag of
+    messages kept out of the sync, or profiles for several pairs of databases
+    to sync, see parse_profiles) and/or through its _notmuch-sync._tcp SRV
+    record. Values given on the command line take precedence. Modifies args in
+    place.
 
+    Args:
+        args: Parsed command-line arguments.
+        config: The parsed configuration file.
+    """
+    section = f"remote {args.remote}"
+    srv = args.srv
+    if config.has_section(section):
+        logger.debug("Using configuration for remote %s.", args.remote)
+        sec = config[section]
+        hosts = sec.get("host", args.remote).replace(",", " ").split()
+        if "hosts-by-network" in sec:
+            host = network_host(sec["hosts-by-network"])
+            if host is not None:
+                hosts = [host] + [h for h in hosts if h != host]
+        args.remote = hosts[0]
+        args.fallbacks = hosts[1:]
+        for key, attr in [("user", "user"), ("path", "path"), ("ssh-cmd", "ssh_cmd"), ("transport", "transport"),
+                          ("notmuch-config", "remote_notmuch_config"), ("profile", "remote_profile"),
+                          ("snapshot-cmd", "remote_snapshot_cmd"), ("folder-layout", "remote_folder_layout"),
+                          ("exclude-tag", "exclude_tag"), ("exclude-tag-mode", "exclude_tag_mode")]:
+            if getattr(args, attr) is None and key in sec:
+                setattr(args, attr, sec[key])
+        if args.port is None and "port" in sec:
+            args.port = sec.getint("port")
+        if args.local_tags is None and "local-tags" in sec:
+            args.local_tags = sec["local-tags"].replace(",", " ").split()
+        for key, attr in [("ignore-tags", "ignore_tags"), ("sync-tags", "sync_tags")]:
+            if getattr(args, attr) is None and key in sec:
+                setattr(args, attr, sec[key].replace(",", " ").split())
+        if args.tag_map is None and "tag-map" in sec:
+            args.tag_map = parse_tag_map(sec["tag-map"])
+        if args.folder_map is None and "folder-map" in sec:
+            args.folder_map = parse_folder_map(sec["folder-map"])
+        if args.received_tag is None and "received-tag" in sec:
+            args.received_tag = sec["received-tag"]
+        if args.profile is None and args.remote_profile is None and "profiles" in sec:
+            args.profiles = parse_profiles(sec["profiles"])
+        srv = srv or sec.getboolean("srv", False)
+    if srv:
+        res = srv_lookup(args.remote)
+        if res is not None:
+            logger.info("Resolved %s to %s port %s through SRV record.", args.remote, res[0], res[1])
+            args.remote = res[0]
+            if args.port is None:
+                args.port = res[1]
+
+
+def failover(args: argparse.Namespace) -> None:
+    """
+    Pick the first of the remote's host and its fallback hosts (e.g. a LAN
+    address and then a WAN address) that accepts connections on the SSH port
+    within the timeout of happy_eyeballs. The last host is used without
+    checking, so that SSH reports why it can't be reached. The sync state is
+    kept per UUID of the other side's database, so switching to a standby
+    server with its own database is safe. Modifies args in place.
 
-def get_ids(prefix: str) -> List[str]:
+    Args:
+        args: Parsed command-line arguments.
     """
-    Get all message IDs from the notmuch database, using Xapian directly (much
-    faster).
+    hosts = [args.remote] + args.fallbacks
+    for host, fallback in zip(hosts, hosts[1:]):
+        if happy_eyeballs(host, args.port or 22) is not None:
+            break
+        logger.info("Could not connect to %s, trying %s.", host, fallback)
+    else:
+        host = hosts[-1]
+    if host != args.remote:
+        logger.warning("Syncing with fallback %s.", host)
+    args.remote = host
+    args.fallbacks = []
+
+
+def ssh_command(args: argparse.Namespace) -> List[str]:
+    """
+    Build the SSH command to connect to the remote, without the command to run
+    there.
 
     Args:
-        prefix (str): Prefix path for filenames (notmuch config database.path).
+        args: Parsed command-line arguments.
 
     Returns:
-        list: All message IDs.
+        list: The command.
     """
-    db = xapian.Database(os.path.join(prefix, ".notmuch", "xapian"))
-    message_ids = []
+    host = args.remote
+    ssh_opts = []
+    if args.port is not None:
+        ssh_opts += ["-p", str(args.port)]
+    if args.ssh_control_path:
+        ssh_opts += ["-o", f"ControlPath={args.ssh_control_path}"]
+    if args.happy_eyeballs:
+        addr = happy_eyeballs(args.remote, args.port or 22)
+        if addr is not None:
+            logger.info("Connecting to %s as %s.", args.remote, addr)
+            host = addr
+            ssh_opts += ["-o", f"HostKeyAlias={args.remote}"]
+    return shlex.split(args.ssh_cmd) + ssh_opts + [(f"{args.user}@" if args.user else "") + host]
+
+
+def ssh_master(args: argparse.Namespace) -> None:
+    """
+    Make sure that an SSH master connection for --ssh-control-path is running
+    that this and later syncs reuse, so that they don't need to authenticate
+    again. It is started in the background (with its input and output
+    detached, so that it doesn't hold on to the pipes of any sync) and exits
+    after --ssh-control-persist without being used. If it can't be started,
+    the sync connects without it.
 
-    logger.info("Getting all message IDs from DB...")
-    ghosts = {p.docid for p in db.postlist("Tghost")} # type: ignore[attr-defined]
-    all_docs = set(range(1, db.get_lastdocid() + 1))
-    for doc_id in all_docs - ghosts:
+    Args:
+        args: Parsed command-line arguments.
+    """
+    ssh = ssh_command(args)
+    # options have to come before the host
+    if subprocess.run(ssh[:-1] + ["-O", "check", ssh[-1]], capture_output=True, check=False).returncode == 0:
+        logger.info("Reusing SSH connection to %s.", args.remote)
+        return
+    logger.info("Starting SSH master connection to %s...", args.remote)
+    res = subprocess.run(ssh[:-1] + ["-o", "ControlMaster=yes", "-o", f"ControlPersist={args.ssh_control_persist}", "-f", "-N", ssh[-1]],
+                         stdin=subprocess.DEVNULL, stdout=subprocess.DEVNULL, stderr=subprocess.DEVNULL, check=False)
+    if res.returncode != 0:
+        logger.warning("Could not start SSH master connection to %s, connecting without it.", args.remote)
+
+
+class NativeSSH:
+    """
+    Connection to the remote with the SSH client of the paramiko module
+    (--transport native-ssh) instead of the ssh command, e.g. where OpenSSH
+    isn't installed. Authenticates with the SSH agent or the default keys and
+    only accepts host keys in known_hosts. Runs the command on the remote with
+    the same interface as a subprocess.Popen with pipes: stdin, stdout, and
+    stderr streams, where stderr is a pipe so that it can be polled with
+    select, and usable as a context manager.
+    """
+
+    def __init__(self, args: argparse.Namespace, command: str):
+        if paramiko is None:
+            raise ValueError("--transport native-ssh requires the paramiko module")
+        self.client = paramiko.SSHClient()
+        self.client.load_system_host_keys()
+        self.client.set_missing_host_key_policy(paramiko.RejectPolicy())
         try:
-            doc = db.get_document(doc_id)
-            value = doc.get_value(1)
-            if value:
-                message_ids.append(value.decode("utf-8"))
-        except xapian.DocNotFoundError:
+            self.client.connect(args.remote, port=args.port or 22, username=args.user, timeout=SSH_TIMEOUT,
+                                banner_timeout=SSH_TIMEOUT, auth_timeout=SSH_TIMEOUT)
+        except paramiko.SSHException as e:
+            self.client.close()
+            raise ConnectionError(f"SSH connection to {args.remote} failed: {e}") from e
+        self.client.get_transport().set_keepalive(SSH_KEEPALIVE)
+        self.stdin, self.stdout, _ = self.client.exec_command(command)
+        self.channel = self.stdout.channel
+        rfd, wfd = os.pipe()
+        self.stderr = os.fdopen(rfd, "rb")
+        self.copier = threading.Thread(target=self._copy_stderr, args=(wfd,), daemon=True)
+        self.copier.start()
+
+    def _copy_stderr(self, fd: int) -> None:
+        try:
+            with os.fdopen(fd, "wb") as f:
+                while data := self.channel.recv_stderr(65536):
+                    f.write(data)
+                    f.flush()
+        except OSError:
+            # stderr has been closed on this side
             pass
-        except RuntimeError:
-            # not entirely sure why, but this seems to happen sometimes
-            continue
 
-    db.close()
+    def __enter__(self) -> "NativeSSH":
+        return self
 
-    return message_ids
+    def __exit__(self, *exc: Any) -> None:
+        for stream in (self.stdin, self.stdout, self.stderr):
+            if stream is not None:
+                stream.close()
+        self.client.close()
+        self.copier.join()
 
 
-# Separate methods for local and remote to avoid sending all IDs both ways --
-# have local figure out what needs to be deleted on both sides
-def sync_deletes_local(
-    prefix: str,
-    from_stream: IO[bytes] | None,
-    to_stream: IO[bytes] | None,
-    no_check: bool = False
-) -> int:
+def connect_remote(args: argparse.Namespace, stdin: bool = True) -> subprocess.Popen | NativeSSH:
     """
-    Synchronize deletions for the local database and instruct remote to delete
-    messages/files as needed.
+    Start the remote side over the transport selected with --transport.
 
     Args:
-        prefix (str): Prefix path for filenames (notmuch config database.path).
-        from_stream: Stream to read from the remote.
-        to_stream: Stream to write to the remote.
-        no_check: Delete message not present on other side even if it doesn't
-        have the 'deleted' tag.
+        args: Parsed command-line arguments.
+        stdin (bool): Whether to send anything to the remote, otherwise its
+        input is closed.
 
     Returns:
-        int: Number of deletions performed.
+        The process or native SSH connection, with stdin (None if not
+        requested), stdout, and stderr streams.
     """
-    ids = {}
-    dels = {'a': 0}
+    if args.transport == "native-ssh" and not args.remote_cmd:
+        protocol_logger.debug("Command to run on remote: %s", remote_args(args))
+        conn = NativeSSH(args, " ".join(remote_args(args)))
+        if not stdin:
+            conn.stdin.close()
+            conn.stdin = None
+        return conn
+    cmd = remote_command(args)
+    protocol_logger.debug("Command to connect to remote: %s", cmd)
+    return subprocess.Popen(cmd, stdin=subprocess.PIPE if stdin else subprocess.DEVNULL,
+                            stdout=subprocess.PIPE, stderr=subprocess.PIPE)
+
+
+def bootstrap(args: argparse.Namespace) -> None:
+    """
+    Check whether notmuch-sync can be run on the remote and if not, install
+    this script there over SSH. Installed copies are kept in BOOTSTRAP_DIR by
+    machine architecture and Python version of the remote (so that e.g. a home
+    directory shared by different machines works) and SHA256 checksum of the
+    script. A copy is only run if its checksum on the remote matches, else it is
+    uploaded again, and only installed if the checksum of the upload matches.
+    Copies of other versions of the script for the same architecture and Python
+    version are removed. Modifies args.path in place to point to the installed
+    script. The remote still needs Python and the notmuch2 and xapian modules.
 
-    def _get_ids():
-        ids["mine"] = get_ids(prefix)
+    Args:
+        args: Parsed command-line arguments.
 
-    def _recv_ids():
-        logger.info("Receiving all message IDs from remote...")
-        ids["theirs"] = json.loads(read(from_stream).decode("utf-8"))
+    Raises:
+        ValueError: If the architecture and Python version of the remote can't
+        be determined or the checksum of the uploaded script doesn't match.
+    """
+    ssh = ssh_command(args)
+    # exit code 127 is "command not found"
+    if subprocess.run(ssh + [args.path, "--version"], capture_output=True, check=False).returncode != 127:
+        return
 
-    run_async(_get_ids, _recv_ids)
+    res = subprocess.run(ssh + ["uname -m && python3 -c 'import sys; print(\"%s.%s\" % sys.version_info[:2])'"],
+                         capture_output=True, check=False)
+    platform_id = res.stdout.decode("utf-8", errors="replace").split()
+    if (res.returncode != 0 or len(platform_id) != 2 or
+            not all(c.isalnum() or c in "._-" for c in "".join(platform_id))):
+        raise ValueError("Could not determine architecture and Python version of remote to install notmuch-sync, aborting...")
+    src = Path(__file__).read_bytes()
+    if not src.startswith(b"#!"):
+        src = b"#!/usr/bin/env python3\n" + src
+    checksum = hashlib.sha256(src).hexdigest()
+    folder = f"{BOOTSTRAP_DIR}/{platform_id[0]}-python{platform_id[1]}"
+    path = f"{folder}/notmuch-sync-{checksum[:16]}"
+
+    def _remote_checksum(fname: str) -> str:
+        # sha256sum isn't available everywhere (e.g. macOS)
+        res = subprocess.run(ssh + [f"sha256sum {fname} 2>/dev/null || shasum -a 256 {fname}"], capture_output=True, check=False)
+        return res.stdout.decode("utf-8", errors="replace").split(" ")[0]
+
+    if _remote_checksum(path) == checksum:
+        logger.info("Using notmuch-sync installed earlier at %s on remote.", path)
+        args.path = path
+        return
 
-    logger.info("Message IDs synced.")
+    logger.warning("%s not found on remote, installing to %s.", args.path, path)
+    tmp = path + ".new"
+    subprocess.run(ssh + [f"mkdir -p {folder} && cat > {tmp}"],
+                   input=src, capture_output=True, check=True)
+    # only install what arrived intact, e.g. not a script truncated by a
+    # dropped connection
+    if _remote_checksum(tmp) != checksum:
+        subprocess.run(ssh + [f"rm -f {tmp}"], capture_output=True, check=False)
+        raise ValueError(f"Checksum of notmuch-sync uploaded to {path} on remote does not match, aborting...")
+    subprocess.run(ssh + [f"chmod +x {tmp} && mv {tmp} {path} && "
+                          f"find {folder} -name 'notmuch-sync-*' ! -name {os.path.basename(path)} -delete"],
+                   capture_output=True, check=True)
+    args.path = path
+
+
+def remote_command(args: argparse.Namespace) -> List[str]:
+    """
+    Build the command to run the remote side, forwarding all relevant flags.
 
-    def _send_del_ids():
-        to_del_remote = list(set(ids["theirs"]) - set(ids["mine"]))
-        logger.debug("Remote IDs to be deleted %s.", to_del_remote)
-        logger.info("Sending message IDs to be deleted to remote...")
-        write(json.dumps(to_del_remote).encode("utf-8"), to_stream)
+    Args:
+        args: Parsed command-line arguments.
 
-    def _recv_del_ids():
-        to_del = set(ids["mine"]) - set(ids["theirs"])
-        logger.debug("Local IDs to be deleted %s.", to_del)
-        with notmuch2.Database(mode=notmuch2.Database.MODE.READ_WRITE) as dbw:
-            for mid in to_del:
-                try:
-                    msg = dbw.find(mid)
-                    if msg.ghost:
-                        continue
-                    if "deleted" in msg.tags or no_check:
-                        dels["a"] += 1
-                        logger.info("Removing %s from DB and deleting files.", mid)
-                        for f in msg.filenames():
-                            logger.debug("Removing %s.", f)
-                            dbw.remove(f)
-                            Path(f).unlink()
-                    else:
-                        # not there on remote, but no "deleted" tag -- assume
-                        # that something went wrong and set tags again to make
-                        # it show up in next changeset to be synced back to
-                        # remote
-                        logger.info("%s set to be removed, but not tagged 'deleted'!", mid)
-                        with msg.frozen():
-                            tmp = "".join(msg.tags)
-                            msg.tags.add(tmp)
-                            msg.tags.discard(tmp)
-                except LookupError:
-                    # already deleted? doesn't matter
-                    pass
+    Returns:
+        list: The command.
+    """
+    if args.remote_cmd:
+        return shlex.split(args.remote_cmd)
+    return ssh_command(args) + remote_args(args)
 
-    run_async(_send_del_ids, _recv_del_ids)
 
-    return dels["a"]
+def remote_args(args: argparse.Namespace) -> List[str]:
+    """
+    Build the command line of notmuch-sync on the remote, forwarding all
+    relevant flags. Arguments are quoted for the remote shell.
 
+    Args:
+        args: Parsed command-line arguments.
 
-def sync_deletes_remote(
-    prefix: str,
-    from_stream: IO[bytes] | None,
-    to_stream: IO[bytes] | None,
-    no_check: bool = False
-) -> int:
+    Returns:
+        list: The command line.
     """
-    Receive instructions from local to delete messages/files from the remote database.
+    rargs = [f"{args.path}"]
+    if args.delete:
+        rargs.append("--delete")
+    if args.delete_no_check:
+        rargs.append("--delete-no-check")
+    if args.delete_grace is not None:
+        rargs.append(f"--delete-grace={args.delete_grace // 3600}h")
+    if args.mbsync:
+        rargs.append("--mbsync")
+    if args.dry_run:
+        rargs.append("--dry-run")
+    if args.min_free:
+        rargs.append(f"--min-free={args.min_free}")
+    if args.clone:
+        rargs.append(f"--clone={args.clone}")
+    if args.min_inodes:
+        rargs.append(f"--min-inodes={args.min_inodes}")
+    if args.space_wait:
+        rargs.append(f"--space-wait={args.space_wait}")
+    if args.pre_new:
+        rargs.append("--pre-new")
+    if args.post_new:
+        rargs.append("--post-new")
+    if args.new_no_hooks:
+        rargs.append("--new-no-hooks")
+    if args.accept_new_uuid:
+        rargs.append("--accept-new-uuid")
+    if args.nfs:
+        rargs.append("--nfs")
+    if args.portable:
+        rargs.append("--portable")
+    if args.no_fsync:
+        rargs.append("--no-fsync")
+    if args.strict:
+        rargs.append("--strict")
+    if args.order != "newest":
+        rargs.append(f"--order={args.order}")
+    # ssh runs the command through the remote shell
+    if args.mail_dirs != ["cur", "new"]:
+        rargs.append(f"--mail-dirs={shlex.quote(','.join(args.mail_dirs))}")
+    if args.remote_notmuch_config:
+        rargs.append(f"--notmuch-config={shlex.quote(args.remote_notmuch_config)}")
+    if args.remote_profile:
+        rargs.append(f"--profile={shlex.quote(args.remote_profile)}")
+    if args.remote_folder_layout:
+        rargs.append(f"--folder-layout={shlex.quote(args.remote_folder_layout)}")
+    if args.remote_snapshot_cmd:
+        rargs.append(f"--snapshot-cmd={shlex.quote(args.remote_snapshot_cmd)}")
+    if args.crash_report_url:
+        rargs.append(f"--crash-report-url={shlex.quote(args.crash_report_url)}")
+    if args.profiles:
+        rargs.append("--multi")
+    if args.command == "hydrate":
+        rargs += ["hydrate", shlex.quote(args.query)]
+    elif args.command == "diff":
+        rargs.append("list")
+    elif args.command == "verify":
+        rargs.append("verify")
+    elif args.command == "capabilities":
+        rargs.append("capabilities")
+    elif args.command == "status":
+        rargs.append("states")
+    return rargs
+
+
+def sync_pair(args: argparse.Namespace, from_remote: IO[bytes] | None, to_remote: IO[bytes] | None) -> Tuple[Tuple[int, ...], Tuple[int, ...]]:
+    """
+    Sync one pair of notmuch databases over an established connection to the
+    remote.
 
     Args:
-        prefix (str): Prefix path for filenames (notmuch config database.path).
-        from_stream: Stream to read from the local.
-        to_stream: Stream to write to the local.
-        no_check: Delete message not present on other side even if it doesn't
-        have the 'deleted' tag.
+        args: Parsed command-line arguments.
+        from_remote: Stream to read from the remote.
+        to_remote: Stream to write to the remote.
+
+    Returns:
+        tuple: Numbers of new messages, new files, files copied/moved, files
+        deleted, messages with tag changes, messages deleted, and duplicate
+        files on this side (see sync_databases), and the numbers sent by the
+        remote.
+    """
+    # phases are counted over all profiles
+    before = copy.deepcopy(phases)
+    changes, sync_fname = sync_databases(args, from_remote, to_remote, True)
+    if args.dry_run:
+        planned_remote = json.loads(read(from_remote).decode("utf-8"))
+        sys.stdout.write(format_plan(planned, "local"))
+        sys.stdout.write(format_plan(planned_remote, "remote"))
+        sys.stdout.flush()
+
+    logger.info("Getting change numbers from remote...")
+    if from_remote is not None:
+        data = from_remote.read(6 * 4)
+        trace_frame("received", data, raw=True)
+        remote_changes = struct.unpack("!IIIIII", data)
+        transfer["read"] += 6 * 4
+        if session["duplicate_counts"]:
+            data = from_remote.read(4)
+            trace_frame("received", data, raw=True)
+            remote_changes += struct.unpack("!I", data)
+            transfer["read"] += 4
+        else:
+            remote_changes += (0,)
+        if session["outcomes"]:
+            recv_outcomes(from_remote)
+    else:
+        remote_changes = (0,0,0,0,0,0,0)
+
+    if args.post_new and not args.dry_run:
+        with context("running notmuch new"):
+            notmuch_new(args.new_no_hooks)
+
+    if not args.dry_run and not session["read_only_db"]:
+        current = {phase: {key: stats[key] - before.get(phase, {}).get(key, 0) for key in stats}
+                   for phase, stats in phases.items() if stats != before.get(phase)}
+        with context("recording phase statistics", sync_fname + "-stats"):
+            track_phases(sync_fname + "-stats", current)
+
+    return changes, remote_changes
+
+
+def activity_path() -> str:
+    """
+    Get the path of the unix socket a running sync streams its activity on:
+    in $XDG_RUNTIME_DIR if set, in the cache directory otherwise.
+
+    Returns:
+        str: The path of the socket.
+    """
+    runtime = os.environ.get("XDG_RUNTIME_DIR")
+    if not runtime:
+        runtime = os.environ.get("XDG_CACHE_HOME", os.path.join(os.path.expanduser("~"), ".cache"))
+    return os.path.join(runtime, "notmuch-sync", "activity")
+
+
+class JSONFormatter(logging.Formatter):
+    """
+    Log formatter that formats each record as a line of JSON with the time,
+    level, message, the phase of the sync if any, the statistics of the sync
+    for the final summary, and the traceback if any, for log collectors.
+    """
+
+    def format(self, record: logging.LogRecord) -> str:
+        entry = {"time": time.strftime("%Y-%m-%dT%H:%M:%S%z", time.localtime(record.created)),
+                 "level": record.levelname.lower(), "message": record.getMessage()}
+        if trace["phase"] is not None:
+            entry["phase"] = trace["phase"]
+        if hasattr(record, "stats"):
+            entry["stats"] = record.stats
+        if record.exc_info:
+            entry["traceback"] = self.formatException(record.exc_info)
+        return json.dumps(entry)
+
+
+class ScopeFilter(logging.Filter):
+    """
+    Log filter that passes records at or above a level, and all records of the
+    loggers of the scopes given with --log-scope (see LOG_SCOPES).
+    """
+
+    def __init__(self, level: int, scopes: List[str]):
+        super().__init__()
+        self.level = level
+        self.names = {f"{__name__}.{scope}" for scope in scopes}
+
+    def filter(self, record: logging.LogRecord) -> bool:
+        return record.levelno >= self.level or record.name in self.names
+
+
+def configure_logging(args: argparse.Namespace) -> None:
+    """
+    Set up logging on the local side: log to stderr, or the file given with
+    --log-file, at the level given by --verbose and --quiet in the format given
+    by --log-format, and everything for the scopes given with --log-scope.
+    Everything is logged at INFO level or above regardless, so that it can be
+    tailed (see ActivityHandler).
 
-    Returns:
-        int: Number of deletions performed.
+    Args:
+        args: Parsed command-line arguments.
+    """
+    if args.verbose == 1:
+        level = logging.INFO
+    elif args.verbose == 2:
+        level = logging.DEBUG
+    else:
+        level = logging.WARNING
+    scopes = args.log_scope
+    if args.quiet:
+        level = logging.CRITICAL + 1
+        scopes = []
+    root = logging.getLogger()
+    if args.log_file:
+        for handler in list(root.handlers):
+            root.removeHandler(handler)
+        root.addHandler(logging.FileHandler(os.path.expanduser(args.log_file), encoding="utf-8"))
+    for handler in root.handlers:
+        handler.setLevel(logging.DEBUG if scopes else level)
+        for f in [f for f in handler.filters if isinstance(f, ScopeFilter)]:
+            handler.removeFilter(f)
+        if scopes:
+            handler.addFilter(ScopeFilter(level, scopes))
+        if args.log_format == "json":
+            handler.setFormatter(JSONFormatter())
+        elif args.log_file:
+            handler.setFormatter(logging.Formatter("[{asctime}] {message}", style="{"))
+    logger.setLevel(level=min(level, logging.INFO))
+    for scope in LOG_SCOPES:
+        logging.getLogger(f"{__name__}.{scope}").setLevel(logging.DEBUG if scope in scopes else logging.NOTSET)
+
+
+class ActivityHandler(logging.Handler):
+    """
+    Log handler that streams the log records of a running sync to clients
+    connected to a unix socket (see tail) at INFO level, regardless of the
+    verbosity on stderr. New clients get the last ACTIVITY_BACKLOG records
+    first. Clients that don't keep up are disconnected rather than slowing
+    down the sync.
     """
-    dels = 0
-    ids = get_ids(prefix)
-    write(json.dumps(ids).encode("utf-8"), to_stream)
 
-    to_del = json.loads(read(from_stream).decode("utf-8"))
-    with notmuch2.Database(mode=notmuch2.Database.MODE.READ_WRITE) as dbw:
-        for mid in to_del:
+    def __init__(self, path: str):
+        super().__init__(logging.INFO)
+        self.setFormatter(logging.Formatter("[{asctime}] {message}", style="{"))
+        self.path = path
+        self.clients: List[socket.socket] = []
+        self.backlog: collections.deque = collections.deque(maxlen=ACTIVITY_BACKLOG)
+        # not the lock of logging.Handler, which is held while emitting
+        self.clients_lock = threading.Lock()
+        Path(path).parent.mkdir(mode=0o700, parents=True, exist_ok=True)
+        with socket.socket(socket.AF_UNIX, socket.SOCK_STREAM) as probe:
             try:
-                msg = dbw.find(mid)
-                if msg.ghost:
-                    continue
-                if "deleted" in msg.tags or no_check:
-                    dels += 1
-                    for f in msg.filenames():
-                        dbw.remove(f)
-                        Path(f).unlink()
-                else:
-                    # not on local, but no "deleted" tag -- assume that
-                    # something went wrong and set tags again to make it
-                    # show up in next changeset to be synced back to local
-                    with msg.frozen():
-                        tmp = "".join(msg.tags)
-                        msg.tags.add(tmp)
-                        msg.tags.discard(tmp)
-            except LookupError:
-                # already deleted? doesn't matter
-                pass
-    return dels
-
-
-def sync_mbsync_local(
-    prefix: str,
-    from_stream: IO[bytes] | None,
-    to_stream: IO[bytes] | None
-) -> None:
+                probe.connect(path)
+                raise OSError(errno.EADDRINUSE, "another sync is already running", path)
+            except (FileNotFoundError, ConnectionRefusedError):
+                # left behind by a sync that didn't finish cleanly
+                with contextlib.suppress(FileNotFoundError):
+                    os.unlink(path)
+        self.sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+        self.sock.bind(path)
+        os.chmod(path, 0o600)
+        self.sock.listen()
+        threading.Thread(target=self._accept, daemon=True).start()
+
+    def _accept(self) -> None:
+        while True:
+            try:
+                conn, _ = self.sock.accept()
+            except OSError:
+                return
+            conn.setblocking(False)
+            with self.clients_lock:
+                try:
+                    conn.sendall(b"".join(self.backlog))
+                    self.clients.append(conn)
+                except OSError:
+                    conn.close()
+
+    def emit(self, record: logging.LogRecord) -> None:
+        line = (self.format(record) + "\n").encode("utf-8", errors="replace")
+        with self.clients_lock:
+            self.backlog.append(line)
+            for conn in list(self.clients):
+                try:
+                    conn.sendall(line)
+                except OSError:
+                    self.clients.remove(conn)
+                    conn.close()
+
+    def close(self) -> None:
+        self.sock.close()
+        with contextlib.suppress(FileNotFoundError):
+            os.unlink(self.path)
+        with self.clients_lock:
+            for conn in self.clients:
+                conn.close()
+            self.clients = []
+        super().close()
+
+
+@contextlib.contextmanager
+def serve_activity(path: str) -> Iterator[None]:
     """
-    Synchronize local mbsync files with remote.
+    Context manager that streams the activity of this side on a unix socket
+    (see ActivityHandler) while it is active. If the socket can't be set up,
+    e.g. because another sync is running, the sync goes ahead without it.
 
     Args:
-        prefix (str): Prefix path for filenames (notmuch config database.path).
-        from_stream: Stream to read from the remote.
-        to_stream: Stream to write to the remote.
+        path (str): Path of the socket, see activity_path.
     """
-    mbsync = {}
+    handler = None
+    try:
+        handler = ActivityHandler(path)
+        logger.addHandler(handler)
+    except OSError as e:
+        logger.debug("Not streaming activity on %s: %s", path, e)
+    try:
+        yield
+    finally:
+        if handler is not None:
+            logger.removeHandler(handler)
+            handler.close()
 
-    def _get_mbsync():
-        logger.info("Getting local mbsync file stats...")
-        mbsync["mine"] = { str(f).removeprefix(prefix): f.stat().st_mtime
-                           for pat in [".uidvalidity", ".mbsyncstate"]
-                           for f in Path(prefix).rglob(pat) }
 
-    def _recv_mbsync():
-        logger.info("Receiving mbsync file stats from remote...")
-        mbsync["theirs"] = json.loads(read(from_stream).decode("utf-8"))
+@contextlib.contextmanager
+def tracing(fname: str | None, payload: bool = False) -> Iterator[None]:
+    """
+    Context manager that records all frames exchanged with the other side to a
+    file while it is active (see trace_frame), after a line of JSON with the
+    version and command-line arguments that replay uses.
 
-    run_async(_get_mbsync, _recv_mbsync)
+    Args:
+        fname (str): Path of the trace file, None to not record anything.
+        payload (bool): Whether to record the data of the frames as well.
+    """
+    if fname is None:
+        yield
+        return
+    with open(fname, "w", encoding="utf-8") as f:
+        f.write(json.dumps({"version": VERSION, "protocol": PROTOCOL, "payload": payload, "argv": sys.argv[1:]}) + "\n")
+        trace["file"] = f
+        trace["payload"] = payload
+        try:
+            yield
+        finally:
+            trace["file"] = None
 
-    logger.info("mbsync file stats synced.")
 
-    pull = [ f for f in mbsync["mine"].keys()
-            if (f in mbsync["theirs"] and mbsync["theirs"][f] > mbsync["mine"][f]) ]
-    pull += list(set(mbsync["theirs"].keys()) - set(mbsync["mine"].keys()))
-    logger.debug("Local mbsync files to be updated from remote %s.", pull)
-    write(json.dumps(pull).encode("utf-8"), to_stream)
+def replay(fname: str) -> None:
+    """
+    Run a sync recorded with --trace-file and --trace-payload again on this
+    side, with the same arguments, with the data received from the other side
+    read from the trace instead. What this side sends is discarded. This
+    changes the local notmuch database and mail directory like the recorded
+    sync, so it is meant to be run on a copy to reproduce problems.
 
-    def _send_mbsync_files():
-        push = [ f for f in mbsync["theirs"].keys()
-                if (f in mbsync["mine"] and mbsync["mine"][f] > mbsync["theirs"][f]) ]
-        push += list(set(mbsync["mine"].keys()) - set(mbsync["theirs"].keys()))
+    Args:
+        fname (str): Path of the trace file.
 
-        logger.debug("mbsync files to update on remote %s.", push)
-        logger.info("Sending %s mbsync files to remote...", len(push))
-        write(json.dumps(push).encode("utf-8"), to_stream)
-        for idx, f in enumerate(push):
-            logger.debug("%s/%s Sending mbsync file %s to remote...", idx + 1,
-                         len(push), f)
-            to_stream.write(struct.pack("!d", mbsync["mine"][f]))
-            to_stream.flush()
-            transfer["write"] += 8
-            send_file(os.path.join(prefix, f), to_stream)
+    Raises:
+        ValueError: If the trace doesn't have the data of the frames, or isn't
+        of a sync of a single database.
+    """
+    with open(fname, "r", encoding="utf-8") as f:
+        header = json.loads(f.readline())
+        entries = [json.loads(line) for line in f]
+    if not header.get("payload"):
+        raise ValueError(f"Trace {fname} was recorded without --trace-payload, can't replay it")
+    args = parse_args(header["argv"])
+    if args.command is not None or args.profiles:
+        raise ValueError(f"Trace {fname} isn't of a sync of a single database, can't replay it")
+    if header["version"] != VERSION:
+        logger.warning("Trace recorded with version %s, replaying with version %s.", header["version"], VERSION)
+    # the snapshot would be of the real mail directory, not the copy
+    args.snapshot_cmd = None
+
+    received = [entry for entry in entries if entry["dir"] == "received"]
+    stream = io.BytesIO()
+    for entry in received:
+        data = base64.b64decode(entry["data"])
+        if not entry.get("raw"):
+            stream.write(struct.pack("!I", len(data)))
+        stream.write(data)
+    stream.seek(0)
+    logger.info("Replaying %s frames received from %s...", len(received), args.remote)
+    sync_pair(args, stream, io.BytesIO())
+    if stream.tell() < len(stream.getbuffer()):
+        logger.warning("Replay finished without reading all recorded data.")
+
+
+def trace_stream(entries: List[Dict[str, Any]], direction: str) -> Tuple[Dict[str, Any], IO[bytes]]:
+    """
+    Get the session parameters one side sent in a trace recorded with
+    --trace-payload (see tracing), and what it sent after them as a stream.
 
-    def _recv_mbsync_files():
-        logger.info("Receiving %s mbsync files from remote...", len(pull))
-        for idx, f in enumerate(pull):
-            logger.debug("%s/%s Receiving mbsync file %s from remote...",
-                         idx + 1, len(pull), f)
-            mtime_data = from_stream.read(8)
-            transfer["read"] += 8
-            mtime = struct.unpack("!d", mtime_data)[0]
-            fname = os.path.join(prefix, f)
-            recv_file(fname, from_stream, overwrite_raise=False)
-            os.utime(fname, (mtime, mtime))
+    Args:
+        entries (list): The frames of the trace.
+        direction (str): "sent" for this side, "received" for the remote.
 
-    run_async(_send_mbsync_files, _recv_mbsync_files)
+    Returns:
+        tuple: (session parameters, stream of the following frames).
 
-    logger.info("mbsync files synced.")
+    Raises:
+        ValueError: If the trace ends before the session parameters.
+    """
+    data = [base64.b64decode(entry["data"]) for entry in entries if entry["dir"] == direction and not entry.get("raw")]
+    if not data:
+        raise ValueError("Trace ends before the session parameters were exchanged, can't reproduce it")
+    return json.loads(data[0].decode("utf-8")), io.BytesIO(b"".join(struct.pack("!I", len(d)) + d for d in data[1:]))
 
 
-def sync_mbsync_remote(
-    prefix: str,
-    from_stream: IO[bytes] | None,
-    to_stream: IO[bytes] | None
-) -> None:
+def repro(fname: str, out: str) -> None:
     """
-    Synchronize remote mbsync files with local.
+    Create a reproduction of a sync recorded with --trace-file and
+    --trace-payload that can be shared without sharing any mail: a pair of
+    mail directories with the messages, files, and tags of the changes of both
+    sides in the trace with made-up contents, and a script that indexes them
+    and syncs them with the same options. Message IDs, folder and file names
+    (except for maildir flags and mbsync UIDs), and tags other than REPRO_TAGS
+    are replaced by salted hashes, so that they can't be recovered. Only the
+    changes exchanged at the start of the sync are reproduced, not e.g. mbsync
+    state files, so not every failure can be reproduced this way.
 
     Args:
-        prefix (str): Prefix path for filenames (notmuch config database.path).
-        from_stream: Stream to read from the remote.
-        to_stream: Stream to write to the remote.
-    """
-    mbsync = { str(f).removeprefix(prefix): f.stat().st_mtime
-               for pat in [".uidvalidity", ".mbsyncstate"]
-               for f in Path(prefix).rglob(pat) }
-    write(json.dumps(mbsync).encode("utf-8"), to_stream)
-    push = json.loads(read(from_stream).decode("utf-8"))
+        fname (str): Path of the trace file.
+        out (str): Directory to create the reproduction in, must not exist.
 
-    def _send_mbsync_files():
-        for f in push:
-            fname = os.path.join(prefix, f)
-            to_stream.write(struct.pack("!d", Path(fname).stat().st_mtime))
-            to_stream.flush()
-            transfer["write"] += 8
-            send_file(fname, to_stream)
+    Raises:
+        ValueError: If the trace doesn't have the data of the frames, isn't of
+        a sync of a single database, or ends before the changes.
+    """
+    with open(fname, "r", encoding="utf-8") as f:
+        header = json.loads(f.readline())
+        entries = [json.loads(line) for line in f]
+    if not header.get("payload"):
+        raise ValueError(f"Trace {fname} was recorded without --trace-payload, can't reproduce it")
+    args = parse_args(header["argv"])
+    if args.command is not None or args.profiles or args.clone:
+        raise ValueError(f"Trace {fname} isn't of a sync of a single database, can't reproduce it")
+
+    hello_mine, sent = trace_stream(entries, "sent")
+    hello_theirs, received = trace_stream(entries, "received")
+    # the changes are encoded as negotiated, see send_changes
+    session.update(negotiate(hello_mine, hello_theirs))
+    try:
+        changes_mine = recv_changes(sent)
+        changes_theirs = recv_changes(received)
+    except EOFError as e:
+        raise ValueError("Trace ends before the changes were exchanged, can't reproduce it") from e
+
+    salt = os.urandom(16)
+
+    def _hash(s: str) -> str:
+        return hashlib.sha256(salt + s.encode("utf-8")).hexdigest()
+
+    def _fname(f: str) -> str:
+        parts = Path(f).parts
+        base, flags = maildir_flags(parts[-1])
+        uid = mbsync_uid(parts[-1])
+        name = _hash(base)[:16] + (f",U={uid}" if uid is not None else "") + (f":2,{flags}" if flags is not None else "")
+        return str(Path(*[p if p in ("cur", "new", "tmp") else "f" + _hash(p)[:8] for p in parts[:-1]], name))
+
+    Path(out).mkdir(parents=True)
+    for side, changes in [("local", changes_mine), ("remote", changes_theirs)]:
+        Path(out, side).mkdir()
+        tags = []
+        for mid, change in changes.items():
+            smid = f"{_hash(mid)[:16]}@repro.invalid"
+            for f in change["files"]:
+                dst = Path(out, side, _fname(f))
+                dst.parent.mkdir(parents=True, exist_ok=True)
+                dst.write_text(f"From: repro@example.invalid\nTo: repro@example.invalid\nSubject: {smid}\n"
+                               f"Date: Mon, 01 Jan 2024 00:00:00 +0000\nMessage-ID: <{smid}>\n\n"
+                               "Made-up contents.\n", encoding="utf-8")
+            if change["files"] and change["tags"]:
+                stags = sorted(t if t in REPRO_TAGS else "tag-" + _hash(t)[:8] for t in change["tags"])
+                tags.append(" ".join(f"+{t}" for t in stags) + f" -- id:{smid}\n")
+        Path(out, f"{side}.tags").write_text("".join(tags), encoding="utf-8")
+
+    flags = [flag for flag, on in [("--delete", args.delete), ("--delete-no-check", args.delete_no_check),
+                                   ("--mbsync", args.mbsync), ("--dry-run", args.dry_run),
+                                   ("--accept-new-uuid", args.accept_new_uuid)] if on]
+    local_flags = flags + [flag for flag, on in [("--delta", args.delta), ("--xattrs", args.xattrs)] if on]
+    local_flags += [f"--encoding={args.encoding}", f"--digest={args.digest}"]
+    script = Path(out, "repro.sh")
+    script.write_text(f"""#!/bin/sh
+# Reproduction of a sync with notmuch-sync {header['version']}, created with
+# notmuch-sync repro. All message IDs, names, tags, and contents are made up.
+set -e
+cd "$(dirname "$0")"
+for side in local remote; do
+    printf '[database]\\npath=%s\\n[new]\\ntags=\\n' "$PWD/$side" > "$side.config"
+    NOTMUCH_CONFIG="$PWD/$side.config" notmuch new --quiet
+    NOTMUCH_CONFIG="$PWD/$side.config" notmuch tag --batch --input="$side.tags"
+done
+NOTMUCH_CONFIG="$PWD/local.config" notmuch-sync -vv {' '.join(local_flags)} \\
+    --remote-cmd "env NOTMUCH_CONFIG='$PWD/remote.config' notmuch-sync {' '.join(flags)}"
+""", encoding="utf-8")
+    script.chmod(0o755)
+    logger.warning("Created reproduction with %s local and %s remote messages in %s, run %s to reproduce.",
+                   len(changes_mine), len(changes_theirs), out, script)
+
+
+def tail(path: str, out: IO[bytes]) -> None:
+    """
+    Stream the activity of a running sync on this machine (see
+    ActivityHandler) until it finishes.
 
-    def _recv_mbsync_files():
-        pull = json.loads(read(from_stream).decode("utf-8"))
-        for f in pull:
-            mtime_data = from_stream.read(8)
-            transfer["read"] += 8
-            mtime = struct.unpack("!d", mtime_data)[0]
-            fname = os.path.join(prefix, f)
-            recv_file(fname, from_stream, overwrite_raise=False)
-            os.utime(fname, (mtime, mtime))
+    Args:
+        path (str): Path of the socket, see activity_path.
+        out: Stream to write the activity to.
 
-    run_async(_send_mbsync_files, _recv_mbsync_files)
+    Raises:
+        OSError: If no sync is running.
+    """
+    with socket.socket(socket.AF_UNIX, socket.SOCK_STREAM) as sock:
+        try:
+            sock.connect(path)
+        except (FileNotFoundError, ConnectionRefusedError) as e:
+            raise OSError(e.errno, "no sync is running", path) from e
+        while data := sock.recv(65536):
+            out.write(data)
+            out.flush()
 
 
-def sync_remote(args: argparse.Namespace) -> None:
+def repair(args: argparse.Namespace) -> None:
     """
-    Run synchronization in remote mode.
+    Reconcile the local database with the files on disk, see repair_db.
 
     Args:
         args: Parsed command-line arguments.
     """
-    with notmuch2.Database(mode=notmuch2.Database.MODE.READ_WRITE) as dbw:
-        prefix = os.path.join(str(dbw.default_path()), '')
-        changes_mine, changes_theirs, tchanges, sync_fname = initial_sync(dbw, prefix, sys.stdin.buffer, sys.stdout.buffer)
-        missing, fchanges, dfchanges = get_missing_files(dbw, prefix, changes_mine, changes_theirs, sys.stdin.buffer, sys.stdout.buffer, move_on_change=False)
-        rmessages, rfiles = sync_files(dbw, prefix, missing, sys.stdin.buffer, sys.stdout.buffer)
-        record_sync(sync_fname, dbw.revision())
+    with open_write_db() as dbw:
+        prefix = mail_root(dbw)
+        use_notmuch_dir(dbw)
+        with context("repairing"):
+            nremoved, nindexed, nlost, ndiffer = repair_db(dbw, prefix, args.dry_run)
+    logger.warning("%s files removed from DB,\t%s files indexed,\t%s messages without files,\t%s messages with differing files",
+                   nremoved, nindexed, nlost, ndiffer)
 
-    dchanges = 0
-    if args.delete:
-        dchanges = sync_deletes_remote(prefix, sys.stdin.buffer, sys.stdout.buffer, args.delete_no_check)
-    if args.mbsync:
-        sync_mbsync_remote(prefix, sys.stdin.buffer, sys.stdout.buffer)
-    sys.stdout.buffer.write(struct.pack("!IIIIII", tchanges, fchanges, dfchanges,
-                                        rmessages, dchanges, rfiles))
-    sys.stdout.buffer.flush()
 
+def undo(args: argparse.Namespace) -> None:
+    """
+    Undo the destructive changes of the last sync on this side, see
+    undo_changes. If the last sync was interrupted, its changes up to that
+    point are undone.
+
+    Args:
+        args: Parsed command-line arguments.
 
-def sync_local(args: argparse.Namespace) -> None:
+    Raises:
+        ValueError: If there is nothing to undo.
+    """
+    with open_write_db() as dbw:
+        prefix = mail_root(dbw)
+        use_notmuch_dir(dbw)
+        session["sync_flags"] = sync_flags_enabled(dbw)
+        paths = [p for p in [state_path(prefix, "notmuch-sync-undo.new"), state_path(prefix, "notmuch-sync-undo")]
+                 if os.path.exists(os.path.join(p, "log"))]
+        if not paths:
+            raise ValueError("No changes of a sync to undo.")
+        with context("undoing", paths[0]):
+            nundone = undo_changes(dbw, prefix, paths[0], args.dry_run)
+        if not args.dry_run:
+            shutil.rmtree(paths[0])
+    logger.warning("%s changes undone.", nundone)
+
+
+def sync_local(args: argparse.Namespace) -> Tuple[Tuple[int, ...], Tuple[int, ...]]:
     """
     Run synchronization in local mode, communicating with the remote over SSH or
     a custom command.
 
     Args:
         args: Parsed command-line arguments.
+
+    Returns:
+        tuple: Numbers of new messages, new files, files copied/moved, files
+        deleted, messages with tag changes, and messages deleted on this side
+        and on the remote, summed over all profiles.
     """
-    if args.remote_cmd:
-        cmd = shlex.split(args.remote_cmd)
-    else:
-        rargs = [(f"{args.user}@" if args.user else "") + args.remote, f"{args.path}"]
-        if args.delete:
-            rargs.append("--delete")
-        if args.delete_no_check:
-            rargs.append("--delete-no-check")
-        if args.mbsync:
-            rargs.append("--mbsync")
-        cmd = shlex.split(args.ssh_cmd) + rargs
+    if args.fallbacks and not args.remote_cmd:
+        failover(args)
+    if args.ssh_control_path and not args.remote_cmd:
+        ssh_master(args)
+    if args.bootstrap and not args.remote_cmd:
+        bootstrap(args)
 
     logger.info("Connecting to remote...")
-    logger.debug("Command to connect to remote: %s", cmd)
-
-    with subprocess.Popen(
-                cmd,
-                stdin=subprocess.PIPE,
-                stdout=subprocess.PIPE,
-                stderr=subprocess.PIPE
-            ) as proc:
+
+    with connect_remote(args) as proc:
         to_remote = proc.stdin
         from_remote = proc.stdout
         err_remote = proc.stderr
 
         data = b''
         try:
-            with notmuch2.Database(mode=notmuch2.Database.MODE.READ_WRITE) as dbw:
-                prefix = os.path.join(str(dbw.default_path()), '')
-                changes_mine, changes_theirs, tchanges, sync_fname = initial_sync(dbw, prefix, from_remote, to_remote)
-                missing, fchanges, dfchanges = get_missing_files(dbw, prefix, changes_mine, changes_theirs, from_remote, to_remote, move_on_change=True)
-                logger.debug("Missing files %s.", missing)
-                rmessages, rfiles = sync_files(dbw, prefix, missing, from_remote, to_remote)
-                record_sync(sync_fname, dbw.revision())
-
-            dchanges = 0
-            if args.delete:
-                dchanges = sync_deletes_local(prefix, from_remote, to_remote, args.delete_no_check)
-            if args.mbsync:
-                sync_mbsync_local(prefix, from_remote, to_remote)
-
-            logger.info("Getting change numbers from remote...")
-            if from_remote is not None:
-                remote_changes = struct.unpack("!IIIIII", from_remote.read(6 * 4))
-                transfer["read"] += 6 * 4
+            if args.command == "hydrate":
+                with open_write_db() as dbw:
+                    prefix = mail_root(dbw)
+                    use_notmuch_dir(dbw)
+                    if not writable(prefix):
+                        raise OSError(errno.EROFS, "mail directory is on a read-only file system, try again once it is writable", prefix)
+                    clean_partials(prefix, args.dry_run)
+                    check_case_insensitive(prefix)
+                    with context("hydrating"):
+                        rmessages, rfiles, rduplicates = hydrate_local(dbw, prefix, from_remote, to_remote, args.min_free * 1024 * 1024,
+                                                                       {"reserve": args.min_free * 1024 * 1024, "inodes": args.min_inodes, "wait": args.space_wait})
             else:
-                remote_changes = (0,0,0,0,0,0)
+                pairs = args.profiles or [(None, None)]
+                results = []
+                for local_profile, remote_profile in pairs:
+                    if local_profile is None:
+                        with lock_mail_dir(args.nfs):
+                            results.append(sync_pair(args, from_remote, to_remote))
+                        continue
+                    logger.info("Syncing profile %s with remote profile %s...", local_profile, remote_profile)
+                    os.environ["NOTMUCH_PROFILE"] = local_profile
+                    write(json.dumps({"profile": remote_profile}).encode("utf-8"), to_remote)
+                    planned.clear()
+                    with context("syncing profile", local_profile), lock_mail_dir(args.nfs):
+                        results.append(sync_pair(args, from_remote, to_remote))
+                if args.profiles:
+                    # no more profiles to sync
+                    write(b"", to_remote)
         finally:
             ready, _, exc = select([err_remote], [], [], 0)
             if err_remote is not None and ready and not exc:
@@ -880,48 +6675,669 @@ def sync_local(args: argparse.Namespace) -> None:
                 from_remote.close()
             if err_remote is not None:
                 err_remote.close()
-
-    logger.warning("local:  %s new messages,\t%s new files,\t%s files copied/moved,\t%s files deleted,\t%s messages with tag changes,\t%s messages deleted", rmessages, rfiles, fchanges, dfchanges, tchanges, dchanges)
-    logger.warning("remote: %s new messages,\t%s new files,\t%s files copied/moved,\t%s files deleted,\t%s messages with tag changes,\t%s messages deleted", remote_changes[3], remote_changes[5], remote_changes[1], remote_changes[2], remote_changes[0], remote_changes[4])
-    logger.warning("%s/%s bytes received from/sent to remote.", transfer["read"], transfer["write"])
+            if len(data) > 0 and sys.exc_info()[0] is not None:
+                # this side failed because the remote did, e.g. because the
+                # connection was closed
+                raise RemoteError("remote failed")
+
+    if args.command == "hydrate":
+        logger.warning("local:  %s new messages,\t%s new files,\t%s duplicate files", rmessages, rfiles, rduplicates)
+        totals = ((rmessages, rfiles, 0, 0, 0, 0, rduplicates), (0, 0, 0, 0, 0, 0, 0))
+    else:
+        totals = ((0, 0, 0, 0, 0, 0, 0), (0, 0, 0, 0, 0, 0, 0))
+        for (local_profile, remote_profile), (changes, remote_changes) in zip(pairs, results):
+            if local_profile is not None:
+                logger.warning("Profile %s with remote profile %s:", local_profile, remote_profile)
+            logger.warning("local:  %s new messages,\t%s new files,\t%s files copied/moved,\t%s files deleted,\t%s messages with tag changes,\t%s messages deleted,\t%s duplicate files", *changes)
+            remote_changes = tuple(remote_changes[i] for i in (3, 5, 1, 2, 0, 4, 6))
+            logger.warning("remote: %s new messages,\t%s new files,\t%s files copied/moved,\t%s files deleted,\t%s messages with tag changes,\t%s messages deleted,\t%s duplicate files", *remote_changes)
+            totals = (tuple(map(sum, zip(totals[0], changes))), tuple(map(sum, zip(totals[1], remote_changes))))
+        for side in ["local", "remote"]:
+            for phase, counts in sorted(outcomes.get(side, {}).items()):
+                if counts["failed"] > 0 or counts["skipped"] > 0:
+                    logger.warning("%-7s %s: %s synced,\t%s failed,\t%s skipped", side + ":", phase,
+                                   counts["success"], counts["failed"], counts["skipped"])
+    logger.warning("%s/%s bytes received from/sent to remote.", transfer["read"], transfer["write"],
+                   extra={"stats": {"transfer": transfer, "phases": phases, "outcomes": outcomes}})
+    for phase, stats in phases.items():
+        logger.info("%s: %.2f s,\t%s/%s bytes received/sent", phase, stats["seconds"], stats["read"], stats["write"])
 
     if len(data) > 0:
         # error output from remote
-        sys.exit(1)
+        sys.exit(EXIT_REMOTE)
+    return totals
 
 
-def main() -> None:
+def sync_retrying(args: argparse.Namespace) -> Tuple[Tuple[int, ...], Tuple[int, ...]]:
     """
-    Entry point for the command-line interface. Parses arguments and dispatches
-    to local or remote sync.
+    Run sync_local, and again up to --retries times if the connection to the
+    remote failed or was lost, waiting --retry-delay seconds before the first
+    retry and twice as long before each further one. This is safe, as an
+    interrupted sync doesn't record the sync state and leaves no partial files
+    behind, so the next attempt picks up everything that wasn't synced yet.
+
+    Args:
+        args: Parsed command-line arguments.
+
+    Returns:
+        tuple: Numbers of changes on this side and the remote, see sync_local.
+    """
+    attempt = 0
+    while True:
+        try:
+            return sync_local(args)
+        except Exception as e:
+            if attempt >= args.retries or exit_code(e) != EXIT_TRANSPORT:
+                raise
+            delay = args.retry_delay * 2 ** attempt
+            attempt += 1
+            logger.warning("%s, retrying in %s seconds (%s of %s)...", format_error(e), delay, attempt, args.retries)
+            time.sleep(delay)
+            planned.clear()
+            outcomes.clear()
+
+
+def format_summary(totals: Tuple[Tuple[int, ...], Tuple[int, ...]]) -> str:
+    """
+    Format the numbers of changes of a sync (see sync_local) for a
+    notification, leaving out anything that didn't change.
+
+    Args:
+        totals (tuple): Numbers of changes on this side and the remote.
+
+    Returns:
+        str: One line for each side with changes, empty if nothing changed.
+    """
+    names = ["new messages", "new files", "files copied/moved", "files deleted", "messages with tag changes", "messages deleted",
+             "duplicate files"]
+    lines = []
+    for side, changes in zip(["local", "remote"], totals):
+        parts = [f"{n} {name}" for n, name in zip(changes, names) if n > 0]
+        if parts:
+            lines.append(f"{side}: {', '.join(parts)}")
+    return "\n".join(lines)
+
+
+def notify(args: argparse.Namespace, totals: Tuple[Tuple[int, ...], Tuple[int, ...]] | None,
+           error: BaseException | None = None) -> None:
+    """
+    Notify about a sync that changed something or failed: on the desktop with
+    notify-send if --notify is given (ringing the terminal bell if notify-send
+    isn't available and stderr is a terminal), and by posting the summary as
+    JSON to the URL given with --notify-url. Problems with notifying are only
+    logged.
+
+    Args:
+        args: Parsed command-line arguments.
+        totals (tuple): Numbers of changes on this side and the remote, see
+        sync_local, None if the sync failed.
+        error: The error the sync failed with, if known.
+    """
+    remote = args.remote or args.remote_cmd or "remote"
+    if totals is None:
+        title = f"Sync with {remote} failed"
+        body = format_error(error) if error is not None else "see the log for details"
+    else:
+        title = f"Synced with {remote}"
+        body = format_summary(totals)
+        if not body:
+            return
+    if args.notify:
+        if shutil.which("notify-send"):
+            try:
+                subprocess.run(["notify-send", "--app-name=notmuch-sync", title, body], check=True, timeout=10)
+            except (OSError, subprocess.SubprocessError) as e:
+                logger.warning("Could not show notification: %s", e)
+        elif sys.stderr.isatty():
+            sys.stderr.write("\a")
+            sys.stderr.flush()
+    if args.notify_url:
+        summary = {"remote": remote, "success": totals is not None, "title": title, "summary": body}
+        if totals is not None:
+            summary["changes"] = {"local": totals[0], "remote": totals[1]}
+        req = urllib.request.Request(args.notify_url, data=json.dumps(summary).encode("utf-8"),
+                                     headers={"Content-Type": "application/json"}, method="POST")
+        try:
+            with urllib.request.urlopen(req, timeout=30):
+                pass
+        except (OSError, ValueError) as e:
+            logger.warning("Could not post notification to %s: %s", args.notify_url, e)
+
+
+def write_metrics(fname: str, success: bool, totals: Tuple[Tuple[int, ...], Tuple[int, ...]] | None = None) -> None:
+    """
+    Update the metrics in a node_exporter textfile after a sync: count the
+    sync, whether it failed, the messages and bytes it transferred, and the
+    time of the last successful sync. Counters are carried over from the
+    metrics already in the file. The file is replaced atomically, so that
+    node_exporter never reads a partial file.
+
+    Args:
+        fname (str): Path of the metrics file, should end in .prom.
+        success (bool): Whether the sync succeeded.
+        totals (tuple): Numbers of changes on this side and the remote, see
+        sync_local, None if the sync failed.
+    """
+    values = {name: 0 for name, _, _ in METRICS}
+    with contextlib.suppress(FileNotFoundError):
+        for line in Path(fname).read_text(encoding="utf-8").splitlines():
+            fields = line.split()
+            if len(fields) == 2 and fields[0] in values:
+                with contextlib.suppress(ValueError):
+                    values[fields[0]] = int(float(fields[1]))
+    values["notmuch_sync_syncs_total"] += 1
+    if totals is not None:
+        values["notmuch_sync_messages_transferred_total"] += totals[0][0] + totals[1][0]
+    values["notmuch_sync_received_bytes_total"] += transfer["read"]
+    values["notmuch_sync_sent_bytes_total"] += transfer["write"]
+    if success:
+        values["notmuch_sync_last_success_timestamp_seconds"] = int(time.time())
+    else:
+        values["notmuch_sync_failures_total"] += 1
+    out = "".join(f"# HELP {name} {desc}\n# TYPE {name} {kind}\n{name} {values[name]}\n" for name, kind, desc in METRICS)
+    # not a .prom file, so that node_exporter ignores it
+    tmp = f"{fname}.{os.getpid()}.tmp"
+    Path(tmp).write_text(out, encoding="utf-8")
+    os.replace(tmp, fname)
+
+
+def parse_limit(limit: str) -> Tuple[float, bool]:
+    """
+    Parse a limit like "100" or "10%".
+
+    Args:
+        limit (str): Number, optionally followed by "%".
+
+    Returns:
+        tuple: The number and whether it is a percentage.
+    """
+    try:
+        value = float(limit.removesuffix("%"))
+    except ValueError as e:
+        raise argparse.ArgumentTypeError(f"invalid limit '{limit}', expected e.g. 100 or 10%") from e
+    if value < 0:
+        raise argparse.ArgumentTypeError(f"invalid limit '{limit}', must not be negative")
+    return (value, limit.endswith("%"))
+
+
+def parse_age(age: str) -> int:
+    """
+    Parse an age like "1y", "6m", "2w", "30d", or "12h".
+
+    Args:
+        age (str): Number followed by a unit.
+
+    Returns:
+        int: The age in seconds.
+    """
+    units = {"h": 3600, "d": 86400, "w": 7 * 86400, "m": 30 * 86400, "y": 365 * 86400}
+    try:
+        return int(age[:-1]) * units[age[-1]]
+    except (ValueError, KeyError, IndexError) as e:
+        raise argparse.ArgumentTypeError(f"invalid age '{age}', expected e.g. 1y, 6m, 2w, 30d, or 12h") from e
+
+
+def log_scopes(scopes: str) -> List[str]:
+    """
+    Parse a comma-separated list of scopes to log everything for, see
+    LOG_SCOPES.
+
+    Args:
+        scopes (str): The scopes, e.g. "protocol,files".
+
+    Returns:
+        list: The scopes.
+    """
+    ret = [scope.strip() for scope in scopes.split(",") if scope.strip()]
+    for scope in ret:
+        if scope not in LOG_SCOPES:
+            raise argparse.ArgumentTypeError(f"invalid log scope '{scope}', expected any of {', '.join(LOG_SCOPES)}")
+    return ret
+
+
+def completion(shell: str, parser: argparse.ArgumentParser, config: configparser.ConfigParser) -> str:
+    """
+    Generate a completion script for a shell that completes commands, flags,
+    the values of flags with choices, and the remote aliases defined in the
+    configuration file for --remote.
+
+    Args:
+        shell (str): One of SHELLS.
+        parser: Parser for command-line arguments, see build_parser.
+        config: Configuration with remote aliases, see read_config.
+
+    Returns:
+        str: The script.
+    """
+    aliases = sorted(s[len("remote "):] for s in config.sections() if s.startswith("remote "))
+    options = [a for a in parser._actions if a.option_strings]
+
+    def _values(action: argparse.Action) -> List[str]:
+        if action.choices:
+            return [str(c) for c in action.choices]
+        return aliases if "--remote" in action.option_strings else []
+
+    def _describe(action: argparse.Action) -> str:
+        # only the first part of the help
+        desc = (action.help or "").replace("%%", "%").split(" (")[0].split(";")[0]
+        return desc if len(desc) <= 60 else desc[:60].rsplit(" ", 1)[0] + "..."
+
+    flags = [o for a in options for o in a.option_strings]
+    if shell == "bash":
+        lines = ["_notmuch_sync() {",
+                 '    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"',
+                 '    case "$prev" in']
+        # without values, fall back to file names
+        lines += [f'        {"|".join(a.option_strings)}) COMPREPLY=($(compgen -W "{" ".join(_values(a))}" -- "$cur")); return;;'
+                  for a in options if a.nargs != 0]
+        lines += ["    esac",
+                  '    if [[ "$cur" == -* ]]; then',
+                  f'        COMPREPLY=($(compgen -W "{" ".join(flags)}" -- "$cur"))',
+                  "    else",
+                  f'        COMPREPLY=($(compgen -W "{" ".join(COMMANDS)}" -- "$cur"))',
+                  "    fi",
+                  "}",
+                  "complete -o default -F _notmuch_sync notmuch-sync"]
+    elif shell == "zsh":
+        def _quote(s: str) -> str:
+            return s.replace("'", "'\\''")
+
+        specs = []
+        for a in options:
+            desc = _describe(a).replace("[", "\\[").replace("]", "\\]")
+            value = ""
+            if a.nargs != 0:
+                values = _values(a)
+                what = f"({' '.join(values)})" if values else "_hosts" if "--remote" in a.option_strings else "_files"
+                value = (":" if a.nargs == "?" else "") + f":{(a.metavar or a.dest).lower()}:{what}"
+            specs += [f"'{_quote(o + '[' + desc + ']' + value)}'" for o in a.option_strings]
+        specs += [f"'1:command:({' '.join(COMMANDS)})'", "'*:argument:_files'"]
+        lines = ["#compdef notmuch-sync", "",
+                 "_notmuch_sync() {",
+                 "    _arguments -s \\"]
+        lines += [f"        {spec} \\" for spec in specs[:-1]] + [f"        {specs[-1]}"]
+        lines += ["}", "",
+                  'if [[ "${zsh_eval_context[-1]}" == loadautofunc ]]; then',
+                  '    _notmuch_sync "$@"',
+                  "else",
+                  "    compdef _notmuch_sync notmuch-sync",
+                  "fi"]
+    elif shell == "fish":
+        def _quote(s: str) -> str:
+            return "'" + s.replace("\\", "\\\\").replace("'", "\\'") + "'"
+
+        lines = ["complete -c notmuch-sync -f",
+                 f"complete -c notmuch-sync -n __fish_use_subcommand -a {_quote(' '.join(COMMANDS))}"]
+        for a in options:
+            parts = ["complete -c notmuch-sync"]
+            for o in a.option_strings:
+                parts.append(f"-l {o[2:]}" if o.startswith("--") else f"-s {o[1:]}")
+            if a.nargs != 0:
+                values = _values(a)
+                parts.append(f"-x -a {_quote(' '.join(values))}" if values else "-r -F")
+            parts.append(f"-d {_quote(_describe(a))}")
+            lines.append(" ".join(parts))
+    else:
+        raise ValueError(f"Unknown shell '{shell}' for completion, use one of {', '.join(SHELLS)}.")
+    return "\n".join(lines) + "\n"
+
+
+class ArgumentParser(argparse.ArgumentParser):
+    """
+    Parser for command-line arguments that exits with EXIT_USAGE on invalid
+    arguments instead of argparse's 2, which is EXIT_TRANSPORT here.
+    """
+
+    def error(self, message: str) -> NoReturn:
+        self.print_usage(sys.stderr)
+        self.exit(EXIT_USAGE, f"{self.prog}: error: {message}\n")
+
+
+def build_parser() -> argparse.ArgumentParser:
     """
-    parser = argparse.ArgumentParser()
-    parser.add_argument("-r", "--remote", type=str, help="remote host to connect to")
+    Build the parser for command-line arguments, see parse_args.
+
+    Returns:
+        The parser.
+    """
+    parser = ArgumentParser()
+    parser.add_argument("command", nargs="*", metavar="COMMAND", help="'sync' syncs with the remote given with -r (the default with -r or --remote-cmd); 'serve' runs the remote side of a sync on stdin/stdout, as started over SSH (the default without -r); 'clone [COMPRESSION]' is the same as sync with --clone; instead of syncing, 'hydrate QUERY' fetches the files of messages matching the notmuch QUERY on the remote that are missing locally, e.g. because they have been evicted; 'diff' reports differences in messages, files, and tags between two remotes given with -r without changing anything; 'verify' reports differences in messages, tags, files, and file contents between this side and the remote without changing anything; 'repair' removes files that no longer exist from the local notmuch database and indexes files that are missing from it (use --dry-run to only report); 'undo' restores the files deleted, moves back the files moved, and restores the tags changed by the last sync on this side (run it there for the remote); 'status' shows when this side last synced with each other side and how many messages have changed here since, and with -r also how many have changed on the remote (connecting to it, but without syncing), e.g. for a status bar; 'capabilities' shows what this side and the remote support (wire protocol, digests, encodings, features, and compressions) to debug syncs between different versions or implementations; 'replay FILE' runs a sync recorded with --trace-file and --trace-payload again on this side with the data received from the remote taken from FILE, to reproduce problems (changes the local notmuch database like the recorded sync, use on a copy); 'repro FILE DIR' creates a pair of mail directories with made-up contents, names, and tags, and a script to sync them, in DIR from a trace recorded with --trace-file and --trace-payload, to share a reproduction of a problem without sharing any mail; 'tail' shows what a sync running on this machine is doing until it finishes; 'completion SHELL' prints a completion script for bash, zsh, or fish, including the remote aliases in the configuration file")
+    parser.add_argument("-r", "--remote", type=str, action="append", help="remote host to connect to (twice for diff)")
     parser.add_argument("-u", "--user", type=str, help="SSH user to use")
-    parser.add_argument("-v", "--verbose", action="count", default=0, help="increases verbosity, up to twice (ignored on remote)")
+    parser.add_argument("-v", "--verbose", action="count", default=0, help="increases verbosity, up to twice: once for the progress of each phase of the sync and the time and bytes transferred in each phase, twice for every file and message as well (ignored on remote)")
     parser.add_argument("-q", "--quiet", action="store_true", help="do not print any output, overrides --verbose")
-    parser.add_argument("-s", "--ssh-cmd", type=str, default="ssh -CTaxq", help="SSH command to use (default 'ssh -CTaxq')")
+    parser.add_argument("--log-format", type=str, choices=["text", "json"], default="text", help="format of log messages, 'json' for one JSON object with time, level, message, and phase of the sync per line (default 'text', ignored on remote)")
+    parser.add_argument("--log-scope", type=log_scopes, default=[], metavar="SCOPE,...", help=f"log all details of the given comma-separated scopes regardless of --verbose: {', '.join(LOG_SCOPES)} (protocol frames and negotiation, decisions about files, changes to the notmuch database; ignored on remote)")
+    parser.add_argument("--log-file", type=str, metavar="FILE", help="append log messages to FILE instead of printing them to stderr (ignored on remote)")
+    parser.add_argument("-s", "--ssh-cmd", type=str, help="SSH command to use (default 'ssh -CTaxq')")
+    parser.add_argument("-P", "--port", type=int, help="SSH port to connect to")
+    parser.add_argument("--srv", action="store_true", help="look up host and port of the remote through its _notmuch-sync._tcp SRV record (requires dnspython module)")
+    parser.add_argument("--config", type=str, default=default_config_path(), help="configuration file with remote aliases (default '$XDG_CONFIG_HOME/notmuch-sync/config')")
+    parser.add_argument("--notmuch-config", type=str, metavar="FILE", help="notmuch configuration file to use on this side (default $NOTMUCH_CONFIG or the notmuch default)")
+    parser.add_argument("--profile", type=str, metavar="NAME", help="notmuch profile to use on this side (default $NOTMUCH_PROFILE)")
+    parser.add_argument("--remote-notmuch-config", type=str, metavar="FILE", help="notmuch configuration file to use on the remote")
+    parser.add_argument("--remote-profile", type=str, metavar="NAME", help="notmuch profile to use on the remote")
+    parser.add_argument("--multi", action="store_true", help="sync several notmuch databases in turn, with the profile for each selected by the other side (used on the remote with profiles configured for a remote)")
     parser.add_argument("-m", "--mbsync", action="store_true", help="sync mbsync files (.mbsyncstate, .uidvalidity)")
-    parser.add_argument("-p", "--path", type=str, default=os.path.basename(sys.argv[0]), help="path to notmuch-sync on remote server")
+    parser.add_argument("-p", "--path", type=str, help="path to notmuch-sync on remote server")
+    parser.add_argument("--bootstrap", action="store_true", help=f"if notmuch-sync isn't found on the remote, install this script to {BOOTSTRAP_DIR} there, keeping a copy for each architecture and Python version (requires Python and the notmuch2 and xapian modules on the remote)")
+    parser.add_argument("--ssh-control-path", type=str, metavar="PATH", help="reuse one SSH connection to the remote for this and later syncs through a master connection with this control socket (e.g. '~/.ssh/notmuch-sync-%%r@%%h:%%p', see ControlPath in ssh_config(5)), so that they don't need to authenticate again")
+    parser.add_argument("--ssh-control-persist", type=str, default="10m", metavar="TIME", help="how long the SSH master connection of --ssh-control-path stays open without being used (default '10m', see ControlPersist in ssh_config(5))")
+    parser.add_argument("--local-tags", type=lambda s: s.replace(",", " ").split(), metavar="PREFIX,...", help="never sync tags that start with any of these comma-separated prefixes (e.g. 'todo-laptop'), on either side: they are neither sent nor changed by the sync")
+    parser.add_argument("--transport", type=str, choices=["ssh", "native-ssh"], help="how to connect to the remote: run the ssh command (default 'ssh') or use the built-in SSH client with key or agent authentication and known_hosts verification ('native-ssh', requires paramiko module, e.g. where OpenSSH isn't installed; ignores --ssh-cmd)")
+    parser.add_argument("--ignore-tags", type=lambda s: s.replace(",", " ").split(), metavar="PATTERN,...", help="never sync tags that match any of these comma-separated shell patterns (e.g. 'draft,calendar::*'), on either side, like --local-tags")
+    parser.add_argument("--sync-tags", type=lambda s: s.replace(",", " ").split(), metavar="PATTERN,...", help="only sync tags that match any of these comma-separated shell patterns, on either side; other tags are neither sent nor changed by the sync")
+    parser.add_argument("--tag-map", type=parse_tag_map, metavar="LOCAL=REMOTE,...", help="sync tag LOCAL on this side as tag REMOTE on the remote (e.g. 'todo=TODO'), for each comma-separated pair; only give this on one side")
+    parser.add_argument("--exclude-tag", type=str, metavar="TAG", help="keep the files of messages with TAG (e.g. 'nosync') on either side out of the sync: they are neither transferred, copied, moved, nor deleted, including with --delete")
+    parser.add_argument("--exclude-tag-mode", type=str, choices=["files", "all"], help="'files' (default) still syncs the tags of messages with --exclude-tag, 'all' doesn't")
+    parser.add_argument("--received-tag", type=str, metavar="TAG", help="add TAG (e.g. 'from-server') to messages added on this side by the sync, to tell them apart from locally delivered mail; it is never synced, like --local-tags")
+    parser.add_argument("--happy-eyeballs", action="store_true", help="resolve IPv4 and IPv6 addresses of the remote host, race connections to the SSH port, and connect to the address that responds first")
     parser.add_argument("-c", "--remote-cmd", type=str, help="command to run to sync; overrides --remote, --user, --ssh-cmd, --path; mostly used for testing")
     parser.add_argument("-d", "--delete", action="store_true", help="sync deleted messages (requires listing all messages in notmuch database, potentially expensive)")
     parser.add_argument("-x", "--delete-no-check", action="store_true", help="delete missing messages even if they don't have the 'deleted' tag (requires --delete) -- potentially unsafe")
-    args = parser.parse_args()
+    parser.add_argument("--delete-grace", type=parse_age, metavar="AGE", help="only delete messages that have been missing on the other side for at least AGE (e.g. 7d, see --evict-older-than), counted from the first sync that found them missing (requires --delete)")
+    parser.add_argument("--max-delete", type=parse_limit, metavar="N", help="with --delete, don't delete anything if more than N messages (or N%% of the messages, e.g. '10%%') would be deleted on either side, e.g. because the notmuch database on one side is empty")
+    parser.add_argument("--force", action="store_true", help="delete even if more than --max-delete messages would be deleted")
+    parser.add_argument("--conflict-cmd", type=str, help="command to resolve messages with different tags or files that have been changed on both sides; gets a JSON description of each conflict on stdin and outputs the resolution as JSON (see README)")
+    parser.add_argument("--snapshot-cmd", type=str, help="command to run on this side before anything is changed, e.g. to create a file system snapshot of the mail directory; the sync is aborted if it fails (not run with --dry-run)")
+    parser.add_argument("--new-mail-cmd", type=str, help="command to run on this side after a sync that added at least --new-mail-min messages here, e.g. to update address completion; gets the number of new messages in $NOTMUCH_SYNC_NEW_MESSAGES (ignored on remote)")
+    parser.add_argument("--new-mail-min", type=int, default=1, metavar="N", help="minimum number of new messages to run --new-mail-cmd (default 1)")
+    parser.add_argument("--remote-snapshot-cmd", type=str, help="command to run on the remote before anything is changed, like --snapshot-cmd")
+    parser.add_argument("--accept-new-uuid", action="store_true", help="sync even if the notmuch database on either side has been recreated (new UUID) since the last sync; required with --delete in that case")
+    parser.add_argument("-n", "--dry-run", action="store_true", help="do not change anything on either side, print diff-like report of the changes that would be made to stdout instead")
+    parser.add_argument("--review", action="store_true", help="show the changes from the remote that would be made on this side like --dry-run and ask whether to apply them before anything is changed on either side")
+    parser.add_argument("--pre-new", action="store_true", help="run notmuch new on both sides before syncing")
+    parser.add_argument("--post-new", action="store_true", help="run notmuch new on both sides after syncing")
+    parser.add_argument("--new-no-hooks", action="store_true", help="run notmuch new with --no-hooks for --pre-new and --post-new")
+    parser.add_argument("--order", type=str, choices=ORDERS, default="newest", help="order to receive missing files in, by the date of their messages or their size, so that the most useful mail arrives first if the sync is interrupted (default newest; requires support on both sides, otherwise files are received in no particular order)")
+    parser.add_argument("--min-free", type=int, default=0, metavar="MB", help="abort before transferring files if less than this many megabytes would remain free on either side (default 0)")
+    parser.add_argument("--min-inodes", type=int, default=0, metavar="N", help="stop receiving files if fewer than this many inodes would remain free (default 0)")
+    parser.add_argument("--space-wait", type=int, default=0, metavar="SECONDS", help="when running low on space or inodes while receiving files, pause for up to this many seconds for space to be freed before aborting (default 0)")
+    parser.add_argument("--hash-workers", type=int, metavar="N", help="number of threads to hash files with on this side (default: tuned automatically, up to the number of CPUs)")
+    parser.add_argument("--delta", action="store_true", help="only transfer the parts that differ for files of messages that already have a file on the receiving side (if supported on both sides)")
+    parser.add_argument("--nfs", action="store_true", help="the mail directory is on a network file system (NFS, SMB) on either side, possibly shared by several machines: lock it while syncing and tolerate NFS rename semantics")
+    parser.add_argument("--read-only", action="store_true", help="never change the notmuch database, mail files, or sync state on this side, e.g. on a remote a less trusted device syncs with through an SSH forced command (command=\"notmuch-sync --read-only\" in authorized_keys): the other side only gets changes from this side, and anything it asks to change here is refused")
+    parser.add_argument("--strict", action="store_true", help="fail the sync, without recording the sync state, instead of warning about problems with individual files or messages (e.g. unreadable files, received files that aren't emails, or messages to be deleted that aren't tagged 'deleted'); passed on to the remote")
+    parser.add_argument("--no-fsync", action="store_true", help="don't wait for received, copied, and moved files and the sync state to be written to disk on either side; faster, but a power loss right after a sync may lose files that are recorded as synced")
+    parser.add_argument("--portable", action="store_true", help="the mail directory is on storage where renames and permissions don't work as usual on either side, e.g. shared storage on Android (Termux): move files by copying and deleting them, and don't set permissions or require modification times to be set")
+    parser.add_argument("--folder-layout", type=str, choices=["nested", "maildir++"], default="nested", help="layout of the maildir folders on this side: nested directories (e.g. 'INBOX/Sub/cur', default) or Maildir++ (e.g. '.INBOX.Sub/cur'); file names are translated if the sides differ")
+    parser.add_argument("--remote-folder-layout", type=str, choices=["nested", "maildir++"], help="layout of the maildir folders on the remote, like --folder-layout")
+    parser.add_argument("--folder-map", type=parse_folder_map, metavar="LOCAL=REMOTE,...", help="sync the files in folder LOCAL (and its subfolders) on this side as folder REMOTE on the remote (e.g. 'INBOX=Inbox'; an empty folder is the top-level maildir, e.g. '=work' to nest everything under 'work' on the remote), for each comma-separated pair; only give this on one side")
+    parser.add_argument("--mail-dirs", type=lambda s: s.replace(",", " ").split(), default=["cur", "new"], metavar="PATTERN,...", help="only accept names of mail files from the other side that are in directories whose name matches one of these comma-separated glob patterns (default 'cur,new', i.e. maildir folders; '*' for any directory)")
+    parser.add_argument("--xattrs", action="store_true", help="preserve extended attributes (e.g. SELinux contexts) of transferred and copied files (if supported on both sides)")
+    parser.add_argument("--clone", type=str, nargs="?", const="none", choices=COMPRESSIONS, help="if the notmuch database on one side is empty, first copy the entire mail directory and tags from the other side as a (optionally compressed) tar stream and run notmuch new, much faster than a regular first sync")
+    parser.add_argument("--evict-older-than", type=parse_age, metavar="AGE", help="after syncing, remove local files of messages older than AGE (e.g. 1y, 6m, 2w, 30d) to free space; they are kept on the remote and not transferred again or deleted there")
+    parser.add_argument("--encoding", type=str, choices=["json", "msgpack", "cbor"], default="json", help="encoding of changes and file names sent to the other side, used if supported on both sides (default 'json'; 'msgpack' and 'cbor' are more compact for large syncs, require msgpack and cbor2 modules, respectively)")
+    parser.add_argument("--digest", type=str, choices=["sha256", "blake3"], default="sha256", help="digest algorithm to identify identical files, used if supported on both sides (default 'sha256'; 'blake3' is faster, requires blake3 module)")
+    parser.add_argument("--crash-report-url", type=str, metavar="URL", help="post a diagnostic bundle (without message contents) to this URL as JSON when a sync fails, on both sides")
+    parser.add_argument("--trace-file", type=str, metavar="FILE", help="record all frames exchanged with the remote (direction, size, and phase of the sync) to FILE as lines of JSON for debugging")
+    parser.add_argument("--trace-payload", action="store_true", help="also record the data of the frames with --trace-file, which is required to replay the trace (includes message contents)")
+    parser.add_argument("--retries", type=int, default=0, metavar="N", help="if the connection to the remote fails or is lost, retry the sync up to N times (default 0)")
+    parser.add_argument("--retry-delay", type=float, default=10, metavar="SECONDS", help="seconds to wait before the first retry with --retries, doubled for each further retry (default 10)")
+    parser.add_argument("--exit-changes", action="store_true", help=f"exit with code {EXIT_CHANGES} if the sync changed anything on either side, or with 'status' if there are changes pending (see README for all exit codes)")
+    parser.add_argument("--notify", action="store_true", help="show a desktop notification with notify-send (or ring the terminal bell if it isn't available) when a sync changes something or fails (ignored on remote)")
+    parser.add_argument("--notify-url", type=str, metavar="URL", help="post a summary of the changes as JSON to this URL when a sync changes something or fails, e.g. for a chat webhook (ignored on remote)")
+    parser.add_argument("--metrics-textfile", type=str, metavar="FILE", help="update counters of syncs, failures, messages and bytes transferred, and the time of the last successful sync in FILE in node_exporter textfile format after each sync (ignored on remote)")
+    parser.add_argument("--version", action="version", version=f"%(prog)s {VERSION} (protocol {PROTOCOL})")
+    return parser
+
+
+def parse_args(argv: List[str] | None = None) -> argparse.Namespace:
+    """
+    Parse command-line arguments.
+
+    Args:
+        argv (list): Arguments to parse, defaults to sys.argv.
+
+    Returns:
+        The parsed arguments.
+    """
+    parser = build_parser()
+    args = parser.parse_args(argv)
+    args.query = None
+    args.replay = None
+    args.repro = None
+    args.shell = None
+    if not args.command:
+        args.command = None
+    elif args.command[0] == "hydrate" and len(args.command) > 1:
+        args.query = " ".join(args.command[1:])
+        args.command = "hydrate"
+    elif args.command[0] == "replay" and len(args.command) == 2:
+        args.replay = args.command[1]
+        args.command = "replay"
+    elif args.command[0] == "repro" and len(args.command) == 3:
+        args.repro = args.command[1:]
+        args.command = "repro"
+    elif args.command[0] == "completion" and len(args.command) == 2:
+        args.shell = args.command[1]
+        if args.shell not in SHELLS:
+            parser.error(f"unknown shell '{args.shell}' for completion, use one of {', '.join(SHELLS)}")
+        args.command = "completion"
+    elif args.command[0] == "clone" and len(args.command) <= 2:
+        args.clone = args.command[1] if len(args.command) == 2 else "none"
+        if args.clone not in COMPRESSIONS:
+            parser.error(f"unknown compression '{args.clone}' for clone, use one of {', '.join(COMPRESSIONS)}")
+        if not args.remote and not args.remote_cmd:
+            parser.error("clone requires a remote")
+        args.command = None
+    elif args.command == ["sync"]:
+        if not args.remote and not args.remote_cmd:
+            parser.error("sync requires a remote")
+        args.command = None
+    elif args.command == ["serve"]:
+        if args.remote or args.remote_cmd:
+            parser.error("serve can't be combined with a remote")
+        args.command = None
+    elif args.command in (["diff"], ["list"], ["tail"], ["verify"], ["repair"], ["undo"], ["capabilities"], ["status"], ["states"]):
+        args.command = args.command[0]
+    else:
+        parser.error(f"unknown command '{' '.join(args.command)}'")
+
+    remotes = args.remote or []
+    if args.command == "diff":
+        if len(remotes) != 2:
+            parser.error("diff requires two remotes")
+    elif len(remotes) > 1:
+        parser.error("only one remote can be given except for diff")
+    args.remote = None
+    args.peers = []
+    args.profiles = []
+    args.fallbacks = []
+    # each remote is resolved separately, as they may have different settings
+    peers = [copy.copy(args) for _ in remotes]
+    for peer, remote in zip(peers, remotes):
+        peer.remote = remote
+        try:
+            resolve_remote(peer, read_config(args.config))
+        except ValueError as e:
+            parser.error(str(e))
+    if args.command == "diff":
+        args.peers = peers
+    elif remotes:
+        args = peers[0]
+    for a in [args] + args.peers:
+        if a.ssh_cmd is None:
+            a.ssh_cmd = "ssh -CTaxq"
+        if a.path is None:
+            a.path = os.path.basename(sys.argv[0])
+        if a.local_tags is None:
+            a.local_tags = []
+        for attr in ["ignore_tags", "sync_tags"]:
+            if getattr(a, attr) is None:
+                setattr(a, attr, [])
+        if a.tag_map is None:
+            a.tag_map = {}
+        if a.folder_map is None:
+            a.folder_map = {}
+        if a.transport is None:
+            a.transport = "ssh"
+        if a.read_only and (a.pre_new or a.post_new or a.snapshot_cmd):
+            parser.error("--read-only can't be combined with --pre-new, --post-new, or --snapshot-cmd")
+        if a.exclude_tag_mode is None:
+            a.exclude_tag_mode = "files"
+        if a.hash_workers is not None and a.hash_workers < 1:
+            parser.error("--hash-workers must be at least 1")
+        if a.exclude_tag_mode not in ("files", "all"):
+            parser.error(f"unknown --exclude-tag-mode '{a.exclude_tag_mode}', use files or all")
+        if a.transport == "native-ssh" and (a.ssh_control_path or a.bootstrap or a.happy_eyeballs):
+            parser.error("--transport native-ssh can't be combined with --ssh-control-path, --bootstrap, or --happy-eyeballs")
+    return args
+
+
+def forced_command_args(args: argparse.Namespace) -> argparse.Namespace:
+    """
+    With --read-only as SSH forced command, take over the flags in
+    FORCED_COMMAND_FLAGS from the command the other side asked for (in
+    $SSH_ORIGINAL_COMMAND), as they determine what is exchanged. --multi,
+    which lets the other side select the notmuch databases to sync, is only
+    taken over if the forced command has it too. All other flags, e.g.
+    commands to run, are ignored.
+
+    Args:
+        args: Parsed command-line arguments of the forced command.
+
+    Returns:
+        The arguments with the flags taken over.
+
+    Raises:
+        ValueError: If the requested command is invalid or not allowed.
+    """
+    original = os.environ.get("SSH_ORIGINAL_COMMAND")
+    if not original:
+        return args
+    try:
+        requested = parse_args(shlex.split(original)[1:])
+    except (ValueError, SystemExit) as e:
+        raise ValueError(f"Invalid command '{original}' requested, aborting...") from e
+    if requested.command not in (None, "hydrate", "list", "verify", "capabilities", "states"):
+        raise ReadOnlyError("run command", [requested.command])
+    if requested.multi and not args.multi:
+        raise ReadOnlyError("select profiles", ["--multi"])
+    args.multi = requested.multi
+    for attr in FORCED_COMMAND_FLAGS:
+        setattr(args, attr, getattr(requested, attr))
+    return args
+
+
+def use_notmuch_config(args: argparse.Namespace) -> None:
+    """
+    Select the notmuch configuration given on the command line for this side,
+    if any. notmuch (both the library and the command line tool run for e.g.
+    --pre-new) take the configuration from the environment.
+
+    Args:
+        args: Parsed command-line arguments.
+    """
+    if args.notmuch_config:
+        os.environ["NOTMUCH_CONFIG"] = os.path.expanduser(args.notmuch_config)
+    if args.profile:
+        os.environ["NOTMUCH_PROFILE"] = args.profile
 
-    if args.remote or args.remote_cmd:
-        if args.verbose == 1:
-            logger.setLevel(level=logging.INFO)
-        elif args.verbose == 2:
-            logger.setLevel(level=logging.DEBUG)
-        else:
-            logger.setLevel(level=logging.WARNING)
 
-        if args.quiet:
-            logger.disabled = True
-        sync_local(args)
+def main() -> None:
+    """
+    Entry point for the command-line interface. Parses arguments and dispatches
+    to local or remote sync.
+    """
+    args = parse_args()
+    use_notmuch_config(args)
+    session["nfs"] = args.nfs
+    session["portable"] = args.portable
+    session["hash_workers"] = args.hash_workers
+    session["order"] = args.order
+    session["mail_dirs"] = args.mail_dirs
+    session["folder_layout"] = args.folder_layout
+    session["folder_map"] = args.folder_map
+    session["fsync"] = not args.no_fsync
+    session["received_tag"] = args.received_tag
+    # until negotiated, e.g. for --clone
+    session["received_tags"] = [args.received_tag] if args.received_tag else []
+    session["tag_map"] = args.tag_map
+    session["strict"] = args.strict
+    session["read_only_db"] = args.read_only
+
+    if args.command == "completion":
+        try:
+            sys.stdout.write(completion(args.shell, build_parser(), read_config(args.config)))
+        except ConfigError as e:
+            report_error(e, "local")
+            sys.exit(EXIT_USAGE)
+    elif args.command == "tail":
+        try:
+            tail(activity_path(), sys.stdout.buffer)
+        except KeyboardInterrupt:
+            pass
+        except Exception as e:
+            report_error(e, "local")
+            sys.exit(exit_code(e))
+    elif args.remote or args.remote_cmd or args.command in ("diff", "repair", "replay", "repro", "undo", "status"):
+        configure_logging(args)
+        success = False
+        totals = None
+        error = None
+        try:
+            with serve_activity(activity_path()), tracing(args.trace_file, args.trace_payload):
+                if args.command == "diff":
+                    if diff_remotes(args) > 0:
+                        sys.exit(EXIT_MISMATCH)
+                elif args.command == "verify":
+                    if verify_remote(args) > 0:
+                        sys.exit(EXIT_MISMATCH)
+                elif args.command == "capabilities":
+                    if not show_capabilities(args):
+                        sys.exit(EXIT_MISMATCH)
+                elif args.command == "status":
+                    if status(args) > 0 and args.exit_changes:
+                        sys.exit(EXIT_CHANGES)
+                elif args.command == "repair":
+                    repair(args)
+                elif args.command == "undo":
+                    undo(args)
+                elif args.command == "replay":
+                    replay(args.replay)
+                elif args.command == "repro":
+                    repro(*args.repro)
+                else:
+                    totals = sync_retrying(args)
+                    if args.new_mail_cmd and not args.dry_run and totals[0][0] >= args.new_mail_min:
+                        new_mail_hook(args.new_mail_cmd, totals[0][0])
+            success = True
+        except Exception as e:
+            error = e
+            if args.log_file or args.log_format == "json":
+                # for log collectors, in addition to stderr
+                logger.error("%s", format_error(e), exc_info=e if is_bug(e) else None)
+            report_error(e, "local", args.crash_report_url)
+            if args.verbose == 2:
+                raise
+            sys.exit(exit_code(e))
+        finally:
+            if args.metrics_textfile and args.command in (None, "hydrate"):
+                try:
+                    write_metrics(args.metrics_textfile, success, totals)
+                except OSError as e:
+                    logger.warning("Could not write metrics to %s: %s", args.metrics_textfile, e)
+            if (args.notify or args.notify_url) and args.command in (None, "hydrate"):
+                notify(args, totals, error)
+        if totals is not None and any(c["failed"] > 0 for side in outcomes.values() for c in side.values()):
+            sys.exit(EXIT_PARTIAL)
+        if args.exit_changes and totals is not None and any(map(any, totals)):
+            sys.exit(EXIT_CHANGES)
     else:
-        logger.disabled = True
-        sync_remote(args)
+        for scoped in [logger, protocol_logger, files_logger, notmuch_logger]:
+            scoped.disabled = True
+        try:
+            if args.read_only:
+                args = forced_command_args(args)
+            if args.multi:
+                sync_remote_profiles(args)
+            else:
+                with lock_mail_dir(args.nfs and args.command is None):
+                    sync_remote(args)
+        except Exception as e:
+            report_error(e, "remote", args.crash_report_url)
+            sys.exit(exit_code(e))
 
 
 if __name__ == "__main__":
@@ -0,0 +1,84 @@
+"""Fuzzing entry points for the decoders of data received from the other side.
+
+Run with atheris (pip install atheris), e.g.
+
+    python3 -m test.fuzz changes
+
+Each entry point takes arbitrary bytes and must only ever raise the errors the
+sync handles (ValueError for invalid data, EOFError for a closed connection);
+anything else is a crash."""
+
+import io
+import sys
+
+import src.notmuch_sync as ns
+
+
+def fuzz_read(data: bytes) -> None:
+    """Read frames from a stream until it's exhausted."""
+    stream = io.BytesIO(data)
+    try:
+        while True:
+            ns.read(stream)
+    except (ValueError, EOFError):
+        pass
+
+
+def fuzz_changes(data: bytes) -> None:
+    """Decode changes, as exchanged at the start of the sync."""
+    try:
+        ns.decode_changes(data)
+    except ValueError:
+        pass
+
+
+def fuzz_fnames(data: bytes) -> None:
+    """Decode and validate file names, as requested by the other side."""
+    try:
+        ns.decode_fnames(data)
+    except ValueError:
+        pass
+
+
+def fuzz_delta(data: bytes) -> None:
+    """Apply a delta, as received for a file the other side has a basis for."""
+    try:
+        ns.apply_delta(bytes(range(256)) * 4, data, 64)
+    except ValueError:
+        pass
+
+
+def fuzz_hashes(data: bytes) -> None:
+    """Decode hashes, as sent back for requested files."""
+    try:
+        ns.decode_hashes(data, 2)
+    except ValueError:
+        pass
+
+
+def fuzz_signatures(data: bytes) -> None:
+    """Decode block signatures and compute deltas against them."""
+    try:
+        sigs = ns.decode_signatures(data, 2)
+    except ValueError:
+        return
+    for sig in sigs:
+        if sig is not None:
+            ns.compute_delta(bytes(range(256)) * 4, sig, 64)
+
+
+TARGETS = {"read": fuzz_read, "changes": fuzz_changes, "fnames": fuzz_fnames, "delta": fuzz_delta,
+           "hashes": fuzz_hashes, "signatures": fuzz_signatures}
+
+
+def main() -> None:
+    import atheris # type: ignore[import-not-found]
+
+    target = TARGETS[sys.argv[1]]
+    atheris.instrument_func(target)
+    atheris.Setup(sys.argv[:1] + sys.argv[2:], target)
+    atheris.Fuzz()
+
+
+if __name__ == "__main__":
+    main()
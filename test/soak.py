@@ -0,0 +1,220 @@
+"""Soak test that syncs two notmuch databases while mail activity goes on.
+
+Two temporary maildirs with notmuch databases are set up and mutated
+concurrently -- new mail is delivered, files are moved between folders and
+have their flags changed like afew or an MUA would, and tags are changed --
+while syncs run in a loop. Afterwards, the mutations are stopped and the
+databases must converge to the same messages, files, and tags. Requires
+notmuch and the notmuch2 Python module, e.g.
+
+    python3 -m test.soak --rounds 20 --seed 42
+
+Syncs may fail while mail is changing underneath them, but must never crash
+with an unexpected error."""
+
+import argparse
+import os
+import random
+import shlex
+import shutil
+import subprocess
+import sys
+import threading
+import time
+from pathlib import Path
+from tempfile import mkdtemp
+
+import src.notmuch_sync as ns
+
+SCRIPT = Path(__file__).resolve().parent.parent / "src" / "notmuch_sync.py"
+FOLDERS = ["INBOX", "Archive", "lists"]
+TAGS = ["todo", "later", "important", "muted"]
+
+
+def write_conf(path: str) -> str:
+    """Write a notmuch configuration for the database in path."""
+    conf = os.path.join(path, ".notmuch-config")
+    with open(conf, "w", encoding="utf-8") as f:
+        f.write(f"[database]\npath={path}\n[new]\ntags=\n[maildir]\nsynchronize_flags=true\n")
+    return conf
+
+
+def notmuch(conf: str, *args: str) -> subprocess.CompletedProcess:
+    """Run notmuch with the given configuration, failures are up to the caller."""
+    return subprocess.run(["notmuch", *args], env=dict(os.environ, NOTMUCH_CONFIG=conf),
+                          capture_output=True, text=True, check=False)
+
+
+class Side:
+    """One side of the sync with its maildir and the activity on it."""
+
+    def __init__(self, name: str, path: str, seed: int):
+        self.name = name
+        self.path = path
+        for folder in FOLDERS:
+            for sub in ["cur", "new", "tmp"]:
+                os.makedirs(os.path.join(path, folder, sub), exist_ok=True)
+        self.conf = write_conf(path)
+        self.rng = random.Random(f"{seed}-{name}")
+        self.delivered = 0
+        self.actions = {"deliver": 0, "move": 0, "flag": 0, "tag": 0}
+
+    def files(self) -> list:
+        """All mail files, relative to the maildir."""
+        return sorted(str(p.relative_to(self.path)) for p in Path(self.path).glob("*/*/*")
+                      if p.parent.name in ["cur", "new"])
+
+    def deliver(self) -> None:
+        """Deliver a new message to new/ through tmp/, as an MDA would."""
+        self.delivered += 1
+        mid = f"soak-{self.name}-{self.delivered}@notmuch-sync"
+        name = f"{time.time_ns()}.{os.getpid()}_{self.delivered}.{self.name}"
+        folder = self.rng.choice(FOLDERS)
+        tmp = os.path.join(self.path, folder, "tmp", name)
+        with open(tmp, "w", encoding="utf-8") as f:
+            f.write(f"From: soak@example.org\nTo: {self.name}@example.org\n"
+                    f"Subject: soak {self.delivered}\nMessage-ID: <{mid}>\n"
+                    f"Date: Thu, 01 Jan 2026 00:00:00 +0000\n\nMessage {self.delivered} on {self.name}.\n")
+        os.rename(tmp, os.path.join(self.path, folder, "new", name))
+
+    def move(self) -> None:
+        """Move a file to cur/ of another folder, as afew's mail mover would."""
+        files = self.files()
+        if files:
+            src = self.rng.choice(files)
+            base, flags = ns.maildir_flags(os.path.basename(src))
+            dst = os.path.join(self.rng.choice(FOLDERS), "cur", f"{base}:2,{flags or ''}")
+            try:
+                os.rename(os.path.join(self.path, src), os.path.join(self.path, dst))
+            except FileNotFoundError:
+                pass
+
+    def flag(self) -> None:
+        """Toggle the seen flag of a file, as an MUA would."""
+        files = self.files()
+        if files:
+            src = self.rng.choice(files)
+            base, flags = ns.maildir_flags(os.path.basename(src))
+            flags = set(flags or "") ^ {"S"}
+            dst = os.path.join(os.path.dirname(os.path.dirname(src)), "cur", f"{base}:2,{''.join(sorted(flags))}")
+            try:
+                os.rename(os.path.join(self.path, src), os.path.join(self.path, dst))
+            except FileNotFoundError:
+                pass
+
+    def tag(self) -> None:
+        """Add or remove a tag on a message."""
+        mids = notmuch(self.conf, "search", "--output=messages", "*").stdout.split()
+        if mids:
+            op = self.rng.choice("+-")
+            notmuch(self.conf, "tag", f"{op}{self.rng.choice(TAGS)}", "--", self.rng.choice(mids))
+
+    def mutate(self, stop: threading.Event) -> None:
+        """Mutate until stopped, indexing changes with notmuch new as they happen."""
+        actions = {"deliver": self.deliver, "move": self.move, "flag": self.flag, "tag": self.tag}
+        while not stop.is_set():
+            action = self.rng.choices(list(actions), weights=[3, 2, 2, 3])[0]
+            actions[action]()
+            self.actions[action] += 1
+            if action != "tag":
+                # the database may be locked by a running sync, retried next time
+                notmuch(self.conf, "new", "--quiet")
+            stop.wait(self.rng.uniform(0, 0.2))
+
+    def state(self) -> tuple:
+        """Messages with tags and files (without maildir flags) as seen by notmuch."""
+        dump = sorted(notmuch(self.conf, "dump").stdout.splitlines())
+        files = notmuch(self.conf, "search", "--output=files", "*").stdout.splitlines()
+        return dump, sorted(ns.maildir_flags(os.path.relpath(f, self.path))[0] for f in files)
+
+
+def sync(local: Side, remote: Side, base: str) -> subprocess.CompletedProcess:
+    """Run one sync between the two sides."""
+    remote_cmd = f"env NOTMUCH_CONFIG={shlex.quote(remote.conf)} {shlex.quote(sys.executable)} {shlex.quote(str(SCRIPT))}"
+    return subprocess.run([sys.executable, str(SCRIPT), "--notmuch-config", local.conf, "--remote-cmd", remote_cmd],
+                          env=dict(os.environ, XDG_CACHE_HOME=base),
+                          capture_output=True, text=True, check=False, timeout=600)
+
+
+def soak(base: str, rounds: int, seed: int) -> bool:
+    """
+    Run the soak test in base.
+
+    Args:
+        base: Directory to set up both sides in.
+        rounds: Number of syncs while mail activity goes on.
+        seed: Seed for the random mail activity.
+
+    Returns:
+        bool: Whether no sync crashed and both sides converged.
+    """
+    local = Side("local", os.path.join(base, "local"), seed)
+    remote = Side("remote", os.path.join(base, "remote"), seed)
+    for side in [local, remote]:
+        for _ in range(5):
+            side.deliver()
+        notmuch(side.conf, "new", "--quiet")
+
+    ok = True
+    failed = 0
+    stop = threading.Event()
+    threads = [threading.Thread(target=side.mutate, args=(stop,)) for side in [local, remote]]
+    for t in threads:
+        t.start()
+    try:
+        for i in range(rounds):
+            res = sync(local, remote, base)
+            if res.returncode != 0:
+                failed += 1
+                print(f"Sync {i + 1}/{rounds} failed: {res.stderr.strip()}")
+                if "likely a bug" in res.stderr:
+                    ok = False
+    finally:
+        stop.set()
+        for t in threads:
+            t.join()
+
+    print(f"{failed}/{rounds} syncs failed during mail activity.")
+    for side in [local, remote]:
+        print(f"{side.name}: {side.actions}")
+        notmuch(side.conf, "new", "--quiet")
+    # the first sync may only pick up changes made while the last one ran
+    for _ in range(2):
+        res = sync(local, remote, base)
+        if res.returncode != 0:
+            print(f"Final sync failed: {res.stderr.strip()}")
+            return False
+
+    lstate = local.state()
+    rstate = remote.state()
+    if lstate[0] != rstate[0]:
+        print(f"Tags differ:\n{sorted(set(lstate[0]) ^ set(rstate[0]))}")
+        ok = False
+    if lstate[1] != rstate[1]:
+        print(f"Files differ:\n{sorted(set(lstate[1]) ^ set(rstate[1]))}")
+        ok = False
+    return ok
+
+
+def main() -> None:
+    parser = argparse.ArgumentParser(description="Soak test syncing while mail activity goes on.")
+    parser.add_argument("--rounds", type=int, default=20, help="number of syncs during mail activity (default 20)")
+    parser.add_argument("--seed", type=int, default=None, help="seed for the mail activity (default random)")
+    parser.add_argument("--keep", action="store_true", help="keep the maildirs and any diagnostic bundles")
+    args = parser.parse_args()
+
+    seed = args.seed if args.seed is not None else random.randrange(2**32)
+    print(f"Seed {seed}.")
+    base = mkdtemp(prefix="notmuch-sync-soak-")
+    try:
+        ok = soak(base, args.rounds, seed)
+    finally:
+        if args.keep:
+            print(f"Kept {base}.")
+        else:
+            shutil.rmtree(base)
+    sys.exit(0 if ok else 1)
+
+
+if __name__ == "__main__":
+    main()
@@ -53,20 +53,20 @@ def test_sync(shell):
             local_sync_file = os.path.join(local, ".notmuch", f"notmuch-sync-{rsum[1]}")
             assert os.path.exists(local_sync_file)
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"5 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["5", lsum[1], "5", rsum[1]]
 
             remote_sync_file = os.path.join(remote, ".notmuch", f"notmuch-sync-{lsum[1]}")
             assert os.path.exists(remote_sync_file)
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"5 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["5", rsum[1], "5", lsum[1]]
 
             out = sync(shell, local_conf, remote_conf).split('\n')
             assert "local:  0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[0]
             assert "remote: 0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[1]
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"5 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["5", lsum[1], "5", rsum[1]]
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"5 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["5", rsum[1], "5", lsum[1]]
 
             lsum = shell.run("notmuch", "count", "--lastmod", env={"NOTMUCH_CONFIG": local_conf}).stdout.split('\t')
             assert lsum[2] == "5\n"
@@ -97,11 +97,11 @@ def test_sync_tags(shell):
             local_sync_file = os.path.join(local, ".notmuch", f"notmuch-sync-{rsum[1]}")
             assert os.path.exists(local_sync_file)
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"5 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["5", lsum[1], "5", rsum[1]]
             remote_sync_file = os.path.join(remote, ".notmuch", f"notmuch-sync-{lsum[1]}")
             assert os.path.exists(remote_sync_file)
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"5 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["5", rsum[1], "5", lsum[1]]
 
             assert shell.run("notmuch", "tag", "+local", "id:874llc2bkp.fsf@curie.anarc.at",
                              env={"NOTMUCH_CONFIG": local_conf}).returncode == 0
@@ -144,9 +144,9 @@ def test_sync_tags(shell):
                              env={"NOTMUCH_CONFIG": remote_conf}).data == ["remote", "unread"]
 
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"11 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["11", lsum[1], "11", rsum[1]]
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"11 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["11", rsum[1], "11", lsum[1]]
 
             lsum = shell.run("notmuch", "count", "--lastmod", env={"NOTMUCH_CONFIG": local_conf}).stdout.split('\t')
             assert lsum[2] == "11\n"
@@ -189,31 +189,35 @@ def test_sync_tags_files_verbose(shell):
             assert 'Sending UUID' in out[1]
             assert 'Receiving UUID...' in out[2]
             assert 'UUIDs synced.' in out[3]
-            assert 'Computing local changes...' in out[4]
-            assert 'Previous sync revision -1, current revision 7.' in out[5]
+            assert 'Local notmuch-sync ' in out[4]
+            assert 'Computing local changes...' in out[5]
+            assert 'Previous sync revision -1, current revision 7.' in out[6]
             assert any('Sending local changes...' in o for o in out)
             assert any('Receiving remote changes...' in o for o in out)
-            assert 'Changes synced.' in out[8]
-            assert any("Setting tags ['local', 'remote'] for 87d1dajhgf.fsf@example.net." in o for o in out)
-            assert any("Setting tags ['attachment', 'local', 'remote'] for 20111101080303.30A10409E@asxas.net." in o for o in out)
-            assert 'Tags synced.' in out[11]
+            assert 'Changes synced.' in out[9]
+            # per-file and per-message actions are only logged with -vv
+            assert 'Tags synced.' in out[10]
             assert any('Sending file names missing on local...' in o for o in out)
             assert any('Receiving file names missing on remote...' in o for o in out)
             assert any('Requesting 0 hashes from remote...' in o for o in out)
             assert any('Receiving hash requests from remote...' in o for o in out)
             assert any('Hashing 0 requested files and sending to remote...' in o for o in out)
             assert any('Receiving hashes from remote...' in o for o in out)
-            assert 'Missing file names synced.' in out[18]
-            assert any('1/1 Sending mails/simple.eml...' in o for o in out)
-            assert any('1/1 Receiving mails/attachment.eml...' in o for o in out)
-            assert any(f'Adding {local}/mails/attachment.eml to DB.' in o for o in out)
-            assert any("Setting tags ['attachment', 'remote'] for received 874llc2bkp.fsf@curie.anarc.at." in o for o in out)
-            assert 'Missing files synced.' in out[23]
-            assert 'Writing last sync revision 11.' in out[24]
-            assert 'Getting change numbers from remote...' in out[25]
-            assert 'local:  1 new messages,\t1 new files,\t0 files copied/moved,\t0 files deleted,\t2 messages with tag changes,\t0 messages deleted' in out[26]
-            assert 'remote: 1 new messages,\t1 new files,\t0 files copied/moved,\t0 files deleted,\t2 messages with tag changes,\t0 messages deleted' in out[27]
-            assert '9098/4288 bytes received from/sent to remote.' in out[28]
+            assert 'Missing file names synced.' in out[17]
+            assert any('Sending dates and sizes of files missing on remote...' in o for o in out)
+            assert any('Receiving dates and sizes of files missing on local...' in o for o in out)
+            assert any('Sending order of files missing on local...' in o for o in out)
+            assert any('Receiving order of files missing on remote...' in o for o in out)
+            assert 'Missing files synced.' in out[22]
+            assert 'Writing last sync revision 11.' in out[23]
+            assert 'Getting change numbers from remote...' in out[24]
+            assert 'local:  1 new messages,\t1 new files,\t0 files copied/moved,\t0 files deleted,\t2 messages with tag changes,\t0 messages deleted' in out[25]
+            assert 'remote: 1 new messages,\t1 new files,\t0 files copied/moved,\t0 files deleted,\t2 messages with tag changes,\t0 messages deleted' in out[26]
+            transferred = [re.search(r'(\d+)/(\d+) bytes received from/sent to remote\.', o) for o in out]
+            received, sent = next(map(int, m.groups()) for m in transferred if m)
+            # the rest depends on host name and paths sent in the session parameters
+            assert received > os.path.getsize("test/mails/attachment.eml")
+            assert sent > os.path.getsize("test/mails/simple.eml")
 
 
 def test_sync_tags_files(shell):
@@ -282,12 +286,12 @@ def test_sync_tags_files(shell):
             local_sync_file = os.path.join(local, ".notmuch", f"notmuch-sync-{rsum[1]}")
             assert os.path.exists(local_sync_file)
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"9 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["9", lsum[1], "9", rsum[1]]
 
             remote_sync_file = os.path.join(remote, ".notmuch", f"notmuch-sync-{lsum[1]}")
             assert os.path.exists(remote_sync_file)
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"9 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["9", rsum[1], "9", lsum[1]]
 
             # we record the last sync before transferring files and
             # adding/tagging them, so the revision after finished sync is higher
@@ -300,9 +304,75 @@ def test_sync_tags_files(shell):
             assert "local:  0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[0]
             assert "remote: 0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[1]
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"9 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["9", lsum[1], "9", rsum[1]]
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"9 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["9", rsum[1], "9", lsum[1]]
+
+
+def test_sync_excluded(shell):
+    # notmuch only applies search.exclude_tags (deleted, see write_conf) on the
+    # command line, so messages with these tags are synced like any other
+    with TemporaryDirectory() as local:
+        with TemporaryDirectory() as remote:
+            assert shell.run("cp", "-r", "test/mails", local).returncode == 0
+            assert shell.run("cp", "-r", "test/mails", remote).returncode == 0
+            Path.unlink(os.path.join(remote, "mails", "attachment.eml"))
+            local_conf = write_conf(local)
+            remote_conf = write_conf(remote)
+            assert shell.run("notmuch", "new", env={"NOTMUCH_CONFIG": local_conf}).returncode == 0
+            assert shell.run("notmuch", "new", env={"NOTMUCH_CONFIG": remote_conf}).returncode == 0
+
+            assert shell.run("notmuch", "tag", "+deleted", "id:874llc2bkp.fsf@curie.anarc.at",
+                             env={"NOTMUCH_CONFIG": local_conf}).returncode == 0
+            assert shell.run("notmuch", "tag", "+deleted", "id:87d1dajhgf.fsf@example.net",
+                             env={"NOTMUCH_CONFIG": local_conf}).returncode == 0
+
+            out = sync(shell, local_conf, remote_conf).split('\n')
+            assert "remote: 1 new messages,\t1 new files,\t0 files copied/moved,\t0 files deleted,\t1 messages with tag changes,\t0 messages deleted" in out[1]
+
+            assert Path(os.path.join(remote, "mails", "attachment.eml")).exists()
+            assert "deleted" in shell.run("notmuch", "search", "--exclude=false", "--output=tags", "--format=json", "id:874llc2bkp.fsf@curie.anarc.at",
+                                          env={"NOTMUCH_CONFIG": remote_conf}).data
+            assert "deleted" in shell.run("notmuch", "search", "--exclude=false", "--output=tags", "--format=json", "id:87d1dajhgf.fsf@example.net",
+                                          env={"NOTMUCH_CONFIG": remote_conf}).data
+
+
+def test_sync_dry_run(shell):
+    with TemporaryDirectory() as local:
+        with TemporaryDirectory() as remote:
+            assert shell.run("cp", "-r", "test/mails", local).returncode == 0
+            Path.unlink(os.path.join(local, "mails", "attachment.eml"))
+            assert shell.run("cp", "-r", "test/mails", remote).returncode == 0
+            Path.unlink(os.path.join(remote, "mails", "simple.eml"))
+            local_conf = write_conf(local)
+            remote_conf = write_conf(remote)
+            assert shell.run("notmuch", "new", env={"NOTMUCH_CONFIG": local_conf}).returncode == 0
+            assert shell.run("notmuch", "new", env={"NOTMUCH_CONFIG": remote_conf}).returncode == 0
+
+            assert shell.run("notmuch", "tag", "+local", "id:87d1dajhgf.fsf@example.net",
+                             env={"NOTMUCH_CONFIG": local_conf}).returncode == 0
+
+            lsum = shell.run("notmuch", "count", "--lastmod", env={"NOTMUCH_CONFIG": local_conf}).stdout.split('\t')
+            rsum = shell.run("notmuch", "count", "--lastmod", env={"NOTMUCH_CONFIG": remote_conf}).stdout.split('\t')
+
+            res = shell.run("./src/notmuch_sync.py", "--dry-run", "--remote-cmd",
+                            f"bash -c 'NOTMUCH_CONFIG={remote_conf} ./src/notmuch_sync.py --dry-run'",
+                            env={"NOTMUCH_CONFIG": local_conf})
+            assert res.returncode == 0
+            out = res.stdout.split('\n')
+            assert "--- local" in out
+            assert "+mails/attachment.eml" in out
+            assert "--- remote" in out
+            assert "+mails/simple.eml" in out
+            assert "@@ message 87d1dajhgf.fsf@example.net @@" in out
+            assert "+tag:local" in out
+
+            assert not Path(os.path.join(local, "mails", "attachment.eml")).exists()
+            assert not Path(os.path.join(remote, "mails", "simple.eml")).exists()
+            assert not os.path.exists(os.path.join(local, ".notmuch", f"notmuch-sync-{rsum[1]}"))
+            assert not os.path.exists(os.path.join(remote, ".notmuch", f"notmuch-sync-{lsum[1]}"))
+            assert shell.run("notmuch", "search", "--output=tags", "--format=json", "id:87d1dajhgf.fsf@example.net",
+                             env={"NOTMUCH_CONFIG": remote_conf}).data == []
 
 
 def test_sync_tags_files_copied(shell):
@@ -367,12 +437,12 @@ def test_sync_tags_files_copied(shell):
             local_sync_file = os.path.join(local, ".notmuch", f"notmuch-sync-{rsum[1]}")
             assert os.path.exists(local_sync_file)
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"10 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["10", lsum[1], "10", rsum[1]]
 
             remote_sync_file = os.path.join(remote, ".notmuch", f"notmuch-sync-{lsum[1]}")
             assert os.path.exists(remote_sync_file)
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"10 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["10", rsum[1], "10", lsum[1]]
 
             # we record the last sync before transferring files and
             # adding/tagging them, so the revision after finished sync is higher
@@ -385,9 +455,9 @@ def test_sync_tags_files_copied(shell):
             assert "local:  0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[0]
             assert "remote: 0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[1]
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"10 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["10", lsum[1], "10", rsum[1]]
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"10 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["10", rsum[1], "10", lsum[1]]
 
 
 def test_sync_tags_files_moved(shell):
@@ -452,12 +522,12 @@ def test_sync_tags_files_moved(shell):
             local_sync_file = os.path.join(local, ".notmuch", f"notmuch-sync-{rsum[1]}")
             assert os.path.exists(local_sync_file)
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"9 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["9", lsum[1], "9", rsum[1]]
 
             remote_sync_file = os.path.join(remote, ".notmuch", f"notmuch-sync-{lsum[1]}")
             assert os.path.exists(remote_sync_file)
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"9 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["9", rsum[1], "9", lsum[1]]
 
             # we record the last sync before transferring files and
             # adding/tagging them, so the revision after finished sync is higher
@@ -476,9 +546,9 @@ def test_sync_tags_files_moved(shell):
             assert "local:  0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[0]
             assert "remote: 0 new messages,\t0 new files,\t1 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[1]
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"11 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["11", lsum[1], "11", rsum[1]]
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"11 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["11", rsum[1], "11", lsum[1]]
 
             assert not Path(os.path.join(remote, "mails", "html-only.eml")).exists()
             assert Path(os.path.join(remote, "mails", "html-only1.eml")).exists()
@@ -494,9 +564,9 @@ def test_sync_tags_files_moved(shell):
             assert "local:  0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[0]
             assert "remote: 0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[1]
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"11 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["11", lsum[1], "11", rsum[1]]
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"11 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["11", rsum[1], "11", lsum[1]]
 
 
 def test_sync_tags_files_moved_twice(shell):
@@ -564,12 +634,12 @@ def test_sync_tags_files_moved_twice(shell):
             local_sync_file = os.path.join(local, ".notmuch", f"notmuch-sync-{rsum[1]}")
             assert os.path.exists(local_sync_file)
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"11 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["11", lsum[1], "9", rsum[1]]
 
             remote_sync_file = os.path.join(remote, ".notmuch", f"notmuch-sync-{lsum[1]}")
             assert os.path.exists(remote_sync_file)
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"9 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["9", rsum[1], "11", lsum[1]]
 
             # we record the last sync before transferring files and
             # adding/tagging them, so the revision after finished sync is higher
@@ -582,9 +652,9 @@ def test_sync_tags_files_moved_twice(shell):
             assert "local:  0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[0]
             assert "remote: 0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[1]
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"11 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["11", lsum[1], "9", rsum[1]]
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"9 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["9", rsum[1], "11", lsum[1]]
 
 
 def test_sync_tags_files_none_remote(shell):
@@ -639,12 +709,12 @@ def test_sync_tags_files_none_remote(shell):
             local_sync_file = os.path.join(local, ".notmuch", f"notmuch-sync-{rsum[1]}")
             assert os.path.exists(local_sync_file)
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"9 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["9", lsum[1], "9", rsum[1]]
 
             remote_sync_file = os.path.join(remote, ".notmuch", f"notmuch-sync-{lsum[1]}")
             assert os.path.exists(remote_sync_file)
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"9 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["9", rsum[1], "9", lsum[1]]
 
             # we record the last sync before transferring files and
             # adding/tagging them, so the revision after finished sync is higher
@@ -657,9 +727,9 @@ def test_sync_tags_files_none_remote(shell):
             assert "local:  0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[0]
             assert "remote: 0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[1]
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"9 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["9", lsum[1], "9", rsum[1]]
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"9 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["9", rsum[1], "9", lsum[1]]
 
 
 def test_sync_files_deleted(shell):
@@ -686,12 +756,12 @@ def test_sync_files_deleted(shell):
             local_sync_file = os.path.join(local, ".notmuch", f"notmuch-sync-{rsum[1]}")
             assert os.path.exists(local_sync_file)
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"5 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["5", lsum[1], "5", rsum[1]]
 
             remote_sync_file = os.path.join(remote, ".notmuch", f"notmuch-sync-{lsum[1]}")
             assert os.path.exists(remote_sync_file)
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"5 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["5", rsum[1], "5", lsum[1]]
 
             Path.unlink(os.path.join(remote, "mails", "html-only1.eml"))
             assert shell.run("notmuch", "new", env={"NOTMUCH_CONFIG": remote_conf}).returncode == 0
@@ -709,9 +779,9 @@ def test_sync_files_deleted(shell):
             assert "local:  0 new messages,\t0 new files,\t0 files copied/moved,\t1 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[0]
             assert "remote: 0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[1]
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"6 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["6", lsum[1], "6", rsum[1]]
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"6 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["6", rsum[1], "6", lsum[1]]
 
             assert shell.run("notmuch", "search", "--output=files", "--format=json", "id:87d1dajhgf.fsf@example.net",
                              env={"NOTMUCH_CONFIG": local_conf}).data == [os.path.join(local, "mails", "html-only.eml")]
@@ -752,12 +822,12 @@ def test_sync_message_deleted_local(shell):
             local_sync_file = os.path.join(local, ".notmuch", f"notmuch-sync-{rsum[1]}")
             assert os.path.exists(local_sync_file)
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"6 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["6", lsum[1], "6", rsum[1]]
 
             remote_sync_file = os.path.join(remote, ".notmuch", f"notmuch-sync-{lsum[1]}")
             assert os.path.exists(remote_sync_file)
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"6 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["6", rsum[1], "6", lsum[1]]
 
             Path.unlink(os.path.join(local, "mails", "simple.eml"))
             assert shell.run("notmuch", "new", env={"NOTMUCH_CONFIG": local_conf}).returncode == 0
@@ -775,9 +845,9 @@ def test_sync_message_deleted_local(shell):
             assert "local:  0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[0]
             assert "remote: 0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t1 messages deleted" in out[1]
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"6 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["6", lsum[1], "6", rsum[1]]
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"6 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["6", rsum[1], "6", lsum[1]]
 
             assert shell.run("notmuch", "search", "--format=json", "id:1258848661-4660-2-git-send-email-stefan@datenfreihafen.org",
                              env={"NOTMUCH_CONFIG": local_conf}).data == []
@@ -836,10 +906,10 @@ def test_sync_message_deleted_local_failsafe(shell):
             assert "remote: 0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[1]
             local_sync_file = os.path.join(local, ".notmuch", f"notmuch-sync-{rsum[1]}")
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"6 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["6", lsum[1], "6", rsum[1]]
             remote_sync_file = os.path.join(remote, ".notmuch", f"notmuch-sync-{lsum[1]}")
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"6 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["6", rsum[1], "6", lsum[1]]
 
             assert shell.run("notmuch", "search", "--output=files", "--format=json", "id:1258848661-4660-2-git-send-email-stefan@datenfreihafen.org",
                              env={"NOTMUCH_CONFIG": local_conf}).data == [os.path.join(local, "mails", "simple.eml")]
@@ -882,12 +952,12 @@ def test_sync_message_deleted_remote(shell):
             local_sync_file = os.path.join(local, ".notmuch", f"notmuch-sync-{rsum[1]}")
             assert os.path.exists(local_sync_file)
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"6 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["6", lsum[1], "6", rsum[1]]
 
             remote_sync_file = os.path.join(remote, ".notmuch", f"notmuch-sync-{lsum[1]}")
             assert os.path.exists(remote_sync_file)
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"6 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["6", rsum[1], "6", lsum[1]]
 
             Path.unlink(os.path.join(remote, "mails", "simple.eml"))
             assert shell.run("notmuch", "new", env={"NOTMUCH_CONFIG": remote_conf}).returncode == 0
@@ -905,9 +975,9 @@ def test_sync_message_deleted_remote(shell):
             assert "local:  0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t1 messages deleted" in out[0]
             assert "remote: 0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[1]
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"6 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["6", lsum[1], "6", rsum[1]]
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"6 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["6", rsum[1], "6", lsum[1]]
 
             assert shell.run("notmuch", "search", "--format=json", "id:1258848661-4660-2-git-send-email-stefan@datenfreihafen.org",
                              env={"NOTMUCH_CONFIG": local_conf}).data == []
@@ -966,10 +1036,10 @@ def test_sync_message_deleted_remote_failsafe(shell):
             assert "remote: 1 new messages,\t1 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[1]
             local_sync_file = os.path.join(local, ".notmuch", f"notmuch-sync-{rsum[1]}")
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"6 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["6", lsum[1], "6", rsum[1]]
             remote_sync_file = os.path.join(remote, ".notmuch", f"notmuch-sync-{lsum[1]}")
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"6 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["6", rsum[1], "6", lsum[1]]
 
             assert shell.run("notmuch", "search", "--output=files", "--format=json", "id:1258848661-4660-2-git-send-email-stefan@datenfreihafen.org",
                              env={"NOTMUCH_CONFIG": local_conf}).data == [os.path.join(local, "mails", "simple.eml")]
@@ -1013,12 +1083,12 @@ def test_sync_message_deleted_multiple_and_back(shell):
             local_sync_file = os.path.join(local, ".notmuch", f"notmuch-sync-{rsum[1]}")
             assert os.path.exists(local_sync_file)
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"7 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["7", lsum[1], "7", rsum[1]]
 
             remote_sync_file = os.path.join(remote, ".notmuch", f"notmuch-sync-{lsum[1]}")
             assert os.path.exists(remote_sync_file)
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"7 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["7", rsum[1], "7", lsum[1]]
 
             Path.unlink(os.path.join(local, "mails", "attachment.eml"))
             Path.unlink(os.path.join(remote, "mails", "simple.eml"))
@@ -1039,9 +1109,9 @@ def test_sync_message_deleted_multiple_and_back(shell):
             assert "local:  0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t1 messages deleted" in out[0]
             assert "remote: 0 new messages,\t0 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t1 messages deleted" in out[1]
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"7 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["7", lsum[1], "7", rsum[1]]
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"7 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["7", rsum[1], "7", lsum[1]]
 
             assert shell.run("notmuch", "search", "--output=files", "--format=json", "id:874llc2bkp.fsf@curie.anarc.at",
                              env={"NOTMUCH_CONFIG": remote_conf}).data == []
@@ -1080,9 +1150,9 @@ def test_sync_message_deleted_multiple_and_back(shell):
             assert "local:  1 new messages,\t1 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[0]
             assert "remote: 1 new messages,\t1 new files,\t0 files copied/moved,\t0 files deleted,\t0 messages with tag changes,\t0 messages deleted" in out[1]
             with open(local_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"10 {lsum[1]}"
+                assert f.read().split(" ")[:4] == ["10", lsum[1], "9", rsum[1]]
             with open(remote_sync_file, "r", encoding="utf-8") as f:
-                assert f.read() == f"9 {rsum[1]}"
+                assert f.read().split(" ")[:4] == ["9", rsum[1], "10", lsum[1]]
 
             assert shell.run("notmuch", "search", "--output=files", "--format=json", "id:874llc2bkp.fsf@curie.anarc.at",
                              env={"NOTMUCH_CONFIG": local_conf}).data == [os.path.join(local, "mails", "attachment.eml")]
@@ -1169,3 +1239,8 @@ def test_sync_mbsync(shell):
                 assert f.read() == "e"
             with open(remote_mbsyncstate, "r", encoding="utf-8") as f:
                 assert f.read() == "e"
+
+
+def test_soak(shell):
+    res = shell.run("python3", "-m", "test.soak", "--rounds", "5", "--seed", "1")
+    assert res.returncode == 0, res.stdout
@@ -1,11 +1,21 @@
 import pytest
 import os
 import sys
+import errno
 import io
 import json
+import logging
+import random
+import re
+import shutil
+import socket
 import stat
 import struct
+import subprocess
+import threading
+import time
 from unittest.mock import MagicMock, PropertyMock, call, mock_open, patch
+from pathlib import Path
 from tempfile import NamedTemporaryFile, TemporaryDirectory, gettempdir
 
 import notmuch2
@@ -87,6 +97,20 @@ def test_changes_changed_uuid():
         assert str(pwe.value) == "Last sync with UUID abc, but notmuch DB has UUID 00000000-0000-0000-0000-000000000000, aborting..."
 
 
+def test_changes_changed_uuid_accept():
+    db = lambda: None
+    db.messages = MagicMock(return_value=[])
+    rev = lambda: None
+    rev.rev = 124
+    rev.uuid = b'00000000-0000-0000-0000-000000000000'
+
+    with NamedTemporaryFile(mode="w+t", prefix="notmuch-sync-test-tmp-") as f:
+        f.write("123 abc")
+        f.flush()
+        assert {} == ns.get_changes(db, rev, prefix, f.name, accept_new_uuid=True)
+        db.messages.assert_called_once_with("lastmod:0..")
+
+
 def test_changes_later_rev():
     db = lambda: None
     rev = lambda: None
@@ -102,6 +126,30 @@ def test_changes_later_rev():
         assert str(pwe.value) == "Last sync revision 123 larger than current DB revision 122, aborting..."
 
 
+def test_changes_peer_rev():
+    db = lambda: None
+    db.messages = MagicMock(return_value=[])
+    rev = lambda: None
+    rev.rev = 124
+    rev.uuid = b'00000000-0000-0000-0000-000000000000'
+
+    with NamedTemporaryFile(mode="w+t", prefix="notmuch-sync-test-tmp-") as f:
+        f.write("123 00000000-0000-0000-0000-000000000000 456 00000000-0000-0000-0000-000000000001 host:/mail/")
+        f.flush()
+        assert {} == ns.get_changes(db, rev, prefix, f.name, peer_rev=460)
+        db.messages.assert_called_once_with("lastmod:124..")
+
+        # neither side changed
+        rev.rev = 123
+        db.messages.reset_mock()
+        assert {} == ns.get_changes(db, rev, prefix, f.name, peer_rev=456)
+        db.messages.assert_not_called()
+
+        # the other side's database has been rolled back
+        assert {} == ns.get_changes(db, rev, prefix, f.name, peer_rev=400)
+        db.messages.assert_called_once_with("lastmod:0..")
+
+
 def test_changes_corrupted_file():
     db = lambda: None
     rev = lambda: None
@@ -125,19 +173,315 @@ def test_initial_sync():
     db.revision = MagicMock(return_value=rev)
 
     fname = os.path.join(gettempdir(), ".notmuch", "notmuch-sync-00000000-0000-0000-0000-000000000001")
-    with patch.object(ns, "get_changes", return_value=[]) as gc:
-        istream = io.BytesIO(b"00000000-0000-0000-0000-000000000001\x00\x00\x00\x02[]")
+    with patch.object(ns, "get_changes", return_value=[]) as gc, patch.object(ns, "notmuch_version", return_value="0.38"):
+        # an older version without conflict resolutions
+        istream = io.BytesIO(b"00000000-0000-0000-0000-000000000001\x00\x00\x00\x0f{\"protocol\": 1}\x00\x00\x00\x02{}")
         ostream = io.BytesIO()
         mine, theirs, nchanges, syncname = ns.initial_sync(db, prefix, istream, ostream)
         assert mine == []
-        assert theirs == []
+        assert theirs == {}
         assert nchanges == 0
         assert syncname == fname
-        assert b"00000000-0000-0000-0000-000000000000\x00\x00\x00\x02[]" == ostream.getvalue()
+        hello = json.dumps({"implementation": "python", "version": ns.VERSION, "protocol": ns.PROTOCOL,
+                            "notmuch": "0.38", "digests": ns.DIGESTS, "encodings": ns.ENCODINGS, "features": ns.FEATURES, "read-only": False,
+                            "read-only-db": False, "last-rev": None,
+                            "peer": f"{socket.gethostname()}:{prefix}", "revision": 123}).encode("utf-8")
+        assert b"00000000-0000-0000-0000-000000000000" + struct.pack("!I", len(hello)) + hello + b"\x00\x00\x00\x02[]" == ostream.getvalue()
+        assert ns.session["digest"] == "sha256"
+
+        gc.assert_called_once_with(db, rev, prefix, fname, False, None, None)
+
+        theirs = json.dumps({"protocol": 1, "features": ["conflict-resolutions"]}).encode("utf-8")
+        istream = io.BytesIO(b"00000000-0000-0000-0000-000000000001" + struct.pack("!I", len(theirs)) + theirs +
+                             b"\x00\x00\x00\x02{}\x00\x00\x00\x02{}")
+        ostream = io.BytesIO()
+        ns.initial_sync(db, prefix, istream, ostream)
+        assert ostream.getvalue().endswith(b"\x00\x00\x00\x02[]\x00\x00\x00\x02{}")
 
-        gc.assert_called_once_with(db, rev, prefix, fname)
+        # resolutions can't be sent to an older version
+        istream = io.BytesIO(b"00000000-0000-0000-0000-000000000001\x00\x00\x00\x0f{\"protocol\": 1}\x00\x00\x00\x02{}")
+        with patch.object(ns, "resolve_conflicts", return_value={"tags": {"foo": ["inbox"]}}):
+            with pytest.raises(ValueError, match="doesn't support exchanging conflict resolutions"):
+                ns.initial_sync(db, prefix, istream, io.BytesIO(), conflict_cmd="resolve")
 
-    assert db.revision.call_count == 1
+    assert db.revision.call_count == 3
+
+
+def test_initial_sync_review(monkeypatch):
+    monkeypatch.setattr(ns, "session", dict(ns.session))
+    db = lambda: None
+    rev = lambda: None
+    rev.rev = 123
+    rev.uuid = b'00000000-0000-0000-0000-000000000000'
+    db.revision = MagicMock(return_value=rev)
+    db.find = MagicMock(side_effect=LookupError)
+
+    theirs = json.dumps({"foo": {"tags": ["inbox"], "files": ["INBOX/cur/1:2,"]}}).encode("utf-8")
+    with patch.object(ns, "get_changes", return_value={}), patch.object(ns, "notmuch_version", return_value="0.38"):
+        for answer, accepted in [("y", True), ("n", False)]:
+            hello = json.dumps({"protocol": 1, "features": ["conflict-resolutions"]}).encode("utf-8")
+            istream = io.BytesIO(b"00000000-0000-0000-0000-000000000001" + struct.pack("!I", len(hello)) + hello +
+                                 struct.pack("!I", len(theirs)) + theirs + b"\x00\x00\x00\x02{}")
+            ostream = io.BytesIO()
+            with patch("builtins.input", return_value=answer) as i, patch("sys.stdout", new_callable=io.StringIO) as out:
+                if accepted:
+                    ns.initial_sync(db, prefix, istream, ostream, review=True)
+                else:
+                    with pytest.raises(ValueError, match="not accepted"):
+                        ns.initial_sync(db, prefix, istream, ostream, review=True)
+                i.assert_called_once()
+                assert "+INBOX/cur/1:2," in out.getvalue()
+            # the remote only changes something once it has the resolutions
+            assert ostream.getvalue().endswith(b"{}\x00\x00\x00\x02{}") == accepted
+
+
+def test_review_changes():
+    m = MagicMock()
+    m.ghost = False
+    type(m).tags = PropertyMock(return_value=["inbox", "unread"])
+    db = lambda: None
+    db.find = MagicMock(return_value=m)
+    changes = {"foo": {"tags": ["inbox"], "files": []}}
+    with patch("builtins.input", return_value="yes"), patch("sys.stdout", new_callable=io.StringIO) as out:
+        assert ns.review_changes(db, prefix, {}, changes)
+        assert "@@ message foo @@\n-tag:unread\n" in out.getvalue()
+    assert [] == ns.planned
+    with patch("builtins.input", side_effect=EOFError), patch("sys.stdout", new_callable=io.StringIO):
+        assert not ns.review_changes(db, prefix, {}, changes)
+    # nothing to review
+    with patch("builtins.input") as i:
+        assert ns.review_changes(db, prefix, {}, {"foo": {"tags": ["inbox", "unread"], "files": []}})
+        i.assert_not_called()
+
+
+def test_initial_sync_incompatible():
+    db = lambda: None
+    rev = lambda: None
+    rev.rev = 123
+    rev.uuid = b'00000000-0000-0000-0000-000000000000'
+    db.revision = MagicMock(return_value=rev)
+
+    with patch.object(ns, "get_changes", return_value=[]) as gc:
+        # older version without hello, sends changes right away
+        istream = io.BytesIO(b"00000000-0000-0000-0000-000000000001\x00\x00\x00\x02{}")
+        with pytest.raises(ValueError) as pwe:
+            ns.initial_sync(db, prefix, istream, io.BytesIO())
+        assert str(pwe.value).startswith("Incompatible notmuch-sync on other side (unknown implementation version unknown, protocol unknown)")
+
+        hello = json.dumps({"implementation": "go", "version": "1.0", "protocol": 99}).encode("utf-8")
+        istream = io.BytesIO(b"00000000-0000-0000-0000-000000000001" + struct.pack("!I", len(hello)) + hello)
+        with pytest.raises(ValueError) as pwe:
+            ns.initial_sync(db, prefix, istream, io.BytesIO())
+        assert str(pwe.value).startswith("Incompatible notmuch-sync on other side (go implementation version 1.0, protocol 99)")
+        gc.assert_not_called()
+
+
+def test_notmuch_version():
+    res = MagicMock()
+    res.stdout = b"notmuch 0.38.3\n"
+    with patch("subprocess.run", return_value=res) as run:
+        assert "0.38.3" == ns.notmuch_version()
+        run.assert_called_once_with(["notmuch", "--version"], capture_output=True, check=True)
+    with patch("subprocess.run", side_effect=FileNotFoundError):
+        assert "unknown" == ns.notmuch_version()
+
+
+def test_report_unavailable(monkeypatch):
+    monkeypatch.setitem(ns.session, "delta", False)
+    monkeypatch.setitem(ns.session, "digest", "sha256")
+    with patch.object(ns.logger, "warning") as w:
+        ns.report_unavailable({"delta": True, "digest": "blake3"}, {"version": "0.0.1", "implementation": "python"})
+        assert w.call_count == 2
+        assert "remote notmuch-sync 0.0.1 (python)" in w.mock_calls[0].args
+    with patch.object(ns.logger, "warning") as w:
+        ns.report_unavailable({"delta": False, "digest": "sha256"}, {})
+        w.assert_not_called()
+
+
+def test_negotiate():
+    assert {"digest": "sha256", "delta": False, "buckets": False, "policies": [], "deferred": False, "xattrs": False, "revisions": False, "batches": False, "encoding": "json", "mbsync_digests": False, "outcomes": False, "local_tags": [], "received_tags": [], "ignore_tags": [], "only_tags": [], "exclude_tags": {}, "pull_only": False, "file_order": False, "resolutions": False, "file_digests": False, "duplicate_counts": False} == ns.negotiate({"digests": ["sha256"], "digest": None},
+                                                {"digests": ["sha256"]})
+    assert {"digest": "blake3", "delta": False, "buckets": False, "policies": [], "deferred": False, "xattrs": False, "revisions": False, "batches": False, "encoding": "json", "mbsync_digests": False, "outcomes": False, "local_tags": [], "received_tags": [], "ignore_tags": [], "only_tags": [], "exclude_tags": {}, "pull_only": False, "file_order": False, "resolutions": False, "file_digests": False, "duplicate_counts": False} == ns.negotiate({"digests": ["sha256", "blake3"], "digest": "blake3"},
+                                                {"digests": ["sha256", "blake3"], "digest": None})
+    assert {"digest": "blake3", "delta": False, "buckets": False, "policies": [], "deferred": False, "xattrs": False, "revisions": False, "batches": False, "encoding": "json", "mbsync_digests": False, "outcomes": False, "local_tags": [], "received_tags": [], "ignore_tags": [], "only_tags": [], "exclude_tags": {}, "pull_only": False, "file_order": False, "resolutions": False, "file_digests": False, "duplicate_counts": False} == ns.negotiate({"digests": ["sha256", "blake3"], "digest": None},
+                                                {"digests": ["sha256", "blake3"], "digest": "blake3"})
+    # not supported on the other side
+    assert {"digest": "sha256", "delta": False, "buckets": False, "policies": [], "deferred": False, "xattrs": False, "revisions": False, "batches": False, "encoding": "json", "mbsync_digests": False, "outcomes": False, "local_tags": [], "received_tags": [], "ignore_tags": [], "only_tags": [], "exclude_tags": {}, "pull_only": False, "file_order": False, "resolutions": False, "file_digests": False, "duplicate_counts": False} == ns.negotiate({"digests": ["sha256", "blake3"], "digest": "blake3"},
+                                                {"digests": ["sha256"], "digest": None})
+    # conflicting preferences
+    assert {"digest": "sha256", "delta": False, "buckets": False, "policies": [], "deferred": False, "xattrs": False, "revisions": False, "batches": False, "encoding": "json", "mbsync_digests": False, "outcomes": False, "local_tags": [], "received_tags": [], "ignore_tags": [], "only_tags": [], "exclude_tags": {}, "pull_only": False, "file_order": False, "resolutions": False, "file_digests": False, "duplicate_counts": False} == ns.negotiate({"digests": ["sha256", "blake3"], "digest": "blake3"},
+                                                {"digests": ["sha256", "blake3"], "digest": "sha256"})
+
+
+def test_negotiate_delta():
+    assert ns.negotiate({"features": ["delta"], "delta": True}, {"features": ["delta"]})["delta"]
+    assert ns.negotiate({"features": ["delta"]}, {"features": ["delta"], "delta": True})["delta"]
+    assert not ns.negotiate({"features": ["delta"]}, {"features": ["delta"]})["delta"]
+    assert not ns.negotiate({"features": ["delta"], "delta": True}, {"features": []})["delta"]
+
+
+def test_negotiate_read_only():
+    res = ns.negotiate({"policies": [{"pattern": "lists/**", "files": False, "delete": True, "priority": 0}]},
+                       {"read-only": True})
+    assert res["deferred"]
+    assert [{"pattern": "lists/**", "files": False, "delete": True, "priority": 0}, ns.READ_ONLY_POLICY] == res["policies"]
+    assert res == ns.negotiate({"read-only": True},
+                               {"policies": [{"pattern": "lists/**", "files": False, "delete": True, "priority": 0}]})
+    assert not ns.negotiate({"read-only": False}, {})["deferred"]
+
+
+def test_policy_for_read_only(monkeypatch):
+    monkeypatch.setitem(ns.session, "policies", [ns.READ_ONLY_POLICY])
+    assert {"files": False, "delete": False, "priority": 0} == ns.policy_for(["INBOX/cur/1:2,S", "foo"])
+
+
+def test_writable(tmp_path):
+    assert ns.writable(str(tmp_path))
+    assert [] == list(tmp_path.iterdir())
+    with patch("tempfile.mkstemp", side_effect=OSError(errno.EROFS, "Read-only file system")):
+        assert not ns.writable(str(tmp_path))
+    # other errors are reported by the actual writes
+    with patch("tempfile.mkstemp", side_effect=PermissionError(errno.EACCES, "Permission denied")):
+        assert ns.writable(str(tmp_path))
+
+
+def test_case_insensitive(tmp_path, monkeypatch):
+    assert not ns.case_insensitive(str(tmp_path))
+    assert [] == list(tmp_path.iterdir())
+    with patch("os.path.exists", return_value=True):
+        assert ns.case_insensitive(str(tmp_path))
+    assert [] == list(tmp_path.iterdir())
+
+    (tmp_path / "A").write_text("mail one")
+    assert ns.case_collision(str(tmp_path / "a")) is None
+    monkeypatch.setitem(ns.session, "case_insensitive", True)
+    # simulate a case-insensitive file system
+    monkeypatch.setattr(ns.os.path, "lexists", lambda p: os.path.basename(p).casefold() in
+                        [e.casefold() for e in os.listdir(os.path.dirname(p))])
+    assert str(tmp_path / "A") == ns.case_collision(str(tmp_path / "a"))
+    assert ns.case_collision(str(tmp_path / "A")) is None
+    assert ns.case_collision(str(tmp_path / "b")) is None
+    assert str(tmp_path / "B") == ns.case_collision(str(tmp_path / "b"), [str(tmp_path / "B")])
+
+    # renamed instead of copied onto itself
+    monkeypatch.setitem(ns.session, "portable", True)
+    ns.move_file(str(tmp_path / "A"), str(tmp_path / "a"))
+    assert ["a"] == os.listdir(tmp_path)
+    assert "mail one" == (tmp_path / "a").read_text()
+
+
+def test_open_write_db():
+    with patch("notmuch2.Database", side_effect=notmuch2.NotmuchError("locked")) as db, \
+            patch.object(ns, "writable", return_value=False), patch("os.path.isdir", return_value=True):
+        db.default_path.return_value = "/mail"
+        with pytest.raises(OSError) as pwe:
+            ns.open_write_db()
+        assert errno.EROFS == pwe.value.errno
+        assert "/mail/.notmuch" == pwe.value.filename
+        assert isinstance(pwe.value.__cause__, notmuch2.NotmuchError)
+    with patch("notmuch2.Database", side_effect=notmuch2.NotmuchError("locked")) as db, \
+            patch.object(ns, "writable", return_value=True), patch("os.path.isdir", return_value=True):
+        db.default_path.return_value = "/mail"
+        with pytest.raises(notmuch2.NotmuchError):
+            ns.open_write_db()
+
+
+def test_negotiate_xattrs():
+    assert ns.negotiate({"features": ["xattrs"], "xattrs": True}, {"features": ["xattrs"]})["xattrs"]
+    assert ns.negotiate({"features": ["xattrs"]}, {"features": ["xattrs"], "xattrs": True})["xattrs"]
+    assert not ns.negotiate({"features": ["xattrs"]}, {"features": ["xattrs"]})["xattrs"]
+    assert not ns.negotiate({"features": ["xattrs"], "xattrs": True}, {"features": ["delta"]})["xattrs"]
+
+
+def test_negotiate_local_tags():
+    assert [] == ns.negotiate({}, {})["local_tags"]
+    assert ["bar", "foo"] == ns.negotiate({"local-tags": ["foo"]}, {"local-tags": ["bar", "foo"]})["local_tags"]
+    assert ["from-laptop", "from-server"] == ns.negotiate({"received-tags": ["from-server"]},
+                                                          {"received-tags": ["from-laptop"]})["received_tags"]
+
+
+def test_negotiate_exclude_tags():
+    assert {} == ns.negotiate({}, {})["exclude_tags"]
+    assert {"nosync": "all", "private": "files"} == ns.negotiate({"exclude-tags": {"nosync": "files"}},
+                                                                  {"exclude-tags": {"nosync": "all", "private": "files"}})["exclude_tags"]
+    assert {"nosync": "all"} == ns.negotiate({"exclude-tags": {"nosync": "all"}}, {"exclude-tags": {"nosync": "files"}})["exclude_tags"]
+
+
+def test_exclude_tag(monkeypatch):
+    monkeypatch.setitem(ns.session, "exclude_tags", {"nosync": "files", "private": "all"})
+    assert ns.excluded(["inbox"]) is None
+    assert "files" == ns.excluded(["inbox", "nosync"])
+    assert "all" == ns.excluded(["nosync", "private"])
+    assert {"files": True, "delete": True, "priority": 0} == ns.policy_for(["cur/1"], ["inbox"])
+    assert {"files": False, "delete": False, "priority": 0} == ns.policy_for(["cur/1"], ["nosync"])
+
+    m = MagicMock()
+    m.ghost = False
+    m.tags = ["private"]
+    db = lambda: None
+    db.find = MagicMock(return_value=m)
+    assert 0 == ns.sync_tags(db, {}, {"foo": {"tags": ["inbox"]}})
+    m.frozen.assert_not_called()
+
+    args = ns.parse_args(["-r", "foo", "--config", "/nonexistent", "--exclude-tag", "nosync"])
+    assert {"nosync": "files"} == ns.exclude_tags(args)
+    assert {} == ns.exclude_tags(ns.parse_args(["-r", "foo", "--config", "/nonexistent"]))
+
+
+def test_read_only_db(monkeypatch):
+    assert ns.negotiate({"read-only-db": True}, {})["pull_only"]
+    assert ns.negotiate({}, {"read-only-db": True})["pull_only"]
+    assert not ns.negotiate({"read-only-db": False}, {})["pull_only"]
+    e = ns.ReadOnlyError("change tags", ["foo", "bar"])
+    assert 'refusing to change tags on read-only side: ["bar", "foo"]' == str(e)
+    assert ("change tags", ["foo", "bar"]) == (e.op, e.targets)
+
+    with pytest.raises(SystemExit):
+        ns.parse_args(["--read-only", "--pre-new"])
+
+    # flags that change what is exchanged are taken over, anything else is ignored
+    args = ns.parse_args(["--read-only"])
+    monkeypatch.setenv("SSH_ORIGINAL_COMMAND", "notmuch-sync --dry-run --delete --snapshot-cmd 'rm -rf ~' hydrate tag:foo")
+    args = ns.forced_command_args(args)
+    assert args.read_only and args.dry_run and not args.delete
+    assert ("hydrate", "tag:foo") == (args.command, args.query)
+    assert args.snapshot_cmd is None
+    monkeypatch.setenv("SSH_ORIGINAL_COMMAND", "notmuch-sync undo")
+    with pytest.raises(ns.ReadOnlyError):
+        ns.forced_command_args(ns.parse_args(["--read-only"]))
+    # the other side only selects profiles if the forced command allows it
+    monkeypatch.setenv("SSH_ORIGINAL_COMMAND", "notmuch-sync --multi")
+    with pytest.raises(ns.ReadOnlyError) as pwe:
+        ns.forced_command_args(ns.parse_args(["--read-only"]))
+    assert ("select profiles", ["--multi"]) == (pwe.value.op, pwe.value.targets)
+    assert ns.forced_command_args(ns.parse_args(["--read-only", "--multi"])).multi
+    monkeypatch.setenv("SSH_ORIGINAL_COMMAND", "notmuch-sync")
+    assert not ns.forced_command_args(ns.parse_args(["--read-only", "--multi"])).multi
+    monkeypatch.delenv("SSH_ORIGINAL_COMMAND")
+    assert not ns.forced_command_args(ns.parse_args(["--read-only"])).dry_run
+
+    monkeypatch.setitem(ns.session, "read_only_db", True)
+    db = MagicMock()
+    db.messages = MagicMock(return_value=[])
+    rev = lambda: None
+    rev.rev = 123
+    rev.uuid = b'00000000-0000-0000-0000-000000000000'
+    # the sync state isn't read, but the revision recorded by the other side is used
+    with patch("builtins.open") as o:
+        assert {} == ns.get_changes(db, rev, prefix, "/nonexistent", last_rev=100)
+        db.messages.assert_called_once_with("lastmod:101..")
+        assert {} == ns.get_changes(db, rev, prefix, "/nonexistent", last_rev=200)
+        db.messages.assert_called_with("lastmod:0..")
+        o.assert_not_called()
+
+    # changes asked for by the other side are refused
+    db.revision = MagicMock(return_value=rev)
+    with patch.object(ns, "get_changes", return_value={}), patch.object(ns, "notmuch_version", return_value="0.38"):
+        changes = b'{"foo": {"tags": ["inbox"], "files": ["cur/1"]}}'
+        istream = io.BytesIO(b"00000000-0000-0000-0000-000000000001\x00\x00\x00\x0f{\"protocol\": 1}" +
+                             struct.pack("!I", len(changes)) + changes)
+        with pytest.raises(ns.ReadOnlyError, match="foo"):
+            ns.initial_sync(db, prefix, istream, io.BytesIO())
 
 
 def test_record_sync():
@@ -146,13 +490,190 @@ def test_record_sync():
     rev.uuid = b'00000000-0000-0000-0000-000000000000'
 
     fname = os.path.join(gettempdir(), ".notmuch", "notmuch-sync-00000000-0000-0000-0000-000000000001")
-    with patch("builtins.open", mock_open()) as o:
+    with patch.object(ns, "write_atomic") as wa, patch("time.time", return_value=1700000000.5):
         ns.record_sync(fname, rev)
-        o.assert_called_once_with(fname, "w", encoding="utf-8")
-        hdl = o()
-        hdl.write.assert_called_once()
-        args = hdl.write.call_args.args
-        assert "123 00000000-0000-0000-0000-000000000000" == args[0]
+        wa.assert_called_once()
+        assert fname == wa.call_args.args[0]
+        state = json.loads(wa.call_args.args[1])
+        checksum = state.pop("checksum")
+        assert {"version": ns.STATE_VERSION, "rev": 123, "uuid": "00000000-0000-0000-0000-000000000000",
+                "peer_rev": None, "peer_uuid": None, "peer": None, "time": 1700000000, "stats": {}} == state
+        del state["version"]
+        assert ns.state_checksum(state) == checksum
+
+
+def test_record_sync_peer_revision(monkeypatch):
+    rev = lambda: None
+    rev.rev = 123
+    rev.uuid = b'00000000-0000-0000-0000-000000000000'
+
+    monkeypatch.setitem(ns.session, "peer", "host:/my mail/")
+    with NamedTemporaryFile(mode="r", prefix="notmuch-sync-test-tmp-") as f, patch("time.time", return_value=1700000000):
+        ns.record_sync(f.name, rev, {"rev": 456, "uuid": "00000000-0000-0000-0000-000000000001"}, {"messages": 2, "tags": 3})
+        assert 456 == json.loads(Path(f.name).read_text())["peer_rev"]
+        assert {"rev": 123, "uuid": "00000000-0000-0000-0000-000000000000", "peer_rev": 456,
+                "peer_uuid": "00000000-0000-0000-0000-000000000001", "peer": "host:/my mail/",
+                "time": 1700000000, "stats": {"messages": 2, "tags": 3}} == ns.read_sync_state(f.name)
+
+
+def test_read_sync_state():
+    with NamedTemporaryFile(mode="w+t", prefix="notmuch-sync-test-tmp-") as f:
+        f.write("123 00000000-0000-0000-0000-000000000000\n")
+        f.flush()
+        assert {"rev": 123, "uuid": "00000000-0000-0000-0000-000000000000", "peer_rev": None,
+                "peer_uuid": None, "peer": None, "time": None, "stats": {}} == ns.read_sync_state(f.name)
+        f.seek(0)
+        f.write("123 00000000-0000-0000-0000-000000000000 host:/mail/")
+        f.flush()
+        assert "host:/mail/" == ns.read_sync_state(f.name)["peer"]
+        assert ns.read_sync_state(f.name)["peer_rev"] is None
+        f.seek(0)
+        f.truncate()
+        f.write("123 00000000-0000-0000-0000-000000000000 456 00000000-0000-0000-0000-000000000001")
+        f.flush()
+        state = ns.read_sync_state(f.name)
+        assert 456 == state["peer_rev"]
+        assert state["peer"] is None
+        f.seek(0)
+        f.truncate()
+        f.write("123")
+        f.flush()
+        with pytest.raises(ValueError):
+            ns.read_sync_state(f.name)
+    with pytest.raises(FileNotFoundError):
+        ns.read_sync_state("/nonexistent/notmuch-sync-00000000-0000-0000-0000-000000000001")
+
+
+def test_read_sync_state_versioned(monkeypatch, tmp_path):
+    rev = lambda: None
+    rev.rev = 123
+    rev.uuid = b'00000000-0000-0000-0000-000000000000'
+    monkeypatch.setitem(ns.session, "peer", "host:/mail/")
+
+    fname = tmp_path / "notmuch-sync-00000000-0000-0000-0000-000000000001"
+    # files in the old format are read and replaced with the next sync
+    fname.write_text("123 00000000-0000-0000-0000-000000000000 host:/mail/")
+    old = ns.read_sync_state(str(fname))
+    assert old["time"] is None
+    ns.record_sync(str(fname), rev)
+    new = ns.read_sync_state(str(fname))
+    assert new.pop("time") > 0
+    assert {**old, "time": None} == {**new, "time": None}
+
+    state = json.loads(fname.read_text())
+    state["rev"] = 122
+    fname.write_text(json.dumps(state))
+    with pytest.raises(ValueError, match="corrupted"):
+        ns.read_sync_state(str(fname))
+    for broken in ["{", "{}", "[1]", '{"version": 1}']:
+        fname.write_text(broken)
+        with pytest.raises(ValueError, match="corrupted"):
+            ns.read_sync_state(str(fname))
+
+    # newer versions may add fields
+    state = {"rev": 123, "uuid": "00000000-0000-0000-0000-000000000000", "clock": {"a": 1}}
+    fname.write_text(json.dumps({"version": ns.STATE_VERSION, **state, "checksum": ns.state_checksum(state)}))
+    assert {"a": 1} == ns.read_sync_state(str(fname))["clock"]
+    fname.write_text(json.dumps({"version": ns.STATE_VERSION + 1, **state, "checksum": ns.state_checksum(state)}))
+    with pytest.raises(ValueError, match="update notmuch-sync"):
+        ns.read_sync_state(str(fname))
+
+
+def test_send_recv_changes(monkeypatch):
+    changes = {f"{i}@example.org": {"tags": ["inbox"], "files": [f"cur/{i}"]} for i in range(5)}
+    monkeypatch.setattr(ns, "ID_BATCH", 2)
+
+    monkeypatch.setitem(ns.session, "batches", False)
+    stream = io.BytesIO()
+    ns.send_changes(changes, stream)
+    stream.seek(0)
+    assert changes == ns.decode_changes(ns.read(stream))
+    stream.seek(0)
+    assert changes == ns.recv_changes(stream)
+
+    monkeypatch.setitem(ns.session, "batches", True)
+    stream = io.BytesIO()
+    ns.send_changes(changes, stream)
+    stream.seek(0)
+    assert [2, 2, 1] == [len(json.loads(ns.read(stream))) for _ in range(3)]
+    assert b"" == ns.read(stream)
+    stream.seek(0)
+    assert changes == ns.recv_changes(stream)
+
+    stream = io.BytesIO()
+    ns.send_changes({}, stream)
+    assert b"\x00\x00\x00\x00" == stream.getvalue()
+    stream.seek(0)
+    assert {} == ns.recv_changes(stream)
+
+    with pytest.raises(ValueError):
+        ns.recv_changes(io.BytesIO(b'\x00\x00\x00\x02[]\x00\x00\x00\x00'))
+
+
+def test_exchange_revisions(monkeypatch):
+    rev = lambda: None
+    rev.rev = 123
+    rev.uuid = b'00000000-0000-0000-0000-000000000000'
+
+    monkeypatch.setitem(ns.session, "revisions", False)
+    ostream = io.BytesIO()
+    assert ns.exchange_revisions(rev, io.BytesIO(), ostream) is None
+    assert b"" == ostream.getvalue()
+
+    monkeypatch.setitem(ns.session, "revisions", True)
+    theirs = b'{"rev": 456, "uuid": "00000000-0000-0000-0000-000000000001"}'
+    istream = io.BytesIO(struct.pack("!I", len(theirs)) + theirs)
+    assert {"rev": 456, "uuid": "00000000-0000-0000-0000-000000000001"} == ns.exchange_revisions(rev, istream, ostream)
+    mine = b'{"rev": 123, "uuid": "00000000-0000-0000-0000-000000000000"}'
+    assert struct.pack("!I", len(mine)) + mine == ostream.getvalue()
+
+    with pytest.raises(ValueError):
+        ns.exchange_revisions(rev, io.BytesIO(b'\x00\x00\x00\x0b{"rev": -1}'), io.BytesIO())
+
+
+def test_record_sync_peer(monkeypatch):
+    rev = lambda: None
+    rev.rev = 123
+    rev.uuid = b'00000000-0000-0000-0000-000000000000'
+
+    monkeypatch.setitem(ns.session, "peer", "host:/mail/")
+    with patch.object(ns, "write_atomic") as wa:
+        ns.record_sync("foo", rev)
+        assert "host:/mail/" == json.loads(wa.call_args.args[1])["peer"]
+
+
+def test_initial_sync_new_uuid(monkeypatch):
+    db = lambda: None
+    rev = lambda: None
+    rev.rev = 123
+    rev.uuid = b'00000000-0000-0000-0000-000000000000'
+    db.revision = MagicMock(return_value=rev)
+
+    with TemporaryDirectory() as tmp:
+        pfx = tmp + os.sep
+        Path(pfx, ".notmuch").mkdir()
+        old = Path(pfx, ".notmuch", "notmuch-sync-00000000-0000-0000-0000-000000000002")
+        old.write_text("100 00000000-0000-0000-0000-000000000000 host:/mail/")
+        Path(pfx, ".notmuch", "notmuch-sync-00000000-0000-0000-0000-000000000003").write_text(
+            "100 00000000-0000-0000-0000-000000000000 other:/mail/")
+
+        hello = json.dumps({"protocol": ns.PROTOCOL, "peer": "host:/mail/"}).encode("utf-8")
+        data = b"00000000-0000-0000-0000-000000000001" + struct.pack("!I", len(hello)) + hello + b"\x00\x00\x00\x02{}\x00\x00\x00\x02{}"
+
+        with patch.object(ns, "get_changes", return_value=[]):
+            with pytest.raises(ValueError) as pwe:
+                ns.initial_sync(db, pfx, io.BytesIO(data), io.BytesIO(), delete=True)
+            assert "refusing to sync deletions" in str(pwe.value)
+            assert old.exists()
+
+            ns.initial_sync(db, pfx, io.BytesIO(data), io.BytesIO(), dry_run=True, delete=True, accept_new_uuid=True)
+            assert old.exists()
+
+            ns.initial_sync(db, pfx, io.BytesIO(data), io.BytesIO())
+            assert not old.exists()
+            assert Path(pfx, ".notmuch", "notmuch-sync-00000000-0000-0000-0000-000000000002.replaced").exists()
+            assert Path(pfx, ".notmuch", "notmuch-sync-00000000-0000-0000-0000-000000000003").exists()
+    ns.session["peer"] = None
 
 
 def test_sync_tags_empty():
@@ -235,6 +756,22 @@ def test_sync_tags_only_theirs_not_found():
     db.find.assert_called_once_with("foo")
 
 
+def test_sync_tags_dry_run():
+    m = MagicMock()
+    m.ghost = False
+    m.tags = ["foo", "bar"]
+
+    db = lambda: None
+    db.find = MagicMock(return_value=m)
+
+    ns.planned.clear()
+    changes = ns.sync_tags(db, {}, {"foo": {"tags": ["bar", "foobar"]}}, dry_run=True)
+    assert changes == 1
+    m.frozen.assert_not_called()
+    assert ns.planned == [{"op": "tags", "id": "foo", "add": ["foobar"], "remove": ["foo"]}]
+    ns.planned.clear()
+
+
 def test_sync_tags_only_mine():
     db = lambda: None
     changes = ns.sync_tags(db, {"foo": {"tags": ["foo", "bar"]}}, {})
@@ -307,10 +844,178 @@ def test_sync_tags_mine_theirs_overlap():
     mt.to_maildir_flags.assert_called_once()
 
 
+def test_sync_tags_mine_theirs_resolved(monkeypatch):
+    m = MagicMock()
+    m.frozen = MagicMock()
+    m.frozen.__enter__.return_value = None
+    m.frozen.__exit__.return_value = False
+    m.ghost = False
+
+    mt = MagicMock(spec=list)
+    tags = ["foo", "bar"]
+    mt.__iter__.return_value = iter(tags)
+    mt.__len__.return_value = len(tags)
+    mt.clear = MagicMock()
+    mt.add = MagicMock()
+    mt.to_maildir_flags = MagicMock()
+    type(m).tags = PropertyMock(return_value=mt)
+
+    db = lambda: None
+    db.find = MagicMock(return_value=m)
+
+    monkeypatch.setitem(ns.session, "resolved", {"tags": {"foo": ["tag1"]}, "files": {}})
+    changes = ns.sync_tags(db, {"foo": {"tags": ["tag1", "tag2"]}}, {"foo": {"tags": ["bar", "foobar"]}})
+    assert changes == 1
+
+    mt.clear.assert_called_once()
+    assert mt.add.mock_calls == [call("tag1")]
+
+
+def test_resolve_conflicts():
+    mine = {"foo": {"tags": ["a", "b"], "files": ["cur/1"]},
+            "bar": {"tags": ["a"], "files": ["cur/2"]},
+            "baz": {"tags": ["a"], "files": ["cur/3"]}}
+    theirs = {"foo": {"tags": ["a"], "files": ["cur/1"]},
+              "bar": {"tags": ["a"], "files": ["new/2"]},
+              "other": {"tags": ["c"], "files": ["cur/4"]}}
+
+    def _run(cmd, input, **kwargs):
+        conflict = json.loads(input.decode("utf-8"))
+        res = MagicMock()
+        if conflict["type"] == "tags":
+            assert conflict == {"type": "tags", "id": "foo", "local": ["a", "b"], "remote": ["a"]}
+            res.stdout = b'{"tags": ["b"]}\n'
+        else:
+            assert conflict == {"type": "files", "id": "bar", "local": ["cur/2"], "remote": ["new/2"]}
+            res.stdout = b'{"files": "local"}'
+        return res
+
+    with patch("subprocess.run", side_effect=_run) as run:
+        res = ns.resolve_conflicts("resolve --flag", mine, theirs)
+        assert {"tags": {"foo": ["b"]}, "files": {"bar": "local"}} == res
+        assert run.call_count == 2
+        assert ["resolve", "--flag"] == run.call_args.args[0]
+
+    res = MagicMock()
+    res.stdout = b""
+    with patch("subprocess.run", return_value=res):
+        assert {"tags": {}, "files": {}} == ns.resolve_conflicts("resolve", mine, theirs)
+
+    res.stdout = b'{"files": "both"}'
+    with patch("subprocess.run", return_value=res):
+        with pytest.raises(ValueError) as pwe:
+            ns.resolve_conflicts("resolve", {"bar": mine["bar"]}, {"bar": theirs["bar"]})
+        assert "invalid resolution 'both'" in str(pwe.value)
+
+
+class FakeTags(set):
+    def to_maildir_flags(self):
+        pass
+
+
+def fake_db(tags):
+    """A notmuch database with the given tags by message ID, modified in place."""
+    msgs = {}
+    for mid in tags:
+        m = MagicMock()
+        m.ghost = False
+        m.tags = FakeTags(tags[mid])
+        msgs[mid] = m
+    db = lambda: None
+    db.find = lambda mid: msgs[mid]
+    return db, msgs
+
+
+def random_changes(rng, msgs, tags):
+    """Change tags of random messages, returning the changes as computed by get_changes."""
+    changes = {}
+    for _ in range(rng.randint(0, 8)):
+        mid = rng.choice(sorted(msgs))
+        tag = rng.choice(tags)
+        if rng.random() < 0.5:
+            msgs[mid].tags.add(tag)
+        else:
+            msgs[mid].tags.discard(tag)
+        changes[mid] = {"tags": sorted(msgs[mid].tags), "files": []}
+    return changes
+
+
+@pytest.mark.parametrize("policy", ["union", "local", "remote", "intersection"])
+def test_sync_tags_converge(monkeypatch, policy):
+    # random changes on both sides, resolved by a conflict command implementing
+    # the policy (default union without one), must result in the same tags
+    tags = ["a", "b", "c", "d"]
+
+    def _resolve(cmd, input, **kwargs):
+        conflict = json.loads(input.decode("utf-8"))
+        res = MagicMock()
+        if policy == "union":
+            res.stdout = b""
+        elif policy == "intersection":
+            res.stdout = json.dumps({"tags": sorted(set(conflict["local"]) & set(conflict["remote"]))}).encode("utf-8")
+        else:
+            res.stdout = json.dumps({"tags": conflict[policy]}).encode("utf-8")
+        return res
+
+    for seed in range(20):
+        rng = random.Random(seed)
+        base = {f"m{i}": set(rng.sample(tags, rng.randint(0, len(tags)))) for i in range(6)}
+        db_local, local = fake_db(base)
+        db_remote, remote = fake_db(base)
+        for _ in range(10):
+            before = {mid: set(local[mid].tags) for mid in local}
+            assert before == {mid: set(remote[mid].tags) for mid in remote}
+            changes_local = random_changes(rng, local, tags)
+            changes_remote = random_changes(rng, remote, tags)
+            edited_local = {mid: set(c["tags"]) for mid, c in changes_local.items()}
+            edited_remote = {mid: set(c["tags"]) for mid, c in changes_remote.items()}
+
+            with patch("subprocess.run", side_effect=_resolve):
+                resolved = ns.resolve_conflicts("resolve", changes_local, changes_remote)
+            monkeypatch.setitem(ns.session, "resolved", resolved)
+            ns.sync_tags(db_local, changes_local, changes_remote)
+            ns.sync_tags(db_remote, changes_remote, changes_local)
+
+            for mid in local:
+                assert set(local[mid].tags) == set(remote[mid].tags), (seed, mid)
+                result = set(local[mid].tags)
+                if mid in edited_local and mid in edited_remote:
+                    if edited_local[mid] == edited_remote[mid] or policy == "union":
+                        assert edited_local[mid] | edited_remote[mid] == result
+                    elif policy == "intersection":
+                        assert edited_local[mid] & edited_remote[mid] == result
+                    else:
+                        assert {"local": edited_local, "remote": edited_remote}[policy][mid] == result
+                elif mid in edited_local:
+                    assert edited_local[mid] == result
+                elif mid in edited_remote:
+                    assert edited_remote[mid] == result
+                else:
+                    assert before[mid] == result
+
+
 def test_sync_server(monkeypatch):
+    monkeypatch.setitem(ns.session, "fsync", False)
     args = lambda: None
     args.delete = False
     args.mbsync = False
+    args.dry_run = False
+    args.min_free = 0
+    args.clone = None
+    args.min_inodes = 0
+    args.space_wait = 0
+    args.pre_new = False
+    args.post_new = False
+    args.snapshot_cmd = None
+    args.config = "/nonexistent"
+    args.accept_new_uuid = False
+    args.command = None
+    args.local_tags = []
+    args.received_tag = None
+    args.strict = False
+    args.exclude_tag = None
+    args.ignore_tags = []
+    args.sync_tags = []
 
     db = lambda: None
     rev = lambda: None
@@ -318,6 +1023,7 @@ def test_sync_server(monkeypatch):
     rev.uuid = b'00000000-0000-0000-0000-000000000000'
     db.revision = MagicMock(return_value=rev)
     db.default_path = MagicMock(return_value=gettempdir())
+    db.config = {}
 
     mock_ctx = MagicMock()
     mock_ctx.__enter__.return_value = db
@@ -326,17 +1032,26 @@ def test_sync_server(monkeypatch):
     fname = os.path.join(gettempdir(), ".notmuch", "notmuch-sync-00000000-0000-0000-0000-000000000001")
     with patch("notmuch2.Database", return_value=mock_ctx):
         with patch.object(ns, "get_changes", return_value=[]) as gc:
-            with patch("builtins.open", mock_open()) as o:
-                mockio = io.BytesIO(b'00000000-0000-0000-0000-000000000001\x00\x00\x00\x02{}\x00\x00\x00\x02[]\x00\x00\x00\x02[]\x00\x00\x00\x02[]')
+            with patch("builtins.open", mock_open()) as o, patch.object(ns, "read_config"), \
+                    patch.object(ns, "read_evicted", return_value={}), patch.object(ns, "clean_partials") as cp, \
+                    patch("os.replace") as rp:
+                mockio = io.BytesIO(b'00000000-0000-0000-0000-000000000001\x00\x00\x00\x0f{"protocol": 1}\x00\x00\x00\x02{}\x00\x00\x00\x02[]\x00\x00\x00\x02[]\x00\x00\x00\x02[]\x00\x00\x00\x24{"free": 0, "size": 0, "reserve": 0}')
                 mockio.buffer = mockio
                 monkeypatch.setattr(sys, "stdin", mockio)
                 ns.sync_remote(args)
-                o.assert_called_once_with(fname, "w", encoding="utf-8")
+                cp.assert_called_once_with(os.path.join(gettempdir(), ""), False)
+                # the undo log of an unfinished sync is read first, then the
+                # sync state for the hello
+                undo = os.path.join(ns.state_path(os.path.join(gettempdir(), ""), "notmuch-sync-undo.new"), "log")
+                assert [call(undo, "r", encoding="utf-8"), call(fname, "r", encoding="utf-8"), call(ns.partial_path(fname), "wb")] == \
+                    [c for c in o.call_args_list if c.args]
                 hdl = o()
                 hdl.write.assert_called_once()
                 args = hdl.write.call_args.args
-                assert "124 00000000-0000-0000-0000-000000000000" == args[0]
-            gc.assert_called_once_with(db, rev, prefix, fname)
+                state = json.loads(args[0])
+                assert (124, "00000000-0000-0000-0000-000000000000") == (state["rev"], state["uuid"])
+                rp.assert_called_once_with(ns.partial_path(fname), fname)
+            gc.assert_called_once_with(db, rev, prefix, fname, False, None, None)
 
     assert db.revision.call_count == 2
     db.default_path.assert_called_once()
@@ -396,6 +1111,38 @@ def test_missing_files_ghost():
     assert db.find.mock_calls == [ call("bar"), call("bar") ]
 
 
+def test_missing_files_policy(monkeypatch):
+    monkeypatch.setitem(ns.session, "policies", [{"pattern": "lists/*", "files": False, "delete": True, "priority": 0}])
+    db = lambda: None
+    db.find = MagicMock(side_effect=LookupError)
+
+    changes = {"foo": {"tags": ["foo"], "files": ["lists/cur/foo"]},
+               "bar": {"tags": ["bar"], "files": ["INBOX/cur/bar"]}}
+
+    istream = io.BytesIO(b"\x00\x00\x00\x02[]\x00\x00\x00\x02[]")
+    ostream = io.BytesIO()
+    exp = {"bar": {"tags": ["bar"], "files": ["INBOX/cur/bar"]}}
+    assert (exp, 0, 0) == ns.get_missing_files(db, prefix, {}, changes, istream, ostream)
+
+
+def test_missing_files_evicted():
+    with TemporaryDirectory() as tmp:
+        pfx = tmp + os.sep
+        Path(pfx, ".notmuch").mkdir()
+        ns.write_evicted(pfx, {"foo": ["foo"]})
+        db = lambda: None
+        db.find = MagicMock(side_effect=LookupError)
+
+        changes = {"foo": {"tags": ["foo", "bar"], "files": ["foofile"]},
+                   "bar": {"tags": ["bar"], "files": ["barfile"]}}
+
+        istream = io.BytesIO(b"\x00\x00\x00\x02[]\x00\x00\x00\x02[]")
+        ostream = io.BytesIO()
+        exp = {"bar": {"tags": ["bar"], "files": ["barfile"]}}
+        assert (exp, 0, 0) == ns.get_missing_files(db, pfx, {}, changes, istream, ostream)
+        assert {"foo": ["foo", "bar"]} == ns.read_evicted(pfx)
+
+
 def test_missing_files_inconsistent_no_move():
     m = MagicMock()
     m.ghost = False
@@ -545,6 +1292,60 @@ def test_missing_files_multiple_dups_copy_move():
     assert db.find.mock_calls == [ call("foo"), call("foo") ]
 
 
+def test_missing_files_case_insensitive(tmp_path, monkeypatch):
+    monkeypatch.setitem(ns.session, "case_insensitive", True)
+    monkeypatch.setattr(ns.os.path, "lexists", lambda p: os.path.basename(p).casefold() in
+                        [e.casefold() for e in os.listdir(os.path.dirname(p))])
+    monkeypatch.setattr(ns, "log_file_warnings", MagicMock())
+    monkeypatch.setattr(ns, "file_warnings", {})
+    pfx = str(tmp_path) + "/"
+    (tmp_path / "cur").mkdir()
+    (tmp_path / "cur" / "A").write_text("mail one")
+    (tmp_path / "cur" / "B").write_text("mail two")
+    m = MagicMock()
+    m.ghost = False
+    m.filenames = MagicMock(return_value=[pfx + "cur/A", pfx + "cur/B"])
+    db = lambda: None
+    db.find = MagicMock(return_value=m)
+    db.add = MagicMock()
+    db.remove = MagicMock()
+
+    # cur/a would be copied onto cur/A, which is needed as well, and cur/b
+    # received onto cur/B; deleting cur/B would delete cur/b
+    h = json.dumps([ns.digest(b"mail one"), ns.digest(b"mail one"), ns.digest(b"mail three")]).encode("utf-8")
+    istream = io.BytesIO(b"\x00\x00\x00\x02[]" + struct.pack("!I", len(h)) + h)
+    changes_theirs = {"foo": {"tags": [], "files": ["cur/a", "cur/A", "cur/b"]}}
+    assert ({}, 0, 0) == ns.get_missing_files(db, pfx, {}, changes_theirs, istream, io.BytesIO())
+    db.add.assert_not_called()
+    db.remove.assert_not_called()
+    assert ["A", "B"] == sorted(os.listdir(tmp_path / "cur"))
+    assert [pfx + "cur/B", pfx + "cur/a", pfx + "cur/b"] == sorted(ns.file_warnings.pop((ns.CASE_COLLISION, pfx + "cur")))
+
+    # renamed on the other side
+    h = json.dumps([ns.digest(b"mail one"), ns.digest(b"mail two")]).encode("utf-8")
+    istream = io.BytesIO(b"\x00\x00\x00\x02[]" + struct.pack("!I", len(h)) + h)
+    changes_theirs = {"foo": {"tags": [], "files": ["cur/A", "cur/b"]}}
+    assert ({}, 1, 0) == ns.get_missing_files(db, pfx, {}, changes_theirs, istream, io.BytesIO())
+    db.add.assert_called_once_with(pfx + "cur/b")
+    db.remove.assert_called_once_with(pfx + "cur/B")
+    assert ["A", "b"] == sorted(os.listdir(tmp_path / "cur"))
+    assert {} == ns.file_warnings
+
+
+@patch.object(ns, "check_space")
+def test_sync_files_case_insensitive(cs, tmp_path, monkeypatch):
+    monkeypatch.setitem(ns.session, "case_insensitive", True)
+    monkeypatch.setattr(ns, "file_warnings", {})
+    missing = {"foo": {"tags": ["foo"], "files": ["a/cur/X", "a/cur/x", "a/cur/y"]}}
+    istream = io.BytesIO(b"\x00\x00\x00\x02[]")
+    ostream = io.BytesIO()
+    ns.planned.clear()
+    assert (1, 2, 0) == ns.sync_files(None, str(tmp_path) + "/", missing, istream, ostream, dry_run=True)
+    assert b'\x00\x00\x00\x16["a/cur/X", "a/cur/y"]' == ostream.getvalue()
+    assert [str(tmp_path / "a/cur/x")] == ns.file_warnings[(ns.CASE_COLLISION, str(tmp_path / "a/cur"))]
+    ns.planned.clear()
+
+
 def test_missing_files_moved():
     m = MagicMock()
     m.ghost = False
@@ -576,6 +1377,265 @@ def test_missing_files_moved():
     assert db.find.mock_calls == [ call("foo"), call("foo") ]
 
 
+def test_missing_files_flags(monkeypatch):
+    monkeypatch.setitem(ns.session, "sync_flags", False)
+    m = MagicMock()
+    m.ghost = False
+    db = lambda: None
+
+    db.find = MagicMock(return_value=m)
+    db.add = MagicMock(return_value=(m, True))
+    db.remove = MagicMock()
+
+    with TemporaryDirectory() as tmp:
+        pfx = tmp + os.sep
+        Path(pfx, "INBOX", "cur").mkdir(parents=True)
+        Path(pfx, "INBOX", "cur", "1:2,S").write_text("mail one")
+        m.filenames = MagicMock(return_value=[Path(pfx, "INBOX", "cur", "1:2,S")])
+        changes = {"foo": {"tags": ["foo"], "files": ["INBOX/cur/1:2,RS"]}}
+
+        # nothing requested, no hashes needed
+        istream = io.BytesIO(b"\x00\x00\x00\x02[]\x00\x00\x00\x02[]")
+        ostream = io.BytesIO()
+        assert ({}, 1, 0) == ns.get_missing_files(db, pfx, {}, changes, istream, ostream)
+        assert b"\x00\x00\x00\x02[]\x00\x00\x00\x02[]" == ostream.getvalue()
+
+        assert Path(pfx, "INBOX", "cur", "1:2,RS").exists()
+        assert not Path(pfx, "INBOX", "cur", "1:2,S").exists()
+        db.add.assert_called_once_with(os.path.join(pfx, "INBOX/cur/1:2,RS"))
+        db.remove.assert_called_once_with(os.path.join(pfx, "INBOX/cur/1:2,S"))
+
+        # flags follow tags, nothing to rename
+        ns.session["sync_flags"] = True
+        changes = {"foo": {"tags": ["foo"], "files": ["INBOX/cur/1:2,FS"]}}
+        m.filenames = MagicMock(return_value=[Path(pfx, "INBOX", "cur", "1:2,RS")])
+        istream = io.BytesIO(b"\x00\x00\x00\x02[]\x00\x00\x00\x02[]")
+        ostream = io.BytesIO()
+        assert ({}, 0, 0) == ns.get_missing_files(db, pfx, {}, changes, istream, ostream)
+        assert b"\x00\x00\x00\x02[]\x00\x00\x00\x02[]" == ostream.getvalue()
+        assert Path(pfx, "INBOX", "cur", "1:2,RS").exists()
+        assert db.add.call_count == 1
+
+
+def test_maildir_flags():
+    assert ("INBOX/cur/1", "RS") == ns.maildir_flags("INBOX/cur/1:2,RS")
+    assert ("INBOX/cur/1", "") == ns.maildir_flags("INBOX/cur/1:2,")
+    assert ("INBOX/new/1", None) == ns.maildir_flags("INBOX/new/1")
+    assert ("a:2,b/new/1", None) == ns.maildir_flags("a:2,b/new/1")
+
+
+def test_mbsync_uid(tmp_path):
+    assert 42 == ns.mbsync_uid("INBOX/cur/123.abc,U=42:2,S")
+    assert 42 == ns.mbsync_uid("INBOX/new/123.abc,U=42")
+    assert ns.mbsync_uid("INBOX/cur/123.abc:2,S") is None
+    assert ns.mbsync_uid("INBOX,U=1/cur/123.abc") is None
+    assert ns.mbsync_uid("INBOX/cur/123.abc,U=x:2,S") is None
+
+    (tmp_path / "cur").mkdir()
+    fname = str(tmp_path / "cur" / "123.abc,U=42:2,S")
+    # no state, can't tell
+    assert ns.mbsync_tracked(fname)
+    assert not ns.mbsync_tracked(str(tmp_path / "cur" / "123.abc:2,S"))
+    (tmp_path / ".mbsyncstate").write_text("FarUidValidity 1\nNearUidValidity 42\nMaxPulledUid 42\n\n7 42 S\n")
+    assert ns.mbsync_tracked(fname)
+    (tmp_path / ".mbsyncstate").write_text("FarUidValidity 1\nNearUidValidity 42\nMaxPulledUid 42\n\n7 43 S\n")
+    assert not ns.mbsync_tracked(fname)
+
+
+def test_flag_renames(monkeypatch):
+    monkeypatch.setitem(ns.session, "sync_flags", False)
+    assert {} == ns.flag_renames(["cur/1:2,S"], ["cur/1:2,S"])
+    assert {"cur/1:2,S": "cur/1:2,RS"} == ns.flag_renames(["cur/1:2,S"], ["cur/1:2,RS"])
+    assert {"cur/1:2,S": "cur/1:2,RS"} == ns.flag_renames(["cur/1:2,RS"], ["cur/1:2,S"])
+    assert {"cur/1:2,FS": "cur/1:2,FRS", "cur/1:2,R": "cur/1:2,FRS"} == \
+        ns.flag_renames(["cur/1:2,FS", "cur/2:2,S"], ["cur/1:2,R", "cur/2:2,S"])
+    # different folders or no flags are different files
+    assert {} == ns.flag_renames(["a/cur/1:2,S"], ["b/cur/1:2,RS"])
+    assert {} == ns.flag_renames(["new/1"], ["new/1:2,S"])
+
+    ns.session["sync_flags"] = True
+    assert {"cur/1:2,RS": "cur/1:2,S"} == ns.flag_renames(["cur/1:2,S"], ["cur/1:2,RS"])
+    assert {"cur/1:2,S": "cur/1:2,RS"} == ns.flag_renames(["cur/1:2,RS"], ["cur/1:2,S"])
+
+
+def test_notmuch_dir(tmp_path):
+    # nothing there yet, e.g. before notmuch new
+    assert str(tmp_path / ".notmuch") == ns.notmuch_dir(str(tmp_path))
+    (tmp_path / "xapian").mkdir()
+    assert str(tmp_path) == ns.notmuch_dir(str(tmp_path))
+    (tmp_path / ".notmuch").mkdir()
+    assert str(tmp_path / ".notmuch") == ns.notmuch_dir(str(tmp_path))
+
+
+def test_use_notmuch_dir(monkeypatch, tmp_path):
+    monkeypatch.setitem(ns.session, "notmuch_dir", None)
+    db = lambda: None
+    db.config = {}
+    ns.use_notmuch_dir(db)
+    assert os.path.join("/mail", ".notmuch", "notmuch-sync-evicted") == ns.state_path("/mail/", "notmuch-sync-evicted")
+
+    (tmp_path / "xapian").mkdir()
+    db.config = {"database.path": str(tmp_path)}
+    ns.use_notmuch_dir(db)
+    assert str(tmp_path / "notmuch-sync-evicted") == ns.state_path("/mail/", "notmuch-sync-evicted")
+    ns.write_evicted("/mail/", {"foo": ["bar"]})
+    assert {"foo": ["bar"]} == ns.read_evicted("/mail/")
+
+
+def test_mail_root():
+    db = lambda: None
+    db.default_path = MagicMock(return_value="/home/user/mail")
+    db.config = {"database.path": "/home/user/mail"}
+    assert "/home/user/mail/" == ns.mail_root(db)
+    db.config = {"database.path": "/home/user/.local/share/notmuch/default", "database.mail_root": "/home/user/mail"}
+    assert "/home/user/mail/" == ns.mail_root(db)
+    db.default_path.assert_not_called()
+    # older notmuch without configuration in the database
+    db.config = {}
+    assert "/home/user/mail/" == ns.mail_root(db)
+
+
+def test_sync_flags_enabled():
+    db = lambda: None
+    db.config = {}
+    assert ns.sync_flags_enabled(db)
+    db.config = {"maildir.synchronize_flags": "true"}
+    assert ns.sync_flags_enabled(db)
+    db.config = {"maildir.synchronize_flags": "False"}
+    assert not ns.sync_flags_enabled(db)
+
+
+def test_sync_tags_no_sync_flags(monkeypatch):
+    monkeypatch.setitem(ns.session, "sync_flags", False)
+    m = MagicMock()
+    m.ghost = False
+    mt = MagicMock(spec=list)
+    mt.__iter__.return_value = iter(["foo"])
+    mt.clear = MagicMock()
+    mt.add = MagicMock()
+    mt.to_maildir_flags = MagicMock()
+    type(m).tags = PropertyMock(return_value=mt)
+
+    db = lambda: None
+    db.find = MagicMock(return_value=m)
+
+    assert 1 == ns.sync_tags(db, {}, {"foo": {"tags": ["bar"]}})
+    mt.add.assert_called_once_with("bar")
+    mt.to_maildir_flags.assert_not_called()
+
+
+def test_sync_tags_read_only(monkeypatch):
+    monkeypatch.setitem(ns.session, "read_only", True)
+    m = MagicMock()
+    m.ghost = False
+    mt = MagicMock(spec=list)
+    mt.__iter__.return_value = iter(["foo"])
+    mt.clear = MagicMock()
+    mt.add = MagicMock()
+    mt.to_maildir_flags = MagicMock()
+    type(m).tags = PropertyMock(return_value=mt)
+
+    db = lambda: None
+    db.find = MagicMock(return_value=m)
+
+    assert 1 == ns.sync_tags(db, {}, {"foo": {"tags": ["bar"]}})
+    mt.add.assert_called_once_with("bar")
+    mt.to_maildir_flags.assert_not_called()
+
+
+def test_sync_tags_local_tags(monkeypatch):
+    monkeypatch.setitem(ns.session, "local_tags", ["todo-laptop"])
+    m = MagicMock()
+    m.ghost = False
+    mt = MagicMock(spec=list)
+    mt.__iter__.return_value = iter(["foo", "todo-laptop"])
+    mt.clear = MagicMock()
+    mt.add = MagicMock()
+    mt.to_maildir_flags = MagicMock()
+    type(m).tags = PropertyMock(return_value=mt)
+
+    db = lambda: None
+    db.find = MagicMock(return_value=m)
+
+    assert 1 == ns.sync_tags(db, {}, {"foo": {"tags": ["bar", "todo-laptop-x"]}})
+    assert [call("bar"), call("todo-laptop")] == mt.add.call_args_list
+
+
+def test_without_local_tags(monkeypatch):
+    assert ["foo", "todo"] == ns.without_local_tags(["foo", "todo", "todo-laptop"], ["todo-"])
+    assert ["foo", "todo-laptop"] == ns.without_local_tags(["foo", "todo-laptop"], [])
+    monkeypatch.setitem(ns.session, "local_tags", ["foo"])
+    assert ["todo-laptop"] == ns.without_local_tags(["foo", "todo-laptop"])
+    # only the exact tag added to received messages
+    monkeypatch.setitem(ns.session, "received_tags", ["new"])
+    assert ["newsletter", "news/tech"] == ns.without_local_tags(["new", "newsletter", "news/tech"], [])
+
+
+def test_without_local_tags_patterns(monkeypatch):
+    assert {"ignore_tags": ["calendar::*", "draft"], "only_tags": [["*"], ["inbox", "calendar::*"]]} == \
+        {k: v for k, v in ns.negotiate({"ignore-tags": ["draft", "calendar::*"], "sync-tags": ["*"]},
+                                       {"ignore-tags": ["draft"], "sync-tags": ["inbox", "calendar::*"]}).items()
+         if k in ("ignore_tags", "only_tags")}
+    monkeypatch.setitem(ns.session, "ignore_tags", ["draft", "calendar::*"])
+    assert ["inbox", "unread"] == ns.without_local_tags(["inbox", "draft", "calendar::event", "unread"])
+    monkeypatch.setitem(ns.session, "only_tags", [["inbox", "un*"], ["*read"]])
+    assert ["unread"] == ns.without_local_tags(["inbox", "draft", "calendar::event", "unread"])
+    assert ns.filters_tags()
+
+
+def test_map_tags(monkeypatch):
+    assert {"todo": "TODO", "x": "y"} == ns.parse_tag_map("todo=TODO, x=y")
+    for invalid in ["todo", "=TODO", "todo=", "a=b,c=b"]:
+        with pytest.raises(ns.argparse.ArgumentTypeError):
+            ns.parse_tag_map(invalid)
+    assert {"todo": "TODO"} == ns.parse_args(["-r", "foo", "--config", "/nonexistent", "--tag-map", "todo=TODO"]).tag_map
+    assert {} == ns.parse_args(["-r", "foo", "--config", "/nonexistent"]).tag_map
+
+    monkeypatch.setitem(ns.session, "tag_map", {"todo": "TODO"})
+    assert ["TODO", "inbox"] == ns.map_tags(["todo", "inbox"], True)
+    assert ["todo", "inbox", "todo"] == ns.map_tags(["TODO", "inbox", "todo"], False)
+
+
+def test_dump_without_local_tags():
+    dump = (b"#notmuch-dump batch-tag:3 config,properties,tags\n"
+            b"+inbox +todo-laptop +todo%20laptop -- id:foo@bar\n"
+            b"+todo-laptop -- id:bar@foo\n")
+    assert dump == ns.dump_without_local_tags(dump, [])
+    assert (b"#notmuch-dump batch-tag:3 config,properties,tags\n"
+            b"+inbox -- id:foo@bar\n"
+            b" -- id:bar@foo\n") == ns.dump_without_local_tags(dump, ["todo"])
+
+
+def test_missing_files_moved_dry_run():
+    m = MagicMock()
+    m.ghost = False
+    db = lambda: None
+
+    db.find = MagicMock(return_value=m)
+    db.add = MagicMock(return_value=(m, True))
+    db.remove = MagicMock()
+
+    ns.planned.clear()
+    with patch("shutil.move") as sm:
+        with NamedTemporaryFile(mode="w+t", prefix="notmuch-sync-test-tmp-") as f1:
+            with NamedTemporaryFile(mode="w+t", prefix="notmuch-sync-test-tmp-") as f2:
+                istream = io.BytesIO(b"\x00\x00\x00\x02[]\x00\x00\x00\x44[\"a983f58ef9ef755c4e5e3755f10cf3e08d9b189b388bcb59d29b56d35d7d6b9d\"]")
+                ostream = io.BytesIO()
+                m.filenames = MagicMock(return_value=[f1.name])
+                f1.write("mail one")
+                f1.flush()
+                f1name = f1.name.removeprefix(prefix)
+                f2name = f2.name.removeprefix(prefix)
+                changes = {"foo": {"tags": ["foo"], "files": [f2name]}}
+                assert ({}, 1, 0) == ns.get_missing_files(db, prefix, {}, changes, istream, ostream, dry_run=True)
+
+                sm.assert_not_called()
+                db.add.assert_not_called()
+                db.remove.assert_not_called()
+                assert ns.planned == [{"op": "move", "src": f1name, "dst": f2name}]
+    ns.planned.clear()
+
+
 def test_missing_files_copied():
     m = MagicMock()
     m.ghost = False
@@ -639,6 +1699,27 @@ def test_missing_files_added():
     assert m.filenames.call_count == 3
 
 
+def test_missing_files_unreadable_theirs():
+    m = MagicMock()
+    m.ghost = False
+    db = lambda: None
+
+    db.find = MagicMock(return_value=m)
+
+    with patch("shutil.copy") as sc:
+        with NamedTemporaryFile(mode="w+t", prefix="notmuch-sync-test-tmp-") as f1:
+            istream = io.BytesIO(b"\x00\x00\x00\x02[]\x00\x00\x00\x4A[\"a983f58ef9ef755c4e5e3755f10cf3e08d9b189b388bcb59d29b56d35d7d6b9d\", null]")
+            ostream = io.BytesIO()
+            m.filenames = MagicMock(return_value=[f1.name])
+            f1.write("mail one")
+            f1.flush()
+            f1name = f1.name.removeprefix(prefix)
+            changes = {"foo": {"tags": ["foo"], "files": [f1name, "bar"]}}
+            # can't be read on remote, so not requested
+            assert ({}, 0, 0) == ns.get_missing_files(db, prefix, {"foo": changes["foo"]}, changes, istream, ostream)
+        assert sc.call_count == 0
+
+
 def test_missing_files_delete():
     m = MagicMock()
     m.ghost = False
@@ -671,6 +1752,27 @@ def test_missing_files_delete():
     assert m.filenames.call_count == 2
 
 
+def test_missing_files_delete_mbsync(tmp_path):
+    (tmp_path / "cur").mkdir()
+    (tmp_path / ".mbsyncstate").write_text("FarUidValidity 1\nNearUidValidity 1\n\n5 7 S\n")
+    for name in ["1,U=7:2,S", "2,U=8:2,S", "3"]:
+        (tmp_path / "cur" / name).write_text("mail one")
+    prefix = str(tmp_path) + os.sep
+    m = MagicMock()
+    m.ghost = False
+    m.filenames = MagicMock(return_value=[prefix + "cur/" + name for name in ["1,U=7:2,S", "2,U=8:2,S", "3"]])
+    db = MagicMock()
+    db.find = MagicMock(return_value=m)
+
+    istream = io.BytesIO(b"\x00\x00\x00\x02[]\x00\x00\x00\x02[]")
+    changes = {"foo": {"tags": ["foo"], "files": ["cur/3"]}}
+    with patch("pathlib.Path.unlink") as pu:
+        assert ({}, 0, 1) == ns.get_missing_files(db, prefix, {}, changes, istream, io.BytesIO())
+    # UID 7 is tracked by mbsync, UID 8 isn't
+    db.remove.assert_called_once_with(prefix + "cur/2,U=8:2,S")
+    pu.assert_called_once()
+
+
 def test_missing_files_delete_changed():
     m = MagicMock()
     m.ghost = False
@@ -791,17 +1893,122 @@ def test_send_file():
         assert b"\x00\x00\x00\x0email one\nmail\n" == out
 
 
+def test_write_file(tmp_path):
+    content = b"".join(f"Line {i} of a long email\n".encode("utf-8") for i in range(10000))
+    (tmp_path / "1").write_bytes(content)
+    r, w = os.pipe()
+    with open(r, "rb") as fr, open(w, "wb") as fw:
+        received = {}
+        reader = threading.Thread(target=lambda: received.update(data=ns.read(fr)))
+        reader.start()
+        before = ns.transfer["write"]
+        with patch("os.sendfile", wraps=os.sendfile) as sf:
+            assert ns.write_file(str(tmp_path / "1"), fw) is None
+            assert sf.call_count > 0
+        reader.join()
+        assert content == received["data"]
+        assert len(content) + 4 == ns.transfer["write"] - before
+        assert content[:64].decode("utf-8") == ns.frames[-1]["data"]
+
+        # hashed while sending in chunks, also with mbsync's X-TUID line
+        (tmp_path / "2").write_bytes(content[:1000] + b"X-TUID: abc\n" + content)
+        (tmp_path / "3").write_bytes(b"")
+        with patch.object(ns, "SEND_CHUNK", 1005), patch("os.sendfile") as sf:
+            for f in ["1", "2", "3"]:
+                reader = threading.Thread(target=lambda: received.update(data=ns.read(fr)))
+                reader.start()
+                assert ns.digest((tmp_path / f).read_bytes()) == ns.write_file(str(tmp_path / f), fw, with_digest=True)
+                reader.join()
+                assert (tmp_path / f).read_bytes() == received["data"]
+            sf.assert_not_called()
+
+        # fall back to writing the content if the pipe doesn't support it
+        reader = threading.Thread(target=lambda: received.update(data=ns.read(fr)))
+        reader.start()
+        with patch("os.sendfile", side_effect=OSError(errno.EINVAL, "Invalid argument")):
+            ns.write_file(str(tmp_path / "1"), fw)
+        reader.join()
+        assert content == received["data"]
+
+
 
 def test_recv_file():
     fname = "foo"
-    with patch("builtins.open", mock_open()) as o:
+    with patch.object(ns, "write_atomic") as wa:
         stream = io.BytesIO(b"\x00\x00\x00\x0email one\nmail\n")
         ns.recv_file("foo", stream, "3d0ea99df44f734ef462d85bfeb1352edcb7af528f3386cdaa0939ac27cd8cb3")
-        o.assert_called_once_with("foo", "wb")
-        hdl = o()
-        hdl.write.assert_called_once()
-        args = hdl.write.call_args.args
-        assert b"mail one\nmail\n" == args[0]
+        wa.assert_called_once_with("foo", b"mail one\nmail\n", None)
+
+
+def test_send_recv_file_xattrs(monkeypatch):
+    monkeypatch.setitem(ns.session, "xattrs", True)
+    with patch.object(ns, "get_xattrs", return_value={"user.foo": "YmFy"}) as gx, \
+            patch("builtins.open", mock_open(read_data=b"mail\n")):
+        stream = io.BytesIO()
+        ns.send_file("foo", stream)
+        gx.assert_called_once_with("foo")
+        assert b'\x00\x00\x00\x05mail\n\x00\x00\x00\x14{"user.foo": "YmFy"}' == stream.getvalue()
+
+    with patch.object(ns, "write_atomic") as wa, patch.object(ns, "set_xattrs") as sx:
+        ns.recv_file("foo", io.BytesIO(stream.getvalue()))
+        wa.assert_called_once_with("foo", b"mail\n", None)
+        sx.assert_called_once_with("foo", {"user.foo": "YmFy"})
+
+    with patch.object(ns, "write_atomic") as wa:
+        with pytest.raises(ValueError) as pwe:
+            ns.recv_file("foo", io.BytesIO(b'\x00\x00\x00\x05mail\n\x00\x00\x00\x02[]'))
+        assert "Invalid extended attributes" in str(pwe.value)
+        wa.assert_not_called()
+
+
+def test_send_recv_file_digest(monkeypatch, tmp_path):
+    monkeypatch.setitem(ns.session, "file_digests", True)
+    (tmp_path / "1").write_bytes(b"mail\n")
+    stream = io.BytesIO()
+    ns.send_file(str(tmp_path / "1"), stream)
+    assert b"\x00\x00\x00\x05mail\n\x00\x00\x00\x40" + ns.digest(b"mail\n").encode("utf-8") == stream.getvalue()
+    # and against a delta
+    (tmp_path / "2").write_bytes(b"mail\nmore\n")
+    delta = io.BytesIO()
+    ns.send_file(str(tmp_path / "2"), delta, ns.block_signature(b"mail\n"))
+    assert delta.getvalue().endswith(b"\x00\x00\x00\x40" + ns.digest(b"mail\nmore\n").encode("utf-8"))
+
+    ns.recv_file(str(tmp_path / "3"), io.BytesIO(stream.getvalue()))
+    assert b"mail\n" == (tmp_path / "3").read_bytes()
+    ns.recv_file(str(tmp_path / "4"), io.BytesIO(delta.getvalue()), basis=str(tmp_path / "1"))
+    assert b"mail\nmore\n" == (tmp_path / "4").read_bytes()
+    # changed in transfer
+    with pytest.raises(ValueError, match="does not match the file on the other side"):
+        ns.recv_file(str(tmp_path / "5"), io.BytesIO(stream.getvalue().replace(b"mail", b"mall")))
+    assert not (tmp_path / "5").exists()
+
+
+def test_xattrs(tmp_path):
+    fname = str(tmp_path / "foo")
+    Path(fname).write_text("mail")
+    try:
+        os.setxattr(fname, "user.notmuch-sync-test", b"bar")
+    except (AttributeError, OSError):
+        pytest.skip("extended attributes not supported")
+    xattrs = ns.get_xattrs(fname)
+    assert "YmFy" == xattrs["user.notmuch-sync-test"]
+
+    copy = str(tmp_path / "copy")
+    Path(copy).write_text("mail")
+    ns.set_xattrs(copy, xattrs)
+    assert b"bar" == os.getxattr(copy, "user.notmuch-sync-test")
+
+    with patch("os.setxattr", side_effect=PermissionError(1, "Operation not permitted")):
+        ns.set_xattrs(copy, {"security.selinux": "Zm9v"})
+    assert [copy] == ns.file_warnings.pop(("could not be given all extended attributes", str(tmp_path)))
+
+
+def test_decode_xattrs():
+    assert {} == ns.decode_xattrs(b"{}")
+    assert {"user.foo": "YmFy"} == ns.decode_xattrs(b'{"user.foo": "YmFy"}')
+    for data in [b"[]", b'{"user.foo": 1}', b'{"user.foo": "not base64!"}', b"{"]:
+        with pytest.raises(ValueError):
+            ns.decode_xattrs(data)
 
 
 def test_recv_file_exists():
@@ -820,16 +2027,309 @@ def test_recv_file_exists():
                 assert o.call_count == 0
 
 
-def test_sync_files_nothing():
+def test_recv_file_write_error():
+    with TemporaryDirectory() as tmpdir:
+        fname = os.path.join(tmpdir, "foo")
+        hdl = mock_open()
+        hdl.return_value.write.side_effect = OSError(28, "No space left on device")
+        stream = io.BytesIO(b"\x00\x00\x00\x09mail one\n")
+        with patch("builtins.open", hdl):
+            with patch("pathlib.Path.unlink") as pu:
+                with pytest.raises(OSError):
+                    ns.recv_file(fname, stream)
+                pu.assert_called_once_with(missing_ok=True)
+        assert not Path(fname).exists()
+
+
+def test_partial_path():
+    assert os.path.join("mail", "INBOX", "tmp", ".notmuch-sync-partial-1:2,S") == \
+        ns.partial_path(os.path.join("mail", "INBOX", "cur", "1:2,S"))
+    assert os.path.join("mail", "INBOX", "tmp", ".notmuch-sync-partial-2") == \
+        ns.partial_path(os.path.join("mail", "INBOX", "new", "2"))
+    assert os.path.join("mail", ".notmuch-sync-partial-.mbsyncstate") == \
+        ns.partial_path(os.path.join("mail", ".mbsyncstate"))
+
+
+def test_write_atomic():
+    with TemporaryDirectory() as tmpdir:
+        fname = os.path.join(tmpdir, "INBOX", "cur", "1:2,S")
+        ns.write_atomic(fname, b"mail one\n", ns.digest(b"mail one\n"))
+        assert b"mail one\n" == Path(fname).read_bytes()
+        assert [] == list(Path(tmpdir, "INBOX", "tmp").iterdir())
+
+        # corrupted on disk or in transfer
+        with patch("pathlib.Path.read_bytes", return_value=b"mail"):
+            with pytest.raises(ValueError) as pwe:
+                ns.write_atomic(fname, b"mail two\n", ns.digest(b"mail two\n"))
+            assert str(pwe.value) == f"Checksum of written '{fname}' does not match the file on the other side, aborting..."
+        with pytest.raises(ValueError):
+            ns.write_atomic(fname, b"mail two\n", ns.digest(b"mail three\n"))
+        assert b"mail one\n" == Path(fname).read_bytes()
+        assert [] == list(Path(tmpdir, "INBOX", "tmp").iterdir())
+
+
+def test_write_atomic_nfs(monkeypatch, tmp_path):
+    fname = str(tmp_path / "INBOX" / "cur" / "1:2,S")
+    replace = os.replace
+
+    def _lost_reply(src, dst):
+        replace(src, dst)
+        raise FileNotFoundError(src)
+
+    with patch("os.replace", side_effect=_lost_reply):
+        with pytest.raises(FileNotFoundError):
+            ns.write_atomic(fname, b"mail one\n")
+        monkeypatch.setitem(ns.session, "nfs", True)
+        ns.write_atomic(fname, b"mail two\n")
+    assert b"mail two\n" == Path(fname).read_bytes()
+    assert [] == list((tmp_path / "INBOX" / "tmp").iterdir())
+
+
+def test_fsync(monkeypatch, tmp_path):
+    fname = str(tmp_path / "INBOX" / "cur" / "1:2,S")
+    with patch("os.fsync") as fs:
+        ns.write_atomic(fname, b"mail\n")
+        # the file and the directory it has been renamed into
+        assert 2 == fs.call_count
+        fs.reset_mock()
+        ns.move_file(fname, str(tmp_path / "INBOX" / "cur" / "2:2,S"))
+        assert 2 == fs.call_count
+        fs.reset_mock()
+        rev = lambda: None
+        rev.rev = 123
+        rev.uuid = b'00000000-0000-0000-0000-000000000000'
+        ns.record_sync(str(tmp_path / "notmuch-sync-00000000-0000-0000-0000-000000000001"), rev)
+        assert 2 == fs.call_count
+        fs.reset_mock()
+
+        monkeypatch.setitem(ns.session, "fsync", False)
+        ns.write_atomic(fname, b"mail\n")
+        ns.copy_file(fname, str(tmp_path / "INBOX" / "cur" / "3:2,S"))
+        fs.assert_not_called()
+    assert b"mail\n" == Path(tmp_path / "INBOX" / "cur" / "3:2,S").read_bytes()
+    # not all file systems support it
+    ns.fsync_path(str(tmp_path / "nonexistent"))
+    assert "--no-fsync" in ns.remote_command(ns.parse_args(["-r", "bar", "--no-fsync"]))
+
+
+def test_portable(monkeypatch, tmp_path):
+    src = tmp_path / "1:2,S"
+    src.write_bytes(b"mail\n")
+    src.chmod(0o400)
+    monkeypatch.setitem(ns.session, "portable", True)
+    with patch("shutil.move") as sm, patch("os.fsync") as fs:
+        ns.move_file(str(src), str(tmp_path / "2:2,S"))
+        sm.assert_not_called()
+        fs.assert_called()
+    assert not src.exists()
+    assert b"mail\n" == (tmp_path / "2:2,S").read_bytes()
+    # permissions are not copied
+    ns.copy_file(str(tmp_path / "2:2,S"), str(tmp_path / "3:2,S"))
+    assert 0o400 != (tmp_path / "3:2,S").stat().st_mode & 0o777
+
+    with patch("os.utime", side_effect=PermissionError("not permitted")):
+        ns.set_mtime(str(tmp_path / "3:2,S"), 0)
+        monkeypatch.setitem(ns.session, "portable", False)
+        with pytest.raises(PermissionError):
+            ns.set_mtime(str(tmp_path / "3:2,S"), 0)
+    ns.set_mtime(str(tmp_path / "3:2,S"), 0)
+    assert 0 == (tmp_path / "3:2,S").stat().st_mtime
+    (tmp_path / "2:2,S").chmod(0o400)
+    ns.copy_file(str(tmp_path / "2:2,S"), str(tmp_path / "4:2,S"))
+    assert 0o400 == (tmp_path / "4:2,S").stat().st_mode & 0o777
+
+    assert "--portable" in ns.remote_command(ns.parse_args(["-r", "bar", "--portable"]))
+
+
+def test_lock_mail_dir(monkeypatch, tmp_path):
+    monkeypatch.setitem(ns.session, "notmuch_dir", None)
+    (tmp_path / ".notmuch").mkdir()
+    db = MagicMock()
+    db.config = {"database.path": str(tmp_path)}
+    mock_ctx = MagicMock()
+    mock_ctx.__enter__.return_value = db
+    mock_ctx.__exit__.return_value = False
+    lock = tmp_path / ".notmuch" / "notmuch-sync.lock"
+
+    with patch("notmuch2.Database", return_value=mock_ctx) as nd:
+        with ns.lock_mail_dir(False):
+            nd.assert_not_called()
+        with ns.lock_mail_dir():
+            host, pid, created = lock.read_text().split()
+            assert ns.socket.gethostname() == host
+            assert os.getpid() == int(pid)
+            assert abs(time.time() - float(created)) < 60
+            with pytest.raises(OSError, match="locked by another sync"):
+                with ns.lock_mail_dir():
+                    pass
+            # still held
+            assert lock.exists()
+        assert not lock.exists()
+
+        with pytest.raises(ValueError):
+            with ns.lock_mail_dir():
+                raise ValueError("failed")
+        assert not lock.exists()
+
+        # left behind by a sync that has died
+        with patch.object(ns, "lock_is_stale", return_value=True):
+            lock.write_text("host 1 0\n")
+            with ns.lock_mail_dir():
+                assert "host 1 0\n" != lock.read_text()
+            assert not lock.exists()
+
+
+def test_lock_is_stale():
+    host = ns.socket.gethostname()
+    assert not ns.lock_is_stale(f"{host} {os.getpid()} {time.time():.0f}")
+    # old format without creation time
+    assert not ns.lock_is_stale(f"{host} {os.getpid()}")
+    assert not ns.lock_is_stale("unknown")
+    with patch("os.kill", side_effect=ProcessLookupError) as k:
+        assert ns.lock_is_stale(f"{host} 12345 {time.time():.0f}")
+        k.assert_called_once_with(12345, 0)
+        # can't tell for other hosts
+        assert not ns.lock_is_stale(f"{host}-other 12345 {time.time():.0f}")
+    # PID has been reused by a process started after the lock was created
+    with patch.object(ns, "process_start_time", return_value=time.time()):
+        assert ns.lock_is_stale(f"{host} {os.getpid()} {time.time() - 3600:.0f}")
+    with patch.object(ns, "process_start_time", return_value=None):
+        assert not ns.lock_is_stale(f"{host} {os.getpid()} {time.time() - 3600:.0f}")
+    started = ns.process_start_time(os.getpid())
+    assert started is None or started <= time.time()
+
+
+def test_clean_partials():
+    with TemporaryDirectory() as tmpdir:
+        Path(tmpdir, "INBOX", "cur").mkdir(parents=True)
+        Path(tmpdir, "INBOX", "tmp").mkdir()
+        Path(tmpdir, ".notmuch").mkdir()
+        Path(tmpdir, "INBOX", "cur", "1:2,S").write_text("mail")
+        Path(tmpdir, "INBOX", "tmp", "2").write_text("mail")
+        Path(tmpdir, "INBOX", "tmp", ".notmuch-sync-partial-3").write_text("ma")
+        Path(tmpdir, ".notmuch-sync-partial-.mbsyncstate").write_text("")
+        Path(tmpdir, ".notmuch", ".notmuch-sync-partial-4").write_text("")
+        # never written there, so not looked for
+        Path(tmpdir, "INBOX", "cur", ".notmuch-sync-partial-5").write_text("")
+
+        assert 2 == ns.clean_partials(tmpdir, dry_run=True)
+        assert Path(tmpdir, "INBOX", "tmp", ".notmuch-sync-partial-3").exists()
+
+        assert 2 == ns.clean_partials(tmpdir)
+        assert not Path(tmpdir, "INBOX", "tmp", ".notmuch-sync-partial-3").exists()
+        assert not Path(tmpdir, ".notmuch-sync-partial-.mbsyncstate").exists()
+        assert Path(tmpdir, "INBOX", "cur", "1:2,S").exists()
+        assert Path(tmpdir, "INBOX", "tmp", "2").exists()
+        assert Path(tmpdir, ".notmuch", ".notmuch-sync-partial-4").exists()
+        assert Path(tmpdir, "INBOX", "cur", ".notmuch-sync-partial-5").exists()
+        assert 0 == ns.clean_partials(tmpdir)
+
+
+def test_wait_for_space():
+    st = os.statvfs_result((4096, 4096, 100, 50, 50, 1000, 10, 10, 0, 255))
+    with patch("os.statvfs", return_value=st) as sv:
+        ns.wait_for_space(os.path.join(gettempdir(), "foo", "bar"), 4096 * 40, 4096 * 10, 9)
+        sv.assert_called_once_with(Path(gettempdir()))
+
+        with pytest.raises(ValueError) as pwe:
+            ns.wait_for_space(os.path.join(gettempdir(), "foo"), 4096 * 40 + 1, 4096 * 10, 9)
+        assert str(pwe.value).startswith(f"Only {4096 * 50} bytes and 10 inodes free to write {4096 * 40 + 1} bytes")
+
+        with pytest.raises(ValueError) as pwe:
+            ns.wait_for_space(os.path.join(gettempdir(), "foo"), 0, 0, 10)
+        assert str(pwe.value).startswith(f"Only {4096 * 50} bytes and 10 inodes free to write 0 bytes")
+
+    # no inode limit
+    st = os.statvfs_result((4096, 4096, 100, 50, 50, 0, 0, 0, 0, 255))
+    with patch("os.statvfs", return_value=st):
+        ns.wait_for_space(os.path.join(gettempdir(), "foo"), 0, 0, 10)
+
+
+def test_wait_for_space_resume():
+    full = os.statvfs_result((4096, 4096, 100, 0, 0, 1000, 10, 10, 0, 255))
+    free = os.statvfs_result((4096, 4096, 100, 50, 50, 1000, 10, 10, 0, 255))
+    with patch("os.statvfs", side_effect=[full, full, free]) as sv:
+        with patch("time.sleep") as ts:
+            ns.wait_for_space(os.path.join(gettempdir(), "foo"), 4096, 0, 0, 60)
+            assert ts.mock_calls == [call(5), call(5)]
+        assert sv.call_count == 3
+
+
+def test_delta():
+    basis = b"".join(f"Line {i} of a long email\n".encode("utf-8") for i in range(200))
+    data = b"X-TUID: foo\n" + basis[:1500] + b"changed\n" + basis[1500:]
+    sig = ns.block_signature(basis, 64)
+    assert len(sig) == len(basis) // 64
+    delta = ns.compute_delta(data, sig, 64)
+    assert len(delta) < len(data) / 4
+    assert data == ns.apply_delta(basis, delta, 64)
+
+    # nothing in common
+    delta = ns.compute_delta(b"foo", sig, 64)
+    assert delta == b"\x00\x00\x00\x03L\x00\x00\x00\x03foo"
+    assert b"foo" == ns.apply_delta(basis, delta, 64)
+
+    # identical
+    delta = ns.compute_delta(basis[:128], sig, 64)
+    assert delta == b"\x00\x00\x00\x80B\x00\x00\x00\x00B\x00\x00\x00\x01"
+
+    with pytest.raises(ValueError) as pwe:
+        ns.apply_delta(basis, b"\x00\x00\x00\x04L\x00\x00\x00\x03foo", 64)
+    assert str(pwe.value) == "Reconstructed 3 bytes from delta, but expected 4, aborting..."
+    for bad, msg in [(b"", "too short"), (b"\x00\x00\x00\x05B\x00", "cut off"), (b"\x00\x00\x00\x05L", "cut off"),
+                     (b"\x00\x00\x00\x40B\x00\x00\x00\x96", "block 150, but the basis only has"),
+                     (b"\x00\x00\x00\x05L\x00\x00\x00\x05foo", "goes past the end"),
+                     (b"\x00\x00\x00\x01L\x00\x00\x00\x03fooB\x00\x00", "Reconstructed 3 bytes")]:
+        with pytest.raises(ValueError, match=msg):
+            ns.apply_delta(basis, bad, 64)
+
+
+@patch.object(ns, "check_space")
+def test_sync_files_delta(cs):
+    basis = b"".join(f"Line {i} of a long email\n".encode("utf-8") for i in range(200))
+    m = MagicMock()
+    m.ghost = False
+    db = lambda: None
+    db.find = MagicMock(return_value=m)
+    db.add = MagicMock(return_value=(m, True))
+    db.atomic = MagicMock()
+
+    with NamedTemporaryFile(mode="w+b", prefix="notmuch-sync-test-tmp-") as f1:
+        f1.write(basis)
+        f1.flush()
+        m.filenames = MagicMock(return_value=[f1.name])
+        with TemporaryDirectory() as tmpdir:
+            dst = os.path.join(tmpdir, "cur", "new")
+            missing = {"foo": {"files": [dst.removeprefix(prefix)]}}
+            data = basis + b"foo"
+            delta = ns.compute_delta(data, ns.block_signature(basis))
+            istream = io.BytesIO(b"\x00\x00\x00\x02[]\x00\x00\x00\x02[]" + struct.pack("!I", len(delta)) + delta)
+            ostream = io.BytesIO()
+            ns.session["delta"] = True
+            try:
+                assert (0, 1, 1) == ns.sync_files(db, prefix, missing, istream, ostream)
+            finally:
+                ns.session["delta"] = False
+            assert data == Path(dst).read_bytes()
+            db.add.assert_called_once_with(dst)
+            tmp = json.dumps([dst.removeprefix(prefix)])
+            sig = json.dumps([ns.block_signature(basis)])
+            assert (struct.pack("!I", len(tmp)) + tmp.encode("utf-8") +
+                    struct.pack("!I", len(sig)) + sig.encode("utf-8")) == ostream.getvalue()
+
+
+@patch.object(ns, "check_space")
+def test_sync_files_nothing(cs):
     db = lambda: None
     istream = io.BytesIO(b"\x00\x00\x00\x02[]")
     ostream = io.BytesIO()
-    assert (0, 0) == ns.sync_files(db, prefix, {}, istream, ostream)
+    assert (0, 0, 0) == ns.sync_files(db, prefix, {}, istream, ostream)
     out = ostream.getvalue()
     assert b"\x00\x00\x00\x02[]" == out
 
 
-def test_sync_files_recv_add():
+@patch.object(ns, "check_space")
+def test_sync_files_recv_add(cs):
     istream = io.BytesIO(b"\x00\x00\x00\x02[]\x00\x00\x00\x09mail one\n\x00\x00\x00\x09mail two\n")
     ostream = io.BytesIO()
 
@@ -844,15 +2344,14 @@ def test_sync_files_recv_add():
 
     db = lambda: None
     db.add = MagicMock(return_value=(lambda: None, True))
+    db.atomic = MagicMock()
 
-    with patch("builtins.open", mock_open()) as o:
-        assert (0, 2) == ns.sync_files(db, prefix, missing, istream, ostream)
-        assert call(f1.name, "wb") in o.mock_calls
-        assert call().write(b'mail one\n') in o.mock_calls
-        assert call(f2.name, "wb") in o.mock_calls
-        assert call().write(b'mail two\n') in o.mock_calls
-        hdl = o()
-        assert hdl.write.call_count == 2
+    with patch("builtins.open", mock_open()) as o, patch.object(ns, "write_atomic") as wa:
+        assert (0, 2, 2) == ns.sync_files(db, prefix, missing, istream, ostream)
+        assert wa.mock_calls == [
+            call(f1.name, b"mail one\n", None),
+            call(f2.name, b"mail two\n", None)
+        ]
 
     assert db.add.mock_calls == [
         call(f1.name),
@@ -862,7 +2361,99 @@ def test_sync_files_recv_add():
     assert struct.pack("!I", len(tmp)) + tmp.encode("utf-8") == ostream.getvalue()
 
 
-def test_sync_files_recv_new():
+@patch.object(ns, "check_space")
+def test_sync_files_recv_dry_run(cs):
+    istream = io.BytesIO(b"\x00\x00\x00\x02[]")
+    ostream = io.BytesIO()
+
+    missing = {"foo": {"tags": ["foo"], "files": ["a/cur/1", "a/cur/2"]}, "bar": {"files": ["b/new/3"]}}
+
+    db = lambda: None
+    db.add = MagicMock()
+
+    ns.planned.clear()
+    with patch("builtins.open", mock_open()) as o:
+        assert (1, 3, 0) == ns.sync_files(db, prefix, missing, istream, ostream, dry_run=True)
+        o.assert_not_called()
+    db.add.assert_not_called()
+    assert ns.planned == [{"op": "add", "name": "a/cur/1"}, {"op": "add", "name": "a/cur/2"},
+                          {"op": "add", "name": "b/new/3"}]
+    ns.planned.clear()
+
+
+@patch.object(ns, "check_space")
+def test_sync_files_priority(cs, monkeypatch):
+    monkeypatch.setitem(ns.session, "policies", [{"pattern": "b/**", "files": True, "delete": True, "priority": 10}])
+    istream = io.BytesIO(b"\x00\x00\x00\x02[]")
+    ostream = io.BytesIO()
+
+    missing = {"foo": {"tags": ["foo"], "files": ["a/cur/1", "a/cur/2"]}, "bar": {"files": ["b/new/3"]}}
+
+    ns.planned.clear()
+    assert (1, 3, 0) == ns.sync_files(None, prefix, missing, istream, ostream, dry_run=True)
+    assert b'\x00\x00\x00\x21["b/new/3", "a/cur/1", "a/cur/2"]' == ostream.getvalue()
+    ns.planned.clear()
+
+
+def test_order_files(tmp_path, monkeypatch):
+    assert ns.negotiate({"features": ["file-order"]}, {"features": ["file-order"]})["file_order"]
+    assert not ns.negotiate({"features": ["file-order"]}, {})["file_order"]
+    assert ns.negotiate({"features": ["conflict-resolutions"]}, {"features": ["conflict-resolutions"]})["resolutions"]
+    assert not ns.negotiate({"features": ["conflict-resolutions"]}, {})["resolutions"]
+    assert ns.negotiate({"features": ["file-digests"]}, {"features": ["file-digests"]})["file_digests"]
+    assert not ns.negotiate({"features": ["file-digests"]}, {})["file_digests"]
+    assert ns.negotiate({"features": ["duplicate-counts"]}, {"features": ["duplicate-counts"]})["duplicate_counts"]
+    assert not ns.negotiate({"features": ["duplicate-counts"]}, {})["duplicate_counts"]
+    args = ns.parse_args(["-r", "foo", "--config", "/nonexistent"])
+    assert "newest" == args.order
+    assert not any(a.startswith("--order") for a in ns.remote_args(args))
+    args = ns.parse_args(["-r", "foo", "--config", "/nonexistent", "--order", "smallest"])
+    assert "--order=smallest" in ns.remote_args(args)
+
+    (tmp_path / "a").write_bytes(b"mail one")
+    (tmp_path / "b").write_bytes(b"mail")
+    os.utime(tmp_path / "b", (1000, 1000))
+    msg = MagicMock()
+    msg.date = 2000
+
+    def _get(fname):
+        if fname.endswith("/a"):
+            return msg
+        raise LookupError(fname)
+
+    db = MagicMock()
+    db.get = MagicMock(side_effect=_get)
+    assert [2000, 8] == ns.file_info(db, str(tmp_path / "a"))
+    assert [1000, 4] == ns.file_info(db, str(tmp_path / "b"))
+    assert [0, 0] == ns.file_info(db, str(tmp_path / "c"))
+
+    monkeypatch.setitem(ns.session, "policies", [{"pattern": "p/**", "files": True, "delete": True, "priority": 10}])
+    for order, exp in [("newest", ["p/cur/4", "x/cur/2", "x/cur/3", "x/cur/1"]),
+                       ("oldest", ["p/cur/4", "x/cur/1", "x/cur/3", "x/cur/2"]),
+                       ("smallest", ["p/cur/4", "x/cur/3", "x/cur/2", "x/cur/1"])]:
+        monkeypatch.setitem(ns.session, "order", order)
+        files = {"mine": [{"name": f, "id": "foo"} for f in ["p/cur/4", "x/cur/1", "x/cur/2", "x/cur/3"]],
+                 "theirs": ["a", "b", "c"]}
+        info = json.dumps([[0, 0], [100, 30], [300, 20], [200, 10]]).encode("utf-8")
+        istream = io.BytesIO(struct.pack("!I", len(info)) + info + b"\x00\x00\x00\x09[2, 0, 1]")
+        ostream = io.BytesIO()
+        ns.order_files(db, str(tmp_path) + "/", files, istream, ostream)
+        assert exp == [f["name"] for f in files["mine"]]
+        assert ["c", "a", "b"] == files["theirs"]
+        sent = json.dumps([[2000, 8], [1000, 4], [0, 0]])
+        order = json.dumps([["p/cur/4", "x/cur/1", "x/cur/2", "x/cur/3"].index(f) for f in exp])
+        assert (struct.pack("!I", len(sent)) + sent.encode("utf-8") +
+                struct.pack("!I", len(order)) + order.encode("utf-8")) == ostream.getvalue()
+
+    files = {"mine": [], "theirs": ["a", "b"]}
+    with pytest.raises(ValueError, match="Order of files"):
+        ns.order_files(db, str(tmp_path) + "/", files, io.BytesIO(b"\x00\x00\x00\x02[]\x00\x00\x00\x06[0, 0]"), io.BytesIO())
+    with pytest.raises(ValueError, match="Dates and sizes"):
+        ns.order_files(db, str(tmp_path) + "/", files, io.BytesIO(b"\x00\x00\x00\x04[[]]"), io.BytesIO())
+
+
+@patch.object(ns, "check_space")
+def test_sync_files_recv_new(cs):
     istream = io.BytesIO(b"\x00\x00\x00\x02[]\x00\x00\x00\x09mail one\n\x00\x00\x00\x09mail two\n")
     ostream = io.BytesIO()
 
@@ -889,21 +2480,22 @@ def test_sync_files_recv_new():
 
     db = lambda: None
     db.add = MagicMock()
+    db.atomic = MagicMock()
     db.add.side_effect = [(m, False), (m, True)]
 
-    with patch("builtins.open", mock_open()) as o:
-        assert (1, 2) == ns.sync_files(db, prefix, missing, istream, ostream)
-        assert call(f1.name, "wb") in o.mock_calls
-        assert call().write(b'mail one\n') in o.mock_calls
-        assert call(f2.name, "wb") in o.mock_calls
-        assert call().write(b'mail two\n') in o.mock_calls
-        hdl = o()
-        assert hdl.write.call_count == 2
+    with patch("builtins.open", mock_open()) as o, patch.object(ns, "write_atomic") as wa:
+        assert (1, 2, 1) == ns.sync_files(db, prefix, missing, istream, ostream)
+        assert wa.mock_calls == [
+            call(f1.name, b"mail one\n", None),
+            call(f2.name, b"mail two\n", None)
+        ]
 
     assert db.add.mock_calls == [
         call(f1.name),
         call(f2.name)
     ]
+    # each file is indexed and tagged in a transaction
+    assert 2 == db.atomic.return_value.__enter__.call_count
     m.frozen.assert_called_once()
     mt.clear.assert_called_once()
     assert mt.add.mock_calls == [
@@ -914,7 +2506,49 @@ def test_sync_files_recv_new():
     assert struct.pack("!I", len(tmp)) + tmp.encode("utf-8") == ostream.getvalue()
 
 
-def test_sync_files_send():
+@patch.object(ns, "check_space")
+def test_sync_files_recv_received_tag(cs, monkeypatch):
+    monkeypatch.setitem(ns.session, "received_tag", "from-server")
+    istream = io.BytesIO(b"\x00\x00\x00\x02[]\x00\x00\x00\x09mail one\n")
+    missing = {"foo": {"tags": ["inbox"], "files": ["INBOX/cur/1:2,S"]}}
+
+    m = MagicMock()
+    mt = MagicMock(spec=list)
+    mt.clear = MagicMock()
+    mt.add = MagicMock()
+    type(m).tags = PropertyMock(return_value=mt)
+    db = lambda: None
+    db.add = MagicMock(return_value=(m, False))
+    db.atomic = MagicMock()
+
+    with patch.object(ns, "write_atomic"):
+        assert (1, 1, 0) == ns.sync_files(db, prefix, missing, istream, io.BytesIO())
+    assert [call("inbox"), call("from-server")] == mt.add.mock_calls
+
+    args = ns.parse_args(["-r", "bar", "--received-tag", "from-server", "--local-tags", "todo"])
+    assert "from-server" == args.received_tag
+    assert ["todo"] == args.local_tags
+
+
+@patch.object(ns, "check_space")
+def test_sync_files_recv_not_email(cs, monkeypatch):
+    monkeypatch.setattr(ns, "outcomes", {})
+    istream = io.BytesIO(b"\x00\x00\x00\x02[]\x00\x00\x00\x09mail one\n")
+    missing = {"foo": {"tags": ["inbox"], "files": ["INBOX/cur/1:2,S"]}}
+
+    db = lambda: None
+    db.add = MagicMock(side_effect=notmuch2.FileNotEmailError("not an email"))
+    db.atomic = MagicMock()
+
+    with patch.object(ns, "write_atomic"):
+        assert (0, 0, 0) == ns.sync_files(db, prefix, missing, istream, io.BytesIO())
+    assert {"local": {"file transfer": {"success": 0, "failed": 1, "skipped": 0}}} == ns.outcomes
+
+
+@patch.object(ns, "check_space")
+def test_sync_files_send(cs, monkeypatch):
+    # files directly in the temporary directory
+    monkeypatch.setitem(ns.session, "mail_dirs", ["*"])
     db = lambda: None
     with NamedTemporaryFile(mode="w+t", prefix="notmuch-sync-test-tmp-") as f1:
         f1.write("mail one\n")
@@ -922,15 +2556,17 @@ def test_sync_files_send():
         with NamedTemporaryFile(mode="w+t", prefix="notmuch-sync-test-tmp-") as f2:
             f2.write("mail two\n")
             f2.flush()
-            tmp = json.dumps([f1.name, f2.name]).encode("utf-8")
+            tmp = json.dumps([f1.name.removeprefix(prefix), f2.name.removeprefix(prefix)]).encode("utf-8")
             istream = io.BytesIO(struct.pack("!I", len(tmp)) + tmp)
             ostream = io.BytesIO()
-            assert (0, 0) == ns.sync_files(db, prefix, {}, istream, ostream)
+            assert (0, 0, 0) == ns.sync_files(db, prefix, {}, istream, ostream)
             out = ostream.getvalue()
             assert b"\x00\x00\x00\x02[]\x00\x00\x00\x09mail one\n\x00\x00\x00\x09mail two\n" == out
 
 
-def test_sync_files_send_recv_add():
+@patch.object(ns, "check_space")
+def test_sync_files_send_recv_add(cs, monkeypatch):
+    monkeypatch.setitem(ns.session, "mail_dirs", ["*"])
     # this is only to get filenames that are guaranteed to be unique
     f1 = NamedTemporaryFile(mode="r", prefix="notmuch-sync-test-tmp-")
     f1.close()
@@ -942,20 +2578,19 @@ def test_sync_files_send_recv_add():
 
     db = lambda: None
     db.add = MagicMock(return_value=(lambda: None, True))
+    db.atomic = MagicMock()
 
-    with patch("builtins.open", mock_open(read_data=b"mail three\n")) as o:
-        tmp = json.dumps([f1.name]).encode("utf-8")
+    with patch("builtins.open", mock_open(read_data=b"mail three\n")) as o, patch.object(ns, "write_atomic") as wa:
+        tmp = json.dumps([f1name]).encode("utf-8")
         istream = io.BytesIO(struct.pack("!I", len(tmp)) + tmp + b"\x00\x00\x00\x09mail one\n\x00\x00\x00\x09mail two\n")
         ostream = io.BytesIO()
-        assert (0, 2) == ns.sync_files(db, prefix, missing, istream, ostream)
-        assert call(f1.name, "wb") in o.mock_calls
-        assert call().write(b'mail one\n') in o.mock_calls
-        assert call(f2.name, "wb") in o.mock_calls
-        assert call().write(b'mail two\n') in o.mock_calls
+        assert (0, 2, 2) == ns.sync_files(db, prefix, missing, istream, ostream)
+        assert wa.mock_calls == [
+            call(f1.name, b"mail one\n", None),
+            call(f2.name, b"mail two\n", None)
+        ]
         assert call(f1.name, "rb") in o.mock_calls
-        assert call().write(b'mail one\n') in o.mock_calls
         hdl = o()
-        assert hdl.write.call_count == 2
         assert hdl.read.call_count == 1
 
         tmp = json.dumps([f1name, f2name])
@@ -967,6 +2602,54 @@ def test_sync_files_send_recv_add():
     ]
 
 
+def test_check_space():
+    usage = shutil._ntuple_diskusage(100, 50, 50)
+    with patch("shutil.disk_usage", return_value=usage) as du:
+        with NamedTemporaryFile(mode="w+t", prefix="notmuch-sync-test-tmp-") as f1:
+            f1.write("mail one\n")
+            f1.flush()
+            tmp = json.dumps({"free": 20, "size": 40, "reserve": 5}).encode("utf-8")
+            istream = io.BytesIO(struct.pack("!I", len(tmp)) + tmp)
+            ostream = io.BytesIO()
+            ns.check_space(prefix, [f1.name.removeprefix(prefix)], 10, istream, ostream)
+            tmp = json.dumps({"free": 50, "size": 9, "reserve": 10}).encode("utf-8")
+            assert struct.pack("!I", len(tmp)) + tmp == ostream.getvalue()
+        du.assert_called_once_with(prefix)
+
+
+def test_check_space_not_enough_mine():
+    usage = shutil._ntuple_diskusage(100, 50, 50)
+    with patch("shutil.disk_usage", return_value=usage):
+        tmp = json.dumps({"free": 20, "size": 45, "reserve": 5}).encode("utf-8")
+        istream = io.BytesIO(struct.pack("!I", len(tmp)) + tmp)
+        ostream = io.BytesIO()
+        with pytest.raises(ValueError) as pwe:
+            ns.check_space(prefix, [], 10, istream, ostream)
+        assert str(pwe.value) == "Not enough space: 45 bytes to be received on this side, but only 50 bytes free (10 bytes to be kept free), aborting..."
+
+        # only warn for dry run
+        istream.seek(0)
+        ns.check_space(prefix, [], 10, istream, ostream, dry_run=True)
+
+
+def test_check_space_not_enough_theirs():
+    usage = shutil._ntuple_diskusage(100, 50, 50)
+    with patch("shutil.disk_usage", return_value=usage):
+        with NamedTemporaryFile(mode="w+t", prefix="notmuch-sync-test-tmp-") as f1:
+            f1.write("mail one\n")
+            f1.flush()
+            tmp = json.dumps({"free": 10, "size": 0, "reserve": 5}).encode("utf-8")
+            istream = io.BytesIO(struct.pack("!I", len(tmp)) + tmp)
+            ostream = io.BytesIO()
+            with pytest.raises(ValueError) as pwe:
+                ns.check_space(prefix, [f1.name.removeprefix(prefix)], 10, istream, ostream)
+            assert str(pwe.value) == "Not enough space: 9 bytes to be received on other side, but only 10 bytes free (5 bytes to be kept free), aborting..."
+
+
+def digest_frame(ids):
+    return b"\x00\x00\x00\x40" + ns.ids_digest(ids).encode("utf-8")
+
+
 def test_sync_deletes_local():
     m1 = lambda: None
     m1.messageid = "foo"
@@ -987,19 +2670,52 @@ def test_sync_deletes_local():
     with patch("notmuch2.Database", return_value=mock_ctx):
         with patch("pathlib.Path.unlink") as pu:
             with patch.object(ns, "get_ids", return_value=["foo", "bar"]) as gi:
-                istream = io.BytesIO(b"\x00\x00\x00\x07[\"foo\"]")
+                istream = io.BytesIO(digest_frame(["foo"]) + b"\x00\x00\x00\x07[\"foo\"]\x00\x00\x00\x00")
                 ostream = io.BytesIO()
                 assert 1 == ns.sync_deletes_local(prefix, istream, ostream)
                 pu.assert_called_once()
                 gi.assert_called_once_with(prefix)
 
                 out = ostream.getvalue()
-                assert b"\x00\x00\x00\x02[]" == out
+                assert digest_frame(["bar", "foo"]) + b"\x00\x00\x00\x00" == out
     db.find.assert_called_once_with("bar")
     db.remove.assert_called_once_with("barfile")
     m2.filenames.assert_called_once()
 
 
+def test_sync_deletes_local_max_delete(monkeypatch):
+    m2 = lambda: None
+    m2.filenames = MagicMock(return_value=["barfile"])
+    m2.tags = ["deleted"]
+    m2.ghost = False
+
+    db = lambda: None
+    db.remove = MagicMock()
+    db.find = MagicMock(return_value=m2)
+
+    mock_ctx = MagicMock()
+    mock_ctx.__enter__.return_value = db
+    mock_ctx.__exit__.return_value = False
+
+    with patch("notmuch2.Database", return_value=mock_ctx), patch("pathlib.Path.unlink"), \
+         patch.object(ns, "get_ids", return_value=["foo", "bar"]):
+        for limit, deleted in [("1", 1), ("0", 0), ("50%", 1), ("49%", 0)]:
+            monkeypatch.setattr(ns, "outcomes", {})
+            istream = io.BytesIO(digest_frame(["foo"]) + b"\x00\x00\x00\x07[\"foo\"]\x00\x00\x00\x00")
+            ostream = io.BytesIO()
+            assert deleted == ns.sync_deletes_local(prefix, istream, ostream, limit=ns.parse_limit(limit))
+            assert digest_frame(["bar", "foo"]) + b"\x00\x00\x00\x00" == ostream.getvalue()
+            assert ns.outcomes.get("local", {}).get("deletes", {}).get("failed", 0) == 1 - deleted
+    assert 2 == db.remove.call_count
+
+    for limit in ["-1", "ten", "10%%"]:
+        with pytest.raises(ns.argparse.ArgumentTypeError):
+            ns.parse_limit(limit)
+    args = ns.parse_args(["-r", "bar", "-d", "--max-delete", "10%"])
+    assert (10.0, True) == args.max_delete
+    assert not args.force
+
+
 def test_sync_deletes_local_no_deleted():
     m1 = lambda: None
     m1.messageid = "foo"
@@ -1029,14 +2745,14 @@ def test_sync_deletes_local_no_deleted():
     with patch("notmuch2.Database", return_value=mock_ctx):
         with patch("pathlib.Path.unlink") as pu:
             with patch.object(ns, "get_ids", return_value=["foo", "bar"]) as gi:
-                istream = io.BytesIO(b"\x00\x00\x00\x07[\"foo\"]")
+                istream = io.BytesIO(digest_frame(["foo"]) + b"\x00\x00\x00\x07[\"foo\"]\x00\x00\x00\x00")
                 ostream = io.BytesIO()
                 assert 0 == ns.sync_deletes_local(prefix, istream, ostream)
                 assert pu.call_count == 0
                 gi.assert_called_once_with(prefix)
 
                 out = ostream.getvalue()
-                assert b"\x00\x00\x00\x02[]" == out
+                assert digest_frame(["bar", "foo"]) + b"\x00\x00\x00\x00" == out
 
     db.find.assert_called_once_with("bar")
     assert db.remove.call_count == 0
@@ -1065,14 +2781,14 @@ def test_sync_deletes_local_no_deleted_no_check():
     with patch("notmuch2.Database", return_value=mock_ctx):
         with patch("pathlib.Path.unlink") as pu:
             with patch.object(ns, "get_ids", return_value=["foo", "bar"]) as gi:
-                istream = io.BytesIO(b"\x00\x00\x00\x07[\"foo\"]")
+                istream = io.BytesIO(digest_frame(["foo"]) + b"\x00\x00\x00\x07[\"foo\"]\x00\x00\x00\x00")
                 ostream = io.BytesIO()
                 assert 1 == ns.sync_deletes_local(prefix, istream, ostream, no_check=True)
                 pu.assert_called_once()
                 gi.assert_called_once_with(prefix)
 
                 out = ostream.getvalue()
-                assert b"\x00\x00\x00\x02[]" == out
+                assert digest_frame(["bar", "foo"]) + b"\x00\x00\x00\x00" == out
 
     db.find.assert_called_once_with("bar")
     db.remove.assert_called_once_with("barfile")
@@ -1098,20 +2814,37 @@ def test_sync_deletes_local_ghost():
     with patch("notmuch2.Database", return_value=mock_ctx):
         with patch("pathlib.Path.unlink") as pu:
             with patch.object(ns, "get_ids", return_value=["foo", "bar"]) as gi:
-                istream = io.BytesIO(b"\x00\x00\x00\x07[\"foo\"]")
+                istream = io.BytesIO(digest_frame(["foo"]) + b"\x00\x00\x00\x07[\"foo\"]\x00\x00\x00\x00")
                 ostream = io.BytesIO()
                 assert 0 == ns.sync_deletes_local(prefix, istream, ostream)
                 assert pu.call_count == 0
                 gi.assert_called_once_with(prefix)
 
                 out = ostream.getvalue()
-                assert b"\x00\x00\x00\x02[]" == out
+                assert digest_frame(["bar", "foo"]) + b"\x00\x00\x00\x00" == out
 
     db.find.assert_called_once_with("bar")
     assert db.remove.call_count == 0
     assert m2.filenames.call_count == 0
 
 
+def test_sync_deletes_local_evicted():
+    with TemporaryDirectory() as tmp:
+        pfx = tmp + os.sep
+        Path(pfx, ".notmuch").mkdir()
+        ns.write_evicted(pfx, {"bar": ["foo"], "baz": []})
+
+        with patch("notmuch2.Database") as db:
+            with patch.object(ns, "get_ids", return_value=["foo"]):
+                # remote still has bar, but not baz anymore
+                istream = io.BytesIO(digest_frame(["bar", "foo"]) + b"\x00\x00\x00\x0E[\"bar\", \"foo\"]\x00\x00\x00\x00")
+                ostream = io.BytesIO()
+                assert 0 == ns.sync_deletes_local(pfx, istream, ostream)
+                assert digest_frame(["bar", "baz", "foo"]) + b"\x00\x00\x00\x00" == ostream.getvalue()
+        assert {"bar": ["foo"]} == ns.read_evicted(pfx)
+        db.return_value.__enter__.return_value.find.assert_not_called()
+
+
 def test_sync_deletes_local_none():
     m1 = lambda: None
     m1.messageid = "foo"
@@ -1128,14 +2861,14 @@ def test_sync_deletes_local_none():
     with patch("notmuch2.Database", return_value=mock_ctx):
         with patch("pathlib.Path.unlink") as pu:
             with patch.object(ns, "get_ids", return_value=["foo", "bar"]) as gi:
-                istream = io.BytesIO(b"\x00\x00\x00\x0E[\"foo\", \"bar\"]")
+                istream = io.BytesIO(digest_frame(["bar", "foo"]))
                 ostream = io.BytesIO()
                 assert 0 == ns.sync_deletes_local(prefix, istream, ostream)
                 assert pu.call_count == 0
                 gi.assert_called_once_with(prefix)
 
                 out = ostream.getvalue()
-                assert b"\x00\x00\x00\x02[]" == out
+                assert digest_frame(["bar", "foo"]) == out
 
     assert db.remove.call_count == 0
 
@@ -1160,16 +2893,15 @@ def test_sync_deletes_remote():
     with patch("notmuch2.Database", return_value=mock_ctx):
         with patch("pathlib.Path.unlink") as pu:
             with patch.object(ns, "get_ids", return_value=["foo", "bar"]) as gi:
-                istream = io.BytesIO(b"\x00\x00\x00\x07[\"bar\"]")
+                istream = io.BytesIO(digest_frame(["foo"]) + b"\x00\x00\x00\x07[\"bar\"]\x00\x00\x00\x00")
                 ostream = io.BytesIO()
                 assert 1 == ns.sync_deletes_remote(prefix, istream, ostream)
                 pu.assert_called_once()
                 gi.assert_called_once_with(prefix)
 
                 out = ostream.getvalue()
-                assert b"\x00\x00\x00\x0E" in out
-                assert b"\"foo\"" in out
-                assert b"\"bar\"" in out
+                assert digest_frame(["bar", "foo"]) + \
+                    b"\x00\x00\x00\x0E[\"bar\", \"foo\"]\x00\x00\x00\x00" == out
 
     db.find.assert_called_once_with("bar")
     db.remove.assert_called_once_with("barfile")
@@ -1205,16 +2937,15 @@ def test_sync_deletes_remote_no_deleted():
     with patch("notmuch2.Database", return_value=mock_ctx):
         with patch("pathlib.Path.unlink") as pu:
             with patch.object(ns, "get_ids", return_value=["foo", "bar"]) as gi:
-                istream = io.BytesIO(b"\x00\x00\x00\x07[\"bar\"]")
+                istream = io.BytesIO(digest_frame(["foo"]) + b"\x00\x00\x00\x07[\"bar\"]\x00\x00\x00\x00")
                 ostream = io.BytesIO()
                 assert 0 == ns.sync_deletes_remote(prefix, istream, ostream)
                 assert pu.call_count == 0
                 gi.assert_called_once_with(prefix)
 
                 out = ostream.getvalue()
-                assert b"\x00\x00\x00\x0E" in out
-                assert b"\"foo\"" in out
-                assert b"\"bar\"" in out
+                assert digest_frame(["bar", "foo"]) + \
+                    b"\x00\x00\x00\x0E[\"bar\", \"foo\"]\x00\x00\x00\x00" == out
 
     db.find.assert_called_once_with("bar")
     assert db.remove.call_count == 0
@@ -1243,16 +2974,15 @@ def test_sync_deletes_remote_no_deleted_no_check():
     with patch("notmuch2.Database", return_value=mock_ctx):
         with patch("pathlib.Path.unlink") as pu:
             with patch.object(ns, "get_ids", return_value=["foo", "bar"]) as gi:
-                istream = io.BytesIO(b"\x00\x00\x00\x07[\"bar\"]")
+                istream = io.BytesIO(digest_frame(["foo"]) + b"\x00\x00\x00\x07[\"bar\"]\x00\x00\x00\x00")
                 ostream = io.BytesIO()
                 assert 1 == ns.sync_deletes_remote(prefix, istream, ostream, no_check=True)
                 pu.assert_called_once()
                 gi.assert_called_once_with(prefix)
 
                 out = ostream.getvalue()
-                assert b"\x00\x00\x00\x0E" in out
-                assert b"\"foo\"" in out
-                assert b"\"bar\"" in out
+                assert digest_frame(["bar", "foo"]) + \
+                    b"\x00\x00\x00\x0E[\"bar\", \"foo\"]\x00\x00\x00\x00" == out
 
     db.find.assert_called_once_with("bar")
     db.remove.assert_called_once_with("barfile")
@@ -1278,16 +3008,15 @@ def test_sync_deletes_remote_ghost():
     with patch("notmuch2.Database", return_value=mock_ctx):
         with patch("pathlib.Path.unlink") as pu:
             with patch.object(ns, "get_ids", return_value=["foo", "bar"]) as gi:
-                istream = io.BytesIO(b"\x00\x00\x00\x07[\"bar\"]")
+                istream = io.BytesIO(digest_frame(["foo"]) + b"\x00\x00\x00\x07[\"bar\"]\x00\x00\x00\x00")
                 ostream = io.BytesIO()
                 assert 0 == ns.sync_deletes_remote(prefix, istream, ostream)
                 assert pu.call_count == 0
                 gi.assert_called_once_with(prefix)
 
                 out = ostream.getvalue()
-                assert b"\x00\x00\x00\x0E" in out
-                assert b"\"foo\"" in out
-                assert b"\"bar\"" in out
+                assert digest_frame(["bar", "foo"]) + \
+                    b"\x00\x00\x00\x0E[\"bar\", \"foo\"]\x00\x00\x00\x00" == out
 
     db.find.assert_called_once_with("bar")
     assert db.remove.call_count == 0
@@ -1310,20 +3039,638 @@ def test_sync_deletes_remote_none():
     with patch("notmuch2.Database", return_value=mock_ctx):
         with patch("pathlib.Path.unlink") as pu:
             with patch.object(ns, "get_ids", return_value=["foo", "bar"]) as gi:
-                istream = io.BytesIO(b"\x00\x00\x00\x02[]")
+                istream = io.BytesIO(digest_frame(["foo"]) + b"\x00\x00\x00\x00")
                 ostream = io.BytesIO()
                 assert 0 == ns.sync_deletes_remote(prefix, istream, ostream)
                 assert pu.call_count == 0
                 gi.assert_called_once_with(prefix)
 
                 out = ostream.getvalue()
-                assert b"\x00\x00\x00\x0E" in out
-                assert b"\"foo\"" in out
-                assert b"\"bar\"" in out
+                assert digest_frame(["bar", "foo"]) + \
+                    b"\x00\x00\x00\x0E[\"bar\", \"foo\"]\x00\x00\x00\x00" == out
 
     assert db.remove.call_count == 0
 
 
+def test_sync_deletes_remote_identical():
+    with patch("notmuch2.Database") as db:
+        with patch.object(ns, "get_ids", return_value=["foo", "bar"]):
+            istream = io.BytesIO(digest_frame(["bar", "foo"]))
+            ostream = io.BytesIO()
+            assert 0 == ns.sync_deletes_remote(prefix, istream, ostream)
+            assert digest_frame(["bar", "foo"]) == ostream.getvalue()
+    db.assert_not_called()
+
+
+def test_bucket_count(monkeypatch):
+    monkeypatch.setattr(ns, "ID_BUCKET_SIZE", 2)
+    assert 1 == ns.bucket_count(0)
+    assert 1 == ns.bucket_count(2)
+    assert 2 == ns.bucket_count(3)
+    assert 4 == ns.bucket_count(5)
+    assert 4 == ns.bucket_count(8)
+
+
+def test_negotiate_buckets():
+    assert ns.negotiate({"features": ["id-buckets"]}, {"features": ["delta", "id-buckets"]})["buckets"]
+    assert not ns.negotiate({"features": ["id-buckets"]}, {"features": ["delta"]})["buckets"]
+
+
+def test_changed_buckets(monkeypatch):
+    monkeypatch.setattr(ns, "ID_BUCKET_SIZE", 1)
+    mine = ["a", "b", "c", "d"]
+    theirs = ["a", "b", "c", "e"]
+    count = ns.bucket_count(4)
+
+    s1, s2 = socket.socketpair()
+    res = {}
+    with s1.makefile("rwb") as f1, s2.makefile("rwb") as f2:
+        ns.run_async(lambda: res.update(mine=ns.changed_buckets(mine, f1, f1)),
+                     lambda: res.update(theirs=ns.changed_buckets(theirs, f2, f2)))
+    s1.close()
+    s2.close()
+
+    differ = {ns.bucket_of("d", count), ns.bucket_of("e", count)}
+    assert [mid for mid in mine if ns.bucket_of(mid, count) in differ] == res["mine"]
+    assert [mid for mid in theirs if ns.bucket_of(mid, count) in differ] == res["theirs"]
+    assert "d" in res["mine"]
+    assert "e" in res["theirs"]
+
+
+def test_diff_sorted():
+    assert (["a", "d"], ["b", "e", "f"]) == ns.diff_sorted(["a", "c", "d"], iter(["b", "c", "e", "f"]))
+    assert ([], []) == ns.diff_sorted(["a"], iter(["a"]))
+    assert (["a"], []) == ns.diff_sorted(["a"], iter([]))
+    assert ([], ["a"]) == ns.diff_sorted([], iter(["a"]))
+
+
+def test_send_recv_ids(monkeypatch):
+    monkeypatch.setattr(ns, "ID_BATCH", 2)
+    stream = io.BytesIO()
+    ns.send_ids(["a", "b", "c"], stream)
+    assert b"\x00\x00\x00\x0A[\"a\", \"b\"]\x00\x00\x00\x05[\"c\"]\x00\x00\x00\x00" == stream.getvalue()
+    stream.seek(0)
+    assert ["a", "b", "c"] == list(ns.recv_ids(stream))
+
+
+def test_sync_deletes_remote_policy(monkeypatch):
+    monkeypatch.setitem(ns.session, "policies", [{"pattern": "archive/*", "files": True, "delete": False, "priority": 0}])
+    m2 = lambda: None
+    m2.filenames = MagicMock(return_value=[prefix + "archive/cur/bar"])
+    m2.tags = ["deleted"]
+    m2.ghost = False
+
+    db = lambda: None
+    db.remove = MagicMock()
+    db.find = MagicMock(return_value=m2)
+
+    mock_ctx = MagicMock()
+    mock_ctx.__enter__.return_value = db
+    mock_ctx.__exit__.return_value = False
+
+    with patch("notmuch2.Database", return_value=mock_ctx):
+        with patch("pathlib.Path.unlink") as pu:
+            with patch.object(ns, "get_ids", return_value=["foo", "bar"]):
+                istream = io.BytesIO(digest_frame(["foo"]) + b"\x00\x00\x00\x07[\"bar\"]\x00\x00\x00\x00")
+                ostream = io.BytesIO()
+                assert 0 == ns.sync_deletes_remote(prefix, istream, ostream)
+                assert pu.call_count == 0
+    assert db.remove.call_count == 0
+
+
+def test_sync_deletes_remote_grace(monkeypatch, tmp_path):
+    monkeypatch.setattr(ns, "state_path", lambda prefix, name: str(tmp_path / name))
+    pending = tmp_path / "notmuch-sync-pending-deletes"
+    m2 = lambda: None
+    m2.filenames = MagicMock(return_value=["barfile"])
+    m2.tags = ["deleted"]
+    m2.ghost = False
+
+    db = lambda: None
+    db.remove = MagicMock()
+    db.find = MagicMock(return_value=m2)
+
+    mock_ctx = MagicMock()
+    mock_ctx.__enter__.return_value = db
+    mock_ctx.__exit__.return_value = False
+
+    grace = 7 * 86400
+    with patch("notmuch2.Database", return_value=mock_ctx), patch("pathlib.Path.unlink") as pu, \
+         patch.object(ns, "get_ids", return_value=["foo", "bar"]):
+        for now, deleted in [(1000, 0), (1000 + grace - 1, 0), (1000 + grace, 1)]:
+            with patch("time.time", return_value=now):
+                istream = io.BytesIO(digest_frame(["foo"]) + b"\x00\x00\x00\x07[\"bar\"]\x00\x00\x00\x00")
+                assert deleted == ns.sync_deletes_remote(prefix, istream, io.BytesIO(), grace=grace)
+            assert ({} if deleted else {"bar": 1000}) == json.loads(pending.read_text())
+        assert pu.call_count == 1
+        db.remove.assert_called_once_with("barfile")
+
+        # back on the other side, no longer pending
+        pending.write_text(json.dumps({"bar": 1000}))
+        assert 0 == ns.sync_deletes_remote(prefix, io.BytesIO(digest_frame(["bar", "foo"])), io.BytesIO(), grace=grace)
+        assert {} == json.loads(pending.read_text())
+
+    # replaced atomically, so an interrupted write leaves the previous file
+    with patch("os.replace", side_effect=OSError("interrupted")), pytest.raises(OSError):
+        ns.write_pending_deletes(prefix, {"baz": 2000})
+    assert {} == json.loads(pending.read_text())
+    assert [pending.name] == [p.name for p in tmp_path.iterdir()]
+
+    assert ns.delete_due({}, "foo", None)
+    assert ["--delete-grace=168h"] == [a for a in ns.remote_args(ns.parse_args(["-r", "bar", "-d", "--delete-grace", "1w"]))
+                                         if a.startswith("--delete-grace")]
+
+
+def test_read_policies(monkeypatch):
+    config = ns.configparser.ConfigParser()
+    config.read_string("[remote foo]\nhost = bar\n"
+                       "[folder lists/**]\nfiles = no\n"
+                       "[folder INBOX/**]\npriority = 10\n"
+                       "[folder archive/**]\ndelete = no\n")
+    policies = ns.read_policies(config)
+    assert [{"pattern": "lists/**", "files": False, "delete": True, "priority": 0},
+            {"pattern": "INBOX/**", "files": True, "delete": True, "priority": 10},
+            {"pattern": "archive/**", "files": True, "delete": False, "priority": 0}] == policies
+
+    monkeypatch.setitem(ns.session, "policies", policies)
+    assert {"files": False, "delete": True, "priority": 0} == ns.policy_for(["/lists/foo/cur/1"])
+    assert {"files": True, "delete": True, "priority": 10} == ns.policy_for(["INBOX/cur/1"])
+    assert {"files": False, "delete": False, "priority": 10} == \
+        ns.policy_for(["INBOX/cur/1", "archive/cur/1", "lists/foo/cur/1"])
+    assert {"files": True, "delete": True, "priority": 0} == ns.policy_for(["other/cur/1"])
+
+
+def test_evict():
+    with TemporaryDirectory() as tmp:
+        pfx = tmp + os.sep
+        Path(pfx, ".notmuch").mkdir()
+        Path(pfx, "cur").mkdir()
+        Path(pfx, "cur", "1").write_bytes(b"one")
+        Path(pfx, "cur", "2").write_bytes(b"two")
+
+        m1 = MagicMock()
+        m1.messageid = "foo"
+        m1.tags = ["inbox"]
+        m1.ghost = False
+        m1.filenames = MagicMock(return_value=[Path(pfx, "cur", "1"), Path(pfx, "cur", "2")])
+        m2 = MagicMock()
+        m2.ghost = True
+        db = MagicMock()
+        db.messages = MagicMock(return_value=[m1, m2])
+
+        ns.planned.clear()
+        with patch("time.time", return_value=1000000):
+            assert 1 == ns.evict(db, pfx, 1000, dry_run=True)
+            db.messages.assert_called_once_with("date:..@999000")
+            assert [{"op": "evict", "id": "foo", "files": ["cur/1", "cur/2"]}] == ns.planned
+            assert "@@ message foo @@\n-cur/1  (evicted)\n-cur/2  (evicted)\n" in ns.format_plan(ns.planned, "local")
+            db.remove.assert_not_called()
+            assert {} == ns.read_evicted(pfx)
+            ns.planned.clear()
+
+            # recorded before anything is removed
+            db.remove.side_effect = OSError("interrupted")
+            with pytest.raises(OSError):
+                ns.evict(db, pfx, 1000)
+            assert {"foo": ["inbox"]} == ns.read_evicted(pfx)
+            assert Path(pfx, "cur", "1").exists()
+            db.remove.reset_mock(side_effect=True)
+
+            assert 1 == ns.evict(db, pfx, 1000)
+        assert db.remove.mock_calls == [call(Path(pfx, "cur", "1")), call(Path(pfx, "cur", "2"))]
+        assert not Path(pfx, "cur", "1").exists()
+        assert not Path(pfx, "cur", "2").exists()
+        assert {"foo": ["inbox"]} == ns.read_evicted(pfx)
+
+
+def test_hydrate_local():
+    with TemporaryDirectory() as tmp:
+        pfx = tmp + os.sep
+        Path(pfx, ".notmuch").mkdir()
+        ns.write_evicted(pfx, {"foo": ["old"], "baz": []})
+
+        present = MagicMock()
+        present.ghost = False
+        ghost = MagicMock()
+        ghost.ghost = True
+
+        def find(mid):
+            if mid == "foo":
+                raise LookupError
+            return {"bar": present, "qux": ghost}[mid]
+        db = lambda: None
+        db.find = MagicMock(side_effect=find)
+
+        found = {"foo": {"tags": ["new"], "files": ["cur/foo"]},
+                 "bar": {"tags": [], "files": ["cur/bar"]},
+                 "qux": {"tags": [], "files": ["cur/qux"]}}
+        data = json.dumps(found).encode("utf-8")
+        istream = io.BytesIO(struct.pack("!I", len(data)) + data)
+        ostream = io.BytesIO()
+        with patch.object(ns, "sync_files", return_value=(2, 2, 0)) as sf:
+            assert (2, 2, 0) == ns.hydrate_local(db, pfx, istream, ostream)
+            sf.assert_called_once_with(db, pfx, {"foo": found["foo"], "qux": found["qux"]}, istream, ostream,
+                                       reserve=0, space=None)
+        assert {"baz": []} == ns.read_evicted(pfx)
+
+
+def test_hydrate_remote():
+    m1 = MagicMock()
+    m1.messageid = "foo"
+    m1.tags = ["inbox"]
+    m1.ghost = False
+    m1.filenames = MagicMock(return_value=[prefix + "cur/foo"])
+    m2 = MagicMock()
+    m2.ghost = True
+    db = MagicMock()
+    db.messages = MagicMock(return_value=[m1, m2])
+
+    istream = io.BytesIO()
+    ostream = io.BytesIO()
+    with patch.object(ns, "sync_files") as sf:
+        ns.hydrate_remote(db, prefix, "tag:inbox", istream, ostream)
+        sf.assert_called_once_with(db, prefix, {}, istream, ostream)
+    db.messages.assert_called_once_with("tag:inbox")
+    data = json.dumps({"foo": {"tags": ["inbox"], "files": ["cur/foo"]}}).encode("utf-8")
+    assert struct.pack("!I", len(data)) + data == ostream.getvalue()
+
+
+def test_parse_args_hydrate():
+    args = ns.parse_args(["-r", "bar", "-p", "ns", "hydrate", "tag:foo", "and", "from:me"])
+    assert "hydrate" == args.command
+    assert "tag:foo and from:me" == args.query
+    assert ["ssh", "-CTaxq", "bar", "ns", "hydrate", "'tag:foo and from:me'"] == ns.remote_command(args)
+    assert ns.parse_args(["-r", "bar"]).command is None
+    with pytest.raises(SystemExit):
+        ns.parse_args(["-r", "bar", "foo"])
+    with pytest.raises(SystemExit):
+        ns.parse_args(["-r", "bar", "hydrate"])
+
+
+def test_listing(monkeypatch):
+    monkeypatch.setattr(ns, "ID_BATCH", 1)
+    m1 = MagicMock()
+    m1.messageid = "foo"
+    m1.tags = ["inbox", "a"]
+    m1.filenames = MagicMock(return_value=[prefix + "cur/2", prefix + "cur/1"])
+    m2 = MagicMock()
+    m2.messageid = "bar"
+    m2.tags = []
+    m2.filenames = MagicMock(return_value=[prefix + "cur/3"])
+    db = MagicMock()
+    db.messages = MagicMock(return_value=[m1, m2])
+
+    stream = io.BytesIO()
+    ns.send_listing(db, prefix, stream)
+    db.messages.assert_called_once_with("*")
+    stream.seek(0)
+    assert {"foo": {"tags": ["a", "inbox"], "files": ["cur/1", "cur/2"]},
+            "bar": {"tags": [], "files": ["cur/3"]}} == ns.recv_listing(stream)
+
+    with pytest.raises(ValueError):
+        ns.recv_listing(io.BytesIO(b"\x00\x00\x00\x02{}"))
+
+
+def test_listing_checksums(tmp_path):
+    (tmp_path / "cur").mkdir()
+    (tmp_path / "cur" / "1").write_bytes(b"foo")
+    m1 = MagicMock()
+    m1.messageid = "foo"
+    m1.tags = ["inbox"]
+    m1.filenames = MagicMock(return_value=[str(tmp_path / "cur" / "2"), str(tmp_path / "cur" / "1")])
+    db = MagicMock()
+    db.messages = MagicMock(return_value=[m1])
+
+    stream = io.BytesIO()
+    ns.send_listing(db, str(tmp_path) + os.sep, stream, checksums=True)
+    stream.seek(0)
+    assert {"foo": {"tags": ["inbox"], "files": ["cur/1", "cur/2"],
+                    "checksums": [ns.digest(b"foo"), None]}} == ns.recv_listing(stream)
+
+    stream = io.BytesIO()
+    ns.write(b'{"protocol": 1}', stream)
+    ns.write(b'{"foo": {"tags": [], "files": ["cur/1"], "checksums": []}}', stream)
+    stream.seek(0)
+    with pytest.raises(ValueError, match="Invalid checksums for 'foo'"):
+        ns.recv_listing(stream)
+
+
+def test_format_diff():
+    a = {"foo": {"tags": ["inbox", "a"], "files": ["cur/1"]},
+         "bar": {"tags": [], "files": ["cur/3"]},
+         "same": {"tags": ["x"], "files": ["cur/4"]}}
+    b = {"foo": {"tags": ["inbox", "b"], "files": ["cur/1", "cur/2"]},
+         "baz": {"tags": ["c"], "files": ["cur/5"]},
+         "same": {"tags": ["x"], "files": ["cur/4"]}}
+    report, ndiff = ns.format_diff((a, b), ("A", "B"))
+    assert 3 == ndiff
+    assert report == "\n".join(["--- A", "+++ B",
+                                "@@ message bar @@", "-message", "-cur/3",
+                                "@@ message baz @@", "+message", "+tag:c", "+cur/5",
+                                "@@ message foo @@", "-tag:a", "+tag:b", "+cur/2"]) + "\n"
+    assert ("--- A\n+++ B\n", 0) == ns.format_diff((a, a), ("A", "B"))
+
+    a = {"foo": {"tags": [], "files": ["cur/1", "cur/2"], "checksums": ["x", "y"]}}
+    b = {"foo": {"tags": [], "files": ["cur/1", "cur/2"], "checksums": ["x", "z"]}}
+    assert ("--- A\n+++ B\n@@ message foo @@\n!cur/2\n", 1) == ns.format_diff((a, b), ("A", "B"))
+    # without checksums on both sides, only names are compared
+    del a["foo"]["checksums"]
+    assert ("--- A\n+++ B\n", 0) == ns.format_diff((a, b), ("A", "B"))
+
+
+def test_undo(monkeypatch, tmp_path):
+    monkeypatch.setattr(ns, "state_path", lambda prefix, name: str(tmp_path / name))
+    pfx = str(tmp_path / "mail") + os.sep
+    Path(pfx, "INBOX", "cur").mkdir(parents=True)
+    Path(pfx, "INBOX", "cur", "1:2,").write_text("mail one")
+    Path(pfx, "INBOX", "cur", "2:2,").write_text("mail two")
+
+    # nothing changed, the changes of the previous sync are kept
+    (tmp_path / "notmuch-sync-undo").mkdir()
+    ns.start_undo(pfx)
+    ns.finish_undo()
+    assert not (tmp_path / "notmuch-sync-undo.new").exists()
+    assert (tmp_path / "notmuch-sync-undo").exists()
+
+    # an attempt that failed keeps its changes for the next one
+    ns.start_undo(pfx)
+    ns.record_undo("tags", id="foo", tags=["inbox", "unread"])
+    ns.finish_undo(completed=False)
+    assert 1 == len(Path(tmp_path, "notmuch-sync-undo.new", "log").read_text().splitlines())
+    # nothing changed in an attempt that failed
+    ns.start_undo(pfx)
+    ns.finish_undo(completed=False)
+    assert (tmp_path / "notmuch-sync-undo.new").exists()
+
+    ns.start_undo(pfx)
+    ns.record_undo("tags", id="foo", tags=["inbox"])
+    ns.record_undo("move", src="INBOX/cur/1:2,", dst="INBOX/cur/1:2,S")
+    os.rename(pfx + "INBOX/cur/1:2,", pfx + "INBOX/cur/1:2,S")
+    ns.record_undo("delete", name="INBOX/cur/2:2,")
+    os.unlink(pfx + "INBOX/cur/2:2,")
+    ns.finish_undo()
+    # not recording anymore
+    ns.record_undo("tags", id="bar", tags=[])
+    path = str(tmp_path / "notmuch-sync-undo")
+    assert 3 == len(Path(path, "log").read_text().splitlines())
+
+    mt = MagicMock()
+    m = MagicMock()
+    type(m).tags = PropertyMock(return_value=mt)
+    db = lambda: None
+    db.add = MagicMock()
+    db.remove = MagicMock()
+    db.find = MagicMock(return_value=m)
+    assert 3 == ns.undo_changes(db, pfx, path, dry_run=True)
+    db.add.assert_not_called()
+    assert 3 == ns.undo_changes(db, pfx, path)
+    assert "mail one" == Path(pfx, "INBOX", "cur", "1:2,").read_text()
+    assert "mail two" == Path(pfx, "INBOX", "cur", "2:2,").read_text()
+    assert not Path(pfx, "INBOX", "cur", "1:2,S").exists()
+    assert [call(pfx + "INBOX/cur/2:2,"), call(pfx + "INBOX/cur/1:2,")] == db.add.mock_calls
+    db.remove.assert_called_once_with(pfx + "INBOX/cur/1:2,S")
+    assert [call("foo"), call("foo")] == db.find.mock_calls
+    assert [call("inbox"), call("unread")] == mt.add.mock_calls
+
+    assert "undo" == ns.parse_args(["undo"]).command
+
+    # cut off by a crash after backing up a deleted file and while recording
+    # the next one; the backups and readable entries are kept
+    new = tmp_path / "notmuch-sync-undo.new"
+    new.mkdir()
+    Path(new, "0").write_text("mail two")
+    Path(new, "1").write_text("mail three")
+    Path(new, "log").write_text('{"op": "delete", "name": "INBOX/cur/2:2,", "backup": "0"}\n{"op": "delete", "name": "INB')
+    ns.start_undo(pfx)
+    assert [{"op": "delete", "name": "INBOX/cur/2:2,", "backup": "0"}] == ns.read_undo_log(str(new))[0]
+    ns.record_undo("tags", id="foo", tags=["inbox"])
+    ns.record_undo("delete", name="INBOX/cur/1:2,")
+    ns.finish_undo(completed=False)
+    entries, broken = ns.read_undo_log(str(new))
+    assert 0 == broken
+    assert ["delete", "tags", "delete"] == [e["op"] for e in entries]
+    assert "3" == entries[2]["backup"]
+    assert ["mail two", "mail three", "mail one"] == [Path(new, n).read_text() for n in ["0", "1", "3"]]
+    # the undo command skips entries that can't be read
+    Path(new, "log").write_text(Path(new, "log").read_text() + "garbage\n")
+    db.add.reset_mock()
+    assert 3 == ns.undo_changes(db, pfx, str(new), dry_run=True)
+
+
+def test_repair_db(tmp_path):
+    for d in ["cur", "new"]:
+        (tmp_path / d).mkdir()
+    for name, content in [("cur/1", b"a"), ("new/moved", b"b"), ("cur/a", b"c"), ("cur/b", b"d"), ("cur/junk", b"")]:
+        (tmp_path / name).write_bytes(content)
+    prefix = str(tmp_path) + os.sep
+
+    def msg(mid, tags, files):
+        m = MagicMock()
+        m.messageid = mid
+        m.ghost = False
+        m.tags = tags
+        m.filenames = MagicMock(return_value=[prefix + f for f in files])
+        return m
+    moved = msg("moved", ["inbox"], ["cur/old"])
+    moved.tags = MagicMock()
+    moved.tags.__iter__ = lambda _: iter(["inbox"])
+    msgs = [msg("ok", [], ["cur/1", "cur/2"]), moved, msg("gone", ["foo"], ["cur/3"]),
+            msg("dup", [], ["cur/a", "cur/b"])]
+    db = MagicMock()
+    db.messages = MagicMock(return_value=msgs)
+    db.find = MagicMock(side_effect=lambda mid: {"moved": moved}[mid])
+    db.add = MagicMock(side_effect=lambda f: (_ for _ in ()).throw(notmuch2.FileNotEmailError()) if f.endswith("junk") else None)
+
+    with patch.object(ns, "read_evicted", return_value={"old": []}), patch.object(ns, "write_evicted") as we:
+        # can't tell which messages have been moved without indexing
+        assert (3, 2, 2, 1) == ns.repair_db(db, prefix, dry_run=True)
+        db.remove.assert_not_called()
+        db.add.assert_not_called()
+        we.assert_not_called()
+
+        assert (3, 1, 1, 1) == ns.repair_db(db, prefix)
+    assert [call(prefix + "cur/2"), call(prefix + "cur/old"), call(prefix + "cur/3")] == db.remove.call_args_list
+    assert [call(prefix + "cur/junk"), call(prefix + "new/moved")] == db.add.call_args_list
+    moved.tags.clear.assert_called_once_with()
+    moved.tags.add.assert_called_once_with("inbox")
+    we.assert_called_once_with(prefix, {"old": [], "gone": ["foo"]})
+
+
+def test_verify_remote(monkeypatch, tmp_path):
+    (tmp_path / "cur").mkdir()
+    (tmp_path / "cur" / "1").write_bytes(b"foo")
+    m1 = MagicMock()
+    m1.messageid = "foo"
+    m1.tags = ["inbox"]
+    m1.filenames = MagicMock(return_value=[str(tmp_path / "cur" / "1")])
+    db = MagicMock()
+    db.messages = MagicMock(return_value=[m1])
+    db.config = {"database.path": str(tmp_path)}
+    mock_ctx = MagicMock()
+    mock_ctx.__enter__.return_value = db
+    mock_ctx.__exit__.return_value = False
+
+    out = io.StringIO()
+    monkeypatch.setattr(sys, "stdout", out)
+    args = ns.parse_args(["-r", "foo", "-p", "ns", "--config", "/nonexistent", "verify"])
+    assert ["ssh", "-CTaxq", "foo", "ns", "verify"] == ns.remote_command(args)
+    remote = {"foo": {"tags": ["inbox"], "files": ["cur/1"], "checksums": [ns.digest(b"bar")]}}
+    with patch("notmuch2.Database", return_value=mock_ctx), patch.object(ns, "use_notmuch_dir"), \
+            patch.object(ns, "get_listing", return_value=remote) as gl:
+        assert 1 == ns.verify_remote(args)
+    gl.assert_called_once_with(args)
+    assert "--- local\n+++ foo\n@@ message foo @@\n!cur/1\n" == out.getvalue()
+
+
+def test_capabilities(monkeypatch):
+    args = ns.parse_args(["-r", "foo", "-p", "ns", "--config", "/nonexistent", "capabilities"])
+    assert ["ssh", "-CTaxq", "foo", "ns", "capabilities"] == ns.remote_command(args)
+
+    with patch.object(ns, "notmuch_version", return_value="0.38"):
+        mine = ns.capabilities()
+    assert "python" == mine["implementation"]
+    assert ns.PROTOCOL == mine["protocol"]
+    assert ns.COMPRESSIONS == mine["compressions"]
+
+    theirs = {"implementation": "go", "version": "1.0", "protocol": ns.PROTOCOL, "digests": ["sha256"],
+              "encodings": mine["encodings"], "features": ["delta", "frobnicate"]}
+    out = ns.format_capabilities(mine, theirs, "foo")
+    lines = out.splitlines()
+    assert lines[0].split() == ["local", "foo"]
+    assert lines[1].split() == ["implementation", "python", ns.VERSION, "go", "1.0"]
+    assert lines[3].split() == ["notmuch", "0.38", "unknown"]
+    assert "common digests: sha256" in lines
+    assert "common features: delta" in lines
+    assert "common compressions: none" in lines
+
+    out = ns.format_capabilities(mine, {"protocol": ns.PROTOCOL + 1}, "foo")
+    assert out.endswith(f"incompatible: protocol {ns.PROTOCOL + 1} on foo, {ns.PROTOCOL} on local\n")
+
+    stdout = MagicMock()
+    stdout.buffer = io.BytesIO()
+    monkeypatch.setattr(sys, "stdout", stdout)
+    with patch.object(ns, "notmuch_version", return_value="0.38"):
+        ns.sync_remote(ns.parse_args(["capabilities"]))
+    stdout.buffer.seek(0)
+    assert mine == json.loads(ns.read(stdout.buffer))
+
+
+def test_status(monkeypatch, tmp_path):
+    (tmp_path / ".notmuch").mkdir()
+    monkeypatch.setitem(ns.session, "notmuch_dir", None)
+    rev = lambda: None
+    rev.rev = 123
+    rev.uuid = b'00000000-0000-0000-0000-000000000000'
+    monkeypatch.setitem(ns.session, "peer", "host:/mail/")
+    with patch("time.time", return_value=1700000000):
+        ns.record_sync(str(tmp_path / ".notmuch" / "notmuch-sync-00000000-0000-0000-0000-000000000001"), rev)
+    monkeypatch.setitem(ns.session, "peer", None)
+    (tmp_path / ".notmuch" / "notmuch-sync-00000000-0000-0000-0000-000000000002").write_text("100 00000000-0000-0000-0000-000000000009")
+    (tmp_path / ".notmuch" / "notmuch-sync-00000000-0000-0000-0000-000000000003").write_text("broken")
+
+    db = MagicMock()
+    current = lambda: None
+    current.rev = 130
+    current.uuid = b'00000000-0000-0000-0000-000000000000'
+    db.revision = MagicMock(return_value=current)
+    db.count_messages = MagicMock(side_effect=lambda query, **kwargs: 5 if query == "lastmod:124.." else 42)
+    mine = ns.sync_status(db, str(tmp_path))
+    assert {"uuid": "00000000-0000-0000-0000-000000000000", "rev": 130, "peers": {
+        "00000000-0000-0000-0000-000000000001": {"peer": "host:/mail/", "time": 1700000000, "rev": 123, "pending": 5},
+        # recreated since
+        "00000000-0000-0000-0000-000000000002": {"peer": None, "time": None, "rev": 100, "pending": 42}}} == mine
+    db.count_messages.assert_any_call("lastmod:124..")
+
+    when = time.strftime("%Y-%m-%d %H:%M", time.localtime(1700000000))
+    assert ("00000000-0000-0000-0000-000000000002: last sync unknown, revision 100 of 130, 42 local changes pending\n"
+            f"host:/mail/: last sync {when}, revision 123 of 130, 5 local changes pending\n") == ns.format_status(mine)
+    theirs = {"uuid": "00000000-0000-0000-0000-000000000001", "rev": 7,
+              "peers": {"00000000-0000-0000-0000-000000000000": {"peer": "me:/mail/", "time": 1700000000, "rev": 6, "pending": 1}}}
+    assert (f"host:/mail/: last sync {when}, revision 123 of 130, 5 local changes pending, 1 remote changes pending\n"
+            == ns.format_status(mine, theirs, "host"))
+    theirs["peers"] = {}
+    assert ns.format_status(mine, theirs, "host").endswith(", no sync state on host\n")
+    theirs["uuid"] = "00000000-0000-0000-0000-000000000004"
+    assert "Never synced with host.\n" == ns.format_status(mine, theirs, "host")
+    assert "Never synced.\n" == ns.format_status({**mine, "peers": {}})
+
+    args = ns.parse_args(["-r", "host", "-p", "ns", "--config", "/nonexistent", "status"])
+    assert ["ssh", "-CTaxq", "host", "ns", "states"] == ns.remote_command(args)
+
+
+def test_parse_args_diff():
+    args = ns.parse_args(["-r", "foo", "-r", "bar", "-u", "me", "-p", "ns", "--config", "/nonexistent", "diff"])
+    assert "diff" == args.command
+    assert args.remote is None
+    assert ["foo", "bar"] == [p.remote for p in args.peers]
+    assert ["ssh", "-CTaxq", "me@bar", "ns", "list"] == ns.remote_command(args.peers[1])
+    with pytest.raises(SystemExit):
+        ns.parse_args(["-r", "foo", "diff"])
+    with pytest.raises(SystemExit):
+        ns.parse_args(["-r", "foo", "-r", "bar"])
+
+
+def test_parse_args_commands():
+    args = ns.parse_args(["-r", "foo", "--config", "/nonexistent", "sync"])
+    assert "foo" == args.remote
+    assert args.command is None and args.clone is None
+    args = ns.parse_args(["serve"])
+    assert args.command is None and args.remote is None
+    args = ns.parse_args(["-r", "foo", "--config", "/nonexistent", "clone"])
+    assert args.command is None and "none" == args.clone
+    args = ns.parse_args(["-c", "cmd", "clone", "xz"])
+    assert args.command is None and "xz" == args.clone
+    # the remote side is still started without a command
+    assert ["ssh", "-CTaxq", "foo", "ns", "--clone=none"] == ns.remote_command(
+        ns.parse_args(["-r", "foo", "-p", "ns", "--config", "/nonexistent", "clone"]))
+    for argv in [["sync"], ["clone"], ["-r", "foo", "--config", "/nonexistent", "serve"], ["-c", "cmd", "clone", "zip"],
+                 ["-c", "cmd", "sync", "now"]]:
+        with pytest.raises(SystemExit):
+            ns.parse_args(argv)
+
+
+def test_completion():
+    config = ns.configparser.ConfigParser()
+    config.read_string("[remote mail]\nhost = mail.example.org\n[remote work]\nhost = work.example.org\n")
+    parser = ns.build_parser()
+
+    bash = ns.completion("bash", parser, config)
+    assert '-r|--remote) COMPREPLY=($(compgen -W "mail work" -- "$cur")); return;;' in bash
+    assert '--log-format) COMPREPLY=($(compgen -W "text json" -- "$cur")); return;;' in bash
+    assert "--max-delete" in bash and "status" in bash
+    assert bash.endswith("complete -o default -F _notmuch_sync notmuch-sync\n")
+
+    zsh = ns.completion("zsh", parser, config)
+    assert zsh.startswith("#compdef notmuch-sync\n")
+    assert "'--remote[remote host to connect to]:remote:(mail work)' \\\n" in zsh
+    assert "'--clone[if the notmuch database on one side is empty, first copy...]::clone:(none gz bz2 xz)' \\\n" in zsh
+    assert "'--force[delete even if more than --max-delete messages would be...]' \\\n" in zsh
+    assert "isn'\\''t" in zsh
+
+    fish = ns.completion("fish", parser, config)
+    assert "complete -c notmuch-sync -s r -l remote -x -a 'mail work' -d 'remote host to connect to'\n" in fish
+    assert "complete -c notmuch-sync -s u -l user -r -F -d 'SSH user to use'\n" in fish
+    assert "isn\\'t" in fish
+
+    assert "complete -c notmuch-sync -s r -l remote -r -F" in ns.completion("fish", parser, ns.configparser.ConfigParser())
+    with pytest.raises(ValueError):
+        ns.completion("tcsh", parser, config)
+
+    assert "zsh" == ns.parse_args(["completion", "zsh"]).shell
+    with pytest.raises(SystemExit):
+        ns.parse_args(["completion", "tcsh"])
+
+
+def test_parse_age():
+    assert 365 * 86400 == ns.parse_age("1y")
+    assert 2 * 7 * 86400 == ns.parse_age("2w")
+    assert 12 * 3600 == ns.parse_age("12h")
+    with pytest.raises(ns.argparse.ArgumentTypeError):
+        ns.parse_age("1x")
+    with pytest.raises(ns.argparse.ArgumentTypeError):
+        ns.parse_age("")
+
+
 def test_get_ids():
     p1 = lambda: None
     p1.docid = 1
@@ -1396,15 +3743,12 @@ def test_sync_mbsync_local():
                 ps.side_effect = effect_stat()
                 with patch("pathlib.Path.mkdir") as pm:
                     with patch("os.utime") as ut:
-                        with patch("builtins.open", mock_open(read_data=b"a")) as o:
+                        with patch("builtins.open", mock_open(read_data=b"a")) as o, patch.object(ns, "write_atomic") as wa:
                             ns.sync_mbsync_local(tmpdir, istream, ostream)
                             assert call(tmpdir + ".uidvalidity", "rb") in o.mock_calls
-                            assert call(tmpdir + ".mbsyncstate", "wb") in o.mock_calls
                             hdl = o()
                             hdl.read.assert_called_once()
-                            hdl.write.assert_called_once()
-                            args = hdl.write.call_args.args
-                            assert b"b" == args[0]
+                            wa.assert_called_once_with(tmpdir + ".mbsyncstate", b"b", None)
                             assert ut.mock_calls == [call(tmpdir + ".mbsyncstate", (0.0, 0.0))]
 
             assert b"\x00\x00\x00\x10[\".mbsyncstate\"]\x00\x00\x00\x10[\".uidvalidity\"]\x3F\xF0\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01a" == ostream.getvalue()
@@ -1440,6 +3784,33 @@ def test_sync_mbsync_local_no_changes():
             assert b"\x00\x00\x00\x02[]\x00\x00\x00\x02[]" == out
 
 
+def test_sync_mbsync_local_digests(monkeypatch, tmp_path):
+    monkeypatch.setitem(ns.session, "mbsync_digests", True)
+    (tmp_path / ".uidvalidity").write_text("1\n")
+    (tmp_path / "INBOX").mkdir()
+    (tmp_path / "INBOX" / ".mbsyncstate").write_text("mine\n")
+    prefix = str(tmp_path) + os.sep
+    assert [".uidvalidity", "INBOX/.mbsyncstate"] == sorted(ns.mbsync_stats(prefix))
+    theirs = {".uidvalidity": [1e12, ns.digest(b"1\n")], "INBOX/.mbsyncstate": [1e12, ns.digest(b"theirs\n")]}
+    istream = io.BytesIO()
+    ns.write(json.dumps(theirs).encode("utf-8"), istream)
+    istream.write(struct.pack("!d", 1e12))
+    istream.seek(0)
+    ostream = io.BytesIO()
+    with patch.object(ns, "recv_file") as rf:
+        ns.sync_mbsync_local(prefix, istream, ostream)
+    # newer on the other side, but only the one with different contents is pulled
+    rf.assert_called_once_with(prefix + "INBOX/.mbsyncstate", istream, overwrite_raise=False)
+    ostream.seek(0)
+    assert ["INBOX/.mbsyncstate"] == json.loads(ns.read(ostream))
+
+    istream = io.BytesIO()
+    ns.write(b'{".uidvalidity": 1}', istream)
+    istream.seek(0)
+    with pytest.raises(ValueError, match="Invalid mbsync file stats"):
+        ns.sync_mbsync_local(prefix, istream, io.BytesIO())
+
+
 def test_sync_mbsync_local_missing():
     with TemporaryDirectory() as _tmpdir:
         tmpdir = _tmpdir + os.sep
@@ -1464,15 +3835,12 @@ def test_sync_mbsync_local_missing():
                 ps.side_effect = effect_stat()
                 with patch("pathlib.Path.mkdir") as pm:
                     with patch("os.utime") as ut:
-                        with patch("builtins.open", mock_open(read_data=b"a")) as o:
+                        with patch("builtins.open", mock_open(read_data=b"a")) as o, patch.object(ns, "write_atomic") as wa:
                             ns.sync_mbsync_local(tmpdir, istream, ostream)
                             assert call(tmpdir + ".uidvalidity", "rb") in o.mock_calls
-                            assert call(tmpdir + ".mbsyncstate", "wb") in o.mock_calls
                             hdl = o()
                             hdl.read.assert_called_once()
-                            hdl.write.assert_called_once()
-                            args = hdl.write.call_args.args
-                            assert b"b" == args[0]
+                            wa.assert_called_once_with(tmpdir + ".mbsyncstate", b"b", None)
                             assert ut.mock_calls == [call(tmpdir + ".mbsyncstate", (0.0, 0.0))]
 
             assert b"\x00\x00\x00\x10[\".mbsyncstate\"]\x00\x00\x00\x10[\".uidvalidity\"]\x3F\xF0\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01a" == ostream.getvalue()
@@ -1526,15 +3894,12 @@ def test_sync_mbsync_remote():
                 ps.side_effect = effect_stat()
                 with patch("pathlib.Path.mkdir") as pm:
                     with patch("os.utime") as ut:
-                        with patch("builtins.open", mock_open(read_data=b"b")) as o:
+                        with patch("builtins.open", mock_open(read_data=b"b")) as o, patch.object(ns, "write_atomic") as wa:
                             ns.sync_mbsync_remote(tmpdir, istream, ostream)
-                            assert call(tmpdir + ".uidvalidity", "wb") in o.mock_calls
                             assert call(tmpdir + ".mbsyncstate", "rb") in o.mock_calls
                             hdl = o()
                             hdl.read.assert_called_once()
-                            hdl.write.assert_called_once()
-                            args = hdl.write.call_args.args
-                            assert b"a" == args[0]
+                            wa.assert_called_once_with(tmpdir + ".uidvalidity", b"a", None)
                             assert ut.mock_calls == [call(tmpdir + ".uidvalidity", (1.0, 1.0))]
 
                 out = ostream.getvalue()
@@ -1595,15 +3960,12 @@ def test_sync_mbsync_remote_missing():
                 ps.side_effect = effect_stat()
                 with patch("pathlib.Path.mkdir") as pm:
                     with patch("os.utime") as ut:
-                        with patch("builtins.open", mock_open(read_data=b"a")) as o:
+                        with patch("builtins.open", mock_open(read_data=b"a")) as o, patch.object(ns, "write_atomic") as wa:
                             ns.sync_mbsync_remote(tmpdir, istream, ostream)
-                            assert call(tmpdir + ".uidvalidity", "wb") in o.mock_calls
                             assert call(tmpdir + ".mbsyncstate", "rb") in o.mock_calls
                             hdl = o()
                             hdl.read.assert_called_once()
-                            hdl.write.assert_called_once()
-                            args = hdl.write.call_args.args
-                            assert b"b" == args[0]
+                            wa.assert_called_once_with(tmpdir + ".uidvalidity", b"b", None)
                             assert ut.mock_calls == [call(tmpdir + ".uidvalidity", (1.0, 1.0))]
 
             out = ostream.getvalue()
@@ -1615,3 +3977,1428 @@ def test_digest():
     assert "578f2f7c0b2e8ea5be4c8d245b07dec37c62ce4644fadb2a5c23839b39d6c260" == ns.digest(b"foo\nbar\nfoobar")
     assert "578f2f7c0b2e8ea5be4c8d245b07dec37c62ce4644fadb2a5c23839b39d6c260" == ns.digest(b"foo\nbar\nX-TUID: bla\nfoobar")
     assert "578f2f7c0b2e8ea5be4c8d245b07dec37c62ce4644fadb2a5c23839b39d6c260" == ns.digest(b"foo\nbar\nX-TUID: blarg\nfoobar")
+
+
+def test_digester():
+    for data in [b"", b"foo\nbar\nX-TUID: bla\nfoobar", b"X-TUID: bla\nfoo\nX-TUID: bar\n", b"foo\nX-TUID: bla",
+                 b"X-TUID", b"foo\nX-TUID: " + b"a" * 100 + b"\n" + b"b" * 100]:
+        # any split of the data gives the digest of all of it
+        for size in [1, 3, 8, 10, 1000]:
+            hasher = ns.Digester()
+            for i in range(0, len(data), size):
+                hasher.update(data[i:i + size])
+            assert ns.digest(data) == hasher.hexdigest()
+    assert ns.digest(b"foo\nbar\nfoobar") == ns.digest(b"foo\nbar\nX-TUID: bla\nfoobar")
+    # an X-TUID: line without an end is kept
+    assert ns.digest(b"foo\nX-TUID: bla") != ns.digest(b"foo\n")
+
+
+def test_digest_algo():
+    assert "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae" == ns.digest(b"foo", "sha256")
+    if ns.blake3 is None:
+        with pytest.raises(ValueError) as pwe:
+            ns.digest(b"foo", "blake3")
+        assert str(pwe.value) == "BLAKE3 digest requested, but blake3 module not available!"
+    else:
+        assert "04e0bb39f30b1a3feb89f536c93be15055482df748674b00d26e5a75777702e9" == ns.digest(b"foo", "blake3")
+        assert ns.digest(b"foo\nX-TUID: bla\nbar", "blake3") == ns.digest(b"foo\nbar", "blake3")
+
+
+def test_encode_decode_data(monkeypatch):
+    changes = {"foo": {"tags": ["inbox"], "files": ["INBOX/cur/1"]}}
+    for encoding in ns.ENCODINGS:
+        monkeypatch.setitem(ns.session, "encoding", encoding)
+        assert changes == ns.decode_changes(ns.encode_data(changes))
+        assert ["INBOX/cur/1", "INBOX/cur/2"] == ns.decode_fnames(ns.encode_data(["INBOX/cur/1", "INBOX/cur/2"]))
+        assert ["abc", None] == ns.decode_data(ns.encode_data(["abc", None]))
+    monkeypatch.setitem(ns.session, "encoding", "json")
+    assert b'["foo"]' == ns.encode_data(["foo"])
+
+    # errors of the decoding modules are invalid data
+    unpacker = lambda: None
+    unpacker.unpackb = MagicMock(side_effect=Exception("unpack(b) received extra data."))
+    monkeypatch.setattr(ns, "msgpack", unpacker)
+    monkeypatch.setitem(ns.session, "encoding", "msgpack")
+    with pytest.raises(ValueError) as pwe:
+        ns.decode_changes(b"\x81")
+    assert "Invalid msgpack data from other side, aborting..." == str(pwe.value)
+
+
+def test_negotiate_encoding():
+    assert "msgpack" == ns.negotiate({"encodings": ["json", "msgpack"], "encoding": "msgpack"},
+                                     {"encodings": ["json", "msgpack", "cbor"]})["encoding"]
+    assert "cbor" == ns.negotiate({"encodings": ["json", "cbor"]},
+                                  {"encodings": ["json", "msgpack", "cbor"], "encoding": "cbor"})["encoding"]
+    # not supported on the other side, e.g. older versions
+    assert "json" == ns.negotiate({"encodings": ["json", "msgpack"], "encoding": "msgpack"}, {})["encoding"]
+    # conflicting preferences
+    assert "json" == ns.negotiate({"encodings": ["json", "msgpack", "cbor"], "encoding": "msgpack"},
+                                  {"encodings": ["json", "msgpack", "cbor"], "encoding": "cbor"})["encoding"]
+
+
+def test_format_plan():
+    entries = [{"op": "tags", "id": "foo", "add": ["foobar"], "remove": ["foo"]},
+               {"op": "add", "name": "INBOX/cur/1"},
+               {"op": "move", "src": "INBOX/new/2", "dst": "INBOX/cur/2"},
+               {"op": "copy", "src": "INBOX/cur/1", "dst": "archive/cur/1"},
+               {"op": "delete", "name": "INBOX/cur/3"},
+               {"op": "delete-message", "id": "bar", "files": ["archive/cur/4"]},
+               {"op": "mbsync-pull", "name": "INBOX/.mbsyncstate"}]
+    assert ns.format_plan(entries, "local") == """--- local
++++ local (after sync)
+@@ folder INBOX @@
++INBOX/.mbsyncstate  (mbsync state from remote)
+@@ folder INBOX/cur @@
++INBOX/cur/1
+-INBOX/new/2
++INBOX/cur/2  (move of INBOX/new/2)
+-INBOX/cur/3
+@@ folder archive/cur @@
++archive/cur/1  (copy of INBOX/cur/1)
+@@ message bar @@
+-message
+-archive/cur/4
+@@ message foo @@
+-tag:foo
++tag:foobar
+"""
+    assert ns.format_plan([], "remote") == "--- remote\n+++ remote (after sync)\n"
+
+
+def test_frames():
+    ostream = io.BytesIO()
+    with ns.FrameWriter(ostream) as fw:
+        fw.write(b"foo")
+        fw.write(b"")
+        fw.write(b"barbaz")
+    assert b"\x00\x00\x00\x03foo\x00\x00\x00\x06barbaz\x00\x00\x00\x00" == ostream.getvalue()
+
+    istream = io.BytesIO(ostream.getvalue() + b"rest")
+    with ns.FrameReader(istream) as fr:
+        assert b"fo" == fr.read(2)
+        assert b"obarbaz" == fr.read()
+        assert b"" == fr.read()
+    assert b"rest" == istream.read()
+
+
+def test_read_closed():
+    with pytest.raises(EOFError) as pwe:
+        ns.read(io.BytesIO(b"\x00\x00"))
+    assert str(pwe.value) == "Connection to other side closed while waiting for data, aborting..."
+    with pytest.raises(ValueError) as pwe:
+        ns.read(io.BytesIO(b"\x00\x00\x00\x05foo"))
+    assert str(pwe.value) == "Tried to read 5 bytes, but read only 3, aborting..."
+
+
+def test_validate_fname():
+    assert "INBOX/cur/1:2,S" == ns.validate_fname("INBOX/cur/1:2,S")
+    assert "INBOX/new/1" == ns.validate_fname("INBOX/new/1")
+    assert ".mbsyncstate" == ns.validate_fname(".mbsyncstate", mail=False)
+    for fname in ["", ".", "./", "/etc/passwd", "../.ssh/id_rsa", "INBOX/../../foo", ".notmuch/xapian/foo",
+                  "foo\0bar", None, 1, ["foo"]]:
+        with pytest.raises(ValueError) as pwe:
+            ns.validate_fname(fname)
+        assert str(pwe.value) == f"Invalid file name {fname!r} from other side, aborting..."
+    for fname in [".mbsyncstate", "INBOX/tmp/1", "INBOX/1", "cur/INBOX/1"]:
+        with pytest.raises(ValueError, match="not in a mail directory"):
+            ns.validate_fname(fname)
+
+
+def test_validate_fname_mail_dirs(monkeypatch):
+    monkeypatch.setitem(ns.session, "mail_dirs", ["*"])
+    assert "INBOX/1" == ns.validate_fname("INBOX/1")
+    assert "1" == ns.validate_fname("1")
+    with pytest.raises(ValueError):
+        ns.validate_fname("../1")
+    args = ns.parse_args(["-r", "bar", "--mail-dirs", "cur,new,[0-9]*"])
+    assert ["cur", "new", "[0-9]*"] == args.mail_dirs
+    assert "--mail-dirs='cur,new,[0-9]*'" in ns.remote_command(args)
+    assert not any(a.startswith("--mail-dirs") for a in ns.remote_command(ns.parse_args(["-r", "bar"])))
+
+
+def test_folder_layout(monkeypatch):
+    assert "INBOX/Sub/cur/1" == ns.to_wire("INBOX/Sub/cur/1")
+    assert "INBOX/Sub/cur/1" == ns.from_wire("INBOX/Sub/cur/1")
+    monkeypatch.setitem(ns.session, "folder_layout", "maildir++")
+    for local, wire in [(".INBOX.Sub/cur/1:2,S", "INBOX/Sub/cur/1:2,S"), (".Sent/new/2", "Sent/new/2"),
+                        ("cur/3", "cur/3")]:
+        assert wire == ns.to_wire(local)
+        assert local == ns.from_wire(wire)
+    with pytest.raises(ValueError, match="can't be represented in Maildir\\+\\+"):
+        ns.from_wire("INBOX/v1.2/cur/1")
+
+    changes = {"foo": {"tags": ["inbox"], "files": [".INBOX.Sub/cur/1"]}}
+    assert {"foo": {"tags": ["inbox"], "files": ["INBOX/Sub/cur/1"]}} == ns.changes_to_wire(changes)
+    assert changes == ns.decode_changes(json.dumps(ns.changes_to_wire(changes)).encode("utf-8"))
+    assert [".INBOX.Sub/cur/1"] == ns.decode_fnames(b'["INBOX/Sub/cur/1"]')
+    out = io.BytesIO()
+    ns.send_changes(changes, out)
+    assert b"INBOX/Sub/cur/1" in out.getvalue()
+    assert changes == ns.recv_changes(io.BytesIO(out.getvalue()))
+
+    args = ns.parse_args(["-r", "bar", "--remote-folder-layout", "maildir++"])
+    assert "nested" == args.folder_layout
+    assert "--folder-layout=maildir++" in ns.remote_command(args)
+
+
+def test_folder_map(monkeypatch):
+    assert {"INBOX": "Inbox", "": "work"} == ns.parse_folder_map("INBOX=Inbox/, =work")
+    for invalid in ["INBOX", "a=a", "../x=y", "x=y,z=y"]:
+        with pytest.raises(ns.argparse.ArgumentTypeError):
+            ns.parse_folder_map(invalid)
+    assert {"INBOX": "Inbox"} == ns.parse_args(["-r", "foo", "--config", "/nonexistent", "--folder-map", "INBOX=Inbox"]).folder_map
+    assert {} == ns.parse_args(["-r", "foo", "--config", "/nonexistent"]).folder_map
+
+    monkeypatch.setitem(ns.session, "folder_map", {"INBOX": "Inbox", "Lists": "work/Lists", "": "work"})
+    for local, wire in [("INBOX/cur/1", "Inbox/cur/1"), ("INBOX/Sub/new/2", "Inbox/Sub/new/2"),
+                        ("Lists/foo/cur/3", "work/Lists/foo/cur/3"), ("Sent/cur/4", "work/Sent/cur/4"),
+                        ("cur/5", "work/cur/5")]:
+        assert wire == ns.to_wire(local)
+        assert local == ns.from_wire(wire)
+    # not in a mapped folder on the remote
+    with pytest.raises(ValueError, match="can't be renamed unambiguously"):
+        ns.from_wire("Archive/cur/1")
+
+    changes = {"foo": {"tags": ["inbox"], "files": ["INBOX/cur/1"]}}
+    assert {"foo": {"tags": ["inbox"], "files": ["Inbox/cur/1"]}} == ns.changes_to_wire(changes)
+    assert ["INBOX/cur/1"] == ns.decode_fnames(b'["Inbox/cur/1"]')
+
+    monkeypatch.setitem(ns.session, "folder_map", {"INBOX": "Inbox"})
+    # would be synced as INBOX on this side
+    with pytest.raises(ValueError, match="can't be renamed unambiguously"):
+        ns.to_wire("Inbox/cur/1")
+    monkeypatch.setitem(ns.session, "folder_layout", "maildir++")
+    assert "Inbox/Sub/cur/1" == ns.to_wire(".INBOX.Sub/cur/1")
+    assert ".INBOX.Sub/cur/1" == ns.from_wire("Inbox/Sub/cur/1")
+    assert ".Sent/cur/1" == ns.from_wire("Sent/cur/1")
+
+
+def test_decode_fnames():
+    assert ["INBOX/cur/1", "INBOX/cur/2"] == ns.decode_fnames(b'["INBOX/cur/1", "INBOX/cur/2"]')
+    assert [] == ns.decode_fnames(b'[]')
+    for data in [b'{}', b'"foo"', b'["../foo"]', b'[1]', b'[', b'\xff', b'["INBOX/tmp/1"]']:
+        with pytest.raises(ValueError):
+            ns.decode_fnames(data)
+    assert [".uidvalidity"] == ns.decode_fnames(b'[".uidvalidity"]', mail=False)
+
+
+def test_decode_changes():
+    changes = {"foo": {"tags": ["inbox"], "files": ["INBOX/cur/1"]}}
+    assert changes == ns.decode_changes(json.dumps(changes).encode("utf-8"))
+    assert {} == ns.decode_changes(b'{}')
+    for data in [b'[]', b'{"foo": []}', b'{"foo": {"tags": []}}', b'{"foo": {"tags": [1], "files": []}}',
+                 b'{"foo": {"tags": "inbox", "files": []}}', b'{"foo": {"tags": [], "files": ["/foo"]}}',
+                 b'{"foo": {"tags": [], "files": [null]}}', b'{', b'\xff']:
+        with pytest.raises(ValueError):
+            ns.decode_changes(data)
+
+
+def test_decode_hashes():
+    assert ["abc", None] == ns.decode_hashes(b'["abc", null]', 2)
+    assert [] == ns.decode_hashes(b'[]', 0)
+    for data in [b'["abc"]', b'{}', b'["abc", 1]', b'["abc", ["def"]]', b'[', b'\xff']:
+        with pytest.raises(ValueError):
+            ns.decode_hashes(data, 2)
+
+
+def test_decode_signatures():
+    sig = ns.block_signature(b"foo" * 100, 64)
+    assert [sig, None] == ns.decode_signatures(json.dumps([sig, None]).encode("utf-8"), 2)
+    for data in [b'[null]', b'{}', b'[[1], null]', b'[[[1]], null]', b'[[["1", "abc"]], null]',
+                 b'[[[true, "abc"]], null]', b'[[[-1, "abc"]], null]', b'[[[4294967296, "abc"]], null]',
+                 b'[[[1, 2]], null]', b'[', b'\xff']:
+        with pytest.raises(ValueError):
+            ns.decode_signatures(data, 2)
+
+
+def test_decode_change():
+    assert {"tags": ["inbox"], "files": ["INBOX/cur/1"]} == \
+        ns.decode_change("foo", {"tags": ["inbox"], "files": ["INBOX/cur/1"], "extra": 1})
+    for change, msg in [([], "expected tags and files, got list"),
+                        ({"tags": []}, "files missing"),
+                        ({"tags": "inbox", "files": []}, "tags must be a list of strings, got 'inbox'"),
+                        ({"tags": [], "files": [1]}, "files must be a list of strings, got [1]")]:
+        with pytest.raises(ValueError) as pwe:
+            ns.decode_change("foo", change)
+        assert f"Invalid changes for 'foo' from other side, {msg}, aborting..." == str(pwe.value)
+    with pytest.raises(ValueError) as pwe:
+        ns.decode_change("", {"tags": [], "files": []})
+    assert "invalid message ID ''" in str(pwe.value)
+    with pytest.raises(ValueError) as pwe:
+        ns.decode_change("foo", {"tags": [], "files": ["../foo"]})
+    assert "Invalid file name '../foo'" in str(pwe.value)
+
+
+def test_fuzz_seeds():
+    from test import fuzz
+    seeds = [b"", b"\x00", b"\x00\x00\x00\x05{}", b"\x00\x00\x00\x02{}\x00\x00", b"\xff\xff\xff\xff",
+             b'{"foo": {"tags": [], "files": []}}', b'["foo", {}]', b'{"a": {"tags": [], "files": [".."]}}',
+             b'[".notmuch"]', b'["."]', b'{"a": {"tags": [[]], "files": []}}', b'null', b'1e999']
+    for target in fuzz.TARGETS.values():
+        for seed in seeds:
+            target(seed)
+
+
+def test_context(monkeypatch):
+    monkeypatch.setitem(ns.session, "peer", "host:/mail/")
+    with pytest.raises(ns.SyncError) as pwe:
+        with ns.context("transferring files"):
+            with ns.context("receiving", "INBOX/cur/1"):
+                ns.read(io.BytesIO(b""))
+    assert pwe.value.phase == "transferring files"
+    assert pwe.value.peer == "host:/mail/"
+    assert pwe.value.obj is None
+    assert isinstance(pwe.value.__cause__, ns.SyncError)
+    assert pwe.value.__cause__.obj == "INBOX/cur/1"
+    assert isinstance(pwe.value.__cause__.__cause__, EOFError)
+    assert ns.format_error(pwe.value) == "transferring files with host:/mail/: receiving INBOX/cur/1: " \
+        "Connection to other side closed while waiting for data, aborting..."
+
+    # nothing to wrap
+    with ns.context("syncing files"):
+        pass
+
+
+def test_measure(monkeypatch):
+    monkeypatch.setattr(ns, "transfer", {"read": 0, "write": 0})
+    monkeypatch.setattr(ns, "phases", {})
+    with ns.measure("tag sync"):
+        ns.write(b"foo", io.BytesIO())
+        ns.read(io.BytesIO(b"\x00\x00\x00\x02ab"))
+    with pytest.raises(EOFError):
+        with ns.measure("tag sync"):
+            ns.read(io.BytesIO(b"\x00\x00\x00\x05abcde"))
+            ns.read(io.BytesIO(b""))
+    with ns.measure("deletes"):
+        pass
+    assert ["tag sync", "deletes"] == list(ns.phases)
+    assert 6 + 9 == ns.phases["tag sync"]["read"]
+    assert 7 == ns.phases["tag sync"]["write"]
+    assert 0 <= ns.phases["tag sync"]["seconds"]
+    assert {"seconds": ns.phases["deletes"]["seconds"], "read": 0, "write": 0} == ns.phases["deletes"]
+
+
+def test_track_phases(tmp_path):
+    fname = str(tmp_path / "notmuch-sync-stats")
+    usual = {"tag sync": {"seconds": 0.5, "read": 100, "write": 100},
+             "file transfer": {"seconds": 2.0, "read": 10 * 1024 * 1024, "write": 0}}
+    with patch.object(ns.logger, "warning") as w:
+        # no baseline yet
+        assert [] == ns.track_phases(fname, {"tag sync": {"seconds": 20.0, "read": 100, "write": 100}})
+        for _ in range(ns.STATS_MIN_HISTORY - 1):
+            assert [] == ns.track_phases(fname, usual)
+        w.assert_not_called()
+        assert [] == ns.track_phases(fname, usual)
+        assert [] == ns.track_phases(fname, {"tag sync": {"seconds": 0.9, "read": 0, "write": 0}})
+        # only slow in absolute terms
+        assert [] == ns.track_phases(fname, {"file transfer": {"seconds": 4.0, "read": 10 * 1024 * 1024, "write": 0}})
+        w.assert_not_called()
+
+        assert ["tag sync"] == ns.track_phases(fname, {"tag sync": {"seconds": 8.0, "read": 100, "write": 100}})
+        assert "the notmuch database on either side" == w.call_args.args[-1]
+        # same amount of data in ten times the time
+        assert ["file transfer"] == ns.track_phases(fname, {"file transfer": {"seconds": 20.0, "read": 10 * 1024 * 1024, "write": 0}})
+        # much more data in more time is fine
+        assert [] == ns.track_phases(fname, {"file transfer": {"seconds": 20.0, "read": 200 * 1024 * 1024, "write": 0}})
+
+    with open(fname, encoding="utf-8") as f:
+        history = json.load(f)
+    assert ns.STATS_MIN_HISTORY + 3 == len(history["tag sync"])
+    assert {"seconds": 8.0, "bytes": 200} == history["tag sync"][-1]
+    for _ in range(ns.STATS_HISTORY):
+        ns.track_phases(fname, usual)
+    with open(fname, encoding="utf-8") as f:
+        assert ns.STATS_HISTORY == len(json.load(f)["tag sync"])
+    # replaced atomically, so an interrupted write leaves the previous history
+    before = Path(fname).read_text(encoding="utf-8")
+    with patch("os.replace", side_effect=OSError("interrupted")), pytest.raises(OSError):
+        ns.track_phases(fname, usual)
+    assert before == Path(fname).read_text(encoding="utf-8")
+
+
+def test_format_error():
+    try:
+        try:
+            json.loads("1 2")
+        except json.JSONDecodeError as e:
+            raise ValueError("Sync state file 'foo' corrupted") from e
+    except ValueError as e:
+        assert ns.format_error(e) == "Sync state file 'foo' corrupted: Extra data: line 1 column 3 (char 2)"
+    assert ns.format_error(KeyError()) == "KeyError"
+
+
+def test_is_bug():
+    assert not ns.is_bug(ValueError("foo"))
+    assert not ns.is_bug(FileNotFoundError("foo"))
+    assert ns.is_bug(KeyError("foo"))
+    try:
+        with ns.context("syncing files"):
+            {}["foo"]
+    except ns.SyncError as e:
+        assert ns.is_bug(e)
+    try:
+        with ns.context("syncing files"):
+            ns.read(io.BytesIO(b""))
+    except ns.SyncError as e:
+        assert not ns.is_bug(e)
+
+
+def test_exit_code():
+    assert ns.EXIT_LOCAL == ns.exit_code(ValueError("foo"))
+    assert ns.EXIT_LOCAL == ns.exit_code(KeyError("foo"))
+    assert ns.EXIT_TRANSPORT == ns.exit_code(BrokenPipeError())
+    try:
+        with ns.context("transferring files"):
+            ns.read(io.BytesIO(b""))
+    except ns.SyncError as e:
+        assert ns.EXIT_TRANSPORT == ns.exit_code(e)
+    try:
+        with ns.context("syncing files"):
+            raise FileNotFoundError("foo")
+    except ns.SyncError as e:
+        assert ns.EXIT_LOCAL == ns.exit_code(e)
+    # the connection was closed because the remote failed
+    try:
+        try:
+            with ns.context("transferring files"):
+                ns.read(io.BytesIO(b""))
+        finally:
+            raise ns.RemoteError("remote failed")
+    except ns.RemoteError as e:
+        assert ns.EXIT_REMOTE == ns.exit_code(e)
+    try:
+        with ns.context("exchanging changes"):
+            raise ns.ConfigError("foo")
+    except ns.SyncError as e:
+        assert ns.EXIT_USAGE == ns.exit_code(e)
+
+
+def test_main_exit_codes(monkeypatch, tmp_path):
+    monkeypatch.setattr(ns, "session", dict(ns.session))
+    monkeypatch.setattr(ns, "outcomes", {})
+    monkeypatch.setattr(ns, "activity_path", lambda: str(tmp_path / "activity"))
+    monkeypatch.setenv("XDG_CACHE_HOME", str(tmp_path))
+    config = tmp_path / "config"
+    config.write_text("")
+    nothing = ((0, 0, 0, 0, 0, 0, 0), (0, 0, 0, 0, 0, 0, 0))
+
+    def _main(argv, **patches):
+        patches.setdefault("sync_retrying", MagicMock(return_value=nothing))
+        monkeypatch.setattr(sys, "argv", ["notmuch-sync"] + argv + ["--config", str(config), "-q"])
+        with patch.multiple(ns, **patches), patch("sys.stderr", new_callable=io.StringIO):
+            try:
+                ns.main()
+            except SystemExit as e:
+                return e.code
+        return 0
+
+    def _partial(args):
+        ns.outcomes["local"] = {"tag sync": {"success": 1, "failed": 1, "skipped": 0}}
+        return nothing
+
+    def _lost(args):
+        with ns.context("transferring files"):
+            ns.read(io.BytesIO(b""))
+
+    def _policies(args):
+        with ns.context("exchanging changes"):
+            ns.read_policies(ns.read_config(args.config))
+
+    assert 0 == _main(["-r", "foo"])
+    # changes only make a difference with --exit-changes
+    changed = ((1, 1, 0, 0, 0, 0, 0), (0, 0, 0, 0, 0, 0, 0))
+    assert 0 == _main(["-r", "foo"], sync_retrying=MagicMock(return_value=changed))
+    assert ns.EXIT_CHANGES == _main(["-r", "foo", "--exit-changes"], sync_retrying=MagicMock(return_value=changed))
+    assert ns.EXIT_TRANSPORT == _main(["-r", "foo"], sync_retrying=_lost)
+    assert ns.EXIT_REMOTE == _main(["-r", "foo"], sync_retrying=MagicMock(side_effect=ns.RemoteError("remote failed")))
+    assert ns.EXIT_LOCAL == _main(["-r", "foo"], sync_retrying=MagicMock(side_effect=OSError(errno.EROFS, "read-only")))
+    assert ns.EXIT_MISMATCH == _main(["verify", "-r", "foo"], verify_remote=MagicMock(return_value=1))
+    assert ns.EXIT_PARTIAL == _main(["-r", "foo"], sync_retrying=_partial)
+    ns.outcomes.clear()
+    assert ns.EXIT_USAGE == _main(["-r", "foo", "--hash-workers", "0"])
+    config.write_text("[folder Spam]\nfiles = maybe\n")
+    assert ns.EXIT_USAGE == _main(["-r", "foo"], sync_retrying=_policies)
+    config.write_text("[remote foo]\nport = ssh\n")
+    assert ns.EXIT_USAGE == _main(["-r", "foo"])
+    config.write_text("port = 22\n")
+    assert ns.EXIT_USAGE == _main(["-r", "foo"])
+    config.write_text("")
+    # not mistaken for changes
+    assert ns.EXIT_LOCAL == _main(["tail"], tail=MagicMock(side_effect=OSError(errno.EACCES, "denied")))
+    # the remote side disables logging
+    for scoped in [ns.logger, ns.protocol_logger, ns.files_logger, ns.notmuch_logger]:
+        monkeypatch.setattr(scoped, "disabled", scoped.disabled)
+    assert ns.EXIT_LOCAL == _main([], sync_remote=MagicMock(side_effect=OSError(errno.EROFS, "read-only")))
+
+
+def test_report_error(monkeypatch):
+    with TemporaryDirectory() as tmpdir:
+        monkeypatch.setenv("XDG_CACHE_HOME", tmpdir)
+        ns.frames.clear()
+        ns.write(b"hello", io.BytesIO())
+        with patch.object(ns, "notmuch_version", return_value="0.38"):
+            try:
+                with ns.context("syncing files"):
+                    ns.read(io.BytesIO(b"\x00\x00\x00\x02{}"))
+                    {}["foo"]
+            except ns.SyncError as e:
+                with patch("sys.stderr", new_callable=io.StringIO) as err:
+                    ns.report_error(e, "local")
+        bundles = list(Path(tmpdir, "notmuch-sync").iterdir())
+        assert 1 == len(bundles)
+        assert err.getvalue() == f"Error: syncing files: 'foo' (this is likely a bug, please attach diagnostic bundle {bundles[0]} to a bug report)\n"
+        bundle = json.loads(bundles[0].read_text())
+        assert "local" == bundle["side"]
+        assert "syncing files: 'foo'" == bundle["error"]
+        assert "KeyError: 'foo'\n" in bundle["traceback"]
+        assert [{"dir": "sent", "size": 5, "data": "hello"}, {"dir": "received", "size": 2, "data": "{}"}] == bundle["frames"]
+        assert "0.38" == bundle["notmuch"]
+
+        # expected errors don't get a bundle
+        with patch("sys.stderr", new_callable=io.StringIO) as err:
+            ns.report_error(ValueError("foo"), "remote")
+        assert "Error: foo\n" == err.getvalue()
+        assert 1 == len(list(Path(tmpdir, "notmuch-sync").iterdir()))
+
+
+def test_report_error_upload(monkeypatch):
+    with TemporaryDirectory() as tmpdir:
+        monkeypatch.setenv("XDG_CACHE_HOME", tmpdir)
+        ns.frames.clear()
+        ns.write(b"From: foo@example.org", io.BytesIO())
+        with patch.object(ns, "notmuch_version", return_value="0.38"), \
+                patch("urllib.request.urlopen") as uo, patch("sys.stderr", new_callable=io.StringIO) as err:
+            ns.report_error(ValueError("foo"), "remote", "https://example.org/crash")
+            assert "Error: foo\n" == err.getvalue()
+            req = uo.call_args.args[0]
+            assert "https://example.org/crash" == req.full_url
+            assert "POST" == req.get_method()
+            bundle = json.loads(req.data)
+            assert "remote" == bundle["side"]
+            assert "foo" == bundle["error"]
+            # no message contents
+            assert [{"dir": "sent", "size": 21}] == bundle["frames"]
+        # only bugs are written locally
+        assert not Path(tmpdir, "notmuch-sync").exists()
+
+        with patch.object(ns, "notmuch_version", return_value="0.38"), \
+                patch("urllib.request.urlopen", side_effect=OSError("Connection refused")), \
+                patch("sys.stderr", new_callable=io.StringIO) as err:
+            ns.report_error(ValueError("foo"), "local", "https://example.org/crash")
+            assert "Error: foo (could not send crash report to https://example.org/crash: Connection refused)\n" == err.getvalue()
+
+
+@pytest.mark.parametrize("compression", ["none", "gz"])
+def test_clone(compression):
+    with TemporaryDirectory() as src:
+        with TemporaryDirectory() as dst:
+            Path(os.path.join(src, "INBOX", "cur")).mkdir(parents=True)
+            Path(os.path.join(src, "INBOX", "cur", "1:2,S")).write_bytes(b"mail one")
+            Path(os.path.join(src, "INBOX", ".mbsyncstate")).write_bytes(b"state")
+            Path(os.path.join(src, ".notmuch", "xapian")).mkdir(parents=True)
+            Path(os.path.join(src, ".notmuch", "xapian", "db")).write_bytes(b"db")
+
+            def mock_db(path, count):
+                db = MagicMock()
+                db.default_path = MagicMock(return_value=path)
+                db.config = {}
+                db.count_messages = MagicMock(return_value=count)
+                mock_ctx = MagicMock()
+                mock_ctx.__enter__.return_value = db
+                mock_ctx.__exit__.return_value = False
+                return mock_ctx
+
+            dump = MagicMock()
+            dump.stdout = b"+inbox -- id:foo\n"
+            with patch("notmuch2.Database", return_value=mock_db(src, 1)):
+                with patch("subprocess.run", return_value=dump) as sr:
+                    istream = io.BytesIO(b"\x00\x00\x00\x010")
+                    ostream = io.BytesIO()
+                    assert 0 == ns.clone(istream, ostream, compression)
+                    sr.assert_called_once_with(["notmuch", "dump"], capture_output=True, check=True)
+
+            with patch("notmuch2.Database", return_value=mock_db(dst, 0)):
+                with patch("subprocess.run") as sr:
+                    istream = io.BytesIO(ostream.getvalue())
+                    ostream = io.BytesIO()
+                    assert 1 == ns.clone(istream, ostream)
+                    assert b"\x00\x00\x00\x010" == ostream.getvalue()
+                    assert sr.mock_calls == [
+                        call(["notmuch", "new"], capture_output=True, check=True),
+                        call(["notmuch", "restore"], input=b"+inbox -- id:foo\n", capture_output=True, check=True)
+                    ]
+
+            assert b"mail one" == Path(os.path.join(dst, "INBOX", "cur", "1:2,S")).read_bytes()
+            assert not Path(os.path.join(dst, "INBOX", ".mbsyncstate")).exists()
+            assert not Path(os.path.join(dst, ".notmuch")).exists()
+
+
+def test_clone_both_nonempty():
+    db = MagicMock()
+    db.default_path = MagicMock(return_value=gettempdir())
+    db.config = {}
+    db.count_messages = MagicMock(return_value=2)
+    mock_ctx = MagicMock()
+    mock_ctx.__enter__.return_value = db
+    mock_ctx.__exit__.return_value = False
+    with patch("notmuch2.Database", return_value=mock_ctx):
+        istream = io.BytesIO(b"\x00\x00\x00\x013")
+        ostream = io.BytesIO()
+        with pytest.raises(ValueError) as pwe:
+            ns.clone(istream, ostream)
+        assert str(pwe.value) == "Cloning requires an empty notmuch database on one side, but local has 2 and remote 3 messages, aborting..."
+    db.count_messages.assert_called_once_with("*")
+
+
+def test_outcomes(monkeypatch):
+    monkeypatch.setattr(ns, "outcomes", {})
+    ns.count_outcome("deletes", "success", 0)
+    assert {} == ns.outcomes
+    ns.count_outcome("deletes", "success", 2)
+    ns.count_outcome("deletes", "skipped")
+    assert {"local": {"deletes": {"success": 2, "failed": 0, "skipped": 1}}} == ns.outcomes
+
+    ns.recv_outcomes(io.BytesIO(b"\x00\x00\x00\x20{\"file transfer\": {\"failed\": 1}}"))
+    assert {"file transfer": {"success": 0, "failed": 1, "skipped": 0}} == ns.outcomes["remote"]
+    for data in [b"[]", b"{\"deletes\": {\"failed\": -1}}", b"{\"deletes\": {\"lost\": 1}}", b"{\"deletes\": 1}"]:
+        with pytest.raises(ValueError):
+            ns.recv_outcomes(io.BytesIO(struct.pack("!I", len(data)) + data))
+
+    assert ns.negotiate({"features": ["outcomes"]}, {"features": ["outcomes"]})["outcomes"]
+    assert not ns.negotiate({"features": ["outcomes"]}, {"features": []})["outcomes"]
+
+
+def test_strict(monkeypatch):
+    monkeypatch.setattr(ns, "outcomes", {})
+    monkeypatch.setattr(ns, "file_warnings", {})
+    monkeypatch.setitem(ns.session, "strict", True)
+    with pytest.raises(ValueError, match="could not be read"):
+        ns.warn_file("/mail/cur/1", "could not be read")
+    assert {} == ns.file_warnings
+    with pytest.raises(ValueError, match="--strict"):
+        ns.count_outcome("deletes", "failed")
+    # skipping is not a failure, and the other side decides for itself
+    ns.count_outcome("deletes", "skipped")
+    ns.count_outcome("deletes", "failed", side="remote")
+    assert {"local": {"deletes": {"success": 0, "failed": 0, "skipped": 1}},
+            "remote": {"deletes": {"success": 0, "failed": 1, "skipped": 0}}} == ns.outcomes
+    assert "--strict" in ns.remote_args(ns.parse_args(["-r", "bar", "--strict"]))
+
+
+def test_tune_workers():
+    # more throughput, keep doubling
+    assert (2, (1, 100.0), True) == ns.tune_workers(1, 100.0, (1, 0.0), 8)
+    assert (4, (2, 150.0), True) == ns.tune_workers(2, 150.0, (1, 100.0), 8)
+    # hit the limit
+    assert (8, (8, 300.0), False) == ns.tune_workers(8, 300.0, (4, 200.0), 8)
+    # no improvement, go back to best and stop
+    assert (4, (4, 200.0), False) == ns.tune_workers(8, 210.0, (4, 200.0), 8)
+
+
+@pytest.mark.parametrize("workers", [None, 1, 3])
+def test_hash_files(workers):
+    with TemporaryDirectory() as tmpdir:
+        fnames = []
+        for i in range(ns.HASH_BATCH * 2 + 3):
+            fname = os.path.join(tmpdir, str(i))
+            Path(fname).write_bytes(f"mail {i}\nX-TUID: {i}\n".encode("utf-8"))
+            fnames.append(fname)
+        exp = [ns.digest(f"mail {i}\n".encode("utf-8")) for i in range(len(fnames))]
+        assert exp == ns.hash_files(fnames, workers)
+    assert [] == ns.hash_files([], workers)
+
+
+def test_hash_workers(monkeypatch):
+    assert ns.parse_args(["-r", "foo", "--config", "/nonexistent"]).hash_workers is None
+    assert 4 == ns.parse_args(["-r", "foo", "--config", "/nonexistent", "--hash-workers", "4"]).hash_workers
+    with pytest.raises(SystemExit):
+        ns.parse_args(["-r", "foo", "--config", "/nonexistent", "--hash-workers", "0"])
+
+    monkeypatch.setitem(ns.session, "hash_workers", 3)
+    with patch.object(ns, "ThreadPoolExecutor", wraps=ns.ThreadPoolExecutor) as tpe:
+        assert [] == ns.hash_files([])
+        with TemporaryDirectory() as tmpdir:
+            Path(tmpdir, "1").write_bytes(b"mail")
+            assert [ns.digest(b"mail")] == ns.hash_files([os.path.join(tmpdir, "1")])
+        tpe.assert_called_once_with(max_workers=3)
+
+    # the files on this side are hashed at once, not for each message
+    m = MagicMock()
+    m.ghost = False
+    m.filenames = MagicMock(return_value=[prefix + "a/cur/1", prefix + "a/cur/2"])
+    db = lambda: None
+    db.find = MagicMock(return_value=m)
+    h = json.dumps([None, None]).encode("utf-8")
+    istream = io.BytesIO(b"\x00\x00\x00\x02[]" + struct.pack("!I", len(h)) + h)
+    changes_theirs = {"foo": {"tags": [], "files": ["a/cur/3"]}, "bar": {"tags": [], "files": ["a/cur/4"]}}
+    with patch.object(ns, "hash_files", return_value=[None, None, None, None]) as hf:
+        assert ({}, 0, 0) == ns.get_missing_files(db, prefix, changes_theirs, changes_theirs, istream, io.BytesIO())
+    assert 2 == len(hf.mock_calls)
+    assert call([]) in hf.mock_calls
+    assert call([prefix + "a/cur/1", prefix + "a/cur/2", prefix + "a/cur/1", prefix + "a/cur/2"]) in hf.mock_calls
+
+
+def test_hash_files_unreadable():
+    with TemporaryDirectory() as tmpdir:
+        fname = os.path.join(tmpdir, "1")
+        Path(fname).write_bytes(b"mail\n")
+        with patch.object(ns, "warn_file") as wf:
+            assert [ns.digest(b"mail\n"), None] == ns.hash_files([fname, os.path.join(tmpdir, "2")])
+            wf.assert_called_once_with(os.path.join(tmpdir, "2"), "could not be read")
+
+
+def test_log_file_warnings():
+    for i in range(3):
+        ns.warn_file(os.path.join("INBOX", "cur", str(i)), "could not be read")
+    ns.warn_file(os.path.join("Sent", "cur", "3"), "could not be read")
+    with patch.object(ns.logger, "warning") as w:
+        ns.log_file_warnings()
+        assert w.mock_calls == [
+            call("%s files %s in folder %s, e.g. %s (use -vv for all).", 3, "could not be read",
+                 os.path.join("INBOX", "cur"), os.path.join("INBOX", "cur", "0")),
+            call("%s %s.", os.path.join("Sent", "cur", "3"), "could not be read")
+        ]
+    assert {} == ns.file_warnings
+    with patch.object(ns.logger, "warning") as w:
+        ns.log_file_warnings()
+        w.assert_not_called()
+
+
+def test_notmuch_new():
+    with patch("subprocess.run") as sr:
+        ns.notmuch_new()
+        ns.notmuch_new(True)
+        assert sr.mock_calls[0] == call(["notmuch", "new"], capture_output=True, check=True)
+        assert call(["notmuch", "new", "--no-hooks"], capture_output=True, check=True) in sr.mock_calls
+
+    # without the notmuch CLI
+    dbw = MagicMock()
+    dbw.__enter__.return_value = dbw
+    with patch("subprocess.run", side_effect=FileNotFoundError), patch.object(ns, "open_write_db", return_value=dbw), \
+            patch.object(ns, "mail_root", return_value="/mail/"), patch.object(ns, "index_new", return_value=(1, 0)) as idx:
+        ns.notmuch_new()
+        idx.assert_called_once_with(dbw, "/mail/")
+
+
+def test_index_new(tmp_path):
+    (tmp_path / "INBOX" / "cur").mkdir(parents=True)
+    (tmp_path / "INBOX" / "tmp").mkdir()
+    for name in ["INBOX/cur/1", "INBOX/cur/2", "INBOX/cur/3", "INBOX/tmp/4", "INBOX/cur/.5"]:
+        (tmp_path / name).write_text("mail")
+    old = MagicMock()
+    old.ghost = False
+    old.filenames = MagicMock(return_value=[tmp_path / "INBOX/cur/1", tmp_path / "INBOX/cur/gone"])
+    new = MagicMock()
+    dup = MagicMock()
+    dbw = MagicMock()
+    dbw.messages = MagicMock(return_value=[old])
+    dbw.config = {"new.tags": "new;unread;"}
+    dbw.add = MagicMock(side_effect=[(new, False), (dup, True)])
+    assert (2, 1) == ns.index_new(dbw, str(tmp_path))
+    dbw.remove.assert_called_once_with(str(tmp_path / "INBOX/cur/gone"))
+    assert dbw.add.mock_calls == [call(str(tmp_path / "INBOX/cur/2")), call(str(tmp_path / "INBOX/cur/3"))]
+    assert new.tags.add.mock_calls == [call("new"), call("unread")]
+    dup.tags.add.assert_not_called()
+
+
+def test_dump_restore_tags():
+    m1 = MagicMock()
+    m1.ghost = False
+    m1.messageid = "foo@bar"
+    m1.tags = ["inbox", "a b", "ü"]
+    m2 = MagicMock()
+    m2.ghost = True
+    db = MagicMock()
+    db.messages = MagicMock(return_value=[m1, m2])
+    dump = ns.dump_tags(db)
+    assert b"+a%20b +inbox +%C3%BC -- id:foo@bar\n" == dump
+
+    msg = MagicMock()
+    dbw = MagicMock()
+    dbw.find = MagicMock(side_effect=[msg, LookupError])
+    assert 1 == ns.restore_tags(dbw, b"#notmuch-dump batch-tag:3 config,properties,tags\n" + dump + b"+x -- id:baz\n")
+    assert dbw.find.mock_calls == [call("foo@bar"), call("baz")]
+    msg.tags.clear.assert_called_once_with()
+    assert msg.tags.add.mock_calls == [call("a b"), call("inbox"), call("ü")]
+
+
+def test_snapshot():
+    with patch("subprocess.run") as sr:
+        ns.snapshot("btrfs subvolume snapshot -r /home '/snapshots/pre sync'")
+        sr.assert_called_once_with(["btrfs", "subvolume", "snapshot", "-r", "/home", "/snapshots/pre sync"],
+                                   capture_output=True, check=True)
+
+
+def test_new_mail_hook():
+    with patch("subprocess.run") as sr:
+        ns.new_mail_hook("notmuch address --output=recipients 'date:1w..'", 12)
+        assert ["notmuch", "address", "--output=recipients", "date:1w.."] == sr.call_args.args[0]
+        assert "12" == sr.call_args.kwargs["env"]["NOTMUCH_SYNC_NEW_MESSAGES"]
+    # only a warning, the sync has succeeded
+    with patch("subprocess.run", side_effect=subprocess.CalledProcessError(1, ["false"], stderr=b"no such query")), \
+            patch.object(ns.logger, "warning") as w:
+        ns.new_mail_hook("false", 1)
+        assert "no such query" == w.call_args.args[-1]
+    with patch.object(ns.logger, "warning") as w:
+        ns.new_mail_hook("/nonexistent/hook", 1)
+        w.assert_called_once()
+
+
+def test_sync_databases(monkeypatch):
+    monkeypatch.setattr(ns, "session", dict(ns.session))
+    monkeypatch.setattr(ns, "outcomes", {})
+    dbw = MagicMock()
+    dbw.__enter__.return_value = dbw
+    dbw.__exit__.return_value = False
+    patches = {"open_write_db": MagicMock(return_value=dbw), "mail_root": MagicMock(return_value=prefix),
+               "use_notmuch_dir": MagicMock(), "sync_flags_enabled": MagicMock(return_value=True),
+               "check_read_only": MagicMock(), "check_case_insensitive": MagicMock(), "clean_partials": MagicMock(),
+               "start_undo": MagicMock(), "finish_undo": MagicMock(),
+               "initial_sync": MagicMock(return_value=({}, {}, 3, "state")),
+               "get_missing_files": MagicMock(return_value=({}, 1, 2)),
+               "sync_files": MagicMock(return_value=(4, 5, 1)), "exchange_revisions": MagicMock(),
+               "record_sync": MagicMock(), "sync_deletes_local": MagicMock(return_value=6),
+               "sync_deletes_remote": MagicMock(return_value=7)}
+    args = ns.parse_args(["-r", "foo", "--config", "/nonexistent", "--delete", "--conflict-cmd", "true"])
+    with patch.multiple(ns, **patches):
+        assert ((4, 5, 1, 2, 3, 6, 1), "state") == ns.sync_databases(args, None, None, True)
+        prefs, *rest = ns.initial_sync.call_args.args[4:]
+        assert "sha256" == prefs["digest"]
+        assert [False, True, False, "true", False] == rest
+        assert ns.get_missing_files.call_args.kwargs["move_on_change"]
+        ns.sync_deletes_remote.assert_not_called()
+        ns.finish_undo.assert_called_once_with(True)
+
+    # the remote neither sends preferences nor resolves conflicts
+    args = ns.parse_args(["--config", "/nonexistent", "--delete"])
+    with patch.multiple(ns, **patches):
+        ns.finish_undo.reset_mock()
+        assert ((4, 5, 1, 2, 3, 7, 1), "state") == ns.sync_databases(args, None, None, False)
+        prefs, *rest = ns.initial_sync.call_args.args[4:]
+        assert "digest" not in prefs
+        assert [False, True, False, None, False] == rest
+        assert not ns.get_missing_files.call_args.kwargs["move_on_change"]
+        ns.finish_undo.assert_called_once_with(True)
+    assert {"local": {"tag sync": {"success": 6, "failed": 0, "skipped": 0},
+                      "file transfer": {"success": 16, "failed": 0, "skipped": 0},
+                      "deletes": {"success": 13, "failed": 0, "skipped": 0}}} == ns.outcomes
+
+
+def test_sync_pair_snapshot_fails():
+    args = ns.parse_args(["-r", "bar", "--snapshot-cmd", "false"])
+    with patch("subprocess.run", side_effect=subprocess.CalledProcessError(1, ["false"])), \
+            patch.object(ns, "open_write_db") as owd:
+        with pytest.raises(ns.SyncError) as pwe:
+            ns.sync_pair(args, None, None)
+        assert "creating snapshot" == pwe.value.phase
+        owd.assert_not_called()
+    # nothing is changed with --dry-run, so no snapshot needed
+    args = ns.parse_args(["-r", "bar", "--snapshot-cmd", "false", "--dry-run"])
+    with patch("subprocess.run") as sr, patch.object(ns, "open_write_db", side_effect=OSError("stop")):
+        with pytest.raises(OSError):
+            ns.sync_pair(args, None, None)
+        sr.assert_not_called()
+
+
+def test_configure_logging(monkeypatch, tmp_path):
+    root = logging.getLogger()
+    monkeypatch.setattr(root, "handlers", [])
+    monkeypatch.setattr(ns.logger, "level", ns.logger.level)
+    fname = tmp_path / "log"
+    args = ns.parse_args(["-r", "foo", "--config", "/nonexistent", "--log-file", str(fname), "--log-format", "json"])
+    ns.configure_logging(args)
+    assert 1 == len(root.handlers)
+    ns.logger.info("not logged")
+    with ns.context("syncing files"):
+        ns.logger.warning("Problem with %s.", "foo")
+    ns.logger.warning("Done.", extra={"stats": {"phases": {"deletes": {"seconds": 0.5, "read": 4, "write": 8}}}})
+    root.handlers[0].close()
+    entry, done = [json.loads(line) for line in fname.read_text(encoding="utf-8").splitlines()]
+    assert {"phases": {"deletes": {"seconds": 0.5, "read": 4, "write": 8}}} == done["stats"]
+    assert "warning" == entry["level"]
+    assert "Problem with foo." == entry["message"]
+    assert "syncing files" == entry["phase"]
+    assert "stats" not in entry
+    # tailing still gets everything
+    assert logging.INFO == ns.logger.getEffectiveLevel()
+
+    handler = logging.StreamHandler(io.StringIO())
+    monkeypatch.setattr(root, "handlers", [handler])
+    ns.configure_logging(ns.parse_args(["-r", "foo", "--config", "/nonexistent", "-q"]))
+    assert [handler] == root.handlers
+    assert logging.CRITICAL < handler.level
+    ns.configure_logging(ns.parse_args(["-r", "foo", "--config", "/nonexistent", "-vv"]))
+    assert logging.DEBUG == handler.level
+    assert logging.DEBUG == ns.logger.level
+
+    # only details of the given scopes
+    for scoped in [ns.protocol_logger, ns.files_logger, ns.notmuch_logger]:
+        monkeypatch.setattr(scoped, "level", scoped.level)
+    out = io.StringIO()
+    handler = logging.StreamHandler(out)
+    monkeypatch.setattr(root, "handlers", [handler])
+    ns.configure_logging(ns.parse_args(["-r", "foo", "--config", "/nonexistent", "-v", "--log-scope", "files,protocol"]))
+    ns.configure_logging(ns.parse_args(["-r", "foo", "--config", "/nonexistent", "-v", "--log-scope", "files"]))
+    assert 1 == len(handler.filters)
+    ns.logger.info("Syncing...")
+    ns.logger.debug("not logged")
+    ns.files_logger.debug("Moving %s.", "foo")
+    ns.protocol_logger.debug("not logged")
+    ns.notmuch_logger.debug("not logged")
+    assert "Syncing...\nMoving foo.\n" == out.getvalue()
+    ns.configure_logging(ns.parse_args(["-r", "foo", "--config", "/nonexistent", "-q", "--log-scope", "files"]))
+    assert [] == handler.filters
+    assert logging.NOTSET == ns.files_logger.level
+    with pytest.raises(SystemExit):
+        ns.parse_args(["-r", "foo", "--config", "/nonexistent", "--log-scope", "files,xapian"])
+
+
+def test_sync_retrying():
+    def _lost():
+        try:
+            with ns.context("transferring files"):
+                ns.read(io.BytesIO(b""))
+        except ns.SyncError as e:
+            return e
+
+    args = ns.parse_args(["-r", "foo", "--config", "/nonexistent", "--retries", "2", "--retry-delay", "5"])
+    totals = ((1, 1, 0, 0, 0, 0), (0, 0, 0, 0, 0, 0))
+    with patch.object(ns, "sync_local", side_effect=[_lost(), _lost(), totals]) as sl, \
+            patch("time.sleep") as sleep:
+        assert totals == ns.sync_retrying(args)
+        assert 3 == sl.call_count
+        assert [call(5), call(10)] == sleep.mock_calls
+    with patch.object(ns, "sync_local", side_effect=[_lost(), _lost(), _lost()]) as sl, patch("time.sleep"):
+        with pytest.raises(ns.SyncError):
+            ns.sync_retrying(args)
+        assert 3 == sl.call_count
+    # only transport failures are retried
+    with patch.object(ns, "sync_local", side_effect=[ValueError("invalid")]) as sl, patch("time.sleep") as sleep:
+        with pytest.raises(ValueError):
+            ns.sync_retrying(args)
+        sleep.assert_not_called()
+    args = ns.parse_args(["-r", "foo", "--config", "/nonexistent"])
+    with patch.object(ns, "sync_local", side_effect=[_lost()]) as sl:
+        with pytest.raises(ns.SyncError):
+            ns.sync_retrying(args)
+
+
+def test_write_metrics(monkeypatch, tmp_path):
+    fname = tmp_path / "notmuch-sync.prom"
+    monkeypatch.setattr(ns, "transfer", {"read": 100, "write": 50})
+    monkeypatch.setattr(ns.time, "time", lambda: 1700000000.5)
+    ns.write_metrics(str(fname), True, ((1, 1, 0, 0, 4, 0), (2, 2, 0, 0, 0, 0)))
+    text = fname.read_text(encoding="utf-8")
+    assert "# TYPE notmuch_sync_syncs_total counter\nnotmuch_sync_syncs_total 1\n" in text
+    assert "notmuch_sync_failures_total 0\n" in text
+    assert "notmuch_sync_messages_transferred_total 3\n" in text
+    assert "notmuch_sync_received_bytes_total 100\n" in text
+    assert "notmuch_sync_sent_bytes_total 50\n" in text
+    assert "notmuch_sync_last_success_timestamp_seconds 1700000000\n" in text
+
+    # counters are carried over, the last success is kept on failure
+    monkeypatch.setattr(ns.time, "time", lambda: 1800000000)
+    ns.write_metrics(str(fname), False)
+    text = fname.read_text(encoding="utf-8")
+    assert "notmuch_sync_syncs_total 2\n" in text
+    assert "notmuch_sync_failures_total 1\n" in text
+    assert "notmuch_sync_messages_transferred_total 3\n" in text
+    assert "notmuch_sync_received_bytes_total 200\n" in text
+    assert "notmuch_sync_last_success_timestamp_seconds 1700000000\n" in text
+    assert [fname] == list(tmp_path.iterdir())
+
+
+def test_notify():
+    assert "" == ns.format_summary(((0, 0, 0, 0, 0, 0), (0, 0, 0, 0, 0, 0)))
+    assert "local: 1 new messages, 2 messages with tag changes\nremote: 3 files deleted" == \
+        ns.format_summary(((1, 0, 0, 0, 2, 0), (0, 0, 0, 3, 0, 0)))
+    assert "local: 1 new messages, 2 new files, 1 duplicate files" == \
+        ns.format_summary(((1, 2, 0, 0, 0, 0, 1), (0, 0, 0, 0, 0, 0, 0)))
+
+    args = ns.parse_args(["-r", "foo", "--config", "/nonexistent", "--notify", "--notify-url", "http://localhost/hook"])
+    with patch("shutil.which", return_value="/usr/bin/notify-send"), patch("subprocess.run") as run, \
+            patch("urllib.request.urlopen") as uo:
+        # nothing changed
+        ns.notify(args, ((0, 0, 0, 0, 0, 0), (0, 0, 0, 0, 0, 0)))
+        run.assert_not_called()
+        uo.assert_not_called()
+
+        ns.notify(args, ((1, 0, 0, 0, 0, 0), (0, 0, 0, 0, 0, 0)))
+        run.assert_called_once_with(["notify-send", "--app-name=notmuch-sync", "Synced with foo", "local: 1 new messages"],
+                                    check=True, timeout=10)
+        req = uo.call_args[0][0]
+        assert "http://localhost/hook" == req.full_url
+        summary = json.loads(req.data)
+        assert summary["success"]
+        assert {"local": [1, 0, 0, 0, 0, 0], "remote": [0, 0, 0, 0, 0, 0]} == summary["changes"]
+
+        run.reset_mock()
+        ns.notify(args, None, ns.SyncError("syncing files", None, None))
+        assert ["notify-send", "--app-name=notmuch-sync", "Sync with foo failed", "syncing files"] == run.call_args[0][0]
+        summary = json.loads(uo.call_args[0][0].data)
+        assert not summary["success"]
+        assert "changes" not in summary
+
+    # problems with notifying don't fail the sync
+    with patch("shutil.which", return_value=None), patch("sys.stderr", new_callable=io.StringIO) as err, \
+            patch("urllib.request.urlopen", side_effect=OSError("Connection refused")):
+        ns.notify(args, None)
+        assert "" == err.getvalue()
+
+
+def test_tail(monkeypatch, tmp_path):
+    monkeypatch.setenv("XDG_RUNTIME_DIR", str(tmp_path))
+    path = ns.activity_path()
+    assert str(tmp_path / "notmuch-sync" / "activity") == path
+    monkeypatch.setattr(ns.logger, "disabled", False)
+    monkeypatch.setattr(ns.logger, "level", ns.logger.level)
+    ns.logger.setLevel(logging.INFO)
+
+    with pytest.raises(OSError) as pwe:
+        ns.tail(path, io.BytesIO())
+    assert "no sync is running" == pwe.value.strerror
+
+    out = io.BytesIO()
+    with ns.serve_activity(path):
+        ns.logger.info("Computing local changes...")
+        ns.logger.debug("not for tail")
+        # only one sync streams its activity at a time
+        with ns.serve_activity(path):
+            assert 1 == len([h for h in ns.logger.handlers if isinstance(h, ns.ActivityHandler)])
+        thread = threading.Thread(target=ns.tail, args=(path, out))
+        thread.start()
+        # wait for the backlog to make sure that tail is connected
+        while b"Computing" not in out.getvalue():
+            time.sleep(0.01)
+        ns.logger.warning("local:  1 new messages")
+    thread.join(timeout=10)
+    assert not thread.is_alive()
+    lines = out.getvalue().decode("utf-8").splitlines()
+    assert 2 == len(lines)
+    assert lines[0].endswith("] Computing local changes...")
+    assert lines[1].endswith("] local:  1 new messages")
+    assert not os.path.exists(path)
+    assert not any(isinstance(h, ns.ActivityHandler) for h in ns.logger.handlers)
+
+    # left behind by a sync that crashed
+    Path(path).touch()
+    with ns.serve_activity(path):
+        assert any(isinstance(h, ns.ActivityHandler) for h in ns.logger.handlers)
+
+
+def test_trace_replay(monkeypatch, tmp_path):
+    fname = str(tmp_path / "trace")
+    monkeypatch.setattr(sys, "argv", ["notmuch-sync", "-r", "foo", "--config", "/nonexistent", "--snapshot-cmd", "true"])
+    with ns.tracing(fname, payload=True):
+        stream = io.BytesIO()
+        with ns.context("exchanging changes"):
+            ns.write(b"foo", stream)
+        ns.trace_frame("received", b"bar", raw=True)
+        stream = io.BytesIO(b"\x00\x00\x00\x03baz")
+        ns.read(stream)
+    assert ns.trace["file"] is None
+    # not recorded anymore
+    ns.write(b"foo", io.BytesIO())
+
+    with open(fname, encoding="utf-8") as f:
+        lines = [json.loads(line) for line in f]
+    assert ["-r", "foo", "--config", "/nonexistent", "--snapshot-cmd", "true"] == lines[0]["argv"]
+    assert [("sent", 3, "exchanging changes", "Zm9v"), ("received", 3, None, "YmFy"), ("received", 3, None, "YmF6")] == \
+        [(e["dir"], e["size"], e["phase"], e["data"]) for e in lines[1:]]
+    assert [False, True, False] == [e.get("raw", False) for e in lines[1:]]
+
+    def _sync_pair(args, from_remote, to_remote):
+        assert "foo" == args.remote
+        assert args.snapshot_cmd is None
+        assert b"bar" == from_remote.read(3)
+        assert b"baz" == ns.read(from_remote)
+    with patch.object(ns, "sync_pair", side_effect=_sync_pair) as sp:
+        ns.replay(fname)
+        sp.assert_called_once()
+
+    with ns.tracing(fname):
+        ns.write(b"foo", io.BytesIO())
+    with open(fname, encoding="utf-8") as f:
+        assert "data" not in f.readlines()[1]
+    with pytest.raises(ValueError, match="without --trace-payload"):
+        ns.replay(fname)
+
+
+def test_repro(monkeypatch, tmp_path):
+    monkeypatch.setattr(ns, "session", dict(ns.session))
+    fname = str(tmp_path / "trace")
+    monkeypatch.setattr(sys, "argv", ["notmuch-sync", "-r", "foo", "--config", "/nonexistent", "-d", "--delta"])
+    hello = {"features": ["change-batches"], "encodings": ["json"]}
+    with ns.tracing(fname, payload=True):
+        for direction, changes in [("sent", {"secret@mine.example": {"tags": ["inbox", "clients"], "files": ["Clients/cur/123.abc,U=42:2,S"]},
+                                             "both@example": {"tags": [], "files": ["Clients/cur/both:2,"]}}),
+                                   ("received", {"both@example": {"tags": ["unread"], "files": ["Archive/cur/both:2,"]}})]:
+            ns.trace_frame(direction, b"0" * 36, raw=True)
+            ns.trace_frame(direction, json.dumps(hello).encode("utf-8"))
+            ns.trace_frame(direction, json.dumps(changes).encode("utf-8"))
+            ns.trace_frame(direction, b"")
+
+    out = tmp_path / "repro"
+    ns.repro(fname, str(out))
+    local = sorted(str(f.relative_to(out / "local")) for f in (out / "local").rglob("*") if f.is_file())
+    remote = sorted(str(f.relative_to(out / "remote")) for f in (out / "remote").rglob("*") if f.is_file())
+    assert 2 == len(local)
+    assert 1 == len(remote)
+    # maildir flags and mbsync UIDs are kept
+    assert any(f.endswith(",U=42:2,S") and "/cur/" in f for f in local)
+    # the same names and contents on both sides
+    both = next(f for f in remote)
+    assert Path(both).name in [Path(f).name for f in local]
+    assert (out / "remote" / both).read_text(encoding="utf-8") in \
+        [(out / "local" / f).read_text(encoding="utf-8") for f in local]
+    tags = (out / "local.tags").read_text(encoding="utf-8").splitlines()
+    assert 1 == len(tags)
+    assert re.fullmatch(r"\+inbox \+tag-[0-9a-f]{8} -- id:[0-9a-f]{16}@repro.invalid", tags[0])
+    assert re.fullmatch(r"\+unread -- id:[0-9a-f]{16}@repro.invalid", (out / "remote.tags").read_text(encoding="utf-8").strip())
+    script = (out / "repro.sh").read_text(encoding="utf-8")
+    assert "notmuch-sync -vv --delete --delta --encoding=json --digest=sha256" in script
+    assert "notmuch-sync --delete\"" in script
+    assert os.access(out / "repro.sh", os.X_OK)
+    for f in out.rglob("*"):
+        if f.is_file():
+            for private in ["secret", "mine.example", "Clients", "Archive", "clients", "abc", "foo"]:
+                assert private not in str(f.relative_to(out))
+                assert private not in f.read_text(encoding="utf-8")
+
+    with pytest.raises(FileExistsError):
+        ns.repro(fname, str(out))
+    with ns.tracing(fname, payload=True):
+        ns.trace_frame("sent", json.dumps(hello).encode("utf-8"))
+        ns.trace_frame("received", json.dumps(hello).encode("utf-8"))
+    with pytest.raises(ValueError, match="before the changes"):
+        ns.repro(fname, str(tmp_path / "other"))
+
+
+def test_remote_command():
+    assert ["bash", "-c", "notmuch-sync --delete"] == ns.remote_command(ns.parse_args(["-c", "bash -c 'notmuch-sync --delete'", "--mbsync"]))
+    assert ["ssh", "-CTaxq", "foo@bar", "ns", "--delete", "--mbsync", "--dry-run", "--min-free=10"] == \
+        ns.remote_command(ns.parse_args(["-r", "bar", "-u", "foo", "-p", "ns", "-d", "-m", "-n", "--min-free", "10"]))
+    assert ["ssh", "-CTaxq", "bar", "ns", "--delete", "--accept-new-uuid"] == \
+        ns.remote_command(ns.parse_args(["-r", "bar", "-p", "ns", "-d", "--accept-new-uuid"]))
+    assert ["ssh", "-CTaxq", "bar", "ns", "--notmuch-config='/home/foo/my config'", "--profile=work"] == \
+        ns.remote_command(ns.parse_args(["-r", "bar", "-p", "ns", "--profile", "home",
+                                         "--remote-notmuch-config", "/home/foo/my config", "--remote-profile", "work"]))
+    assert ["ssh", "-CTaxq", "bar", "ns", "--snapshot-cmd='snap --name pre-sync'"] == \
+        ns.remote_command(ns.parse_args(["-r", "bar", "-p", "ns", "--snapshot-cmd", "local-snap",
+                                         "--remote-snapshot-cmd", "snap --name pre-sync"]))
+    assert ["ssh", "-CTaxq", "bar", "ns", "--crash-report-url=https://example.org/crash"] == \
+        ns.remote_command(ns.parse_args(["-r", "bar", "-p", "ns", "--crash-report-url", "https://example.org/crash"]))
+
+
+def test_use_notmuch_config(monkeypatch):
+    monkeypatch.delenv("NOTMUCH_CONFIG", raising=False)
+    monkeypatch.delenv("NOTMUCH_PROFILE", raising=False)
+    ns.use_notmuch_config(ns.parse_args(["-r", "bar"]))
+    assert "NOTMUCH_CONFIG" not in os.environ
+    assert "NOTMUCH_PROFILE" not in os.environ
+
+    monkeypatch.setenv("NOTMUCH_CONFIG", "/foo")
+    monkeypatch.setenv("NOTMUCH_PROFILE", "home")
+    ns.use_notmuch_config(ns.parse_args(["-r", "bar"]))
+    assert "/foo" == os.environ["NOTMUCH_CONFIG"]
+    assert "home" == os.environ["NOTMUCH_PROFILE"]
+
+    ns.use_notmuch_config(ns.parse_args(["--notmuch-config", "~/notmuch-config", "--profile", "work"]))
+    assert os.path.expanduser("~/notmuch-config") == os.environ["NOTMUCH_CONFIG"]
+    assert "work" == os.environ["NOTMUCH_PROFILE"]
+
+
+def test_bootstrap():
+    args = ns.parse_args(["-r", "bar", "-s", "ssh", "-p", "ns", "--bootstrap"])
+
+    def res(code):
+        r = MagicMock()
+        r.returncode = code
+        return r
+
+    with patch("subprocess.run", return_value=res(0)) as run:
+        ns.bootstrap(args)
+        run.assert_called_once_with(["ssh", "bar", "ns", "--version"], capture_output=True, check=False)
+    assert "ns" == args.path
+
+    def remote(installed=None, platform="x86_64\n3.11\n", upload=lambda src: src):
+        files = {} if installed is None else dict(installed)
+
+        def _run(cmd, **kwargs):
+            r = res(0)
+            r.stdout = b""
+            if cmd[-1].endswith("--version"):
+                r.returncode = 127
+            elif cmd[-1].startswith("uname -m"):
+                r.stdout = platform.encode("utf-8")
+            elif "input" in kwargs:
+                files[cmd[-1].split("> ")[-1]] = upload(kwargs["input"])
+            elif cmd[-1].startswith("sha256sum"):
+                fname = cmd[-1].split(" ")[1]
+                if fname in files:
+                    r.stdout = f"{ns.hashlib.sha256(files[fname]).hexdigest()}  {fname}\n".encode("utf-8")
+                else:
+                    r.returncode = 1
+            return r
+        return _run, files
+
+    folder = ns.BOOTSTRAP_DIR + "/x86_64-python3.11"
+    _run, files = remote()
+    with patch("subprocess.run", side_effect=_run) as run:
+        ns.bootstrap(args)
+        assert 6 == run.call_count
+    src = files[args.path + ".new"]
+    assert src.startswith(b"#!/usr/bin/env python3\n")
+    assert b"def bootstrap(" in src
+    path = f"{folder}/notmuch-sync-{ns.hashlib.sha256(src).hexdigest()[:16]}"
+    assert path == args.path
+    assert ["ssh", "bar", f"mkdir -p {folder} && cat > {path}.new"] == run.mock_calls[3].args[0]
+    assert ["ssh", "bar", f"chmod +x {path}.new && mv {path}.new {path} && "
+            f"find {folder} -name 'notmuch-sync-*' ! -name {os.path.basename(path)} -delete"] == run.mock_calls[5].args[0]
+
+    # installed earlier, run after checking it
+    args.path = "ns"
+    _run, _ = remote({path: src})
+    with patch("subprocess.run", side_effect=_run) as run:
+        ns.bootstrap(args)
+        assert 3 == run.call_count
+    assert path == args.path
+
+    # modified or other version on the remote, or other architecture
+    for installed, platform in [({path: src + b"\n"}, "x86_64\n3.11\n"), ({path: src}, "aarch64\n3.11\n"),
+                                ({path: src}, "x86_64\n3.12\n")]:
+        args.path = "ns"
+        _run, _ = remote(installed, platform)
+        with patch("subprocess.run", side_effect=_run) as run:
+            ns.bootstrap(args)
+            assert 6 == run.call_count
+        assert args.path.endswith(os.path.basename(path))
+        assert args.path.startswith(ns.BOOTSTRAP_DIR + "/" + "-python".join(platform.split()) + "/")
+
+    # truncated upload
+    args.path = "ns"
+    _run, _ = remote(upload=lambda src: src[:100])
+    with patch("subprocess.run", side_effect=_run) as run:
+        with pytest.raises(ValueError, match="Checksum"):
+            ns.bootstrap(args)
+        assert ["ssh", "bar", f"rm -f {path}.new"] == run.mock_calls[5].args[0]
+    assert "ns" == args.path
+
+    # no Python or something unexpected
+    for platform in ["x86_64\n", "x86_64\n3.11; rm -rf ~\n"]:
+        _run, _ = remote(platform=platform)
+        with patch("subprocess.run", side_effect=_run):
+            with pytest.raises(ValueError, match="Could not determine architecture and Python version"):
+                ns.bootstrap(args)
+    assert "ns" == args.path
+
+
+def test_ssh_master():
+    args = ns.parse_args(["-r", "bar", "-s", "ssh", "-p", "ns", "--ssh-control-path", "~/.ssh/ns-%h"])
+    assert ["ssh", "-o", "ControlPath=~/.ssh/ns-%h", "bar", "ns"] == ns.remote_command(args)
+
+    def res(code):
+        r = MagicMock()
+        r.returncode = code
+        return r
+
+    with patch("subprocess.run", return_value=res(0)) as run:
+        ns.ssh_master(args)
+        run.assert_called_once_with(["ssh", "-o", "ControlPath=~/.ssh/ns-%h", "-O", "check", "bar"], capture_output=True, check=False)
+    with patch("subprocess.run", side_effect=[res(255), res(0)]) as run:
+        ns.ssh_master(args)
+        assert ["ssh", "-o", "ControlPath=~/.ssh/ns-%h", "-o", "ControlMaster=yes", "-o", "ControlPersist=10m", "-f", "-N", "bar"] == \
+            run.mock_calls[1].args[0]
+        assert subprocess.DEVNULL == run.mock_calls[1].kwargs["stderr"]
+    # connects without it
+    with patch("subprocess.run", side_effect=[res(255), res(255)]) as run:
+        ns.ssh_master(args)
+        assert 2 == run.call_count
+
+
+def test_native_ssh(monkeypatch):
+    class SSHException(Exception):
+        pass
+
+    pm = MagicMock()
+    pm.SSHException = SSHException
+    monkeypatch.setattr(ns, "paramiko", pm)
+    client = pm.SSHClient.return_value
+    stdin = MagicMock()
+    stdout = MagicMock()
+    stdout.channel.recv_stderr.side_effect = [b"remote error", b"", b""]
+    client.exec_command.return_value = (stdin, stdout, MagicMock())
+
+    args = ns.parse_args(["-r", "bar", "-u", "me", "-p", "ns", "--transport", "native-ssh", "--delete"])
+    with ns.connect_remote(args) as conn:
+        client.connect.assert_called_once_with("bar", port=22, username="me", timeout=ns.SSH_TIMEOUT,
+                                               banner_timeout=ns.SSH_TIMEOUT, auth_timeout=ns.SSH_TIMEOUT)
+        client.set_missing_host_key_policy.assert_called_once_with(pm.RejectPolicy.return_value)
+        client.get_transport.return_value.set_keepalive.assert_called_once_with(ns.SSH_KEEPALIVE)
+        client.exec_command.assert_called_once_with("ns --delete")
+        assert stdin == conn.stdin
+        assert stdout == conn.stdout
+        assert b"remote error" == conn.stderr.read()
+    client.close.assert_called_once()
+
+    with ns.connect_remote(args, stdin=False) as conn:
+        assert conn.stdin is None
+        stdin.close.assert_called()
+
+    client.connect.side_effect = SSHException("host key not found")
+    with pytest.raises(ConnectionError, match="host key not found"):
+        ns.connect_remote(args)
+
+    monkeypatch.setattr(ns, "paramiko", None)
+    with pytest.raises(ValueError, match="requires the paramiko module"):
+        ns.connect_remote(args)
+
+    # the command is run as given
+    with patch("subprocess.Popen") as po:
+        ns.connect_remote(ns.parse_args(["-r", "bar", "--transport", "native-ssh", "-c", "ns --remote"]))
+        assert ["ns", "--remote"] == po.call_args.args[0]
+    with pytest.raises(SystemExit):
+        ns.parse_args(["-r", "bar", "--transport", "native-ssh", "--bootstrap"])
+
+
+def test_remote_command_happy_eyeballs():
+    with patch.object(ns, "happy_eyeballs", return_value="::1") as he:
+        assert ["ssh", "-o", "HostKeyAlias=bar", "::1", "ns"] == \
+            ns.remote_command(ns.parse_args(["-r", "bar", "-s", "ssh", "-p", "ns", "--happy-eyeballs"]))
+        he.assert_called_once_with("bar", 22)
+    with patch.object(ns, "happy_eyeballs", return_value=None) as he:
+        assert ["ssh", "-p", "2222", "bar", "ns"] == \
+            ns.remote_command(ns.parse_args(["-r", "bar", "-s", "ssh", "-p", "ns", "--happy-eyeballs", "-P", "2222"]))
+        he.assert_called_once_with("bar", 2222)
+
+
+def test_resolve_remote():
+    with NamedTemporaryFile(mode="w+t", prefix="notmuch-sync-test-tmp-") as f:
+        f.write("[remote home]\nhost = mail.example.org\nuser = foo\nport = 2222\npath = /opt/ns\nprofile = home\n"
+                "[remote away]\nsrv = yes\n"
+                "[remote both]\nprofiles = work, personal:home\n"
+                "[remote roam]\nhost = 192.168.1.2, mail.example.org\n"
+                "[remote split]\nhost = mail.example.org\nhosts-by-network = 127.0.0.0/8=localhost\n"
+                "[remote laptop]\nhost = mail.example.org\nlocal-tags = todo-laptop, draft-\n"
+                "received-tag = from-server\n")
+        f.flush()
+        args = ns.parse_args(["-r", "home", "--config", f.name])
+        assert "mail.example.org" == args.remote
+        assert "foo" == args.user
+        assert 2222 == args.port
+        assert "/opt/ns" == args.path
+        assert ["ssh", "-CTaxq", "-p", "2222", "foo@mail.example.org", "/opt/ns", "--profile=home"] == ns.remote_command(args)
+
+        # command line takes precedence
+        args = ns.parse_args(["-r", "home", "--config", f.name, "-u", "bar", "-P", "22"])
+        assert "bar" == args.user
+        assert 22 == args.port
+
+        with patch.object(ns, "srv_lookup", return_value=("srv.example.org", 2200)) as sl:
+            args = ns.parse_args(["-r", "away", "--config", f.name])
+            sl.assert_called_once_with("away")
+            assert "srv.example.org" == args.remote
+            assert 2200 == args.port
+
+        args = ns.parse_args(["-r", "both", "--config", f.name, "-s", "ssh", "-p", "ns"])
+        assert [("work", "work"), ("personal", "home")] == args.profiles
+        assert ["ssh", "both", "ns", "--multi"] == ns.remote_command(args)
+        # a single profile on the command line takes precedence
+        args = ns.parse_args(["-r", "both", "--config", f.name, "--remote-profile", "work"])
+        assert [] == args.profiles
+
+        args = ns.parse_args(["-r", "roam", "--config", f.name])
+        assert "192.168.1.2" == args.remote
+        assert ["mail.example.org"] == args.fallbacks
+        args = ns.parse_args(["-r", "home", "--config", f.name])
+        assert [] == args.fallbacks
+        args = ns.parse_args(["-r", "split", "--config", f.name])
+        assert "localhost" == args.remote
+        assert ["mail.example.org"] == args.fallbacks
+        args = ns.parse_args(["-r", "laptop", "--config", f.name])
+        assert "from-server" == args.received_tag
+        assert ["todo-laptop", "draft-"] == args.local_tags
+        assert [] == ns.parse_args(["-r", "home", "--config", f.name]).local_tags
+        args = ns.parse_args(["-r", "laptop", "--config", f.name, "--local-tags", "todo"])
+        assert ["todo"] == args.local_tags
+
+        # not in config
+        with patch.object(ns, "srv_lookup", return_value=None) as sl:
+            args = ns.parse_args(["-r", "example.org", "--config", f.name, "--srv"])
+            sl.assert_called_once_with("example.org")
+            assert "example.org" == args.remote
+            assert args.port is None
+
+
+def test_parse_profiles():
+    assert [] == ns.parse_profiles("")
+    assert [("work", "work")] == ns.parse_profiles("work")
+    assert [("work", "work"), ("personal", "home"), ("a", "b")] == ns.parse_profiles(" work personal:home,a:b\n")
+
+
+def test_sync_remote_profiles(monkeypatch):
+    monkeypatch.delenv("NOTMUCH_PROFILE", raising=False)
+    profiles = []
+    args = ns.argparse.Namespace(nfs=False)
+    mockio = io.BytesIO(b'\x00\x00\x00\x13{"profile": "work"}\x00\x00\x00\x13{"profile": "home"}\x00\x00\x00\x00')
+    mockio.buffer = mockio
+    monkeypatch.setattr(sys, "stdin", mockio)
+    with patch.object(ns, "sync_remote", side_effect=lambda args: profiles.append(os.environ["NOTMUCH_PROFILE"])) as sr:
+        ns.sync_remote_profiles(args)
+        assert 2 == sr.call_count
+        sr.assert_called_with(args)
+    assert ["work", "home"] == profiles
+
+    mockio = io.BytesIO(b'\x00\x00\x00\x0e{"profile": 1}')
+    mockio.buffer = mockio
+    monkeypatch.setattr(sys, "stdin", mockio)
+    with patch.object(ns, "sync_remote") as sr:
+        with pytest.raises(ValueError) as pwe:
+            ns.sync_remote_profiles(args)
+        assert "Invalid profile" in str(pwe.value)
+        sr.assert_not_called()
+
+
+def test_default_config_path(monkeypatch):
+    monkeypatch.setenv("XDG_CONFIG_HOME", "/foo")
+    assert "/foo/notmuch-sync/config" == ns.default_config_path()
+
+
+def test_network_host():
+    assert "lo" == ns.network_host("198.51.100.0/24=test, foo=bar 127.0.0.0/8=lo")
+    assert ns.network_host("198.51.100.0/24=test") is None
+    assert ns.network_host("") is None
+
+
+def test_failover():
+    args = ns.parse_args(["-r", "lan", "--config", "/nonexistent"])
+    args.fallbacks = ["wan", "vpn"]
+    with patch.object(ns, "happy_eyeballs", return_value="10.0.0.1") as he:
+        ns.failover(args)
+        he.assert_called_once_with("lan", 22)
+    assert "lan" == args.remote
+    assert [] == args.fallbacks
+
+    args.fallbacks = ["wan", "vpn"]
+    args.port = 2222
+    with patch.object(ns, "happy_eyeballs", return_value=None) as he:
+        ns.failover(args)
+        # the last one is left to ssh
+        assert [call("lan", 2222), call("wan", 2222)] == he.call_args_list
+    assert "vpn" == args.remote
+
+    args.remote = "lan"
+    args.fallbacks = ["wan"]
+    with patch.object(ns, "happy_eyeballs", side_effect=[None]) as he:
+        ns.failover(args)
+    assert "wan" == args.remote
+
+
+def test_happy_eyeballs():
+    with socket.socket(socket.AF_INET, socket.SOCK_STREAM) as srv:
+        srv.bind(("127.0.0.1", 0))
+        srv.listen()
+        port = srv.getsockname()[1]
+        assert "127.0.0.1" == ns.happy_eyeballs("localhost", port)
+    # nothing listening anymore
+    assert ns.happy_eyeballs("127.0.0.1", port) is None